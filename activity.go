@@ -0,0 +1,110 @@
+package brunch
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The activity log is kept in the data-store, one JSON entry per line so it is only ever
+// appended to. Snapshots have everything but have to be loaded whole to see what happened
+const activityLogFile = "activity.jsonl"
+
+const (
+	ActivityMessage    = "message"
+	ActivityRegenerate = "regenerate"
+	ActivityEdit       = "edit"
+)
+
+// One thing that happened in a chat
+type ActivityEntry struct {
+	Time     time.Time     `json:"time"`
+	Chat     string        `json:"chat"`
+	Action   string        `json:"action"`
+	Node     string        `json:"node"`
+	Tokens   int           `json:"tokens"` // estimated, request and response
+	Duration time.Duration `json:"duration"`
+	Latency  *Latency      `json:"latency,omitempty"` // the provider's part of the duration
+}
+
+// The log is a record, failing to write it never fails what was recorded
+func (c *Core) recordActivity(entry ActivityEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		c.logger.Warn("failed to marshal activity", "error", err)
+		return
+	}
+
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	file, err := os.OpenFile(c.storePath(dataStoreDirectory, activityLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		c.logger.Warn("failed to open activity log", "error", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		c.logger.Warn("failed to write activity", "error", err)
+	}
+}
+
+// The most recent entries across every chat, newest first. A limit of 0 returns all of them
+func (c *Core) RecentActivity(limit int) ([]ActivityEntry, error) {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+
+	file, err := os.Open(c.storePath(dataStoreDirectory, activityLogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return []ActivityEntry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open activity log: %w", err)
+	}
+	defer file.Close()
+
+	entries := []ActivityEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry ActivityEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line cut short by a crash shouldn't hide the rest of the log
+			c.logger.Debug("skipping bad activity entry", "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read activity log: %w", err)
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// Record something the chat did. The tokens are what the main usage grew by since `before`
+func (c *chatInstance) recordActivity(action string, node Node, before ChatUsage, started time.Time) {
+	if c.core == nil || c.name == "" {
+		return
+	}
+	entry := ActivityEntry{
+		Time:     time.Now(),
+		Chat:     c.name,
+		Action:   action,
+		Node:     node.Hash(),
+		Tokens:   c.usage.get().Main.Tokens - before.Main.Tokens,
+		Duration: time.Since(started),
+	}
+	if mp, isPair := node.(*MessagePairNode); isPair {
+		entry.Latency = mp.Latency
+	}
+	c.core.recordActivity(entry)
+}
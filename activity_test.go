@@ -0,0 +1,50 @@
+package brunch
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCore_Activity(t *testing.T) {
+	core := newTestCore(t)
+	entries, err := core.RecentActivity(10)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	a := newBranchTestChat(t, core, "a")
+	b := newBranchTestChat(t, core, "b")
+	_, err = a.SubmitMessage("one")
+	require.NoError(t, err)
+	_, err = b.SubmitMessage("two")
+	require.NoError(t, err)
+	_, err = b.Regenerate()
+	require.NoError(t, err)
+
+	entries, err = core.RecentActivity(0)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "b", entries[0].Chat)
+	assert.Equal(t, ActivityRegenerate, entries[0].Action)
+	assert.Equal(t, b.currentNode.Hash(), entries[0].Node)
+	assert.Equal(t, "a", entries[2].Chat)
+	assert.Equal(t, ActivityMessage, entries[2].Action)
+	assert.Greater(t, entries[2].Tokens, 0)
+
+	// A damaged line doesn't take the rest of the log with it
+	file, err := os.OpenFile(core.storePath(dataStoreDirectory, activityLogFile), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString("{\"time\": \"cut\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	_, err = a.SubmitMessage("three")
+	require.NoError(t, err)
+
+	entries, err = core.RecentActivity(2)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "a", entries[0].Chat)
+	assert.Equal(t, ActivityRegenerate, entries[1].Action)
+}
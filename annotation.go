@@ -0,0 +1,108 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The kinds of annotation that can be put into a tree alongside the messages. None of them
+// are ever sent to a provider to be answered
+type AnnotationKind string
+
+const (
+	AK_NOTE     AnnotationKind = "note"     // written by the user, like why a branch exists
+	AK_SYSTEM   AnnotationKind = "system"   // something that happened, like the provider being changed
+	AK_DOCUMENT AnnotationKind = "document" // the content of a file brought into the conversation
+	AK_MERGE    AnnotationKind = "merge"    // the results of two branches brought together (see merge.go)
+)
+
+func (k AnnotationKind) valid() bool {
+	return k == AK_NOTE || k == AK_SYSTEM || k == AK_DOCUMENT || k == AK_MERGE
+}
+
+// An annotation is a message pair without a user or assistant message. It lives in the tree like
+// any other node (it can be gone to, branched from, pruned) so nothing that walks the tree has
+// to know about it
+type Annotation struct {
+	Kind    AnnotationKind `json:"kind"`
+	Content string         `json:"content"`
+
+	// Sent to the provider as part of the branch. Otherwise it is only there for whoever reads the tree
+	InHistory bool `json:"in_history,omitempty"`
+}
+
+// What the assistant "said" to an annotation sent with the history. Providers expect the
+// history to alternate, so the annotation goes as a user message that was acknowledged
+const annotationAcknowledgement = "Understood."
+
+func NewAnnotationNode(parent Node, annotation Annotation) *MessagePairNode {
+	pair := NewMessagePairNode(parent)
+	pair.Annotation = &annotation
+	return pair
+}
+
+// The user and assistant messages the pair adds to the history sent to a provider. It is false for
+// pairs that are still waiting on their reply, for annotations that are kept out of the history and
+// for the notes on the parts of a chunked message
+func (m *MessagePairNode) Exchange() (*MessageData, *MessageData, bool) {
+	if m.Annotation != nil {
+		if !m.Annotation.InHistory {
+			return nil, nil, false
+		}
+		content := fmt.Sprintf("<%s>\n%s\n</%s>", m.Annotation.Kind, m.Annotation.Content, m.Annotation.Kind)
+		return NewMessageData("user", content), NewMessageData("assistant", annotationAcknowledgement), true
+	}
+	if m.User == nil || m.Assistant == nil || m.ChunkStep != nil {
+		return nil, nil, false
+	}
+	if m.Chunked != nil {
+		return NewMessageData("user", m.Chunked.Sent), m.Assistant, true
+	}
+	if len(m.ToolCalls) > 0 {
+		return m.User, NewMessageData("assistant", toolCallsText(m.Assistant.UnencodedContent(), m.ToolCalls)), true
+	}
+	return m.User, m.Assistant, true
+}
+
+// Add an annotation under the current node and move to it, so what comes next follows it
+func (c *chatInstance) Annotate(annotation Annotation) (string, error) {
+	if !annotation.Kind.valid() {
+		return "", fmt.Errorf("unknown annotation kind: %s", annotation.Kind)
+	}
+	if annotation.Content == "" {
+		return "", errors.New("annotation is empty")
+	}
+
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	if err := c.checkGrowth(c.currentNode, 1); err != nil {
+		return "", err
+	}
+
+	pair := NewAnnotationNode(c.currentNode, annotation)
+	switch parent := c.currentNode.(type) {
+	case *RootNode:
+		parent.AddChild(pair)
+	case *MessagePairNode:
+		parent.AddChild(pair)
+	default:
+		return "", errors.New("the current node can't be annotated")
+	}
+	c.currentNode = pair
+	return pair.Hash(), nil
+}
+
+// Annotate with the content of a file, named so it is clear where it came from
+func (c *chatInstance) AnnotateWithDocument(file string, inHistory bool) (string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read document: %w", err)
+	}
+	return c.Annotate(Annotation{
+		Kind:      AK_DOCUMENT,
+		Content:   fmt.Sprintf("%s\n\n%s", filepath.Base(file), content),
+		InHistory: inHistory,
+	})
+}
@@ -0,0 +1,79 @@
+package brunch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChat_Annotate(t *testing.T) {
+	core := newTestCore(t)
+	chat := newBranchTestChat(t, core, "a")
+	_, err := chat.SubmitMessage("one")
+	require.NoError(t, err)
+
+	_, err = chat.Annotate(Annotation{Kind: "shout", Content: "x"})
+	assert.Error(t, err)
+	_, err = chat.Annotate(Annotation{Kind: AK_NOTE})
+	assert.Error(t, err)
+
+	note, err := chat.Annotate(Annotation{Kind: AK_NOTE, Content: "trying a shorter prompt"})
+	require.NoError(t, err)
+	assert.Equal(t, note, chat.currentNode.Hash())
+	assert.Contains(t, chat.PrintTree(), "[NOTE]")
+
+	// Messages carry on from the note, which isn't part of what is sent
+	_, err = chat.SubmitMessage("two")
+	require.NoError(t, err)
+	assert.Equal(t, note, nodeParent(chat.currentNode).Hash())
+	history := chat.PrintHistory()
+	assert.Contains(t, history, "one")
+	assert.Contains(t, history, "two")
+	assert.NotContains(t, history, "shorter prompt")
+
+	// Unless it is asked to be
+	file := filepath.Join(t.TempDir(), "spec.txt")
+	require.NoError(t, os.WriteFile(file, []byte("the spec"), 0644))
+	_, err = chat.AnnotateWithDocument(file, true)
+	require.NoError(t, err)
+	assert.Contains(t, chat.PrintHistory(), "<document>\nspec.txt\n\nthe spec\n</document>")
+	assert.Contains(t, chat.PrintHistory(), annotationAcknowledgement)
+
+	// They aren't messages, so they can't be asked again
+	_, err = chat.Regenerate()
+	assert.Error(t, err)
+
+	// And they survive the chat being saved and loaded
+	hash := chat.currentNode.Hash()
+	require.NoError(t, core.writeSnapshot("a", chat))
+	loaded, err := core.loadChat("a", &hash)
+	require.NoError(t, err)
+	pair, ok := loaded.currentNode.(*MessagePairNode)
+	require.True(t, ok)
+	require.NotNil(t, pair.Annotation)
+	assert.Equal(t, AK_DOCUMENT, pair.Annotation.Kind)
+	assert.True(t, pair.Annotation.InHistory)
+	assert.Len(t, MapTree(&loaded.root), 5)
+}
+
+func TestBranch_Annotations(t *testing.T) {
+	core := newTestCore(t)
+	source := newBranchTestChat(t, core, "source")
+	_, err := source.SubmitMessage("one")
+	require.NoError(t, err)
+	_, err = source.Annotate(Annotation{Kind: AK_SYSTEM, Content: "provider changed"})
+	require.NoError(t, err)
+	data, err := source.ExportBranch("")
+	require.NoError(t, err)
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "target" :provider "mock"`)))
+	leaf, err := core.ImportBranch("target", data)
+	require.NoError(t, err)
+	assert.Equal(t, source.currentNode.Hash(), leaf)
+
+	_, err = core.ImportBranch("target", []byte(`{"version": 1, "messages": [{"annotation": {"kind": "shout", "content": "x"}}]}`))
+	assert.Error(t, err)
+}
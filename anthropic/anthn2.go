@@ -1,6 +1,7 @@
 package anthropic
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -20,15 +21,37 @@ type AnthropicProvider struct {
 
 	providerName     string
 	hostProviderName string
+	companion        string
+
+	// The messages API has no seed, it is only kept so the settings survive a save
+	seed *int64
+
+	// Applied by the chat, the provider only carries them
+	postProcess []string
+	fallbacks   []string
+	window      *brunch.ContextWindow
+	rateLimit   *brunch.RateLimit
 }
 
 var _ brunch.Provider = (*AnthropicProvider)(nil)
+var _ brunch.RawRecorder = (*AnthropicProvider)(nil)
+
+var ErrMissingAPIKey = errors.New("ANTHROPIC_API_KEY environment variable is not set")
 
-func InitialAnthropicProvider() brunch.Provider {
+// The key is read from the environment every time a provider is made so that a key set
+// after startup is picked up by the next provider or chat
+func apiKeyFromEnv() (string, error) {
 	apiKey := os.Getenv("ANTHROPIC_API_KEY")
 	if apiKey == "" {
-		fmt.Println("Please set ANTHROPIC_API_KEY environment variable")
-		os.Exit(1)
+		return "", ErrMissingAPIKey
+	}
+	return apiKey, nil
+}
+
+func InitialAnthropicProvider() (brunch.Provider, error) {
+	apiKey, err := apiKeyFromEnv()
+	if err != nil {
+		return nil, err
 	}
 	client, err := New(
 		"anthropic",
@@ -38,10 +61,9 @@ func InitialAnthropicProvider() brunch.Provider {
 		4000,
 	)
 	if err != nil {
-		fmt.Printf("Failed to create Anthropic client: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to create Anthropic client: %w", err)
 	}
-	return NewAnthropicProvider("anthropic", "anthropic", client)
+	return NewAnthropicProvider("anthropic", "anthropic", client), nil
 }
 
 func (ap *AnthropicProvider) MaxTokens() int {
@@ -67,7 +89,7 @@ func (ap *AnthropicProvider) NewConversationRoot() brunch.RootNode {
 	})
 }
 
-func (ap *AnthropicProvider) ExtendFrom(node brunch.Node) brunch.MessageCreator {
+func (ap *AnthropicProvider) ExtendFrom(ctx context.Context, node brunch.Node) brunch.MessageCreator {
 	msgPair := brunch.NewMessagePairNode(node)
 
 	switch parent := node.(type) {
@@ -94,9 +116,9 @@ func (ap *AnthropicProvider) ExtendFrom(node brunch.Node) brunch.MessageCreator
 
 		if len(ap.pendingImages) > 0 {
 			usedImages = ap.pendingImages
-			resp, err = localClient.AskWithImage(userMessage, ap.pendingImages)
+			resp, err = localClient.AskWithImage(ctx, userMessage, ap.pendingImages)
 		} else {
-			resp, err = localClient.Ask(userMessage)
+			resp, err = localClient.Ask(ctx, userMessage)
 		}
 
 		if err != nil {
@@ -104,6 +126,7 @@ func (ap *AnthropicProvider) ExtendFrom(node brunch.Node) brunch.MessageCreator
 		}
 		msgPair.User = brunch.NewMessageData("user", userMessage)
 		msgPair.Assistant = brunch.NewMessageData("assistant", resp)
+		msgPair.Usage, msgPair.Response = localClient.usage, localClient.response
 
 		if len(usedImages) > 0 {
 			msgPair.User.Images = usedImages
@@ -140,15 +163,15 @@ func (ap *AnthropicProvider) GetHistory(node brunch.Node) []map[string]string {
 	current := node
 	for {
 		if msgPair, ok := current.(*brunch.MessagePairNode); ok {
-			if msgPair.Assistant != nil && msgPair.User != nil {
+			if user, assistant, ok := msgPair.Exchange(); ok {
 				history = append([]map[string]string{
 					{
-						"role":    msgPair.Assistant.Role,
-						"content": msgPair.Assistant.UnencodedContent(),
+						"role":    assistant.Role,
+						"content": assistant.UnencodedContent(),
 					},
 					{
-						"role":    msgPair.User.Role,
-						"content": msgPair.User.UnencodedContent(),
+						"role":    user.Role,
+						"content": user.UnencodedContent(),
 					},
 				}, history...)
 			}
@@ -163,6 +186,10 @@ func (ap *AnthropicProvider) GetHistory(node brunch.Node) []map[string]string {
 	return history
 }
 
+func (ap *AnthropicProvider) RecordRaw(record func(brunch.RawExchange)) {
+	ap.client.recordRaw = record
+}
+
 func (ap *AnthropicProvider) QueueImages(paths []string) error {
 	ap.pendingImages = append(ap.pendingImages, paths...)
 	return nil
@@ -176,14 +203,21 @@ func (ap *AnthropicProvider) Settings() brunch.ProviderSettings {
 		SystemPrompt: ap.client.systemPrompt,
 		Name:         ap.client.clientId,
 		Host:         ap.hostProviderName,
+		Companion:    ap.companion,
+		PromptSuffix: ap.client.promptSuffix,
+		Seed:         ap.seed,
+		PostProcess:  ap.postProcess,
+		Fallbacks:    ap.fallbacks,
+		Window:       ap.window,
+		MaxAttempts:  ap.client.maxAttempts,
+		RateLimit:    ap.rateLimit,
 	}
 }
 
-func (ap *AnthropicProvider) CloneWithSettings(settings brunch.ProviderSettings) brunch.Provider {
-	apiKey := os.Getenv("ANTHROPIC_API_KEY")
-	if apiKey == "" {
-		fmt.Println("Please set ANTHROPIC_API_KEY environment variable")
-		os.Exit(1)
+func (ap *AnthropicProvider) CloneWithSettings(settings brunch.ProviderSettings) (brunch.Provider, error) {
+	apiKey, err := apiKeyFromEnv()
+	if err != nil {
+		return nil, err
 	}
 	client, err := New(
 		settings.Name,
@@ -192,21 +226,23 @@ func (ap *AnthropicProvider) CloneWithSettings(settings brunch.ProviderSettings)
 		settings.Temperature,
 		settings.MaxTokens,
 	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Anthropic client: %w", err)
+	}
 
 	if settings.BaseUrl != "" {
 		client.apiEndpoint = settings.BaseUrl
 	} else {
 		client.apiEndpoint = DefaultAPIEndpoint
 	}
-	if err != nil {
-		fmt.Printf("Failed to create Anthropic client: %v\n", err)
-		os.Exit(1)
-	}
-	return NewAnthropicProvider(settings.Host, settings.Name, client)
-}
-
-func (ap *AnthropicProvider) AttachKnowledgeContext(ctx brunch.ContextSettings) error {
-
-	// This isn't going to be implemented for the basic anthropic client
-	return errors.New("not implemented for anthropic client")
+	client.SetPromptSuffix(settings.PromptSuffix)
+	client.SetMaxAttempts(settings.MaxAttempts)
+	provider := NewAnthropicProvider(settings.Host, settings.Name, client)
+	provider.companion = settings.Companion
+	provider.seed = settings.Seed
+	provider.postProcess = settings.PostProcess
+	provider.fallbacks = settings.Fallbacks
+	provider.window = settings.Window
+	provider.rateLimit = settings.RateLimit
+	return provider, nil
 }
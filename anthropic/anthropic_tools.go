@@ -1,89 +1,193 @@
 package anthropic
 
-// TODO: Work this into brunch so they can define callbacks and tools and whatnot
-
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"strings"
 	"time"
+
+	"github.com/bosley/brunch"
 )
 
-type ToolsClient struct {
-	*Client
-	toolCalls []ToolCall
-}
+var _ brunch.ToolCaller = (*AnthropicProvider)(nil)
 
-type ToolCall struct {
-	Role      string    `json:"role"`
-	Content   string    `json:"content"`         // b64 user input
-	Response  string    `json:"response"`        // b64 LLM response
-	Tool      string    `json:"tool"`            // tool name
-	Schema    string    `json:"schema"`          // b64 tool schema
-	Error     string    `json:"error,omitempty"` // error message if failed
-	Success   bool      `json:"success"`         // whether the call succeeded
-	Timestamp time.Time `json:"timestamp"`
+type apiTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
 }
 
-func NewTools(apiKey, systemPrompt string, temperature float64, maxTokens int) (*ToolsClient, error) {
-	baseClient, err := New("anthropic-tools", apiKey, systemPrompt, temperature, maxTokens)
+// Ask with the tools the model can call. The content is a string or []MessagePart (tool results),
+// what comes back is the text of the reply and the calls it made, if any
+func (c *Client) AskWithTools(ctx context.Context, content interface{}, tools []apiTool) (string, []brunch.ToolCall, error) {
+	messages := make([]apiMessage, 0, len(c.conversations)+1)
+	for _, msg := range c.conversations {
+		messages = append(messages, apiMessage{Role: msg.Role, Content: msg.Content})
+	}
+	messages = append(messages, apiMessage{Role: "user", Content: content})
+
+	jsonBody, err := json.Marshal(apiRequest{
+		Model:       c.model,
+		Messages:    messages,
+		System:      c.system(),
+		MaxTokens:   c.maxTokens,
+		Temperature: c.temperature,
+		Tools:       tools,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create base client: %w", err)
+		return "", nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
+	slog.Debug("tools request payload", "body", string(jsonBody))
 
-	return &ToolsClient{
-		Client:    baseClient,
-		toolCalls: make([]ToolCall, 0),
-	}, nil
-}
+	body, err := c.send(ctx, jsonBody)
+	if err != nil {
+		return "", nil, err
+	}
 
-func (tc *ToolsClient) CallTool(input string, toolSchema string) (string, error) {
-	// Base64 encode the raw user input
-	encodedInput := base64.StdEncoding.EncodeToString([]byte(input))
+	var apiResp apiResponse
+	if err := json.Unmarshal(body, &apiResp); err != nil {
+		return "", nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if len(apiResp.Content) == 0 {
+		return "", nil, fmt.Errorf("empty response content from API")
+	}
 
-	// Make the tool call using raw schema
-	response, err := tc.Ask(fmt.Sprintf("%s\n\n%s", toolSchema, input))
+	texts := []string{}
+	calls := []brunch.ToolCall{}
+	for _, block := range apiResp.Content {
+		switch block.Type {
+		case "tool_use":
+			calls = append(calls, brunch.ToolCall{ID: block.ID, Name: block.Name, Input: block.Input})
+		case "text":
+			texts = append(texts, block.Text)
+		}
+	}
+	response := strings.Join(texts, "\n")
+	c.usage, c.response = apiResp.tokenUsage(), apiResp.meta()
 
-	// Encode schema for storage
-	encodedSchema := base64.StdEncoding.EncodeToString([]byte(toolSchema))
+	c.conversations = append(c.conversations,
+		Message{
+			Role:      "user",
+			Content:   content,
+			Timestamp: time.Now(),
+		},
+		Message{
+			Role:      "assistant",
+			Content:   assistantContent(response, calls),
+			Timestamp: time.Now(),
+		},
+	)
+	return response, calls, nil
+}
 
-	// Create tool call record - store both success and failure
-	toolCall := ToolCall{
-		Role:      "user",
-		Content:   encodedInput,
-		Tool:      "tool",
-		Schema:    encodedSchema,
-		Success:   err == nil,
-		Timestamp: time.Now(),
+// The reply as blocks, the text and then the tools it called
+func assistantContent(text string, calls []brunch.ToolCall) interface{} {
+	if len(calls) == 0 {
+		return text
+	}
+	parts := make([]MessagePart, 0, len(calls)+1)
+	if text != "" {
+		parts = append(parts, MessagePart{Type: "text", Text: text})
+	}
+	for _, call := range calls {
+		input := call.Input
+		if len(input) == 0 {
+			input = json.RawMessage("{}")
+		}
+		parts = append(parts, MessagePart{Type: "tool_use", ID: call.ID, Name: call.Name, Input: input})
 	}
+	return parts
+}
 
-	if err != nil {
-		toolCall.Error = err.Error()
-		toolCall.Response = ""
-	} else {
-		toolCall.Response = base64.StdEncoding.EncodeToString([]byte(response))
+// The message sent after a pair. When the pair called tools the results go as tool_result blocks,
+// and the message is only added as text if it is more than the results written out
+func userContent(previous *brunch.MessagePairNode, message string) interface{} {
+	if previous == nil || len(previous.ToolCalls) == 0 {
+		return message
+	}
+	parts := make([]MessagePart, 0, len(previous.ToolCalls)+1)
+	for _, call := range previous.ToolCalls {
+		result := MessagePart{Type: "tool_result", ToolUseID: call.ID, Content: call.Output}
+		if call.Error != "" {
+			result.Content, result.IsError = call.Error, true
+		}
+		parts = append(parts, result)
+	}
+	if message != brunch.ToolResults(previous.ToolCalls) {
+		parts = append(parts, MessagePart{Type: "text", Text: message})
 	}
+	return parts
+}
 
-	// Store the tool call
-	tc.toolCalls = append(tc.toolCalls, toolCall)
+// The branch down to the node with the tool calls and their results as blocks, the API only
+// takes tool results that follow the tool_use they answer
+func toolHistory(node brunch.Node) []Message {
+	pairs := []*brunch.MessagePairNode{}
+	for current := node; current != nil; {
+		msgPair, ok := current.(*brunch.MessagePairNode)
+		if !ok {
+			break
+		}
+		pairs = append([]*brunch.MessagePairNode{msgPair}, pairs...)
+		current = msgPair.Parent
+	}
 
-	// Return original error
-	if err != nil {
-		return "", err
+	messages := []Message{}
+	var previous *brunch.MessagePairNode
+	for _, msgPair := range pairs {
+		user, assistant, ok := msgPair.Exchange()
+		if !ok {
+			continue
+		}
+		reply := assistant.UnencodedContent()
+		if len(msgPair.ToolCalls) > 0 {
+			reply = msgPair.Assistant.UnencodedContent()
+		}
+		messages = append(messages,
+			Message{Role: user.Role, Content: userContent(previous, user.UnencodedContent())},
+			Message{Role: assistant.Role, Content: assistantContent(reply, msgPair.ToolCalls)},
+		)
+		previous = msgPair
 	}
-	return response, nil
+	return messages
 }
 
-func (tc *ToolsClient) ExportToolCalls() ([]byte, error) {
-	export := struct {
-		Model      string     `json:"model"`
-		ToolCalls  []ToolCall `json:"tool_calls"`
-		ExportedAt time.Time  `json:"exported_at"`
-	}{
-		Model:      tc.model,
-		ToolCalls:  tc.toolCalls,
-		ExportedAt: time.Now(),
+// ExtendFrom with the tools offered. Messages with images queued are sent without them
+func (ap *AnthropicProvider) ExtendWithTools(ctx context.Context, node brunch.Node, tools []brunch.Tool) brunch.MessageCreator {
+	if len(ap.pendingImages) > 0 {
+		return ap.ExtendFrom(ctx, node)
 	}
+	msgPair := brunch.NewMessagePairNode(node)
 
-	return json.Marshal(export)
+	switch parent := node.(type) {
+	case *brunch.RootNode:
+		parent.AddChild(msgPair)
+	case *brunch.MessagePairNode:
+		parent.AddChild(msgPair)
+	}
+
+	offered := make([]apiTool, len(tools))
+	for i, tool := range tools {
+		offered[i] = apiTool{Name: tool.Name, Description: tool.Description, InputSchema: tool.Schema}
+	}
+
+	return func(userMessage string) (*brunch.MessagePairNode, error) {
+		localClient := ap.client.Copy()
+		localClient.conversations = toolHistory(node)
+
+		previous, _ := node.(*brunch.MessagePairNode)
+		resp, calls, err := localClient.AskWithTools(ctx, userContent(previous, userMessage), offered)
+		if err != nil {
+			return nil, err
+		}
+		msgPair.User = brunch.NewMessageData("user", userMessage)
+		msgPair.Assistant = brunch.NewMessageData("assistant", resp)
+		msgPair.Usage, msgPair.Response = localClient.usage, localClient.response
+		if len(calls) > 0 {
+			msgPair.ToolCalls = calls
+		}
+		return msgPair, nil
+	}
 }
@@ -0,0 +1,166 @@
+package anthropic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bosley/brunch"
+)
+
+// Requests the API refuses because it is rate limited (429) or has trouble of its own (5xx,
+// 529 when overloaded) are tried again after a while, waiting twice as long each time with
+// some jitter so chats that were refused together don't come back together. When the API
+// says how long to wait (Retry-After) that is how long is waited. Other refusals, like a bad
+// request, are returned right away
+const DefaultMaxAttempts = 3
+
+var (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+
+	// A Retry-After longer than this isn't waited for, the error is returned so another
+	// provider can answer (see brunch.ProviderSettings.Fallbacks)
+	retryAfterLimit = time.Minute
+)
+
+// The API refused the request. Rate limits, server errors and overloads may pass, or another
+// provider may answer, so they are marked as the provider being unavailable
+type APIError struct {
+	Status     int
+	Body       string
+	RetryAfter time.Duration // how long the API asked to be given, zero when it didn't say
+}
+
+func (e *APIError) Error() string {
+	message := fmt.Sprintf("API request failed with status %d: %s", e.Status, e.Body)
+	if e.RetryAfter > 0 {
+		message += fmt.Sprintf(" (retry after %s)", e.RetryAfter)
+	}
+	return message
+}
+
+func (e *APIError) Unwrap() error {
+	if e.retryable() {
+		return brunch.ErrProviderUnavailable
+	}
+	return nil
+}
+
+func (e *APIError) retryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= http.StatusInternalServerError
+}
+
+// Retry-After is either a number of seconds or a date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// How long to wait before the attempt after the given one (1 for the first)
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (c *Client) SetMaxAttempts(attempts int) {
+	if attempts <= 0 {
+		attempts = DefaultMaxAttempts
+	}
+	c.maxAttempts = attempts
+}
+
+// Send the request body to the API, trying again while it is rate limited or overloaded. The
+// body of the response is returned when the request was answered
+func (c *Client) send(ctx context.Context, jsonBody []byte) ([]byte, error) {
+	attempts := max(c.maxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		body, err := c.sendOnce(ctx, jsonBody)
+		var apiErr *APIError
+		if err == nil || !errors.As(err, &apiErr) || !apiErr.retryable() || attempt >= attempts {
+			return body, err
+		}
+
+		wait := backoff(attempt)
+		if apiErr.RetryAfter > 0 {
+			if apiErr.RetryAfter > retryAfterLimit {
+				return nil, err
+			}
+			wait = apiErr.RetryAfter
+		}
+		slog.Warn("API request refused, trying again",
+			"status_code", apiErr.Status,
+			"attempt", attempt,
+			"wait", wait,
+		)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up waiting to try again after %v: %w", err, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *Client) sendOnce(ctx context.Context, jsonBody []byte) ([]byte, error) {
+	slog.Debug("sending API request",
+		"endpoint", c.apiEndpoint,
+		"request_size", len(jsonBody),
+	)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.apiEndpoint, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", c.apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		c.logRaw(req, jsonBody, 0, nil)
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	slog.Debug("received response",
+		"status_code", resp.StatusCode,
+		"content_length", resp.ContentLength,
+	)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	c.logRaw(req, jsonBody, resp.StatusCode, body)
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("API request failed",
+			"status_code", resp.StatusCode,
+			"response", string(body),
+		)
+		return nil, &APIError{
+			Status:     resp.StatusCode,
+			Body:       string(body),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,120 @@
+package anthropic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bosley/brunch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const answer = `{"id":"msg_1","model":"claude-test","role":"assistant","stop_reason":"end_turn",` +
+	`"content":[{"type":"text","text":"hello"}],"usage":{"input_tokens":3,"output_tokens":1}}`
+
+// Answers with the statuses in order, then with the answer
+func statusServer(t *testing.T, retryAfter string, statuses ...int) (*Client, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(calls.Add(1)) - 1
+		if call < len(statuses) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statuses[call])
+			w.Write([]byte(`{"type":"error"}`))
+			return
+		}
+		w.Write([]byte(answer))
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := New("test", "key", "", 0.5, 100)
+	require.NoError(t, err)
+	client.SetEndpoint(server.URL)
+	return client, &calls
+}
+
+func fastRetries(t *testing.T) {
+	base, limit := retryBaseDelay, retryAfterLimit
+	retryBaseDelay = time.Millisecond
+	t.Cleanup(func() { retryBaseDelay, retryAfterLimit = base, limit })
+}
+
+func TestClient_RetriesRateLimits(t *testing.T) {
+	fastRetries(t)
+	client, calls := statusServer(t, "", http.StatusTooManyRequests, 529)
+	reply, err := client.Ask(context.Background(), "hi")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", reply)
+	assert.EqualValues(t, 3, calls.Load())
+	assert.Equal(t, &brunch.ResponseMeta{ID: "msg_1", Model: "claude-test", StopReason: "end_turn"}, client.response)
+
+	// Out of attempts, the last refusal is returned as the provider being unavailable
+	client, calls = statusServer(t, "", http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	_, err = client.Ask(context.Background(), "hi")
+	assert.ErrorIs(t, err, brunch.ErrProviderUnavailable)
+	assert.EqualValues(t, 3, calls.Load())
+
+	client, calls = statusServer(t, "", http.StatusServiceUnavailable)
+	client.SetMaxAttempts(1)
+	_, err = client.Ask(context.Background(), "hi")
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, calls.Load())
+}
+
+func TestClient_DoesNotRetryBadRequests(t *testing.T) {
+	fastRetries(t)
+	client, calls := statusServer(t, "", http.StatusBadRequest)
+	_, _, err := client.AskWithTools(context.Background(), "hi", nil)
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	assert.NotErrorIs(t, err, brunch.ErrProviderUnavailable)
+	assert.EqualValues(t, 1, calls.Load())
+}
+
+func TestClient_RetryAfter(t *testing.T) {
+	fastRetries(t)
+	client, calls := statusServer(t, "1", http.StatusTooManyRequests)
+	started := time.Now()
+	_, err := client.Ask(context.Background(), "hi")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(started), time.Second)
+	assert.EqualValues(t, 2, calls.Load())
+
+	// Waits longer than the limit are left to another provider
+	retryAfterLimit = time.Millisecond
+	client, calls = statusServer(t, "120", http.StatusTooManyRequests)
+	_, err = client.Ask(context.Background(), "hi")
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 2*time.Minute, apiErr.RetryAfter)
+	assert.Contains(t, err.Error(), "retry after 2m0s")
+	assert.EqualValues(t, 1, calls.Load())
+
+	// Waiting stops with the context
+	retryAfterLimit = time.Minute
+	client, _ = statusServer(t, "30", http.StatusTooManyRequests)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.Ask(ctx, "hi")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, brunch.ErrProviderUnavailable)
+}
+
+func TestBackoff(t *testing.T) {
+	fastRetries(t)
+	for attempt := 1; attempt < 70; attempt++ {
+		delay := backoff(attempt)
+		assert.Positive(t, delay)
+		assert.LessOrEqual(t, delay, retryMaxDelay)
+	}
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5"))
+	assert.Zero(t, parseRetryAfter("soon"))
+	assert.InDelta(t, float64(time.Hour), float64(parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))), float64(2*time.Second))
+}
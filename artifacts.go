@@ -213,10 +213,41 @@ func (a *FileArtifact) Write(dir string, name string) error {
 		}
 	}
 
-	fullPath := filepath.Join(dir, fileName)
+	fullPath, err := artifactPath(dir, fileName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
 	return os.WriteFile(fullPath, []byte(a.Data), 0644)
 }
 
+// Characters that can't be in a file name on windows, they're swapped for underscores everywhere
+// so an artifact writes to the same name on every platform
+const invalidFileNameChars = `<>:"|?*`
+
+// Where an artifact with the given name goes in dir. Names come from the provider, and may
+// be a relative path with forward slashes ("src/main.go"), but they must stay inside of dir
+func artifactPath(dir string, name string) (string, error) {
+	parts := strings.Split(strings.ReplaceAll(name, "\\", "/"), "/")
+	for i, part := range parts {
+		parts[i] = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(invalidFileNameChars, r) || r < ' ' {
+				return '_'
+			}
+			return r
+		}, part)
+	}
+
+	cleaned := filepath.Clean(filepath.Join(parts...))
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) ||
+		strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") {
+		return "", fmt.Errorf("artifact name %q is not a path inside of the target directory", name)
+	}
+	return filepath.Join(dir, cleaned), nil
+}
+
 func (a *NonFileArtifact) Write(dir string, name string) error {
 	if name == "" {
 		return fmt.Errorf("name is required for writing artifacts")
@@ -230,6 +261,9 @@ func (a *NonFileArtifact) Write(dir string, name string) error {
 		name = name + ".txt"
 	}
 
-	fullPath := filepath.Join(dir, name)
+	fullPath, err := artifactPath(dir, name)
+	if err != nil {
+		return err
+	}
 	return os.WriteFile(fullPath, []byte(a.Data), 0644)
 }
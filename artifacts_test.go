@@ -2,9 +2,12 @@ package brunch
 
 import (
 	"encoding/base64"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseArtifactsFrom(t *testing.T) {
@@ -339,3 +342,45 @@ end
 		assert.NotContains(t, artifact.Data, "```", "Non-file artifact should not contain code block markers")
 	}
 }
+
+func TestArtifactPath(t *testing.T) {
+	dir := filepath.Join("out", "artifacts")
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "notes.md", want: filepath.Join(dir, "notes.md")},
+		{name: "src/main.go", want: filepath.Join(dir, "src", "main.go")},
+		{name: `src\main.go`, want: filepath.Join(dir, "src", "main.go")},
+		{name: "a:b?.txt", want: filepath.Join(dir, "a_b_.txt")},
+		{name: `C:\temp\x.txt`, want: filepath.Join(dir, "C_", "temp", "x.txt")},
+		{name: "src/../main.go", want: filepath.Join(dir, "main.go")},
+		{name: "../escape.txt", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+		{name: `\\server\share`, wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := artifactPath(dir, tt.name)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFileArtifact_WriteNested(t *testing.T) {
+	dir := t.TempDir()
+	artifact := &FileArtifact{Name: "src/main.go", Data: "package main"}
+	require.NoError(t, artifact.Write(dir, ""))
+	content, err := os.ReadFile(filepath.Join(dir, "src", "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package main", string(content))
+
+	assert.Error(t, (&FileArtifact{Name: "../main.go", Data: "x"}).Write(dir, ""))
+}
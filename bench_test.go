@@ -0,0 +1,167 @@
+package brunch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Build a tree with n message pairs where every node has up to `branching` children,
+// so a branching of 1 is a single long conversation
+func syntheticTree(n int, branching int) *RootNode {
+	root := NewRootNode(RootOpt{
+		Provider:    "bench",
+		Model:       "bench-model",
+		Prompt:      "you are a benchmark",
+		Temperature: 0.5,
+		MaxTokens:   1000,
+	})
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	parents := []Node{root}
+	for i := 0; i < n; i++ {
+		parent := parents[i/branching]
+		msgPair := NewMessagePairNode(parent)
+		msgPair.User = NewMessageData("user", fmt.Sprintf("question number %d, with a bit of padding to look like a real message", i))
+		msgPair.Assistant = NewMessageData("assistant", fmt.Sprintf("answer number %d, which is usually quite a lot longer than the question that was asked", i))
+		msgPair.Time = start.Add(time.Duration(i) * time.Second)
+		switch p := parent.(type) {
+		case *RootNode:
+			p.AddChild(msgPair)
+		case *MessagePairNode:
+			p.AddChild(msgPair)
+		}
+		parents = append(parents, msgPair)
+	}
+	return root
+}
+
+var benchTrees = []struct {
+	name      string
+	nodes     int
+	branching int
+}{
+	{"wide-10k", 10000, 3},
+	{"chain-1k", 1000, 1},
+}
+
+func BenchmarkMarshalNode(b *testing.B) {
+	for _, bt := range benchTrees {
+		root := syntheticTree(bt.nodes, bt.branching)
+		b.Run(bt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := marshalNode(root); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshalNode(b *testing.B) {
+	for _, bt := range benchTrees {
+		data, err := marshalNode(syntheticTree(bt.nodes, bt.branching))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(bt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := unmarshalNode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Saving a chat, the tree and then the snapshot around it in canonical form
+func BenchmarkSnapshotMarshal(b *testing.B) {
+	for _, bt := range benchTrees {
+		root := syntheticTree(bt.nodes, bt.branching)
+		b.Run(bt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				contents, err := marshalNode(root)
+				if err != nil {
+					b.Fatal(err)
+				}
+				snapshot := Snapshot{ProviderName: "bench", ActiveBranch: root.Hash(), Contents: contents, Contexts: []string{}}
+				if _, err := snapshot.Marshal(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMapTree(b *testing.B) {
+	for _, bt := range benchTrees {
+		root := syntheticTree(bt.nodes, bt.branching)
+		b.Run(bt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if len(MapTree(root)) != bt.nodes+1 {
+					b.Fatal("tree is missing nodes")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPrintTree(b *testing.B) {
+	for _, bt := range benchTrees {
+		root := syntheticTree(bt.nodes, bt.branching)
+		b.Run(bt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				PrintTree(root)
+			}
+		})
+	}
+}
+
+// The benchmark trees are also a good check that the optimized paths produce the same thing
+func TestSyntheticTreeRoundTrip(t *testing.T) {
+	root := syntheticTree(500, 3)
+	data, err := marshalNode(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := unmarshalNode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := MapTree(root)
+	after := MapTree(loaded)
+	if len(before) != 501 || len(after) != len(before) {
+		t.Fatalf("expected 501 nodes, had %d and %d after loading", len(before), len(after))
+	}
+	for hash := range before {
+		if _, ok := after[hash]; !ok {
+			t.Fatalf("node %s was lost in the round trip", hash)
+		}
+	}
+}
+
+// Navigation maps the tree to find nodes, so this is what moving around a big chat costs
+func BenchmarkGotoLeaf(b *testing.B) {
+	root := syntheticTree(10000, 3)
+	chat := &chatInstance{root: *root}
+	chat.currentNode = &chat.root
+	var leaf string
+	for hash, node := range MapTree(&chat.root) {
+		if len(node.ToMap()) == 0 {
+			leaf = hash
+			break
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := chat.Goto(leaf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
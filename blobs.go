@@ -0,0 +1,290 @@
+package brunch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Large strings in snapshots (system prompts, pasted context, long replies) repeat across
+// every chat derived from the same provider or forked from the same chat. They are kept once
+// in the data-store, named by the sha256 of their content, and the snapshot has a reference
+// in their place:
+//
+//	{"$blob": "<sha256>"}
+//
+// Snapshots are written with the references and read with them resolved, so nothing past the
+// chat store sees them. Blobs nothing refers to anymore are removed when the trash is emptied
+// or by Core.CollectBlobs
+const blobDirectory = "blobs"
+
+// Strings at least this long are kept as blobs
+const blobThreshold = 1024
+
+const blobKey = "$blob"
+
+var (
+	blobReference = regexp.MustCompile(`"\$blob":\s*"([0-9a-f]{64})"`)
+	blobHashForm  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// The hash the object refers to, if it is a reference
+func referencedHash(object map[string]interface{}) (string, bool) {
+	hash, ok := object[blobKey].(string)
+	if !ok || len(object) != 1 || !blobHashForm.MatchString(hash) {
+		return "", false
+	}
+	return hash, true
+}
+
+func (c *Core) blobPath(hash string) string {
+	return c.storePath(dataStoreDirectory, blobDirectory, hash)
+}
+
+func blobHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Keep the content as a blob, unless it already is one
+func (c *Core) writeBlob(content string) (string, error) {
+	hash := blobHash(content)
+	path := c.blobPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	// Written aside and moved in, a blob that is there is always whole
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return "", fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write blob: %w", err)
+	}
+	return hash, nil
+}
+
+func (c *Core) readBlob(hash string) (string, error) {
+	content, err := os.ReadFile(c.blobPath(hash))
+	if err != nil {
+		return "", fmt.Errorf("blob %s is missing: %w", hash, err)
+	}
+	if blobHash(string(content)) != hash {
+		return "", fmt.Errorf("blob %s is corrupt, its content doesn't match its hash", hash)
+	}
+	return string(content), nil
+}
+
+func decodeJSON(content string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Something that already looks like a reference can't be told apart from one, so a document
+// with one is written without blobs
+func containsReference(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if _, isReference := referencedHash(v); isReference {
+			return true
+		}
+		for _, member := range v {
+			if containsReference(member) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, element := range v {
+			if containsReference(element) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Move the large strings of the JSON document into blobs. Documents without any, or that
+// aren't JSON, are returned as they are
+func (c *Core) storeBlobs(content string) (string, error) {
+	if len(content) < blobThreshold {
+		return content, nil
+	}
+	value, err := decodeJSON(content)
+	if err != nil {
+		return content, nil
+	}
+	if containsReference(value) {
+		c.logger.Debug("document has something that looks like a blob reference, keeping it inline")
+		return content, nil
+	}
+
+	stored := 0
+	var walk func(value interface{}) (interface{}, error)
+	walk = func(value interface{}) (interface{}, error) {
+		switch v := value.(type) {
+		case string:
+			if len(v) < blobThreshold {
+				return v, nil
+			}
+			hash, err := c.writeBlob(v)
+			if err != nil {
+				return nil, err
+			}
+			stored++
+			return map[string]interface{}{blobKey: hash}, nil
+		case map[string]interface{}:
+			for key, member := range v {
+				replaced, err := walk(member)
+				if err != nil {
+					return nil, err
+				}
+				v[key] = replaced
+			}
+		case []interface{}:
+			for i, element := range v {
+				replaced, err := walk(element)
+				if err != nil {
+					return nil, err
+				}
+				v[i] = replaced
+			}
+		}
+		return value, nil
+	}
+	value, err = walk(value)
+	if err != nil {
+		return "", err
+	}
+	if stored == 0 {
+		return content, nil
+	}
+	data, err := canonicalValue(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Put the blobs the JSON document refers to back in place
+func (c *Core) resolveBlobs(content string) (string, error) {
+	if !strings.Contains(content, `"`+blobKey+`"`) {
+		return content, nil
+	}
+	value, err := decodeJSON(content)
+	if err != nil {
+		return content, nil
+	}
+
+	var walk func(value interface{}) (interface{}, error)
+	walk = func(value interface{}) (interface{}, error) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if hash, isReference := referencedHash(v); isReference {
+				return c.readBlob(hash)
+			}
+			for key, member := range v {
+				resolved, err := walk(member)
+				if err != nil {
+					return nil, err
+				}
+				v[key] = resolved
+			}
+		case []interface{}:
+			for i, element := range v {
+				resolved, err := walk(element)
+				if err != nil {
+					return nil, err
+				}
+				v[i] = resolved
+			}
+		}
+		return value, nil
+	}
+	value, err = walk(value)
+	if err != nil {
+		return "", err
+	}
+	data, err := canonicalValue(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// The blobs referred to by the chats in the chat store, and the ones in the trash or
+// quarantine, which may still come back
+func (c *Core) referencedBlobs() (map[string]bool, error) {
+	referenced := map[string]bool{}
+	dirs := []string{
+		c.storePath(chatStoreDirectory),
+		c.trashPath(chatStoreDirectory, ""),
+		c.quarantinePath(chatStoreDirectory, ""),
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+				continue
+			}
+			content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", entry.Name(), err)
+			}
+			for _, match := range blobReference.FindAllSubmatch(content, -1) {
+				referenced[string(match[1])] = true
+			}
+		}
+	}
+	return referenced, nil
+}
+
+// CollectBlobs removes the blobs no chat refers to anymore, returning how many were removed
+func (c *Core) CollectBlobs() (int, error) {
+	c.blobMu.Lock()
+	defer c.blobMu.Unlock()
+
+	entries, err := os.ReadDir(c.storePath(dataStoreDirectory, blobDirectory))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read blobs: %w", err)
+	}
+	referenced, err := c.referencedBlobs()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if referenced[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(c.blobPath(entry.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove blob %s: %w", entry.Name(), err)
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,114 @@
+package brunch
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func blobCount(t *testing.T, core *Core) int {
+	entries, err := os.ReadDir(core.storePath(dataStoreDirectory, blobDirectory))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	require.NoError(t, err)
+	return len(entries)
+}
+
+func TestCore_SnapshotBlobs(t *testing.T) {
+	core := newTestCore(t)
+	run := func(stmt string) error {
+		return core.ExecuteStatement("s1", NewStatement(stmt))
+	}
+	prompt := strings.Repeat("You are a careful reviewer. ", 100)
+	require.NoError(t, run(`\new-provider "reviewer" :host "mock" :system-prompt "`+prompt+`"`))
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, run(`\new-chat "`+name+`" :provider "reviewer"`))
+	}
+
+	// The prompt is kept once, the chats refer to it
+	assert.Equal(t, 1, blobCount(t, core))
+	raw, err := os.ReadFile(core.storePath(chatStoreDirectory, "a.json"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), prompt)
+	assert.Contains(t, string(raw), `"$blob": "`+blobHash(prompt)+`"`)
+
+	// And it is back in place when the chat is read
+	content, err := core.LoadFromChatStore("a.json")
+	require.NoError(t, err)
+	assert.NotContains(t, content, blobKey)
+	require.NoError(t, run(`\chat "c"`))
+	chat, err := core.GetActiveChat("c")
+	require.NoError(t, err)
+	assert.Equal(t, prompt, chat.root.Prompt)
+
+	// Saving it again gives the same file
+	raw, err = os.ReadFile(core.storePath(chatStoreDirectory, "c.json"))
+	require.NoError(t, err)
+	require.NoError(t, core.SaveActiveChat("s1"))
+	again, err := os.ReadFile(core.storePath(chatStoreDirectory, "c.json"))
+	require.NoError(t, err)
+	assert.Equal(t, raw, again)
+
+	// Chats in the trash keep their blobs, they can still be restored
+	require.NoError(t, run(`\del-chat "a"`))
+	require.NoError(t, run(`\del-chat "b"`))
+	removed, err := core.CollectBlobs()
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+	require.NoError(t, run(`\restore "b" :kind "chat"`))
+	content, err = core.LoadFromChatStore("b.json")
+	require.NoError(t, err)
+	assert.Contains(t, content, prompt)
+
+	// Emptying the trash leaves the blobs the remaining chat refers to
+	require.NoError(t, run(`\del-chat "b"`))
+	for _, name := range []string{"a", "b"} {
+		expireTrash(t, core, TrashKindChat, name)
+	}
+	require.NoError(t, run(`\new-chat "d" :provider "mock"`))
+	require.NoError(t, run(`\del-chat "d"`))
+	assert.Equal(t, 1, blobCount(t, core))
+
+	require.NoError(t, os.Remove(core.storePath(chatStoreDirectory, "c.json")))
+	removed, err = core.CollectBlobs()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Zero(t, blobCount(t, core))
+}
+
+func TestCore_MissingBlob(t *testing.T) {
+	core := newTestCore(t)
+	prompt := strings.Repeat("x", blobThreshold)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "long" :host "mock" :system-prompt "`+prompt+`"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "long"`)))
+	require.NoError(t, os.Remove(core.blobPath(blobHash(prompt))))
+
+	_, err := core.LoadFromChatStore("a.json")
+	assert.ErrorContains(t, err, "missing")
+	report, err := core.Verify()
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.True(t, report.Problems[0].Corrupt)
+}
+
+func TestCore_StoreBlobsLookalike(t *testing.T) {
+	core := newTestCore(t)
+
+	// A document with something that looks like a reference is written as it is
+	lookalike := `{"input": {"$blob": "` + blobHash("not a blob") + `"}, "long": "` + strings.Repeat("y", blobThreshold) + `"}`
+	stored, err := core.storeBlobs(lookalike)
+	require.NoError(t, err)
+	assert.Equal(t, lookalike, stored)
+
+	// Small documents and documents that aren't JSON aren't touched either
+	for _, content := range []string{`{"a": "b"}`, strings.Repeat("z", 2*blobThreshold)} {
+		stored, err := core.storeBlobs(content)
+		require.NoError(t, err)
+		assert.Equal(t, content, stored)
+	}
+	assert.Zero(t, blobCount(t, core))
+}
@@ -0,0 +1,232 @@
+package brunch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The version of the branch export schema. Fields are only ever added to it, anything else
+// gets a new version, so an export can be read by every version of brunch since it was made
+const BranchExportVersion = 1
+
+// A branch of a chat, from the root down to one of its nodes, in a form that can be handed
+// around (attached to a bug report, sent to someone else) and imported into any chat
+type BranchExport struct {
+	Version    int                `json:"version"`
+	ExportedAt time.Time          `json:"exported_at"`
+	Root       BranchExportRoot   `json:"root"`
+	Messages   []BranchExportPair `json:"messages"`
+}
+
+// What the branch's chat was set up with. It is informational, an import goes under the
+// root of the chat it is imported into
+type BranchExportRoot struct {
+	Provider    string  `json:"provider"`
+	Model       string  `json:"model"`
+	Prompt      string  `json:"prompt"`
+	Temperature float64 `json:"temperature"`
+	MaxTokens   int     `json:"max_tokens"`
+}
+
+// The time is kept with its offset, it is part of the node's hash. Annotations have
+// no user or assistant content
+type BranchExportPair struct {
+	Time       time.Time   `json:"time"`
+	User       string      `json:"user"`
+	Assistant  string      `json:"assistant"`
+	Images     []string    `json:"images,omitempty"`
+	Annotation *Annotation `json:"annotation,omitempty"`
+}
+
+// Export the branch ending at the node with the given hash, or at the current node if the hash is empty
+func (c *chatInstance) ExportBranch(hash string) ([]byte, error) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+
+	target := c.currentNode
+	if hash != "" {
+		found, exists := MapTree(&c.root)[hash]
+		if !exists {
+			return nil, fmt.Errorf("node %s not found", hash)
+		}
+		target = found
+	}
+
+	export := BranchExport{
+		Version:    BranchExportVersion,
+		ExportedAt: time.Now().UTC(),
+		Root: BranchExportRoot{
+			Provider:    c.root.Provider,
+			Model:       c.root.Model,
+			Prompt:      c.root.Prompt,
+			Temperature: c.root.Temperature,
+			MaxTokens:   c.root.MaxTokens,
+		},
+		Messages: []BranchExportPair{},
+	}
+	for n := target; n != nil; n = nodeParent(n) {
+		mp, ok := n.(*MessagePairNode)
+		if !ok {
+			break
+		}
+		if mp.Annotation != nil {
+			annotation := *mp.Annotation
+			export.Messages = append([]BranchExportPair{{Time: mp.Time, Annotation: &annotation}}, export.Messages...)
+			continue
+		}
+		if mp.User == nil || mp.Assistant == nil {
+			continue
+		}
+		pair := BranchExportPair{
+			Time:      mp.Time,
+			User:      mp.User.UnencodedContent(),
+			Assistant: mp.Assistant.UnencodedContent(),
+		}
+		if len(mp.User.Images) > 0 {
+			pair.Images = append([]string{}, mp.User.Images...)
+		}
+		export.Messages = append([]BranchExportPair{pair}, export.Messages...)
+	}
+	return json.MarshalIndent(export, "", "  ")
+}
+
+func parseBranchExport(data []byte) (*BranchExport, error) {
+	var export BranchExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal branch: %w", err)
+	}
+	if export.Version < 1 || export.Version > BranchExportVersion {
+		return nil, fmt.Errorf("unsupported branch export version %d", export.Version)
+	}
+	if len(export.Messages) == 0 {
+		return nil, errors.New("branch has no messages")
+	}
+	for idx, pair := range export.Messages {
+		if pair.Annotation != nil {
+			if !pair.Annotation.Kind.valid() || pair.Annotation.Content == "" {
+				return nil, fmt.Errorf("message %d is not a valid annotation", idx)
+			}
+			continue
+		}
+		if pair.User == "" || pair.Assistant == "" {
+			return nil, fmt.Errorf("message %d is missing the user or assistant content", idx)
+		}
+	}
+	return &export, nil
+}
+
+// Put the branch under the root. Where the start of the branch is already in the tree (the
+// same messages at the same time) the existing nodes are followed instead of being duplicated,
+// so importing a branch into the chat it came from changes nothing. The rest of it has to fit
+// the tree limits, nothing is added when it doesn't. The leaf is returned
+func graftBranch(root *RootNode, export *BranchExport, limits TreeLimits) (*MessagePairNode, error) {
+	var parent Node = root
+	var leaf *MessagePairNode
+	checked := false
+	for idx, message := range export.Messages {
+		pair := NewMessagePairNode(parent)
+		if !message.Time.IsZero() {
+			pair.Time = message.Time
+		}
+		if message.Annotation != nil {
+			annotation := *message.Annotation
+			pair.Annotation = &annotation
+		} else {
+			pair.User = NewMessageData("user", message.User)
+			pair.Assistant = NewMessageData("assistant", message.Assistant)
+			if len(message.Images) > 0 {
+				pair.User.Images = append([]string{}, message.Images...)
+			}
+		}
+
+		var existing *MessagePairNode
+		for _, child := range nodeChildren(parent) {
+			if mp, ok := child.(*MessagePairNode); ok && mp.Hash() == pair.Hash() {
+				existing = mp
+				break
+			}
+		}
+		if existing != nil {
+			parent, leaf = existing, existing
+			continue
+		}
+		if !checked {
+			if err := limits.check(root, parent, len(export.Messages)-idx, len(export.Messages)-idx, 1); err != nil {
+				return nil, err
+			}
+			checked = true
+		}
+
+		switch p := parent.(type) {
+		case *RootNode:
+			p.AddChild(pair)
+		case *MessagePairNode:
+			p.AddChild(pair)
+		}
+		parent, leaf = pair, pair
+	}
+	return leaf, nil
+}
+
+// Import an exported branch into the chat as a new branch off of its root, and save the chat.
+// The hash of the branch's last node is returned so it can be gone to
+func (c *Core) ImportBranch(chatName string, data []byte) (string, error) {
+	export, err := parseBranchExport(data)
+	if err != nil {
+		return "", err
+	}
+
+	c.chatMu.Lock()
+	chat, active := c.activeChats[chatName]
+	c.chatMu.Unlock()
+
+	if active {
+		chat.submitMu.Lock()
+		defer chat.submitMu.Unlock()
+		leaf, err := graftBranch(&chat.root, export, c.treeLimits)
+		if err != nil {
+			return "", err
+		}
+		return leaf.Hash(), c.writeSnapshot(chatName, chat)
+	}
+
+	file := fmt.Sprintf("%s.json", chatName)
+	content, err := c.LoadFromChatStore(file)
+	if err != nil {
+		return "", fmt.Errorf("chat %s does not exist", chatName)
+	}
+	snapshot, err := SnapshotFromJSON([]byte(content))
+	if err != nil {
+		return "", err
+	}
+	decoded, err := unmarshalNode(snapshot.Contents)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal chat %s: %w", chatName, err)
+	}
+	root, ok := decoded.(*RootNode)
+	if !ok {
+		return "", fmt.Errorf("chat %s does not contain a valid root node", chatName)
+	}
+
+	leaf, err := graftBranch(root, export, c.treeLimits)
+	if err != nil {
+		return "", err
+	}
+	if snapshot.Contents, err = marshalNode(root); err != nil {
+		return "", err
+	}
+	updated, err := snapshot.Marshal()
+	if err != nil {
+		return "", err
+	}
+	if err := c.AddToChatStore(file, string(updated)); err != nil {
+		return "", err
+	}
+	return leaf.Hash(), c.indexChat(chatName, chatReferences{
+		Provider: snapshot.ProviderName,
+		Contexts: snapshot.Contexts,
+		Nodes:    len(MapTree(root)),
+	})
+}
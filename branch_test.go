@@ -0,0 +1,97 @@
+package brunch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBranchTestChat(t *testing.T, core *Core, name string) *chatInstance {
+	t.Helper()
+	require.NoError(t, core.ExecuteStatement("s-"+name, NewStatement(`\new-chat "`+name+`" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s-"+name, NewStatement(`\chat "`+name+`"`)))
+	chat, err := core.GetActiveChat(name)
+	require.NoError(t, err)
+	return chat
+}
+
+func TestChat_ExportBranch(t *testing.T) {
+	core := newTestCore(t)
+	chat := newBranchTestChat(t, core, "a")
+	_, err := chat.SubmitMessage("one")
+	require.NoError(t, err)
+	first := chat.currentNode.Hash()
+	_, err = chat.SubmitMessage("two")
+	require.NoError(t, err)
+	chat.currentNode.(*MessagePairNode).User.Images = []string{"a.png"}
+
+	data, err := chat.ExportBranch("")
+	require.NoError(t, err)
+	var export BranchExport
+	require.NoError(t, json.Unmarshal(data, &export))
+	assert.Equal(t, BranchExportVersion, export.Version)
+	assert.Equal(t, chat.root.Provider, export.Root.Provider)
+	require.Len(t, export.Messages, 2)
+	assert.Equal(t, "one", export.Messages[0].User)
+	assert.Equal(t, "echo: two", export.Messages[1].Assistant)
+	assert.Equal(t, []string{"a.png"}, export.Messages[1].Images)
+
+	data, err = chat.ExportBranch(first)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &export))
+	assert.Len(t, export.Messages, 1)
+
+	_, err = chat.ExportBranch("missing")
+	assert.Error(t, err)
+}
+
+func TestCore_ImportBranch(t *testing.T) {
+	core := newTestCore(t)
+	source := newBranchTestChat(t, core, "source")
+	_, err := source.SubmitMessage("one")
+	require.NoError(t, err)
+	_, err = source.SubmitMessage("two")
+	require.NoError(t, err)
+	data, err := source.ExportBranch("")
+	require.NoError(t, err)
+
+	// Into a chat that isn't loaded, it is written to the store
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "target" :provider "mock"`)))
+	leaf, err := core.ImportBranch("target", data)
+	require.NoError(t, err)
+	assert.Equal(t, source.currentNode.Hash(), leaf, "the import has the same hashes as the export")
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "target"`)))
+	target, err := core.GetActiveChat("target")
+	require.NoError(t, err)
+	require.NoError(t, target.Goto(leaf))
+	assert.Equal(t, "echo: two", target.currentNode.(*MessagePairNode).Assistant.UnencodedContent())
+	metadata, err := core.ChatMetadata("target")
+	require.NoError(t, err)
+	assert.Equal(t, 3, metadata.Nodes)
+
+	// Into an active chat, and importing what is already there adds nothing
+	_, err = core.ImportBranch("source", data)
+	require.NoError(t, err)
+	assert.Len(t, MapTree(&source.root), 3)
+
+	// A branch that shares the start of one in the tree splits off where they differ
+	var export BranchExport
+	require.NoError(t, json.Unmarshal(data, &export))
+	export.Messages[1].User = "something else"
+	changed, err := json.Marshal(export)
+	require.NoError(t, err)
+	_, err = core.ImportBranch("source", changed)
+	require.NoError(t, err)
+	assert.Len(t, MapTree(&source.root), 4)
+	assert.Len(t, source.root.Children, 1)
+
+	_, err = core.ImportBranch("missing", data)
+	assert.Error(t, err)
+	_, err = core.ImportBranch("target", []byte(`{"version": 99, "messages": [{"user": "a", "assistant": "b"}]}`))
+	assert.Error(t, err)
+	_, err = core.ImportBranch("target", []byte(`{"version": 1, "messages": []}`))
+	assert.Error(t, err)
+}
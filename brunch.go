@@ -1,12 +1,16 @@
 package brunch
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +23,35 @@ type ProviderSettings struct {
 	MaxTokens    int     `json:"max_tokens"`
 	Temperature  float64 `json:"temperature"`
 	SystemPrompt string  `json:"system_prompt"`
+
+	// Another provider (usually a cheaper model) that handles auxiliary work like summaries
+	// and titles for chats using this one, so the main model only answers the user
+	Companion string `json:"companion,omitempty"`
+
+	// Appended to the system prompt when it is sent, but not part of it. Nothing is appended
+	// unless this is set
+	PromptSuffix string `json:"prompt_suffix,omitempty"`
+
+	// Asks the provider to sample deterministically so the same history and message give the
+	// same answer. Providers that can't seed (anthropic) keep it but otherwise ignore it
+	Seed *int64 `json:"seed,omitempty"`
+
+	// Post-processors run over every reply before it is stored, in order (see postprocess.go)
+	PostProcess []string `json:"post_process,omitempty"`
+
+	// Providers asked in order when this one can't answer (it can't be reached, is rate limited
+	// or overloaded), see failover.go
+	Fallbacks []string `json:"fallbacks,omitempty"`
+
+	// Keeps the branch sent within what the model takes in, see window.go
+	Window *ContextWindow `json:"context_window,omitempty"`
+
+	// How many times a request is tried when the provider is rate limited or overloaded, the
+	// provider's own default when not set. Providers that don't retry ignore it
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	// Holds back what is sent so the chats on the provider stay under the API's limits, see ratelimit.go
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
 }
 
 // A provider is an abstraction of some (presumably LLM) message generation service
@@ -31,8 +64,9 @@ type Provider interface {
 
 	// ExtendFrom takes a node and returns a function that can be used to create a new message pair node
 	// This means that this is the function we call in order to get a function to send a message,
-	// and then receive a response
-	ExtendFrom(Node) MessageCreator
+	// and then receive a response. The request is made in the context, it should stop when the
+	// context is cancelled or its deadline passes
+	ExtendFrom(context.Context, Node) MessageCreator
 
 	// GetRoot takes a node and returns the root node
 	GetRoot(Node) RootNode
@@ -51,19 +85,22 @@ type Provider interface {
 	// CloneWithSettings returns a new provider with the given settings
 	// This is so we can derive providers from existing providers at runtime
 	// and have them be available to the user
-	CloneWithSettings(ProviderSettings) Provider
+	CloneWithSettings(ProviderSettings) (Provider, error)
+}
 
-	// AttachKnowledgeContext attaches a knowledge context to the provider
-	// A knowledge context could be a directory, a database, a web page, etc.
-	// HOW the knowledge is incorperated into the conversation is up to the provider
-	// and if the provider doesn't support knowledge contexts, this should return an error
+// A KnowledgeAttacher is a provider that incorporates knowledge contexts itself. A knowledge
+// context could be a directory, a database, a web page, etc. Chats on providers that aren't
+// attachers use the context's KnowledgeProvider instead (see knowledge.go)
+type KnowledgeAttacher interface {
+
+	// AttachKnowledgeContext attaches a knowledge context to the provider. HOW the knowledge
+	// is incorperated into the conversation is up to the provider
 	AttachKnowledgeContext(ContextSettings) error
 }
 
 // A context type is a type of knowledge that can be attached to a conversation
 // This could be a directory, a database, a web page, etc.
-// HOW the knowledge is incorperated into the conversation is up to the provider
-// and if the provider doesn't support knowledge contexts, this should return an error
+// Each type has a built-in KnowledgeProvider, unless the chat's provider attaches it itself
 type ContextType string
 
 const (
@@ -101,6 +138,9 @@ type node struct {
 	Type     NodeTyppe `json:"type"`
 	Parent   Node      `json:"parent,omitempty"`
 	Children []Node    `json:"children"`
+
+	// Messages sent from the node while the provider couldn't be reached, see pending.go
+	Pending []PendingMessage `json:"pending,omitempty"`
 }
 
 func (n *node) AddChild(child Node) {
@@ -125,6 +165,34 @@ type RootNode struct {
 	Prompt      string  `json:"prompt"`
 	Temperature float64 `json:"temperature"`
 	MaxTokens   int     `json:"max_tokens"`
+
+	hash atomic.Value
+}
+
+// Hashes are needed constantly (navigation, mapping the tree, building prompts) so they are
+// memoized on the node along with what they were computed from. The fields are public and can
+// be changed at any point, so the inputs are compared on every call and the hash recomputed
+// if any of them differ. The comparison is cheap as unchanged strings share their memory
+type memoizedHash[T comparable] struct {
+	inputs T
+	hash   string
+}
+
+func memoize[T comparable](memo *atomic.Value, inputs T, compute func() string) string {
+	if m, ok := memo.Load().(*memoizedHash[T]); ok && m.inputs == inputs {
+		return m.hash
+	}
+	hash := compute()
+	memo.Store(&memoizedHash[T]{inputs: inputs, hash: hash})
+	return hash
+}
+
+type rootHashInputs struct {
+	provider    string
+	model       string
+	prompt      string
+	temperature float64
+	maxTokens   int
 }
 
 func (r *RootNode) Type() NodeTyppe {
@@ -132,9 +200,12 @@ func (r *RootNode) Type() NodeTyppe {
 }
 
 func (r *RootNode) Hash() string {
-	hasher := sha256.New()
-	hasher.Write([]byte(r.Provider + r.Model + r.Prompt + strconv.FormatFloat(r.Temperature, 'f', -1, 64) + strconv.Itoa(r.MaxTokens)))
-	return hex.EncodeToString(hasher.Sum(nil))
+	inputs := rootHashInputs{r.Provider, r.Model, r.Prompt, r.Temperature, r.MaxTokens}
+	return memoize(&r.hash, inputs, func() string {
+		hasher := sha256.New()
+		hasher.Write([]byte(r.Provider + r.Model + r.Prompt + strconv.FormatFloat(r.Temperature, 'f', -1, 64) + strconv.Itoa(r.MaxTokens)))
+		return hex.EncodeToString(hasher.Sum(nil))
+	})
 }
 
 type RootOpt struct {
@@ -145,11 +216,63 @@ type RootOpt struct {
 	MaxTokens   int
 }
 
+// What the provider said about an answer, so it can be traced back to the exact model that
+// gave it. Providers set what they know of it
+type ResponseMeta struct {
+	ID         string `json:"id,omitempty"`          // the provider's id for the response
+	Model      string `json:"model,omitempty"`       // the model version that answered
+	StopReason string `json:"stop_reason,omitempty"` // why it stopped, like end_turn or max_tokens
+}
+
 type MessagePairNode struct {
 	node
 	Assistant *MessageData `json:"assistant"`
 	User      *MessageData `json:"user"`
 	Time      time.Time    `json:"time"`
+
+	// Content the pair had before it was regenerated or edited, oldest first
+	Revisions []Revision `json:"revisions,omitempty"`
+
+	// Set when the answer was checked for unsupported claims
+	Verdict *Verdict `json:"verdict,omitempty"`
+
+	// The seed the answer was generated with, only set by providers that honor one
+	Seed *int64 `json:"seed,omitempty"`
+
+	// How long the provider took to answer
+	Latency *Latency `json:"latency,omitempty"`
+
+	// The fallback provider that answered when the chat's own provider couldn't, see failover.go
+	AnsweredBy string `json:"answered_by,omitempty"`
+
+	// The tokens the message took, see usage.go
+	Usage *TokenUsage `json:"usage,omitempty"`
+
+	// What the provider said about the answer
+	Response *ResponseMeta `json:"response,omitempty"`
+
+	// The tools the reply asked for and what they returned, the pairs under it were sent the results
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+
+	// Set when the message was too long to send at once and was answered from notes on its parts
+	Chunked *ChunkedInput `json:"chunked,omitempty"`
+
+	// Set on the notes on one part of a chunked message, under its answer. They are never sent again
+	ChunkStep *ChunkStep `json:"chunk_step,omitempty"`
+
+	// Set when the pair is an annotation instead of an exchange, it has no user or assistant message then
+	Annotation *Annotation `json:"annotation,omitempty"`
+
+	// The pieces of the chat's contexts that were sent with the message, see knowledge.go
+	Citations []Citation `json:"citations,omitempty"`
+
+	hash atomic.Value
+}
+
+type pairHashInputs struct {
+	assistant string
+	user      string
+	time      time.Time
 }
 
 func NewMessagePairNode(parent Node) *MessagePairNode {
@@ -162,17 +285,66 @@ func NewMessagePairNode(parent Node) *MessagePairNode {
 	}
 }
 
+// A copy of the pair with everything it recorded, under the given parent and without children.
+// Nothing is shared with the original, so either can be changed
+func (m *MessagePairNode) clone(parent Node) *MessagePairNode {
+	pair := &MessagePairNode{
+		node:       node{Type: NT_MESSAGE_PAIR, Parent: parent},
+		User:       copyMessage(m.User),
+		Assistant:  copyMessage(m.Assistant),
+		Time:       m.Time,
+		Seed:       copyOf(m.Seed),
+		Latency:    copyOf(m.Latency),
+		AnsweredBy: m.AnsweredBy,
+		Usage:      copyOf(m.Usage),
+		Response:   copyOf(m.Response),
+		Chunked:    copyOf(m.Chunked),
+		ChunkStep:  copyOf(m.ChunkStep),
+		Annotation: copyOf(m.Annotation),
+	}
+	for _, revision := range m.Revisions {
+		revision.User, revision.Assistant = copyMessage(revision.User), copyMessage(revision.Assistant)
+		revision.Seed, revision.Usage, revision.Response = copyOf(revision.Seed), copyOf(revision.Usage), copyOf(revision.Response)
+		revision.Citations = append([]Citation(nil), revision.Citations...)
+		pair.Revisions = append(pair.Revisions, revision)
+	}
+	if m.Verdict != nil {
+		verdict := *m.Verdict
+		verdict.Unsupported = append([]string(nil), m.Verdict.Unsupported...)
+		pair.Verdict = &verdict
+	}
+	pair.ToolCalls = append([]ToolCall(nil), m.ToolCalls...)
+	pair.Citations = append([]Citation(nil), m.Citations...)
+	return pair
+}
+
+func copyOf[T any](value *T) *T {
+	if value == nil {
+		return nil
+	}
+	copied := *value
+	return &copied
+}
+
 func (m *MessagePairNode) Type() NodeTyppe {
 	return NT_MESSAGE_PAIR
 }
 
 func (m *MessagePairNode) Hash() string {
-	hasher := sha256.New()
-	if m.Assistant == nil || m.User == nil {
+	var inputs pairHashInputs
+	switch {
+	case m.Annotation != nil:
+		inputs = pairHashInputs{"", string(m.Annotation.Kind) + "\n" + m.Annotation.Content, m.Time}
+	case m.Assistant == nil || m.User == nil:
 		return ""
+	default:
+		inputs = pairHashInputs{m.Assistant.UnencodedContent(), m.User.UnencodedContent(), m.Time}
 	}
-	hasher.Write([]byte(m.Assistant.UnencodedContent() + m.User.UnencodedContent() + m.Time.Format(time.RFC3339)))
-	return hex.EncodeToString(hasher.Sum(nil))
+	return memoize(&m.hash, inputs, func() string {
+		hasher := sha256.New()
+		hasher.Write([]byte(inputs.assistant + inputs.user + inputs.time.Format(time.RFC3339)))
+		return hex.EncodeToString(hasher.Sum(nil))
+	})
 }
 
 type MessageData struct {
@@ -180,6 +352,9 @@ type MessageData struct {
 	B64EncodedContent string   `json:"-"`
 	RawContent        string   `json:"content"`
 	Images            []string `json:"images,omitempty"`
+
+	// Set when the message went through the translation layer
+	Translation *Translation `json:"translation,omitempty"`
 }
 
 func NewRootNode(opts RootOpt) *RootNode {
@@ -278,6 +453,9 @@ func (m *node) History() []string {
 func (m *node) ToString() string {
 	if m.Type == NT_MESSAGE_PAIR {
 		if mp, ok := interface{}(m).(*MessagePairNode); ok {
+			if mp.Annotation != nil {
+				return fmt.Sprintf("%s: %s", mp.Annotation.Kind, mp.Annotation.Content)
+			}
 			return fmt.Sprintf("User: %s\nAssistant: %s", mp.User.UnencodedContent(), mp.Assistant.UnencodedContent())
 		}
 	} else if m.Type == NT_ROOT {
@@ -300,14 +478,28 @@ func historyFromNode(node Node, list []MessageData) []MessageData {
 	}
 
 	if node.Type() == NT_MESSAGE_PAIR {
-		if mp, ok := node.(*MessagePairNode); ok && mp.Assistant != nil && mp.User != nil {
-			list = append(list, *mp.User, *mp.Assistant)
+		if mp, ok := node.(*MessagePairNode); ok {
+			if user, assistant, ok := mp.Exchange(); ok {
+				list = append(list, *user, *assistant)
+			}
 		}
 	}
 	return list
 }
 
 func marshalNode(node Node) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := marshalNodeTo(&buf, node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Each node is written as {"node_data":{...},"children":{"<hash>":{...},...}} with children
+// ordered by hash. We write the nesting straight into one buffer rather than marshalling each
+// level into a json.RawMessage, as encoding/json re-scans raw messages at every level which
+// makes long conversations quadratic to save
+func marshalNodeTo(buf *bytes.Buffer, node Node) error {
 	type nodeDataRoot struct {
 		Type        NodeTyppe `json:"type"`
 		Provider    string    `json:"provider"`
@@ -315,66 +507,119 @@ func marshalNode(node Node) ([]byte, error) {
 		Prompt      string    `json:"prompt"`
 		Temperature float64   `json:"temperature"`
 		MaxTokens   int       `json:"max_tokens"`
-	}
-
-	type nodeDataMessagePair struct {
-		Type      NodeTyppe    `json:"type"`
-		Assistant *MessageData `json:"assistant"`
-		User      *MessageData `json:"user"`
-		Time      time.Time    `json:"time"`
-	}
-
-	type nodeWrapper struct {
-		NodeData interface{}                `json:"node_data"`
-		Children map[string]json.RawMessage `json:"children"`
-	}
 
-	wrapper := nodeWrapper{
-		Children: make(map[string]json.RawMessage),
+		Pending []PendingMessage `json:"pending,omitempty"`
 	}
 
-	// Marshal children recursively
-	for hash, child := range node.ToMap() {
-		childData, err := marshalNode(child)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal child node: %w", err)
-		}
-		wrapper.Children[hash] = json.RawMessage(childData)
+	type nodeDataMessagePair struct {
+		Type       NodeTyppe     `json:"type"`
+		Assistant  *MessageData  `json:"assistant"`
+		User       *MessageData  `json:"user"`
+		Time       time.Time     `json:"time"`
+		Revisions  []Revision    `json:"revisions,omitempty"`
+		Verdict    *Verdict      `json:"verdict,omitempty"`
+		Seed       *int64        `json:"seed,omitempty"`
+		Latency    *Latency      `json:"latency,omitempty"`
+		AnsweredBy string        `json:"answered_by,omitempty"`
+		Usage      *TokenUsage   `json:"usage,omitempty"`
+		Response   *ResponseMeta `json:"response,omitempty"`
+		ToolCalls  []ToolCall    `json:"tool_calls,omitempty"`
+		Chunked    *ChunkedInput `json:"chunked,omitempty"`
+		ChunkStep  *ChunkStep    `json:"chunk_step,omitempty"`
+		Annotation *Annotation   `json:"annotation,omitempty"`
+		Citations  []Citation    `json:"citations,omitempty"`
+
+		Pending []PendingMessage `json:"pending,omitempty"`
 	}
 
 	// Marshal node data based on type
+	var nodeData interface{}
 	switch n := node.(type) {
 	case *RootNode:
-		wrapper.NodeData = nodeDataRoot{
+		nodeData = nodeDataRoot{
 			Type:        n.Type(),
 			Provider:    n.Provider,
 			Model:       n.Model,
 			Prompt:      n.Prompt,
 			Temperature: n.Temperature,
 			MaxTokens:   n.MaxTokens,
+			Pending:     n.Pending,
 		}
 	case *MessagePairNode:
-		wrapper.NodeData = nodeDataMessagePair{
-			Type:      n.Type(),
-			Assistant: n.Assistant,
-			User:      n.User,
-			Time:      n.Time,
+		nodeData = nodeDataMessagePair{
+			Type:       n.Type(),
+			Assistant:  n.Assistant,
+			User:       n.User,
+			Time:       n.Time,
+			Revisions:  n.Revisions,
+			Verdict:    n.Verdict,
+			Seed:       n.Seed,
+			Latency:    n.Latency,
+			AnsweredBy: n.AnsweredBy,
+			Usage:      n.Usage,
+			Response:   n.Response,
+			ToolCalls:  n.ToolCalls,
+			Chunked:    n.Chunked,
+			ChunkStep:  n.ChunkStep,
+			Annotation: n.Annotation,
+			Citations:  n.Citations,
+			Pending:    n.Pending,
 		}
 	default:
-		return nil, fmt.Errorf("unknown node type: %T", node)
+		return fmt.Errorf("unknown node type: %T", node)
+	}
+
+	data, err := json.Marshal(nodeData)
+	if err != nil {
+		return err
+	}
+	buf.WriteString(`{"node_data":`)
+	buf.Write(data)
+	buf.WriteString(`,"children":{`)
+
+	// Marshal children recursively
+	children := node.ToMap()
+	hashes := make([]string, 0, len(children))
+	for hash := range children {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for idx, hash := range hashes {
+		if idx > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(hash)
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		if err := marshalNodeTo(buf, children[hash]); err != nil {
+			return fmt.Errorf("failed to marshal child node: %w", err)
+		}
 	}
+	buf.WriteString("}}")
+	return nil
+}
 
-	return json.Marshal(wrapper)
+// The serialized form of a node and, recursively, its children. Decoding the whole
+// tree in one pass avoids re-scanning the nested children at every level
+type nodeEnvelope struct {
+	NodeData json.RawMessage          `json:"node_data"`
+	Children map[string]*nodeEnvelope `json:"children"`
 }
 
 func unmarshalNode(data []byte) (Node, error) {
-	var wrapper struct {
-		NodeData json.RawMessage            `json:"node_data"`
-		Children map[string]json.RawMessage `json:"children"`
+	var envelope nodeEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal wrapper: %w", err)
 	}
+	return nodeFromEnvelope(&envelope)
+}
 
-	if err := json.Unmarshal(data, &wrapper); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal wrapper: %w", err)
+func nodeFromEnvelope(wrapper *nodeEnvelope) (Node, error) {
+	if wrapper == nil {
+		return nil, fmt.Errorf("failed to unmarshal wrapper: missing node")
 	}
 
 	// First, determine the node type
@@ -397,24 +642,42 @@ func unmarshalNode(data []byte) (Node, error) {
 			Prompt      string    `json:"prompt"`
 			Temperature float64   `json:"temperature"`
 			MaxTokens   int       `json:"max_tokens"`
+
+			Pending []PendingMessage `json:"pending"`
 		}
 		if err := json.Unmarshal(wrapper.NodeData, &rootData); err != nil {
 			return nil, fmt.Errorf("failed to unmarshal root node: %w", err)
 		}
-		result = NewRootNode(RootOpt{
+		root := NewRootNode(RootOpt{
 			Provider:    rootData.Provider,
 			Model:       rootData.Model,
 			Prompt:      rootData.Prompt,
 			Temperature: rootData.Temperature,
 			MaxTokens:   rootData.MaxTokens,
 		})
+		root.Pending = rootData.Pending
+		result = root
 
 	case NT_MESSAGE_PAIR:
 		var msgData struct {
-			Type      NodeTyppe    `json:"type"`
-			Assistant *MessageData `json:"assistant"`
-			User      *MessageData `json:"user"`
-			Time      time.Time    `json:"time"`
+			Type       NodeTyppe     `json:"type"`
+			Assistant  *MessageData  `json:"assistant"`
+			User       *MessageData  `json:"user"`
+			Time       time.Time     `json:"time"`
+			Revisions  []Revision    `json:"revisions"`
+			Verdict    *Verdict      `json:"verdict"`
+			Seed       *int64        `json:"seed"`
+			Latency    *Latency      `json:"latency"`
+			AnsweredBy string        `json:"answered_by"`
+			Usage      *TokenUsage   `json:"usage"`
+			Response   *ResponseMeta `json:"response"`
+			ToolCalls  []ToolCall    `json:"tool_calls"`
+			Chunked    *ChunkedInput `json:"chunked"`
+			ChunkStep  *ChunkStep    `json:"chunk_step"`
+			Annotation *Annotation   `json:"annotation"`
+			Citations  []Citation    `json:"citations"`
+
+			Pending []PendingMessage `json:"pending"`
 		}
 		if err := json.Unmarshal(wrapper.NodeData, &msgData); err != nil {
 			return nil, fmt.Errorf("failed to unmarshal message pair node: %w", err)
@@ -423,6 +686,19 @@ func unmarshalNode(data []byte) (Node, error) {
 		msgPair.Assistant = msgData.Assistant
 		msgPair.User = msgData.User
 		msgPair.Time = msgData.Time
+		msgPair.Revisions = msgData.Revisions
+		msgPair.Verdict = msgData.Verdict
+		msgPair.Seed = msgData.Seed
+		msgPair.Latency = msgData.Latency
+		msgPair.AnsweredBy = msgData.AnsweredBy
+		msgPair.Usage = msgData.Usage
+		msgPair.Response = msgData.Response
+		msgPair.ToolCalls = msgData.ToolCalls
+		msgPair.Chunked = msgData.Chunked
+		msgPair.ChunkStep = msgData.ChunkStep
+		msgPair.Annotation = msgData.Annotation
+		msgPair.Citations = msgData.Citations
+		msgPair.Pending = msgData.Pending
 		result = msgPair
 
 	default:
@@ -433,7 +709,7 @@ func unmarshalNode(data []byte) (Node, error) {
 	if len(wrapper.Children) > 0 {
 		children := make([]Node, 0, len(wrapper.Children))
 		for _, childData := range wrapper.Children {
-			child, err := unmarshalNode(childData)
+			child, err := nodeFromEnvelope(childData)
 			if err != nil {
 				return nil, fmt.Errorf("failed to unmarshal child node: %w", err)
 			}
@@ -0,0 +1,96 @@
+package brunch
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNodeHashFollowsChanges(t *testing.T) {
+	root := NewRootNode(RootOpt{Provider: "p", Model: "m", Prompt: "be nice", Temperature: 0.5, MaxTokens: 10})
+	rootHash := root.Hash()
+	if root.Hash() != rootHash {
+		t.Fatal("root hash is not stable")
+	}
+	root.Prompt = "be mean"
+	if root.Hash() == rootHash {
+		t.Error("root hash did not change with the prompt")
+	}
+	root.Prompt = "be nice"
+	if root.Hash() != rootHash {
+		t.Error("root hash did not return to the original")
+	}
+
+	pair := NewMessagePairNode(root)
+	if pair.Hash() != "" {
+		t.Error("incomplete message pair should not have a hash")
+	}
+	pair.User = NewMessageData("user", "hello")
+	pair.Assistant = NewMessageData("assistant", "hi")
+	pairHash := pair.Hash()
+	if pairHash == "" || pair.Hash() != pairHash {
+		t.Fatal("message pair hash is not stable")
+	}
+
+	// Changing the message in place, replacing it, or moving the time all change the hash
+	pair.Assistant.RawContent = "hi there"
+	changed := pair.Hash()
+	if changed == pairHash {
+		t.Error("hash did not change with the message content")
+	}
+	pair.User = NewMessageData("user", "goodbye")
+	if pair.Hash() == changed {
+		t.Error("hash did not change with a new user message")
+	}
+	changed = pair.Hash()
+	pair.Time = pair.Time.Add(time.Hour)
+	if pair.Hash() == changed {
+		t.Error("hash did not change with the time")
+	}
+
+	// A copied node keeps working from its own fields
+	copied := *root
+	copied.Model = "other"
+	if copied.Hash() == root.Hash() {
+		t.Error("copied root reused the original hash")
+	}
+}
+
+func TestMessagePairNodeClone(t *testing.T) {
+	seed := int64(7)
+	mp := NewMessagePairNode(nil)
+	mp.User = NewMessageData("user", "hello")
+	mp.Assistant = NewMessageData("assistant", "hi")
+	mp.Revisions = []Revision{{User: NewMessageData("user", "hey"), Assistant: NewMessageData("assistant", "yo"), Seed: &seed, Reason: RevisionRegenerated}}
+	mp.Verdict = &Verdict{Unsupported: []string{"a claim"}}
+	mp.Seed = &seed
+	mp.Latency = &Latency{Provider: "mock", Duration: time.Second, Tokens: 1, TokensPerSecond: 1}
+	mp.AnsweredBy = "fallback"
+	mp.Usage = &TokenUsage{InputTokens: 10, OutputTokens: 2}
+	mp.Response = &ResponseMeta{ID: "msg_1", Model: "model-1", StopReason: "end_turn"}
+	mp.ToolCalls = []ToolCall{{ID: "call_1", Name: "weather"}}
+	mp.Chunked = &ChunkedInput{Parts: 2, Sent: "notes"}
+	mp.ChunkStep = &ChunkStep{Part: 1, Parts: 2}
+
+	copied := mp.clone(nil)
+	if !reflect.DeepEqual(mp, copied) {
+		t.Fatalf("clone differs:\n%+v\n%+v", mp, copied)
+	}
+	if copied.Hash() != mp.Hash() {
+		t.Error("clone hashes differently")
+	}
+
+	// Nothing is shared
+	copied.Usage.InputTokens = 99
+	copied.Verdict.Unsupported[0] = "changed"
+	copied.Revisions[0].User.RawContent = "changed"
+	copied.ToolCalls[0].Output = "changed"
+	if mp.Usage.InputTokens != 10 || mp.Verdict.Unsupported[0] != "a claim" || mp.Revisions[0].User.UnencodedContent() != "hey" || mp.ToolCalls[0].Output != "" {
+		t.Error("clone shares what it copied with the original")
+	}
+
+	parent := NewRootNode(RootOpt{Provider: "p"})
+	if mp.clone(parent).Parent != parent {
+		t.Error("clone should be under the given parent")
+	}
+}
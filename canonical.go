@@ -0,0 +1,89 @@
+package brunch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Snapshots are written as canonical JSON: the keys of every object are sorted, every member
+// and element is on a line of its own, and the tree is embedded as JSON instead of base64. Saving
+// a chat that didn't change gives the same bytes, so a diff between saved versions shows what
+// changed and a hash of the file identifies what is in it. Nothing is indented, the tree nests
+// as deep as the conversation goes and indenting it would make the file grow with the square
+// of the depth. Snapshots written before, with the tree in base64, still load
+
+// The snapshot as it is written, with the tree as it is
+type snapshotJSON struct {
+	snapshotFields
+	Contents json.RawMessage `json:"contents"`
+}
+
+type snapshotFields Snapshot
+
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	contents := json.RawMessage(s.Contents)
+	if !json.Valid(s.Contents) {
+		encoded, err := json.Marshal(s.Contents)
+		if err != nil {
+			return nil, err
+		}
+		contents = encoded
+	}
+	data, err := json.Marshal(snapshotJSON{snapshotFields: snapshotFields(s), Contents: contents})
+	if err != nil {
+		return nil, err
+	}
+	return canonicalJSON(data)
+}
+
+func (s *Snapshot) UnmarshalJSON(data []byte) error {
+	var decoded snapshotJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*s = Snapshot(decoded.snapshotFields)
+
+	contents := bytes.TrimSpace(decoded.Contents)
+	switch {
+	case len(contents) == 0 || bytes.Equal(contents, []byte("null")):
+		s.Contents = nil
+	case contents[0] == '"':
+		// Written before snapshots were canonical, base64
+		if err := json.Unmarshal(contents, &s.Contents); err != nil {
+			return fmt.Errorf("failed to decode contents: %w", err)
+		}
+	default:
+		s.Contents = append([]byte(nil), contents...)
+	}
+	return nil
+}
+
+// Re-encode the JSON with sorted keys, one member or element per line. Numbers are kept as
+// they were written
+func canonicalJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("failed to decode for canonical form: %w", err)
+	}
+	return canonicalValue(value)
+}
+
+// Encode the decoded JSON in canonical form
+func canonicalValue(value interface{}) ([]byte, error) {
+	var compact bytes.Buffer
+	encoder := json.NewEncoder(&compact)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, fmt.Errorf("failed to encode canonical form: %w", err)
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, bytes.TrimSpace(compact.Bytes()), "", ""); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
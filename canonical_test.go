@@ -0,0 +1,76 @@
+package brunch
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot_Canonical(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	for _, message := range []string{"one", "two <b>&</b>", "three"} {
+		_, err := chat.SubmitMessage(message)
+		require.NoError(t, err)
+	}
+	require.NoError(t, chat.Parent())
+	_, err = chat.SubmitMessage("branch")
+	require.NoError(t, err)
+	require.NoError(t, chat.Remember("z", "last"))
+	require.NoError(t, chat.Remember("a", "first"))
+	require.NoError(t, chat.SetEnv("TOKEN", "secret"))
+
+	require.NoError(t, core.SaveActiveChat("s1"))
+	first, err := core.LoadFromChatStore("a.json")
+	require.NoError(t, err)
+	require.NoError(t, core.SaveActiveChat("s1"))
+	second, err := core.LoadFromChatStore("a.json")
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	// The tree is readable in the file, keys are sorted
+	assert.Contains(t, first, "\"user\": {")
+	assert.Contains(t, first, "two <b>&</b>")
+	assert.Less(t, strings.Index(first, `"active_branch"`), strings.Index(first, `"contents"`))
+	assert.Less(t, strings.Index(first, `"contents"`), strings.Index(first, `"provider_name"`))
+
+	// Loading and saving again doesn't change anything either
+	snapshot, err := SnapshotFromJSON([]byte(first))
+	require.NoError(t, err)
+	loaded, err := newChatInstanceFromSnapshot(core, snapshot)
+	require.NoError(t, err)
+	resaved, err := loaded.Snapshot()
+	require.NoError(t, err)
+	data, err := resaved.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, first, string(data))
+	assert.Equal(t, "secret", loaded.Environment()["TOKEN"])
+}
+
+func TestSnapshot_LegacyContents(t *testing.T) {
+	root := newMockProvider("mock").NewConversationRoot()
+	contents, err := marshalNode(&root)
+	require.NoError(t, err)
+
+	// Written before snapshots were canonical, the tree in base64
+	legacy := fmt.Sprintf(`{"provider_name":"mock","active_branch":"","contents":"%s","contexts":[]}`,
+		base64.StdEncoding.EncodeToString(contents))
+	snapshot, err := SnapshotFromJSON([]byte(legacy))
+	require.NoError(t, err)
+	assert.Equal(t, contents, snapshot.Contents)
+	_, err = unmarshalNode(snapshot.Contents)
+	require.NoError(t, err)
+
+	data, err := snapshot.Marshal()
+	require.NoError(t, err)
+	again, err := SnapshotFromJSON(data)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(contents), string(again.Contents))
+}
@@ -1,11 +1,16 @@
 package brunch
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // The panel is an interface for the user of brunch to interact with our chat instance
@@ -15,6 +20,27 @@ type Conversation interface {
 	// Print the entire tree of the conversation, which includes all branches
 	PrintTree() string
 
+	// Print the tree within the given limits, split into pages
+	PrintTreePages(opts TreePrintOpts) []string
+
+	// Print only the parts of the tree with activity since the given time
+	PrintTreeSince(since time.Time) string
+
+	// Print the current branch, `around` nodes above and below the current node, split into pages
+	PrintBranchPages(around int, opts TreePrintOpts) []string
+
+	// Get the size and shape of the tree, with a summary of each branch
+	TreeStats() TreeStats
+
+	// Find the branches with no activity for the given duration, see FindAbandonedBranches
+	AbandonedBranches(olderThan time.Duration) []AbandonedBranch
+
+	// Use the given summarizer for this chat, or nil to go back to the default
+	SetSummarizer(s Summarizer)
+
+	// Summarize the current branch, from the root down to the current node
+	Summarize(purpose SummaryPurpose) (string, error)
+
 	// Print the history of the conversation, on the current branch back to the root
 	PrintHistory() string
 
@@ -34,7 +60,8 @@ type Conversation interface {
 	// Attach an existing context to the conversation
 	AttachContext(ctxName string) error
 
-	// Goto a specific node in the conversation via hash (use PrintTree of History to see hashes)
+	// Goto a specific node in the conversation via hash (use PrintTree of History to see hashes),
+	// or the start of one (like the short hash ListChildren gives) if only one node has it
 	Goto(nodeHash string) error
 
 	// Navigate to the parent node of the current node
@@ -46,8 +73,11 @@ type Conversation interface {
 	// Navigate to the root node of the conversation
 	Root() error
 
-	// List the children of the current node
-	ListChildren() []string
+	// List the children of the current node, with what tells them apart
+	ListChildren() []ChildEntry
+
+	// One-line summaries of the current node's children by hash, made as needed when it has many
+	ChildSummaries() map[string]string
 
 	// Check if the current node has a parent
 	HasParent() bool
@@ -64,8 +94,118 @@ type Conversation interface {
 	// Submit a message to the chat provider
 	SubmitMessage(message string) (string, error)
 
+	// Submit a message to the chat provider, giving up when the context is cancelled. Each
+	// request made for it is also given the core's request timeout
+	SubmitMessageContext(ctx context.Context, message string) (string, error)
+
+	// Send a message, compacting the branch if it is too long for the provider. Used after
+	// SubmitMessage failed with a ContextOverflowError
+	SubmitCompacted(message string) (string, error)
+
+	// Call the tools the current node called again and ask the provider from the new results,
+	// on a branch next to the one that is there
+	ReplayTools() (string, error)
+
+	// Ask the current message again, keeping the reply it had as a revision
+	Regenerate() (string, error)
+
+	// Replace the current message and ask it again, keeping what it had as a revision
+	Edit(message string) (string, error)
+
+	// List the revisions of the current node, oldest first
+	Revisions() []Revision
+
+	// Put back a revision of the current node, what it replaces becomes a revision
+	RestoreRevision(idx int) error
+
+	// Add an annotation (a note, system event, or document) under the current node and move to it
+	Annotate(annotation Annotation) (string, error)
+
+	// Merge the branches down to the two nodes (from where they split) into a new node under
+	// the node they split from, and move to it. Returns the hash of the new node
+	Merge(hashA, hashB string) (string, error)
+
+	// Remove the node and everything under it, it can't be the current node or lead to it.
+	// Returns the number of nodes removed
+	Prune(hash string) (int, error)
+
+	// Send the messages that were queued while the provider couldn't be reached (see pending.go),
+	// returning the ones that were answered
+	Flush() ([]FlushedMessage, error)
+
+	// Annotate with the content of a file
+	AnnotateWithDocument(file string, inHistory bool) (string, error)
+
 	// List the knowledge contexts that are attached to the conversation
 	ListKnowledgeContexts() []string
+
+	// The contexts that couldn't be attached when the chat was loaded, and why
+	UnavailableContexts() map[string]string
+
+	// Point a context somewhere else and attach it
+	RepointContext(ctxName string, value string) error
+
+	// Stop using a context
+	DetachContext(ctxName string) error
+
+	// Get the state of the submission queue for the conversation
+	QueueStatus() QueueStatus
+
+	// Get what the chat has used since it was loaded, split between the main and auxiliary work
+	Usage() ChatUsage
+
+	// Turn on the translation layer for the chat, or off with nil
+	SetTranslation(opts *TranslationOpts)
+
+	// Turn on verification of every reply, or off with nil
+	SetVerification(opts *VerificationOpts)
+
+	// Check the current node's answer for unsupported claims, the verdict is kept on the node
+	Verify() (*Verdict, error)
+
+	// Remember a fact for the rest of the conversation, it is added to the system prompt
+	Remember(key string, fact string) error
+
+	// Forget a remembered fact
+	Forget(key string) error
+
+	// Get the facts the conversation remembers
+	Memory() map[string]string
+
+	// Set an environment variable for the tools and shell commands run for the conversation
+	SetEnv(name string, value string) error
+
+	// Remove an environment variable
+	UnsetEnv(name string) error
+
+	// Get the environment variables
+	Environment() map[string]string
+
+	// Get the environment variables as NAME=value pairs, to add to a command's environment
+	Environ() []string
+
+	// Get how long the provider took to answer each message on the current branch
+	Latencies() []MessageLatency
+
+	// Get the HTTP calls the provider made for the current node, if raw logging was on
+	RawExchanges() ([]RawExchange, error)
+
+	// Export the branch ending at the node with the given hash (or the current node if empty)
+	// as portable JSON, see BranchExport
+	ExportBranch(hash string) ([]byte, error)
+
+	// Include (or stop including) the core's profile in the system prompt
+	UseProfile(on bool) error
+
+	// Whether the core's profile is included
+	UsesProfile() bool
+}
+
+// Submissions to a chat are serialized so that multiple sessions (or an autosave and a user)
+// sharing a chat don't race on the provider. This reports what is waiting on the chat
+type QueueStatus struct {
+	Pending int  `json:"pending"` // submissions waiting for their turn
+	Active  bool `json:"active"`  // a submission is currently with the provider
 }
 
 // The snapshot is a hollistic snapshot of the current state of the chat
@@ -79,10 +219,26 @@ type Snapshot struct {
 	ActiveBranch string   `json:"active_branch"`
 	Contents     []byte   `json:"contents"`
 	Contexts     []string `json:"contexts"`
+
+	// Facts remembered by the chat, folded into the system prompt when it is loaded
+	Memory map[string]string `json:"memory,omitempty"`
+
+	// Whether the core's profile is folded into the system prompt as well
+	UseProfile bool `json:"use_profile,omitempty"`
+
+	// The chat's environment variables, sealed with the core's environment key (see env.go)
+	Environment string `json:"environment,omitempty"`
+
+	// One-line summaries of the children of nodes with many, by hash (see siblings.go)
+	BranchSummaries map[string]string `json:"branch_summaries,omitempty"`
+
+	// The tokens the auxiliary work done for the chat used, by provider (see usage.go)
+	AuxiliaryUsage map[string]UsageTotals `json:"auxiliary_usage,omitempty"`
 }
 
+// Marshal the snapshot as canonical JSON, see canonical.go
 func (s *Snapshot) Marshal() ([]byte, error) {
-	return json.Marshal(s)
+	return s.MarshalJSON()
 }
 
 func SnapshotFromJSON(data []byte) (*Snapshot, error) {
@@ -95,6 +251,7 @@ func SnapshotFromJSON(data []byte) (*Snapshot, error) {
 
 type chatInstance struct {
 	core         *Core
+	name         string // set when it is loaded as one of the core's active chats
 	provider     Provider
 	root         RootNode
 	currentNode  Node
@@ -102,6 +259,60 @@ type chatInstance struct {
 	queuedImages []string
 
 	contexts map[string]*ContextSettings
+
+	// Contexts the chat was saved with that couldn't be attached (degraded load), and why
+	unavailableContexts map[string]string
+
+	// The contexts indexed for the chat, when its provider doesn't attach them itself
+	knowledge map[string]KnowledgeProvider
+
+	// Environment variables for the tools and shell commands run for the chat
+	env map[string]string
+
+	// The environment as it was last sealed, sealing picks a new nonce so an environment
+	// that didn't change is saved as it was
+	sealedEnv  string
+	sealedFrom map[string]string
+
+	// The environment the chat was saved with when it couldn't be opened (sealed with another
+	// install's key). It is saved back as it was until the environment is set again
+	unopenedEnv string
+
+	// The remembered facts, and the system prompt they are added to
+	memory     map[string]string
+	basePrompt string
+
+	// A copy of the core's profile, taken when the chat is loaded, if the chat uses it
+	useProfile bool
+	profile    map[string]string
+
+	// Set on the chat it overrides the provider's companion, which overrides the core's
+	// summarizer, which overrides the chat's own provider
+	summarizer Summarizer
+
+	// Summaries of the children of nodes with many, by hash
+	branchSummaries map[string]string
+	branchMu        sync.Mutex
+
+	usage usageCounter
+
+	// When set, messages and replies go through the translation layer
+	translation *TranslationOpts
+
+	// When set, every reply is verified
+	verification *VerificationOpts
+
+	// Set while a message is sent that is to be compacted if it overflows, see overflow.go
+	compacting bool
+
+	// The context the message being sent was submitted with, see timeout.go
+	ctx context.Context
+
+	// Held while a message is answered, and while the tree is read or moved around in,
+	// as answering changes both the tree and the current node
+	submitMu sync.Mutex
+	pending  atomic.Int32
+	active   atomic.Bool
 }
 
 func newChatInstance(provider Provider) *chatInstance {
@@ -112,11 +323,46 @@ func newChatInstance(provider Provider) *chatInstance {
 		chatEnabled:  true,
 		queuedImages: []string{},
 		contexts:     map[string]*ContextSettings{},
+		memory:       map[string]string{},
+		basePrompt:   provider.Settings().SystemPrompt,
 	}
 	chat.currentNode = &chat.root
 	return chat
 }
 
+// Chats made by the core log where the core does. Chats made on their own use slog's default logger
+func (c *chatInstance) logger() *slog.Logger {
+	if c.core != nil {
+		return c.core.logger
+	}
+	return slog.Default()
+}
+
+// The root records what the chat was created with, but the provider it names may have been changed
+// (or deleted and made again) since. The chat keeps running with the settings it was created with,
+// and anything that can't be carried over, like the model, is only warned about
+func (c *Core) reconcileRootSettings(root *RootNode, provider Provider, settings ProviderSettings) ProviderSettings {
+	// Roots that didn't record any settings have nothing to reconcile
+	if root.MaxTokens <= 0 {
+		return settings
+	}
+	if root.Temperature != settings.Temperature {
+		c.logger.Warn("provider temperature differs from the chat's, using the chat's",
+			"provider", settings.Host, "provider_temperature", settings.Temperature, "chat_temperature", root.Temperature)
+		settings.Temperature = root.Temperature
+	}
+	if root.MaxTokens != settings.MaxTokens {
+		c.logger.Warn("provider max tokens differ from the chat's, using the chat's",
+			"provider", settings.Host, "provider_max_tokens", settings.MaxTokens, "chat_max_tokens", root.MaxTokens)
+		settings.MaxTokens = root.MaxTokens
+	}
+	if model := provider.NewConversationRoot().Model; root.Model != "" && model != "" && model != root.Model {
+		c.logger.Warn("provider model differs from the one the chat was created with",
+			"provider", settings.Host, "provider_model", model, "chat_model", root.Model)
+	}
+	return settings
+}
+
 func newChatInstanceFromSnapshot(core *Core, snap *Snapshot) (*chatInstance, error) {
 	root, err := unmarshalNode(snap.Contents)
 	if err != nil {
@@ -133,6 +379,33 @@ func newChatInstanceFromSnapshot(core *Core, snap *Snapshot) (*chatInstance, err
 		return nil, fmt.Errorf("provider %s not found", snap.ProviderName)
 	}
 
+	// Same as when the chat was created, the chat's provider is hosted by the named provider
+	// so that the snapshot keeps pointing at it when the chat is saved again
+	settings := provider.Settings()
+	settings.Host = snap.ProviderName
+	var profile map[string]string
+	if snap.UseProfile {
+		profile = core.Profile()
+	}
+
+	settings = core.reconcileRootSettings(rootNode, provider, settings)
+
+	basePrompt := settings.SystemPrompt
+	settings.SystemPrompt = composePrompt(basePrompt, profile, snap.Memory)
+	provider, err = provider.CloneWithSettings(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone provider %s: %w", snap.ProviderName, err)
+	}
+
+	memory := make(map[string]string, len(snap.Memory))
+	for key, fact := range snap.Memory {
+		memory[key] = fact
+	}
+	branchSummaries := make(map[string]string, len(snap.BranchSummaries))
+	for hash, summary := range snap.BranchSummaries {
+		branchSummaries[hash] = summary
+	}
+
 	chat := &chatInstance{
 		core:         core,
 		provider:     provider,
@@ -140,21 +413,35 @@ func newChatInstanceFromSnapshot(core *Core, snap *Snapshot) (*chatInstance, err
 		chatEnabled:  true,
 		queuedImages: []string{},
 		contexts:     map[string]*ContextSettings{},
+		memory:       memory,
+		basePrompt:   basePrompt,
+		useProfile:   snap.UseProfile,
+		profile:      profile,
+
+		branchSummaries:     branchSummaries,
+		unavailableContexts: map[string]string{},
 	}
+	chat.usage.auxiliary = copyUsage(snap.AuxiliaryUsage)
 	chat.currentNode = &chat.root
 
-	for _, ctxName := range snap.Contexts {
-		ctx, exists := core.contexts[ctxName]
-		if !exists {
-			return nil, fmt.Errorf("context %s not found in available contexts", ctxName)
+	if snap.Environment != "" {
+		if err := chat.openSavedEnvironment(snap.Environment); err != nil {
+			core.logger.Warn("loading chat without its environment, it is kept as it was", "error", err)
+			chat.unopenedEnv = snap.Environment
 		}
-		if err := chat.provider.AttachKnowledgeContext(*ctx); err != nil {
-			return nil, fmt.Errorf("failed to attach context %s: %w", ctxName, err)
+	}
+
+	for _, ctxName := range snap.Contexts {
+		if err := chat.attachSavedContext(ctxName); err != nil {
+			if !core.degradedContextLoad {
+				return nil, err
+			}
+			core.logger.Warn("loading chat without unavailable context", "context", ctxName, "error", err)
+			chat.unavailableContexts[ctxName] = err.Error()
 		}
-		chat.contexts[ctxName] = ctx
 	}
 
-	slog.Debug("loaded snapshot", "num_contexts", len(chat.contexts))
+	core.logger.Debug("loaded snapshot", "num_contexts", len(chat.contexts))
 
 	if snap.ActiveBranch != "" {
 		nodeMap := MapTree(&chat.root)
@@ -176,43 +463,216 @@ func newChatInstanceFromSnapshot(core *Core, snap *Snapshot) (*chatInstance, err
 
 // SubmitMessage sends a message to the provider and returns the response
 func (c *chatInstance) SubmitMessage(message string) (string, error) {
+	return c.submitOrQueue(context.Background(), message, false)
+}
+
+func (c *chatInstance) SubmitMessageContext(ctx context.Context, message string) (string, error) {
+	return c.submitOrQueue(ctx, message, false)
+}
+
+func (c *chatInstance) submit(ctx context.Context, message string, compact bool) (string, error) {
 	if !c.chatEnabled {
 		return "", nil
 	}
 
+	c.pending.Add(1)
+	c.submitMu.Lock()
+	c.pending.Add(-1)
+	c.active.Store(true)
+	c.compacting = compact
+	c.ctx = ctx
+	defer func() {
+		c.ctx = nil
+		c.compacting = false
+		c.active.Store(false)
+		c.submitMu.Unlock()
+	}()
+
+	if err := c.checkSecrets(message, "message"); err != nil {
+		return "", err
+	}
+	if err := c.checkGrowth(c.currentNode, 1); err != nil {
+		return "", err
+	}
+
 	if len(c.queuedImages) > 0 {
 		c.provider.QueueImages(c.queuedImages)
 		c.queuedImages = []string{}
 	}
 
-	creator := c.provider.ExtendFrom(c.currentNode)
-	msgPair, err := creator(message)
+	original := message
+	var lang string
+	if c.translation != nil {
+		var err error
+		if message, lang, err = c.translateIn(message); err != nil {
+			return "", fmt.Errorf("translation failed, message was not sent: %w", err)
+		}
+	}
+
+	before, started := c.usage.get(), time.Now()
+
+	var msgPair *MessagePairNode
+	var err error
+	if estimateTokens(message) > c.chunkedInputTokens() {
+		msgPair, err = c.askChunked(c.currentNode, message)
+	} else {
+		msgPair, err = c.ask(c.currentNode, message, c.tools())
+	}
 	if err != nil {
 		return "", err
 	}
+	if err := c.postProcess(msgPair); err != nil {
+		return "", err
+	}
 
 	c.currentNode = msgPair
-	return msgPair.Assistant.UnencodedContent(), nil
+	response := msgPair.Assistant.UnencodedContent()
+	c.usage.addMain(msgPair)
+	c.recordActivity(ActivityMessage, msgPair, before, started)
+
+	if c.verification != nil {
+		c.verifyReply(msgPair)
+	}
+	if lang != "" {
+		response = c.translateOut(msgPair, original, lang)
+	}
+	return response, nil
+}
+
+func (c *chatInstance) SetTranslation(opts *TranslationOpts) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	c.translation = opts
+}
+
+func (c *chatInstance) Usage() ChatUsage {
+	return c.usage.get()
+}
+
+func (c *chatInstance) QueueStatus() QueueStatus {
+	return QueueStatus{
+		Pending: int(c.pending.Load()),
+		Active:  c.active.Load(),
+	}
 }
 
 func (c *chatInstance) PrintTree() string {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	return PrintTree(&c.root)
 }
 
+func (c *chatInstance) PrintTreeSince(since time.Time) string {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	return PrintTreeSince(&c.root, since)
+}
+
+func (c *chatInstance) PrintTreePages(opts TreePrintOpts) []string {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	return PrintTreePages(&c.root, opts)
+}
+
+func (c *chatInstance) PrintBranchPages(around int, opts TreePrintOpts) []string {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	return PrintBranchPages(c.currentNode, around, opts)
+}
+
+func (c *chatInstance) TreeStats() TreeStats {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	return ComputeTreeStats(&c.root)
+}
+
+func (c *chatInstance) AbandonedBranches(olderThan time.Duration) []AbandonedBranch {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	return FindAbandonedBranches(&c.root, c.currentNode, time.Now().Add(-olderThan))
+}
+
+func (c *chatInstance) SetSummarizer(s Summarizer) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	c.summarizer = s
+}
+
+func (c *chatInstance) getSummarizer() Summarizer {
+	if c.summarizer != nil {
+		return c.summarizer
+	}
+	if companion, ok := c.companion(); ok {
+		return NewProviderSummarizer(companion)
+	}
+	if c.core != nil && c.core.summarizer != nil {
+		return c.core.summarizer
+	}
+	return NewProviderSummarizer(c.provider)
+}
+
+// The provider's companion, if it has one that is available
+func (c *chatInstance) companion() (Provider, bool) {
+	name := c.provider.Settings().Companion
+	if name == "" || c.core == nil {
+		return nil, false
+	}
+	c.core.provMu.Lock()
+	provider, exists := c.core.providers[name]
+	c.core.provMu.Unlock()
+	if !exists {
+		c.core.logger.Warn("companion provider not found, using the chat's own provider", "companion", name)
+	}
+	return provider, exists
+}
+
+// Auxiliary work goes to the companion when there is one
+func (c *chatInstance) auxiliaryProvider() Provider {
+	if companion, ok := c.companion(); ok {
+		return companion
+	}
+	return c.provider
+}
+
+func (c *chatInstance) Summarize(purpose SummaryPurpose) (string, error) {
+	// Waits for submissions so the branch is complete
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	content := branchHistory(c.currentNode)
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	summary, err := c.getSummarizer().Summarize(ctx, purpose, content)
+	if err != nil {
+		return "", err
+	}
+	c.estimateAuxiliary(ctx, content, summary)
+	return summary, nil
+}
+
 func (c *chatInstance) PrintHistory() string {
-	result := c.currentNode.History()
-	switch c.currentNode.Type() {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	history := branchHistory(c.currentNode)
+	if verdicts := branchVerdicts(c.currentNode); verdicts != "" {
+		history += "\n\n" + verdicts
+	}
+	return history
+}
+
+// The branch from the root down to (and including) the node, as it is sent to a provider
+func branchHistory(n Node) string {
+	result := n.History()
+	switch n.Type() {
 	case NT_MESSAGE_PAIR:
-		if mp, ok := c.currentNode.(*MessagePairNode); ok && mp.Parent != nil {
-			if len(mp.User.Images) > 0 {
-				result = append(result, messageToStringWithImages(mp.User, mp.User.Images))
-			} else {
-				result = append(result, messageToString(mp.User))
-			}
-			if len(mp.Assistant.Images) > 0 {
-				result = append(result, messageToStringWithImages(mp.Assistant, mp.Assistant.Images))
-			} else {
-				result = append(result, messageToString(mp.Assistant))
+		if mp, ok := n.(*MessagePairNode); ok && mp.Parent != nil {
+			if user, assistant, ok := mp.Exchange(); ok {
+				for _, msg := range []*MessageData{user, assistant} {
+					if len(msg.Images) > 0 {
+						result = append(result, messageToStringWithImages(msg, msg.Images))
+					} else {
+						result = append(result, messageToString(msg))
+					}
+				}
 			}
 		}
 	}
@@ -220,11 +680,20 @@ func (c *chatInstance) PrintHistory() string {
 }
 
 func (c *chatInstance) QueueImages(paths []string) error {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	c.queuedImages = append(c.queuedImages, paths...)
 	return nil
 }
 
 func (c *chatInstance) Snapshot() (*Snapshot, error) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	return c.snapshot()
+}
+
+// The snapshot of a chat the caller has the lock of, or has to itself
+func (c *chatInstance) snapshot() (*Snapshot, error) {
 	b, e := marshalNode(&c.root)
 	if e != nil {
 		return nil, e
@@ -234,26 +703,68 @@ func (c *chatInstance) Snapshot() (*Snapshot, error) {
 	for _, ctx := range c.contexts {
 		contexts = append(contexts, ctx.Name)
 	}
+	for name := range c.unavailableContexts {
+		contexts = append(contexts, name)
+	}
+	sort.Strings(contexts)
+	var memory map[string]string
+	if len(c.memory) > 0 {
+		memory = make(map[string]string, len(c.memory))
+		for key, fact := range c.memory {
+			memory[key] = fact
+		}
+	}
+	env, err := c.sealedEnvironment()
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal environment: %w", err)
+	}
 	s := &Snapshot{
+		Environment:  env,
 		ProviderName: c.provider.Settings().Host,
 		ActiveBranch: c.currentNode.Hash(),
 		Contents:     b,
 		Contexts:     contexts,
+		Memory:       memory,
+		UseProfile:   c.useProfile,
+
+		BranchSummaries: c.keptBranchSummaries(),
+		AuxiliaryUsage:  c.usage.auxiliaryTotals(),
 	}
-	slog.Debug("snapshot", "snapshot", s, "num_contexts", len(contexts))
+	c.logger().Debug("snapshot", "snapshot", s, "num_contexts", len(contexts))
 	return s, nil
 }
 
 func (c *chatInstance) Goto(nodeHash string) error {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	nodeMap := MapTree(&c.root)
 	if node, exists := nodeMap[nodeHash]; exists {
 		c.currentNode = node
 		return nil
 	}
-	return errors.New("node not found")
+	if nodeHash == "" {
+		return errors.New("node not found")
+	}
+	var found Node
+	for hash, node := range nodeMap {
+		if !strings.HasPrefix(hash, nodeHash) {
+			continue
+		}
+		if found != nil {
+			return fmt.Errorf("more than one node starts with %s, give more of the hash", nodeHash)
+		}
+		found = node
+	}
+	if found == nil {
+		return errors.New("node not found")
+	}
+	c.currentNode = found
+	return nil
 }
 
 func (c *chatInstance) Parent() error {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	switch c.currentNode.Type() {
 	case NT_MESSAGE_PAIR:
 		if mpn, ok := c.currentNode.(*MessagePairNode); ok && mpn.Parent != nil {
@@ -268,6 +779,8 @@ func (c *chatInstance) Parent() error {
 }
 
 func (c *chatInstance) Child(idx int) error {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	switch c.currentNode.Type() {
 	case NT_ROOT:
 		if rn, ok := c.currentNode.(*RootNode); ok && idx < len(rn.Children) {
@@ -286,11 +799,15 @@ func (c *chatInstance) Child(idx int) error {
 }
 
 func (c *chatInstance) Root() error {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	c.currentNode = &c.root
 	return nil
 }
 
 func (c *chatInstance) HasParent() bool {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	switch c.currentNode.Type() {
 	case NT_MESSAGE_PAIR:
 		if mpn, ok := c.currentNode.(*MessagePairNode); ok {
@@ -300,29 +817,33 @@ func (c *chatInstance) HasParent() bool {
 	return false
 }
 
-func (c *chatInstance) ListChildren() []string {
-	switch c.currentNode.Type() {
-	case NT_ROOT:
-		if rn, ok := c.currentNode.(*RootNode); ok {
-			children := []string{}
-			for _, child := range rn.Children {
-				children = append(children, child.Hash())
-			}
-			return children
+func (c *chatInstance) ListChildren() []ChildEntry {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	children := []ChildEntry{}
+	for _, child := range nodeChildren(c.currentNode) {
+		mp, ok := child.(*MessagePairNode)
+		if !ok {
+			continue
 		}
-	case NT_MESSAGE_PAIR:
-		if mpn, ok := c.currentNode.(*MessagePairNode); ok {
-			children := []string{}
-			for _, child := range mpn.Children {
-				children = append(children, child.Hash())
-			}
-			return children
+		entry := ChildEntry{
+			Hash:      mp.Hash(),
+			ShortHash: ShortHash(mp.Hash()),
+			Time:      mp.Time,
+			Preview:   pairPreview(mp),
+			Children:  len(mp.Children),
 		}
+		c.branchMu.Lock()
+		entry.Summary = c.branchSummaries[entry.Hash]
+		c.branchMu.Unlock()
+		children = append(children, entry)
 	}
-	return []string{}
+	return children
 }
 
 func (c *chatInstance) Info() string {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	return fmt.Sprintf("current node: %s", c.currentNode.Hash())
 }
 
@@ -331,16 +852,20 @@ func (c *chatInstance) ToggleChat(enabled bool) {
 }
 
 func (c *chatInstance) CurrentNode() Node {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	return c.currentNode
 }
 
 func (c *chatInstance) Artifacts() []Artifact {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
 	switch c.currentNode.Type() {
 	case NT_MESSAGE_PAIR:
 		if mpn, ok := c.currentNode.(*MessagePairNode); ok {
 			artifacts, err := ParseArtifactsFrom(mpn.Assistant)
 			if err != nil {
-				fmt.Println("error parsing artifacts:", err)
+				c.logger().Warn("failed to parse artifacts", "error", err)
 				return []Artifact{}
 			}
 			return artifacts
@@ -350,7 +875,7 @@ func (c *chatInstance) Artifacts() []Artifact {
 }
 
 func (c *chatInstance) CreateContext(ctx *ContextSettings) error {
-	if err := c.provider.AttachKnowledgeContext(*ctx); err != nil {
+	if err := c.attachKnowledge(ctx); err != nil {
 		return err
 	}
 
@@ -367,7 +892,7 @@ func (c *chatInstance) AttachContext(ctxName string) error {
 		return fmt.Errorf("context %s not found", ctxName)
 	}
 
-	if err := c.provider.AttachKnowledgeContext(*ctx); err != nil {
+	if err := c.attachKnowledge(ctx); err != nil {
 		return err
 	}
 
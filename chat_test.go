@@ -0,0 +1,94 @@
+package brunch
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Holds each submission with the provider for a moment so overlapping submissions would race
+type slowProvider struct {
+	*mockProvider
+}
+
+func (sp *slowProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	creator := sp.mockProvider.ExtendFrom(ctx, node)
+	return func(userMessage string) (*MessagePairNode, error) {
+		time.Sleep(5 * time.Millisecond)
+		return creator(userMessage)
+	}
+}
+
+func TestChat_SubmitMessageIsSerialized(t *testing.T) {
+	chat := newChatInstance(&slowProvider{newMockProvider("mock")})
+
+	const submissions = 8
+	var wg sync.WaitGroup
+	for i := 0; i < submissions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := chat.SubmitMessage("hello")
+			assert.NoError(t, err)
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return chat.QueueStatus().Active
+	}, time.Second, time.Millisecond)
+
+	wg.Wait()
+	assert.Equal(t, QueueStatus{}, chat.QueueStatus())
+
+	// Every submission extended the one before it, so the tree is a single branch
+	depth := 0
+	var current Node = &chat.root
+	for {
+		children := current.ToMap()
+		if len(children) == 0 {
+			break
+		}
+		require.Len(t, children, 1)
+		for _, child := range children {
+			current = child
+		}
+		depth++
+	}
+	assert.Equal(t, submissions, depth)
+}
+
+func TestChat_NavigationWaitsForSubmit(t *testing.T) {
+	chat := newChatInstance(&slowProvider{newMockProvider("mock")})
+	_, err := chat.SubmitMessage("first")
+	require.NoError(t, err)
+
+	// Moving around while messages are answered never sees a half-added node (run with -race)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for _, message := range []string{"one", "two", "three", "four"} {
+			_, err := chat.SubmitMessage(message)
+			assert.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			assert.NoError(t, chat.Root())
+			_ = chat.Child(0)
+			chat.ListChildren()
+			chat.HasParent()
+			chat.PrintHistory()
+			chat.PrintTree()
+			assert.NotNil(t, chat.CurrentNode())
+		}
+	}()
+	wg.Wait()
+
+	assert.Len(t, MapTree(&chat.root), 6)
+}
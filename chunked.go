@@ -0,0 +1,140 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A message that is far too long to send at once (a pasted log, a whole document) is sent in
+// parts instead. The provider takes notes on each part, and then answers the message from the
+// notes. The tree keeps the message as the user wrote it, and the notes as nodes under the answer
+// (MessagePairNode.ChunkStep) so it can be seen what the answer was made from. The notes are what
+// the message is sent as in the history of later messages, so the branch doesn't overflow after it
+const (
+	// Messages estimated to be longer than this are sent in parts, unless the core was given
+	// another limit (CoreOpts.ChunkedInputTokens)
+	DefaultChunkedInputTokens = 32000
+
+	// How much of the beginning and end of the message is sent with the notes, as that is
+	// usually where the question is. Never more than a quarter of a part
+	chunkedInputExcerpt = 2000
+)
+
+// How a message that was sent in parts was answered
+type ChunkedInput struct {
+	Parts int `json:"parts"`
+
+	// What the answer was asked from in place of the message, and what is sent for it in the
+	// history of later messages
+	Sent string `json:"sent"`
+}
+
+// One part of a chunked message, the pair was sent the part and replied with the notes on it
+type ChunkStep struct {
+	Part  int `json:"part"`
+	Parts int `json:"parts"`
+}
+
+func (c *chatInstance) chunkedInputTokens() int {
+	if c.core != nil && c.core.chunkedInputTokens > 0 {
+		return c.core.chunkedInputTokens
+	}
+	return DefaultChunkedInputTokens
+}
+
+func chunkPrompt(part int, parts int, content string) string {
+	return fmt.Sprintf("My next message is too long to send at once, so it is sent in %d parts and this is part %d. "+
+		"Take notes on it: everything in it that answering the whole message could need, and any question or "+
+		"instruction it contains. Reply with the notes only.\n\n<part number=\"%d\">\n%s\n</part>", parts, part, part, content)
+}
+
+// The message as the notes on its parts, with its beginning and end
+func chunkedPrompt(message string, steps []*MessagePairNode, partSize int) string {
+	size := min(chunkedInputExcerpt, partSize/4)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "My message was too long to send at once. It was sent in %d parts and these are your notes on each:\n\n", len(steps))
+	for _, step := range steps {
+		fmt.Fprintf(&sb, "<notes part=\"%d\">\n%s\n</notes>\n", step.ChunkStep.Part, step.Assistant.UnencodedContent())
+	}
+	fmt.Fprintf(&sb, "\nIt began with:\n<beginning>\n%s\n</beginning>\n", excerpt(message, size, false))
+	fmt.Fprintf(&sb, "and ended with:\n<end>\n%s\n</end>\n\nAnswer the message from the notes.", excerpt(message, size, true))
+	return sb.String()
+}
+
+// At most size bytes from the start of the text, or from its end, without cutting a character
+func excerpt(text string, size int, fromEnd bool) string {
+	if len(text) <= size {
+		return text
+	}
+	if fromEnd {
+		cut := len(text) - size
+		for cut < len(text) && !utf8.RuneStart(text[cut]) {
+			cut++
+		}
+		return text[cut:]
+	}
+	cut := size
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut]
+}
+
+// Send the message in parts and ask for the answer from the notes on them. Each part is sent from
+// the parent like the message would have been, and the notes are moved under the answer
+func (c *chatInstance) askChunked(parent Node, message string) (*MessagePairNode, error) {
+	holder, ok := treeNode(parent)
+	if !ok {
+		return nil, errors.New("the current node can't be replied to")
+	}
+	// Each part is half the limit, so the parts are sent with room left for the branch
+	partSize := c.chunkedInputTokens() * 4 / 2
+	parts := splitText(message, partSize)
+
+	// The answer is added with the notes on every part under it
+	if err := c.treeLimits().check(&c.root, parent, 2, 1+len(parts), len(parts)); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	logRaw := c.recordRaw()
+
+	steps := make([]*MessagePairNode, len(parts))
+	children := len(holder.Children)
+	for i, part := range parts {
+		prompt := chunkPrompt(i+1, len(parts), part)
+		step, err := c.extend(parent, prompt, nil)
+		holder.Children = holder.Children[:children]
+		if err != nil {
+			logRaw(parent, true)
+			return nil, fmt.Errorf("failed to send part %d of %d: %w", i+1, len(parts), err)
+		}
+		if step.Assistant == nil {
+			return nil, fmt.Errorf("provider did not reply to part %d of %d", i+1, len(parts))
+		}
+		c.usage.addMain(step)
+		step.ChunkStep = &ChunkStep{Part: i + 1, Parts: len(parts)}
+		steps[i] = step
+	}
+	c.logger().Debug("took notes on a long message", "parts", len(parts))
+
+	sent := chunkedPrompt(message, steps, partSize)
+	pair, err := c.extend(parent, sent, nil)
+	if err != nil {
+		logRaw(parent, true)
+		return nil, err
+	}
+	restoreUser(pair, message, sent)
+	pair.Chunked = &ChunkedInput{Parts: len(parts), Sent: sent}
+	for _, step := range steps {
+		step.Parent = pair
+		pair.AddChild(step)
+	}
+	if pair.Assistant != nil {
+		pair.Latency = newLatency(c.provider.Settings().Host, time.Since(started), pair.Assistant.UnencodedContent())
+	}
+	logRaw(pair, false)
+	return pair, nil
+}
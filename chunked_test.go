@@ -0,0 +1,96 @@
+package brunch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExcerpt(t *testing.T) {
+	assert.Equal(t, "short", excerpt("short", 10, false))
+	assert.Equal(t, "abc", excerpt("abcdef", 3, false))
+	assert.Equal(t, "def", excerpt("abcdef", 3, true))
+	// Characters aren't cut in half
+	assert.Equal(t, "a", excerpt("aéb", 2, false))
+	assert.Equal(t, "b", excerpt("aéb", 2, true))
+}
+
+// Takes short notes on the parts it is sent, and echoes anything else
+type notesProvider struct {
+	mockProvider
+}
+
+func (np *notesProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	return func(userMessage string) (*MessagePairNode, error) {
+		pair, err := np.mockProvider.ExtendFrom(ctx, node)(userMessage)
+		if err == nil && strings.HasPrefix(userMessage, "My next message is too long") {
+			line := userMessage[strings.Index(userMessage, "line "):]
+			pair.Assistant = NewMessageData("assistant", "notes from "+line[:strings.Index(line, ":")])
+		}
+		return pair, err
+	}
+}
+
+func TestChat_ChunkedInput(t *testing.T) {
+	core := newTestCore(t)
+	core.chunkedInputTokens = 100
+	chat := newChatInstance(&notesProvider{*newMockProvider("mock")})
+	chat.core = core
+
+	_, err := chat.SubmitMessage("hello")
+	require.NoError(t, err)
+	parent := chat.currentNode.(*MessagePairNode)
+
+	paragraphs := []string{"what do these logs say?"}
+	for i := 0; i < 12; i++ {
+		paragraphs = append(paragraphs, fmt.Sprintf("line %d: %s", i, strings.Repeat("x", 60)))
+	}
+	message := strings.Join(paragraphs, "\n\n")
+	require.Greater(t, estimateTokens(message), 100)
+
+	reply, err := chat.SubmitMessage(message)
+	require.NoError(t, err)
+	answer := chat.currentNode.(*MessagePairNode)
+	require.NotNil(t, answer.Chunked)
+	parts := answer.Chunked.Parts
+	assert.Greater(t, parts, 1)
+	assert.Same(t, parent, answer.Parent)
+	require.Len(t, parent.Children, 1, "the parts are moved under the answer")
+
+	// The answer was asked from the notes and the message is kept as it was written
+	assert.Equal(t, "echo: "+answer.Chunked.Sent, reply)
+	assert.Equal(t, message, answer.User.UnencodedContent())
+	assert.Contains(t, answer.Chunked.Sent, "what do these logs say?")
+	require.Len(t, answer.Children, parts)
+	for i, child := range answer.Children {
+		step := child.(*MessagePairNode)
+		require.NotNil(t, step.ChunkStep)
+		assert.Equal(t, i+1, step.ChunkStep.Part)
+		assert.Contains(t, answer.Chunked.Sent, step.Assistant.UnencodedContent())
+	}
+
+	// Later messages are sent the notes, not the message
+	_, err = chat.SubmitMessage("thanks")
+	require.NoError(t, err)
+	history := branchHistory(chat.currentNode)
+	assert.Contains(t, history, "these are your notes on each")
+	assert.NotContains(t, history, "line 6: ")
+	assert.Len(t, answer.Children, parts+1)
+
+	// The notes are kept with the tree
+	data, err := marshalNode(&chat.root)
+	require.NoError(t, err)
+	loaded, err := unmarshalNode(data)
+	require.NoError(t, err)
+	assert.Equal(t, ComputeTreeStats(&chat.root).Nodes, ComputeTreeStats(loaded).Nodes)
+	reloaded := loaded.(*RootNode).Children[0].(*MessagePairNode).Children[0].(*MessagePairNode)
+	assert.Equal(t, answer.Chunked, reloaded.Chunked)
+
+	require.NoError(t, chat.Goto(answer.Hash()))
+	_, err = chat.Regenerate()
+	assert.Error(t, err)
+}
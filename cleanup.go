@@ -0,0 +1,172 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AbandonedBranch is a part of the tree that nobody has touched in a while. Every node in it is
+// older than the cutoff it was found with, and pruning it removes Hash and everything under it
+type AbandonedBranch struct {
+	Hash         string    `json:"hash"`          // the top of the branch, where it splits off the tree
+	Nodes        int       `json:"nodes"`         // nodes that would be removed
+	LastActivity time.Time `json:"last_activity"` // most recent message pair in the branch
+}
+
+// FindAbandonedBranches finds the largest branches where every message pair is older than the cutoff,
+// in tree order. The current node and the branch leading to it are never abandoned, and neither
+// is the root. Nodes can't be tagged or rated yet, so age is the only thing that marks a branch as unused
+func FindAbandonedBranches(root Node, current Node, cutoff time.Time) []AbandonedBranch {
+	protected := map[Node]bool{}
+	for node := current; node != nil; node = nodeParent(node) {
+		protected[node] = true
+	}
+
+	found := []AbandonedBranch{}
+	var walk func(node Node) (removable bool, nodes int, last time.Time)
+	walk = func(node Node) (bool, int, time.Time) {
+		mp, isPair := node.(*MessagePairNode)
+		removable := isPair && !protected[node] && mp.Time.Before(cutoff)
+		nodes := 1
+		var last time.Time
+		if isPair {
+			last = mp.Time
+		}
+
+		var candidates []AbandonedBranch
+		for _, child := range nodeChildren(node) {
+			childRemovable, childNodes, childLast := walk(child)
+			if !childRemovable {
+				removable = false
+				continue
+			}
+			nodes += childNodes
+			if childLast.After(last) {
+				last = childLast
+			}
+			candidates = append(candidates, AbandonedBranch{
+				Hash:         child.Hash(),
+				Nodes:        childNodes,
+				LastActivity: childLast,
+			})
+		}
+
+		// If this node can go then so can its children along with it, they are only
+		// reported separately when this node has to stay
+		if !removable {
+			found = append(found, candidates...)
+		}
+		return removable, nodes, last
+	}
+	walk(root)
+	return found
+}
+
+// Remove the nodes with the given hashes, and everything under them, from the tree.
+// Returns the number of nodes removed
+func pruneNodes(root Node, hashes map[string]bool) int {
+	removed := 0
+	var walk func(current Node)
+	walk = func(current Node) {
+		var parent *node
+		switch n := current.(type) {
+		case *RootNode:
+			parent = &n.node
+		case *MessagePairNode:
+			parent = &n.node
+		default:
+			return
+		}
+		kept := parent.Children[:0]
+		for _, child := range parent.Children {
+			if hashes[child.Hash()] {
+				removed += 1 + countDescendants(child)
+				continue
+			}
+			kept = append(kept, child)
+			walk(child)
+		}
+		parent.Children = kept
+	}
+	walk(root)
+	return removed
+}
+
+// PruneAbandonedBranches removes the branches of the session's active chat that have had no activity
+// for the given duration (see FindAbandonedBranches). Before anything is removed the chat is saved as a
+// backup chat in the chat store, which can be loaded like any other chat to get the branches back.
+// Nothing is written if there is nothing to prune
+func (c *Core) PruneAbandonedBranches(sessionId string, olderThan time.Duration) (backup string, pruned []AbandonedBranch, err error) {
+	if olderThan <= 0 {
+		return "", nil, errors.New("branches must be older than a positive duration to be pruned")
+	}
+
+	c.sesMu.Lock()
+	session, exists := c.sessions[sessionId]
+	var name string
+	if exists {
+		name = session.activeChatId
+	}
+	c.sesMu.Unlock()
+	if !exists {
+		return "", nil, fmt.Errorf("session [%s] does not exist", sessionId)
+	}
+
+	c.chatMu.Lock()
+	chat, exists := c.activeChats[name]
+	c.chatMu.Unlock()
+	if !exists {
+		return "", nil, fmt.Errorf("chat [%s] is not active", name)
+	}
+
+	// Hold off submissions so the tree doesn't change underneath us
+	chat.submitMu.Lock()
+	defer chat.submitMu.Unlock()
+
+	pruned = FindAbandonedBranches(&chat.root, chat.currentNode, time.Now().Add(-olderThan))
+	if len(pruned) == 0 {
+		return "", pruned, nil
+	}
+
+	backup = fmt.Sprintf("%s.backup-%s", name, time.Now().Format("20060102-150405"))
+	if err := c.writeSnapshot(backup, chat); err != nil {
+		return "", nil, fmt.Errorf("failed to back up chat %s: %w", name, err)
+	}
+
+	hashes := make(map[string]bool, len(pruned))
+	for _, branch := range pruned {
+		hashes[branch.Hash] = true
+	}
+	pruneNodes(&chat.root, hashes)
+
+	if err := c.writeSnapshot(name, chat); err != nil {
+		return backup, nil, fmt.Errorf("failed to save pruned chat %s (backup is in %s): %w", name, backup, err)
+	}
+	return backup, pruned, nil
+}
+
+// Prune removes the node with the hash and everything under it from the tree, returning how many
+// nodes were removed. The root, the current node and the nodes on the way to it can't be pruned,
+// move somewhere else first
+func (c *chatInstance) Prune(hash string) (int, error) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+
+	target, exists := MapTree(&c.root)[hash]
+	if !exists {
+		return 0, fmt.Errorf("node %s not found", hash)
+	}
+	if _, isRoot := target.(*RootNode); isRoot {
+		return 0, errors.New("the root can't be pruned")
+	}
+	for n := c.currentNode; n != nil; n = nodeParent(n) {
+		if n == target {
+			return 0, errors.New("the node is the current node or leads to it, move off of its branch first")
+		}
+	}
+
+	removed := pruneNodes(&c.root, map[string]bool{hash: true})
+	c.logger().Debug("pruned", "node", hash, "removed", removed)
+	return removed, nil
+}
@@ -0,0 +1,121 @@
+package brunch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func addPair(parent Node, content string, at time.Time) *MessagePairNode {
+	pair := NewMessagePairNode(parent)
+	pair.User = NewMessageData("user", content)
+	pair.Assistant = NewMessageData("assistant", "re: "+content)
+	pair.Time = at
+	switch p := parent.(type) {
+	case *RootNode:
+		p.AddChild(pair)
+	case *MessagePairNode:
+		p.AddChild(pair)
+	}
+	return pair
+}
+
+func TestFindAbandonedBranches(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-30 * 24 * time.Hour)
+	cutoff := now.Add(-7 * 24 * time.Hour)
+
+	root := NewRootNode(RootOpt{Provider: "mock", Model: "m"})
+	// An old branch that was continued recently, so only its old side branch can go
+	a := addPair(root, "a", old)
+	a1 := addPair(a, "a1", old)
+	addPair(a1, "a1-1", old)
+	a2 := addPair(a, "a2", now)
+	// An old branch with nothing recent under it goes as a whole
+	b := addPair(root, "b", old)
+	addPair(b, "b1", old)
+	addPair(b, "b2", old)
+	// The current node is old but is where the user is
+	c := addPair(root, "c", old)
+
+	found := FindAbandonedBranches(root, c, cutoff)
+	require.Len(t, found, 2)
+	assert.Equal(t, a1.Hash(), found[0].Hash)
+	assert.Equal(t, 2, found[0].Nodes)
+	assert.Equal(t, b.Hash(), found[1].Hash)
+	assert.Equal(t, 3, found[1].Nodes)
+	assert.True(t, found[1].LastActivity.Equal(old))
+
+	// Standing in the old branch keeps the way to it, but not what is under it
+	found = FindAbandonedBranches(root, a1, cutoff)
+	require.Len(t, found, 3)
+	assert.Equal(t, a1.Children[0].Hash(), found[0].Hash)
+	assert.Equal(t, b.Hash(), found[1].Hash)
+	assert.Equal(t, c.Hash(), found[2].Hash)
+
+	removed := pruneNodes(root, map[string]bool{a1.Hash(): true, b.Hash(): true})
+	assert.Equal(t, 5, removed)
+	assert.Equal(t, []Node{a, c}, root.Children)
+	assert.Equal(t, []Node{a2}, a.Children)
+}
+
+func TestCore_PruneAbandonedBranches(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	stale := addPair(&chat.root, "stale", old)
+	addPair(stale, "stale too", old)
+	chat.currentNode = addPair(&chat.root, "fresh", time.Now())
+
+	_, _, err = core.PruneAbandonedBranches("s1", 0)
+	assert.Error(t, err)
+
+	backup, pruned, err := core.PruneAbandonedBranches("s1", 7*24*time.Hour)
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, stale.Hash(), pruned[0].Hash)
+	assert.Len(t, chat.root.Children, 1)
+
+	// The backup still has the branch and the saved chat doesn't
+	meta, err := core.ChatMetadata(backup)
+	require.NoError(t, err)
+	assert.Equal(t, 4, meta.Nodes)
+	meta, err = core.ChatMetadata("a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, meta.Nodes)
+
+	// Nothing left to prune means no new backup
+	backup, pruned, err = core.PruneAbandonedBranches("s1", 7*24*time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+	assert.Empty(t, backup)
+}
+
+func TestChat_Prune(t *testing.T) {
+	chat := newChatInstance(newMockProvider("mock"))
+	now := time.Now()
+	a := addPair(&chat.root, "a", now)
+	b := addPair(a, "b", now)
+	addPair(b, "c", now)
+	dead := addPair(a, "dead end", now)
+	addPair(dead, "deeper", now)
+	chat.currentNode = b
+
+	for _, hash := range []string{chat.root.Hash(), a.Hash(), b.Hash(), "nope"} {
+		_, err := chat.Prune(hash)
+		assert.Error(t, err, "%s can't be pruned", hash)
+	}
+
+	removed, err := chat.Prune(dead.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, []Node{b}, a.Children)
+	assert.Equal(t, 4, len(MapTree(&chat.root)))
+	assert.Same(t, Node(b), chat.currentNode)
+}
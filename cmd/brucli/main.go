@@ -12,17 +12,25 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bosley/brunch"
 	"github.com/bosley/brunch/anthropic"
+	"github.com/bosley/brunch/plugin"
 )
 
 var loadDir *string
@@ -31,7 +39,35 @@ var core *brunch.Core
 var logger *slog.Logger
 var busy bool
 
-const sessionId = "cli-session"
+// Output from \sh commands the user elected to send along with their next message
+var pendingShellOutput []string
+
+// Replies are printed as they would be said, and piped to the text-to-speech command if there is one
+var speechOutput bool
+var speechCommand string
+
+// Trees are printed without box-drawing glyphs, for screen readers or when output is piped to a file
+var plainTree bool
+
+var sessionId string
+
+// Translations of what the CLI prints and aliases for its commands, nil without -catalog
+var catalog *brunch.Catalog
+
+// Plugins given as name=command on the command line, registered as base providers
+type pluginFlags []string
+
+func (p *pluginFlags) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pluginFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("plugin must be given as name=command")
+	}
+	*p = append(*p, value)
+	return nil
+}
 
 var infoCb = brunch.InformationCallback{
 	OnListChats:       infoCbListChats,
@@ -39,6 +75,12 @@ var infoCb = brunch.InformationCallback{
 	OnListContexts:    infoCbListContexts,
 	OnDescribeContext: infoCbDescribeContext,
 	OnDescribeChat:    infoCbDescribeChat,
+	OnHistory:         infoCbHistory,
+	OnWhereUsed:       infoCbWhereUsed,
+	OnCheckContext:    infoCbCheckContext,
+	OnFsck:            infoCbFsck,
+	OnUsage:           infoCbUsage,
+	OnTrash:           infoCbTrash,
 }
 
 func main() {
@@ -47,18 +89,73 @@ func main() {
 	}))
 	slog.SetDefault(logger)
 
-	loadDir = flag.String("load", "/tmp/brunch", "Load directory containing insu.yaml")
+	loadDir = flag.String("load", filepath.Join(os.TempDir(), "brunch"), "Install directory, or empty to use the XDG data and config directories")
+	dataStore := flag.String("data-store", "", "Put the data-store somewhere other than the install directory")
+	flag.StringVar(&sessionId, "session", "cli-session", "Name of the session to start or resume")
+	var plugins pluginFlags
+	flag.Var(&plugins, "plugin", "Register a provider plugin as name=command (may be repeated)")
+	script := flag.String("script", "", "Execute the statements in a file and exit")
+	check := flag.Bool("check", false, "With -script, validate the statements without executing them")
+	catalogPath := flag.String("catalog", "", "Localize the CLI with a message catalog (JSON with messages, keywords and commands)")
+	secrets := flag.String("secrets", "warn", "What to do when a message or the context sent with it holds a secret (API key, private key): warn, block or off")
+	flag.BoolVar(&plainTree, "plain-tree", false, "Print trees without box-drawing glyphs (plain indentation, each node names its parent)")
+	flag.StringVar(&speechCommand, "speak", "", "Speak replies by piping them to a text-to-speech command (like say or espeak), turns speech output on")
+	exportWorkspace := flag.String("export-workspace", "", "Write a workspace's providers, contexts and chats to stdout as JSON and exit")
+	timeout := flag.Duration("timeout", brunch.DefaultRequestTimeout, "How long a provider has to answer a message")
+	var limits brunch.TreeLimits
+	flag.IntVar(&limits.MaxDepth, "max-depth", 0, "Refuse messages that would make a branch deeper than this, 0 for no limit")
+	flag.IntVar(&limits.MaxChildren, "max-children", 0, "Refuse messages under a node that already has this many replies, 0 for no limit")
+	flag.IntVar(&limits.MaxNodes, "max-nodes", 0, "Refuse messages that would grow a chat's tree past this many nodes, 0 for no limit")
 	flag.Parse()
+	speechOutput = speechCommand != ""
+
+	secretPolicy, ok := map[string]brunch.SecretPolicy{
+		"warn":  brunch.SecretsWarn,
+		"block": brunch.SecretsBlock,
+		"off":   brunch.SecretsOff,
+	}[*secrets]
+	if !ok {
+		fmt.Println("-secrets must be warn, block or off")
+		os.Exit(1)
+	}
+
+	if *catalogPath != "" {
+		var err error
+		if catalog, err = brunch.LoadCatalog(*catalogPath); err != nil {
+			fmt.Println("Failed to load catalog:", err)
+			os.Exit(1)
+		}
+		if err := catalog.RegisterKeywords(); err != nil {
+			slog.Warn("some statement keywords of the catalog are unavailable", "error", err)
+		}
+	}
+
+	// These are not saved to disk - only derivatives are saved. Without a key the CLI can
+	// still be used with plugins
+	baseProviders := map[string]brunch.Provider{}
+	if provider, err := anthropic.InitialAnthropicProvider(); err != nil {
+		slog.Warn("anthropic provider is not available", "error", err)
+	} else {
+		baseProviders["anthropic"] = provider
+	}
 
 	core = brunch.NewCore(brunch.CoreOpts{
 		InstallDirectory: *loadDir,
-
-		// These are not saved to disk - only derivatives are saved
-		BaseProviders: map[string]brunch.Provider{
-			"anthropic": anthropic.InitialAnthropicProvider(),
-		},
+		StorePaths:       brunch.StorePaths{Data: *dataStore},
+		BaseProviders:    baseProviders,
 
 		InfoHandler: infoCb,
+		Logger:      logger,
+
+		// A chat whose context moved is still worth opening, the user is asked what to do with it
+		DegradedContextLoad: true,
+		Secrets:             secretPolicy,
+
+		// Messages sent while offline wait on the tree for \flush
+		QueueOffline:   true,
+		RequestTimeout: *timeout,
+		TreeLimits:     limits,
+		Prices:         map[string]brunch.TokenPrice{"anthropic": anthropic.DefaultPrice},
 		ChatStartHandler: func(req brunch.Conversation) error {
 
 			// I know this is hacky, but this is a POC and we are tossing the CLI once we start on the server so fuck off
@@ -69,6 +166,24 @@ func main() {
 		},
 	})
 
+	for _, p := range plugins {
+		name, command, _ := strings.Cut(p, "=")
+		fields := strings.Fields(command)
+		if len(fields) == 0 {
+			fmt.Println("plugin", name, "has no command")
+			os.Exit(1)
+		}
+		provider, err := plugin.LaunchProvider(name, fields[0], fields[1:]...)
+		if err != nil {
+			slog.Error("failed to launch plugin", "plugin", name, "error", err)
+			os.Exit(1)
+		}
+		if err := core.RegisterBaseProvider(name, provider); err != nil {
+			slog.Error("failed to register plugin", "plugin", name, "error", err)
+			os.Exit(1)
+		}
+	}
+
 	if !core.IsInstalled() {
 		slog.Info("installing core", "dir", *loadDir)
 		if err := core.Install(); err != nil {
@@ -86,9 +201,69 @@ func main() {
 			os.Exit(1)
 		}
 	}
+
+	if *script != "" {
+		os.Exit(runScript(*script, *check))
+	}
+
+	if *exportWorkspace != "" {
+		data, err := core.ExportWorkspace(*exportWorkspace)
+		if err != nil {
+			fmt.Println("Failed to export workspace:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
+
+	// A fresh install has no saved session so this is a no-op
+	conversation, err := core.ResumeSession(sessionId)
+	if err != nil {
+		slog.Debug("no session to resume", "session", sessionId, "error", err)
+	} else if conversation != nil {
+		slog.Info("resuming session", "session", sessionId, "node", conversation.CurrentNode().Hash())
+		doChat(conversation)
+	}
 	doRepl()
 }
 
+// Run (or with check, only validate) a file of statements. Returns the exit code
+func runScript(path string, check bool) int {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Failed to read script: %v\n", err)
+		return 1
+	}
+	statements := brunch.ParseStatements(string(content))
+
+	if check {
+		if err := core.ValidateStatements(statements); err != nil {
+			var parseErr *brunch.ParseError
+			if errors.As(err, &parseErr) {
+				fmt.Printf("%s: %v\n%s\n", path, err, parseErr.Detail())
+			} else {
+				fmt.Printf("%s: %v\n", path, err)
+			}
+			return 1
+		}
+		fmt.Printf("%s: %d statements ok\n", path, len(statements))
+		return 0
+	}
+
+	// Scripts run as a transaction so a failure part way through doesn't leave half a setup behind
+	if err := core.ExecuteTransaction(sessionId, statements); err != nil {
+		var parseErr *brunch.ParseError
+		if errors.As(err, &parseErr) {
+			fmt.Printf("%s: %v\n%s\n", path, err, parseErr.Detail())
+		} else {
+			fmt.Printf("%s: %v\n", path, err)
+		}
+		fmt.Println("no changes were made")
+		return 1
+	}
+	return 0
+}
+
 func doRepl() {
 	reader := bufio.NewReader(os.Stdin)
 
@@ -96,7 +271,7 @@ func doRepl() {
 		fmt.Print(">")
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			fmt.Printf("Error reading input: %v\n", err)
+			fmt.Println(catalog.Textf("Error reading input: %v", err))
 			continue
 		}
 
@@ -108,23 +283,76 @@ func doRepl() {
 
 		// Check for "brunch statement"
 		if !strings.HasPrefix(statement, "\\") {
-			fmt.Println("invalid branch statement")
+			fmt.Println(catalog.Text("invalid branch statement"))
 			continue
 		}
 
-		stmt := brunch.NewStatement(statement)
-		if err := stmt.Prepare(); err != nil {
-			fmt.Printf("Error preparing statement: %v\n", err)
-			continue
+		// A line may hold several statements separated by ';'
+		for _, stmt := range brunch.ParseStatements(statement) {
+			if !runStatement(stmt) {
+				break
+			}
 		}
+	}
+}
 
-		if err := core.ExecuteStatement(sessionId, stmt); err != nil {
-			fmt.Printf("Error: %v\n", err)
-			continue
+// Prepare and execute a single statement, reporting any error. Returns false if the statement failed
+func runStatement(stmt *brunch.Statement) bool {
+	if err := stmt.Prepare(); err != nil {
+		var parseErr *brunch.ParseError
+		if errors.As(err, &parseErr) {
+			fmt.Println(catalog.Textf("Error preparing statement:\n%s", parseErr.Detail()))
+		} else {
+			fmt.Println(catalog.Textf("Error preparing statement: %v", err))
 		}
+		return false
+	}
+
+	if err := core.ExecuteStatement(sessionId, stmt); err != nil {
+		fmt.Println(catalog.Textf("Error: %v", err))
+		return false
+	}
+
+	for busy {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
 
-		for busy {
-			time.Sleep(100 * time.Millisecond)
+// Ask what to do about each context the chat couldn't attach when it was loaded. Anything
+// that is kept stays unavailable and is asked about again the next time the chat is loaded
+func fixUnavailableContexts(chat brunch.Conversation, reader *bufio.Reader) {
+	for name, reason := range chat.UnavailableContexts() {
+		fmt.Println(catalog.Textf("context %s is unavailable: %s", name, reason))
+		for {
+			fmt.Print(catalog.Text("[r]e-point it, [d]etach it, or [k]eep it unavailable? "))
+			answer, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch strings.TrimSpace(answer) {
+			case "r":
+				fmt.Print(catalog.Text("new location: "))
+				value, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if err := chat.RepointContext(name, strings.TrimSpace(value)); err != nil {
+					fmt.Println(catalog.Text("failed to re-point context:"), err)
+					continue
+				}
+				fmt.Println(catalog.Text("re-pointed context"), name)
+			case "d":
+				if err := chat.DetachContext(name); err != nil {
+					fmt.Println(catalog.Text("failed to detach context:"), err)
+					continue
+				}
+				fmt.Println(catalog.Text("detached context"), name)
+			case "k":
+			default:
+				continue
+			}
+			break
 		}
 	}
 }
@@ -139,12 +367,14 @@ func doChat(chat brunch.Conversation) {
 	chat.ToggleChat(chatEnabled)
 
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("Chat started. Press Ctrl+C to exit and view conversation tree.")
-	fmt.Println("Enter your messages (press Enter twice to send):")
+	fixUnavailableContexts(chat, reader)
+
+	fmt.Println(catalog.Text("Chat started. Press Ctrl+C to exit and view conversation tree."))
+	fmt.Println(catalog.Text("Enter your messages (press Enter twice to send):"))
 
 	for {
 		var lines []string
-		currentHash := chat.CurrentNode().Hash()[:8]
+		currentHash := brunch.ShortHash(chat.CurrentNode().Hash())
 		fmt.Printf("\n[%s]>  ", currentHash)
 
 		// Read until double Enter
@@ -169,7 +399,7 @@ func doChat(chat brunch.Conversation) {
 					if doQuit {
 						return
 					}
-					currentHash = chat.CurrentNode().Hash()[:8]
+					currentHash = brunch.ShortHash(chat.CurrentNode().Hash())
 					fmt.Printf("\n[%s]>  ", currentHash)
 				} else {
 					lines = append(lines, line)
@@ -178,48 +408,366 @@ func doChat(chat brunch.Conversation) {
 		}
 
 		if !chatEnabled {
-			fmt.Println("chat is disabled, skipping. use \\x to toggle")
+			fmt.Println(catalog.Text("chat is disabled, skipping. use \\x to toggle"))
 			continue
 		}
 
 		question := strings.Join(lines, "\n")
-		response, err := chat.SubmitMessage(question)
+		if len(pendingShellOutput) > 0 {
+			question = strings.Join(append(pendingShellOutput, question), "\n\n")
+			pendingShellOutput = nil
+		}
+
+		// Ctrl+C while waiting on the reply gives up on it instead of quitting
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		response, err := chat.SubmitMessageContext(ctx, question)
+		stop()
+		if errors.Is(err, context.Canceled) {
+			fmt.Println(catalog.Text("cancelled, the message was not answered"))
+			continue
+		}
+		var overflow *brunch.ContextOverflowError
+		if errors.As(err, &overflow) {
+			fmt.Print(catalog.Text("the branch is too long for the provider, summarize the older messages and send it again? [y/N]: "))
+			var answer string
+			fmt.Scanln(&answer)
+			if strings.ToLower(strings.TrimSpace(answer)) == "y" {
+				response, err = chat.SubmitCompacted(question)
+			}
+		}
+		var queued *brunch.MessageQueuedError
+		if errors.As(err, &queued) {
+			fmt.Println(catalog.Text("the provider can't be reached, the message was queued, send it with \\flush once back online"))
+			continue
+		}
 		if err != nil {
 			slog.Error("failed to submit message", "error", err)
 			continue
 		}
 
-		fmt.Println("assistant> ", response)
+		printReply(response)
+		printCitations(chat.CurrentNode())
 	}
 }
 
 func handleCommand(conversation brunch.Conversation, line string) (bool, error) {
 	parts := strings.Split(line, " ")
+	parts[0] = catalog.Command(parts[0])
 	switch parts[0] {
 	case "\\?":
-		fmt.Println("Commands:")
-		fmt.Println("\t\\l: List chat history [current branch of chat]")
-		fmt.Println("\t\\t: List chat tree [all branches]")
-		fmt.Println("\t\\i: Queue image [import image file into chat for inquiry]")
-		fmt.Println("\t\\s: Save snapshot [save a snapshot of the current tree to disk]")
-		fmt.Println("\t\\p: Go to parent [traverse up the tree]")
-		fmt.Println("\t\\c: Go to child [traverse down the tree to the nth child]")
-		fmt.Println("\t\\r: Go to root [traverse to the root of the tree]")
-		fmt.Println("\t\\g: Go to node [traverse to a specific node by hash]")
-		fmt.Println("\t\\.: List children [list all children of the current node]")
-		fmt.Println("\t\\x: Toggle chat [toggle chat mode on/off - chat on by default press enter twice to send with no command leading]")
-		fmt.Println("\t\\a: List artifacts [display artifacts from current node] or [write artifacts to disk if followed by a directory path]")
-		fmt.Println("\t\\q: Quit [save and quit]")
+		fmt.Println(catalog.Text("Commands:"))
+		helpLine("\\l", "List chat history [current branch of chat]")
+		helpLine("\\t", "List chat tree [all branches, or limited with: depth <n> limit <n> around <n> page <n>, or only recent activity with: --since <2d|1w|6h|date>, or without box-drawing glyphs with: plain on|off]")
+		helpLine("\\log", "Recent activity [messages across every chat, newest first: \\log [count]]")
+		helpLine("\\raw", "Log the exact HTTP bodies sent to and received from providers [on|off, or show what was logged for the current message with: show]")
+		helpLine("\\latency", "How long answers took [on this branch, or by provider across every chat with: report [since 2d|1w|6h|date]]")
+		helpLine("\\tools", "Tools the model can call [list them, or call the current node's tools again and continue on a new branch with: replay]")
+		helpLine("\\stats", "Tree statistics [node count, depth, and branches ranked by: recent (default), size, or depth]")
+		helpLine("\\cleanup", "Prune abandoned branches [branches untouched for <days>, backed up to a new chat first]")
+		helpLine("\\translate", "Translation layer [translate messages to the model language (default en) and replies back, or off]")
+		helpLine("\\fork", "Fork the current branch [write root to current node as a new chat: \\fork \"name\"]")
+		helpLine("\\regen", "Regenerate [ask the current message again, the old reply is kept as a revision]")
+		helpLine("\\edit", "Edit message [replace the current message and ask again: \\edit <message>]")
+		helpLine("\\revisions", "List revisions [of the current node, or put one back with: \\revisions restore <idx>]")
+		helpLine("\\verify", "Verify answer [check the current answer for unsupported claims, or verify every reply with: on|off]")
+		helpLine("\\remember", "Remember a fact [added to the system prompt: \\remember <key> <fact>, or list what is remembered]")
+		helpLine("\\forget", "Forget a fact [\\forget <key>]")
+		helpLine("\\env", "Environment variables for shell commands [list them, set with: <NAME> <value>, or remove with: -<NAME>; saved encrypted]")
+		helpLine("\\export-branch", "Export branch [write root to current node (or to a hash) as JSON: \\export-branch <file> [hash]]")
+		helpLine("\\import-branch", "Import branch [add an exported branch to a chat: \\import-branch <chat> <file>]")
+		helpLine("\\import-chats", "Import conversations [from a ChatGPT or Claude export, as new chats on a provider: \\import-chats <chatgpt|claude> <provider> <file>]")
+		helpLine("\\merge", "Merge two branches [put the results of the branches down to two nodes into a new node where they split: \\merge <hash> <hash>]")
+		helpLine("\\prune", "Prune a branch [remove a node and everything under it, not the current node or one leading to it: \\prune <hash>]")
+		helpLine("\\flush", "Send queued messages [messages that couldn't reach the provider, sent from the nodes they were queued on]")
+		helpLine("\\note", "Add a note [under the current node, kept out of what is sent unless given --send: \\note [--send] <text>]")
+		helpLine("\\doc", "Add a document [a file's content as a node, sent along with --send: \\doc [--send] <file>]")
+		helpLine("\\profile", "Profile shared by every chat [list it, include it in this chat with: on|off, or change it with: set <key> <fact>, forget <key>, clear]")
+		helpLine("\\i", "Queue image [import image file into chat for inquiry]")
+		helpLine("\\s", "Save snapshot [save a snapshot of the current tree to disk]")
+		helpLine("\\p", "Go to parent [traverse up the tree]")
+		helpLine("\\c", "Go to child [traverse down the tree to the nth child]")
+		helpLine("\\r", "Go to root [traverse to the root of the tree]")
+		helpLine("\\g", "Go to node [traverse to a specific node by hash, or the start of one like the short hash \\. shows]")
+		helpLine("\\.", "List children [list all children of the current node with their short hash, time and first line, and a one-line summary of each once it has many]")
+		helpLine("\\x", "Toggle chat [toggle chat mode on/off - chat on by default press enter twice to send with no command leading]")
+		helpLine("\\a", "List artifacts [display artifacts from current node] or [write artifacts to disk if followed by a directory path]")
+		helpLine("\\speech", "Speech output [print replies without markdown or code and speak them: on|off, or set the text-to-speech command with: cmd <command>]")
+		helpLine("\\sh", "Run shell command [through sh, or cmd on windows; show output and optionally insert it into the next message]")
+		helpLine("\\q", "Quit [save and quit]")
 
 		// Added for convenience, so we don't have to exit the current chat to add a new context to the core
 		// When a context is added via a chat, it is automatically saved to disk and will be mandatory for the chat
 		// to be restored in the future.
-		fmt.Println("\t\\new-k: Attach new knowledge-context [attach a non-existing knowledge-context to the chat]")
-		fmt.Println("\t\\attach-k: Attach existing knowledge-context [attach an existing knowledge-context to the chat]")
+		helpLine("\\new-k", "Attach new knowledge-context [attach a non-existing knowledge-context to the chat]")
+		helpLine("\\attach-k", "Attach existing knowledge-context [attach an existing knowledge-context to the chat]")
 	case "\\l":
 		fmt.Println(conversation.PrintHistory())
 	case "\\t":
-		fmt.Println(conversation.PrintTree())
+		if len(parts) == 1 {
+			if plainTree {
+				fmt.Print(conversation.PrintTreePages(brunch.TreePrintOpts{Plain: true})[0])
+				return false, nil
+			}
+			fmt.Println(conversation.PrintTree())
+			return false, nil
+		}
+		if parts[1] == "plain" {
+			if len(parts) != 3 || (parts[2] != "on" && parts[2] != "off") {
+				fmt.Println("usage: \\t plain on|off")
+				return false, nil
+			}
+			plainTree = parts[2] == "on"
+			fmt.Println("plain trees are", parts[2])
+			return false, nil
+		}
+		if parts[1] == "--since" {
+			if len(parts) != 3 {
+				fmt.Println("usage: \\t --since <age, like 2d, 1w or 6h, or a date like 2024-01-31>")
+				return false, nil
+			}
+			since, err := parseSince(parts[2], time.Now())
+			if err != nil {
+				fmt.Println(err)
+				return false, nil
+			}
+			fmt.Print(conversation.PrintTreeSince(since))
+			return false, nil
+		}
+		return handleTreePaging(conversation, parts[1:])
+	case "\\stats":
+		return handleTreeStats(conversation, parts[1:])
+	case "\\raw":
+		return handleRaw(conversation, parts[1:])
+	case "\\latency":
+		return handleLatency(conversation, parts[1:])
+	case "\\tools":
+		return handleTools(conversation, parts[1:])
+	case "\\log":
+		return handleActivityLog(parts[1:])
+	case "\\cleanup":
+		return handleCleanup(conversation, parts[1:])
+	case "\\translate":
+		if len(parts) > 1 && parts[1] == "off" {
+			conversation.SetTranslation(nil)
+			fmt.Println("translation off")
+			return false, nil
+		}
+		opts := &brunch.TranslationOpts{}
+		if len(parts) > 1 {
+			opts.ModelLanguage = parts[1]
+		}
+		conversation.SetTranslation(opts)
+		fmt.Println("translation on, use \\translate off to stop")
+	case "\\fork":
+		// Forking is a statement, the current branch is found through the session
+		if runStatement(brunch.NewStatement(line)) {
+			fmt.Println("forked the current branch, load it with \\chat")
+		}
+	case "\\regen":
+		response, err := conversation.Regenerate()
+		if err != nil {
+			fmt.Println("failed to regenerate", err)
+			return true, err
+		}
+		printReply(response)
+		printCitations(conversation.CurrentNode())
+	case "\\edit":
+		message := strings.TrimSpace(strings.TrimPrefix(line, "\\edit"))
+		if message == "" {
+			fmt.Println("usage: \\edit <message>")
+			return false, nil
+		}
+		response, err := conversation.Edit(message)
+		if err != nil {
+			fmt.Println("failed to edit", err)
+			return true, err
+		}
+		printReply(response)
+		printCitations(conversation.CurrentNode())
+	case "\\revisions":
+		return handleRevisions(conversation, parts[1:])
+	case "\\verify":
+		if len(parts) > 1 {
+			switch parts[1] {
+			case "on":
+				conversation.SetVerification(&brunch.VerificationOpts{})
+				fmt.Println("every reply will be verified, see \\l for what was flagged")
+			case "off":
+				conversation.SetVerification(nil)
+				fmt.Println("verification off")
+			default:
+				fmt.Println("usage: \\verify [on|off]")
+			}
+			return false, nil
+		}
+		verdict, err := conversation.Verify()
+		if err != nil {
+			fmt.Println("failed to verify", err)
+			return true, err
+		}
+		if verdict.Supported {
+			fmt.Println("no unsupported claims were found")
+			return false, nil
+		}
+		fmt.Println("unsupported claims:")
+		for _, claim := range verdict.Unsupported {
+			fmt.Println("\t-", claim)
+		}
+	case "\\remember":
+		if len(parts) == 1 {
+			memory := conversation.Memory()
+			if len(memory) == 0 {
+				fmt.Println("nothing is remembered, use \\remember <key> <fact>")
+				return false, nil
+			}
+			keys := make([]string, 0, len(memory))
+			for key := range memory {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Printf("\t%s: %s\n", key, memory[key])
+			}
+			return false, nil
+		}
+		if len(parts) < 3 {
+			fmt.Println("usage: \\remember <key> <fact>")
+			return false, nil
+		}
+		if err := conversation.Remember(parts[1], strings.Join(parts[2:], " ")); err != nil {
+			fmt.Println("failed to remember", err)
+			return true, err
+		}
+		fmt.Println("remembered", parts[1])
+	case "\\forget":
+		if len(parts) != 2 {
+			fmt.Println("usage: \\forget <key>")
+			return false, nil
+		}
+		if err := conversation.Forget(parts[1]); err != nil {
+			fmt.Println("failed to forget", err)
+			return true, err
+		}
+		fmt.Println("forgot", parts[1])
+	case "\\env":
+		return handleEnv(conversation, parts[1:])
+	case "\\profile":
+		return handleProfile(conversation, parts[1:])
+	case "\\export-branch":
+		if len(parts) < 2 || len(parts) > 3 {
+			fmt.Println("usage: \\export-branch <file> [hash]")
+			return false, nil
+		}
+		hash := ""
+		if len(parts) == 3 {
+			hash = parts[2]
+		}
+		data, err := conversation.ExportBranch(hash)
+		if err != nil {
+			fmt.Println("failed to export branch", err)
+			return true, err
+		}
+		if err := os.WriteFile(parts[1], data, 0644); err != nil {
+			fmt.Println("failed to write branch", err)
+			return true, err
+		}
+		fmt.Println("branch written to", parts[1])
+	case "\\import-branch":
+		if len(parts) != 3 {
+			fmt.Println("usage: \\import-branch <chat> <file>")
+			return false, nil
+		}
+		data, err := os.ReadFile(parts[2])
+		if err != nil {
+			fmt.Println("failed to read branch", err)
+			return true, err
+		}
+		leaf, err := core.ImportBranch(parts[1], data)
+		if err != nil {
+			fmt.Println("failed to import branch", err)
+			return true, err
+		}
+		fmt.Println("branch imported into", parts[1], "ending at", leaf)
+	case "\\import-chats":
+		if len(parts) != 4 {
+			fmt.Println("usage: \\import-chats <chatgpt|claude> <provider> <file>")
+			return false, nil
+		}
+		data, err := os.ReadFile(parts[3])
+		if err != nil {
+			fmt.Println("failed to read export", err)
+			return true, err
+		}
+		names, err := core.ImportConversations(parts[2], data, brunch.ImportFormat(parts[1]))
+		if err != nil {
+			fmt.Println("failed to import conversations", err)
+		}
+		if len(names) > 0 {
+			fmt.Println("imported", strings.Join(names, ", "))
+		}
+	case "\\merge":
+		if len(parts) != 3 {
+			fmt.Println("usage: \\merge <hash> <hash>")
+			return false, nil
+		}
+		hash, err := conversation.Merge(parts[1], parts[2])
+		if err != nil {
+			fmt.Println("failed to merge", err)
+			return false, nil
+		}
+		fmt.Println("merged into", hash)
+	case "\\prune":
+		if len(parts) != 2 {
+			fmt.Println("usage: \\prune <hash>")
+			return false, nil
+		}
+		fmt.Printf("remove %s and everything under it? [y/N]: ", parts[1])
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			return false, nil
+		}
+		removed, err := conversation.Prune(parts[1])
+		if err != nil {
+			fmt.Println("failed to prune", err)
+			return false, nil
+		}
+		fmt.Printf("pruned %d nodes, save with \\s to keep them out of the snapshot\n", removed)
+	case "\\flush":
+		flushed, err := conversation.Flush()
+		for _, sent := range flushed {
+			fmt.Println("sent>", sent.Message)
+			printReply(sent.Response)
+		}
+		if err != nil {
+			fmt.Println("failed to flush", err)
+			return false, nil
+		}
+		if len(flushed) == 0 {
+			fmt.Println("no messages are queued")
+		}
+	case "\\note", "\\doc":
+		rest := strings.TrimSpace(strings.TrimPrefix(line, parts[0]))
+		send := strings.HasPrefix(rest, "--send")
+		if send {
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, "--send"))
+		}
+		if rest == "" {
+			fmt.Println("usage: \\note [--send] <text> or \\doc [--send] <file>")
+			return false, nil
+		}
+		var hash string
+		var err error
+		if parts[0] == "\\note" {
+			hash, err = conversation.Annotate(brunch.Annotation{Kind: brunch.AK_NOTE, Content: rest, InHistory: send})
+		} else {
+			hash, err = conversation.AnnotateWithDocument(rest, send)
+		}
+		if err != nil {
+			fmt.Println("failed to annotate", err)
+			return true, err
+		}
+		fmt.Println("added", hash)
 	case "\\i":
 		fmt.Println("Enter image path:")
 		var imagePath string
@@ -267,14 +815,19 @@ func handleCommand(conversation brunch.Conversation, line string) (bool, error)
 		if conversation.HasParent() {
 			fmt.Println("current node has parent; use \\p to access")
 		}
+		// Makes the summaries the listing shows, if there are enough children to need them
+		conversation.ChildSummaries()
 		children := conversation.ListChildren()
 		if len(children) == 0 {
 			fmt.Println("current node has no children")
 			return false, nil
 		}
-		fmt.Println("current node has children\n\tidx:\thash")
+		fmt.Println("current node has children\n\tidx:\thash\t\ttime\t\t\treplies\tmessage")
 		for idx, child := range children {
-			fmt.Printf("\t%d:\t%s\n", idx, child)
+			fmt.Printf("\t%d:\t%s\t%s\t%d\t%s\n", idx, child.ShortHash, child.Time.Format("2006-01-02 15:04:05"), child.Children, child.Preview)
+			if child.Summary != "" {
+				fmt.Printf("\t\t%s\n", child.Summary)
+			}
 		}
 		fmt.Println("\nuse \\c <idx> to go to child")
 	case "\\x":
@@ -340,6 +893,10 @@ func handleCommand(conversation brunch.Conversation, line string) (bool, error)
 		for _, ctx := range conversation.ListKnowledgeContexts() {
 			fmt.Printf("\t%s\n", ctx)
 		}
+	case "\\speech":
+		return handleSpeech(parts[1:])
+	case "\\sh":
+		return handleShell(conversation, strings.TrimSpace(strings.TrimPrefix(line, "\\sh")))
 	case "\\q":
 		fmt.Println("saving back to loaded snapshot")
 		if err := saveSnapshot(); err != nil {
@@ -358,7 +915,7 @@ func saveSnapshot() error {
 }
 
 func banner() {
-	fmt.Println(`
+	fmt.Println(catalog.Text(`
 
 		        W E L C O M E
 
@@ -368,7 +925,7 @@ func banner() {
 
 		To see a list of commands type '\?'
 		To quit, type '\q'
-		`)
+		`))
 }
 
 func isNonReplQuit(line string) bool {
@@ -383,6 +940,534 @@ func isNonReplQuit(line string) bool {
 	return false
 }
 
+// The command runs through the platform's shell so pipes and the like work everywhere
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// A line of the chat help, the description is translated by the catalog
+func helpLine(command string, description string) {
+	fmt.Printf("\t%s: %s\n", command, catalog.Text(description))
+}
+
+// Print a reply, as it would be said when speech output is on, and speak it if there is a command to
+func printReply(response string) {
+	if !speechOutput {
+		fmt.Println("assistant> ", response)
+		return
+	}
+	spoken := brunch.SpeechText(response)
+	fmt.Println("assistant> ", spoken)
+	if speechCommand == "" {
+		return
+	}
+	cmd := shellCommand(speechCommand)
+	cmd.Stdin = strings.NewReader(spoken)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		fmt.Println("failed to speak the reply:", err, strings.TrimSpace(string(output)))
+	}
+}
+
+// List the pieces of the chat's contexts the answer was given. After tool calls they are on the
+// message that started them
+func printCitations(node brunch.Node) {
+	mp, ok := node.(*brunch.MessagePairNode)
+	for ok && len(mp.Citations) == 0 {
+		parent, isPair := mp.Parent.(*brunch.MessagePairNode)
+		if !isPair || len(parent.ToolCalls) == 0 {
+			return
+		}
+		mp = parent
+	}
+	if !ok {
+		return
+	}
+	fmt.Println(catalog.Text("sources:"))
+	for i, citation := range mp.Citations {
+		fmt.Printf("\t[%d] %s\n", i+1, citation)
+	}
+}
+
+// \speech [on|off|cmd <command>]
+func handleSpeech(args []string) (bool, error) {
+	if len(args) == 0 {
+		state := "off"
+		if speechOutput {
+			state = "on"
+		}
+		if speechCommand == "" {
+			fmt.Println("speech output is", state+", replies aren't spoken (set a command with \\speech cmd <command>)")
+		} else {
+			fmt.Println("speech output is", state+", replies are spoken with:", speechCommand)
+		}
+		return false, nil
+	}
+	switch args[0] {
+	case "on", "off":
+		speechOutput = args[0] == "on"
+		fmt.Println("speech output is", args[0])
+	case "cmd":
+		speechCommand = strings.Join(args[1:], " ")
+		if speechCommand == "" {
+			fmt.Println("replies won't be spoken")
+			return false, nil
+		}
+		speechOutput = true
+		fmt.Println("replies will be spoken with:", speechCommand)
+	default:
+		fmt.Println("usage: \\speech [on|off|cmd <command>]")
+	}
+	return false, nil
+}
+
+// Run a command locally with the chat's environment, show the user what it produced, and if
+// they want it, stage the output to be sent as a fenced block at the top of the next message
+func handleShell(conversation brunch.Conversation, command string) (bool, error) {
+	if command == "" {
+		fmt.Println("usage: \\sh <command>")
+		return false, nil
+	}
+
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(), conversation.Environ()...)
+	output, err := cmd.CombinedOutput()
+	fmt.Println(string(output))
+	if err != nil {
+		fmt.Println("command exited with error:", err)
+	}
+
+	fmt.Print("insert output into next message? [y/N]: ")
+	var answer string
+	fmt.Scanln(&answer)
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		return false, nil
+	}
+
+	pendingShellOutput = append(pendingShellOutput,
+		fmt.Sprintf("$ %s\n```\n%s\n```", command, strings.TrimRight(string(output), "\n")))
+	fmt.Println("output will be sent with the next message")
+	return false, nil
+}
+
+func handleTreeStats(conversation brunch.Conversation, args []string) (bool, error) {
+	order := brunch.BranchOrderRecent
+	if len(args) > 0 {
+		switch args[0] {
+		case "recent":
+		case "size":
+			order = brunch.BranchOrderSize
+		case "depth":
+			order = brunch.BranchOrderDepth
+		default:
+			fmt.Println("usage: \\stats [recent|size|depth]")
+			return false, nil
+		}
+	}
+
+	stats := conversation.TreeStats()
+	fmt.Printf("nodes: %d, max depth: %d, branches: %d\n", stats.Nodes, stats.MaxDepth, stats.BranchCount)
+	if stats.BranchCount == 0 {
+		return false, nil
+	}
+	fmt.Println("\tdepth\ttokens\tlast activity\t\tleaf")
+	for _, branch := range brunch.RankBranches(stats.Branches, order) {
+		fmt.Printf("\t%d\t~%d\t%s\t%s\n", branch.Depth, branch.Tokens, branch.LastActivity.Format("2006-01-02 15:04:05"), branch.Leaf)
+	}
+	fmt.Println("\nuse \\g <leaf> to go to a branch")
+	return false, nil
+}
+
+func handleActivityLog(args []string) (bool, error) {
+	count := 20
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fmt.Println("usage: \\log [count]")
+			return false, nil
+		}
+		count = n
+	}
+	entries, err := core.RecentActivity(count)
+	if err != nil {
+		fmt.Println("failed to read activity", err)
+		return true, err
+	}
+	if len(entries) == 0 {
+		fmt.Println("no activity yet")
+		return false, nil
+	}
+	fmt.Println("\ttime\t\t\tchat\taction\ttokens\ttook\tnode")
+	for _, entry := range entries {
+		fmt.Printf("\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			entry.Time.Format("2006-01-02 15:04:05"),
+			entry.Chat,
+			entry.Action,
+			entry.Tokens,
+			entry.Duration.Round(time.Millisecond),
+			entry.Node)
+	}
+	return false, nil
+}
+
+// \raw [on|off|show]
+func handleRaw(conversation brunch.Conversation, args []string) (bool, error) {
+	if len(args) == 0 {
+		if core.RawLogging() {
+			fmt.Println("raw logging is on")
+		} else {
+			fmt.Println("raw logging is off")
+		}
+		return false, nil
+	}
+	switch args[0] {
+	case "on", "off":
+		core.SetRawLogging(args[0] == "on")
+		fmt.Println("raw logging is", args[0])
+	case "show":
+		exchanges, err := conversation.RawExchanges()
+		if err != nil {
+			fmt.Println(err)
+			return false, nil
+		}
+		for _, exchange := range exchanges {
+			fmt.Printf("%s %s [%d]\n", exchange.Time.Format("2006-01-02 15:04:05"), exchange.Endpoint, exchange.Status)
+			fmt.Println("request>", exchange.Request)
+			fmt.Println("response>", exchange.Response)
+		}
+	default:
+		fmt.Println("usage: \\raw [on|off|show]")
+	}
+	return false, nil
+}
+
+// \tools [replay]
+func handleTools(conversation brunch.Conversation, args []string) (bool, error) {
+	if len(args) == 0 {
+		tools := core.Tools()
+		if len(tools) == 0 {
+			fmt.Println("no tools are registered")
+			return false, nil
+		}
+		for _, tool := range tools {
+			fmt.Printf("\t%s: %s\n", tool.Name, tool.Description)
+		}
+		return false, nil
+	}
+	if args[0] != "replay" || len(args) > 1 {
+		fmt.Println("usage: \\tools [replay]")
+		return false, nil
+	}
+	response, err := conversation.ReplayTools()
+	if err != nil {
+		fmt.Println("failed to replay tools", err)
+		return true, err
+	}
+	printReply(response)
+	return false, nil
+}
+
+// \latency [report [since]]
+func handleLatency(conversation brunch.Conversation, args []string) (bool, error) {
+	if len(args) == 0 {
+		latencies := conversation.Latencies()
+		if len(latencies) == 0 {
+			fmt.Println("no answers on this branch were timed")
+			return false, nil
+		}
+		fmt.Println("\ttime\t\t\tprovider\ttook\ttokens/s\tnode")
+		for _, message := range latencies {
+			fmt.Printf("\t%s\t%s\t\t%s\t%.1f\t\t%s\n",
+				message.Time.Format("2006-01-02 15:04:05"),
+				message.Latency.Provider,
+				message.Latency.Duration.Round(time.Millisecond),
+				message.Latency.TokensPerSecond,
+				message.Node)
+		}
+		return false, nil
+	}
+
+	if args[0] != "report" || len(args) > 2 {
+		fmt.Println("usage: \\latency [report [since]]")
+		return false, nil
+	}
+	since := time.Time{}
+	if len(args) == 2 {
+		var err error
+		if since, err = parseSince(args[1], time.Now()); err != nil {
+			fmt.Println(err)
+			return false, nil
+		}
+	}
+	report, err := core.LatencyReport(since)
+	if err != nil {
+		fmt.Println("failed to read activity", err)
+		return true, err
+	}
+	if len(report) == 0 {
+		fmt.Println("no answers were timed")
+		return false, nil
+	}
+	fmt.Println("\tprovider\tmessages\tmean\tp50\tp95\tslowest\ttokens/s")
+	for _, summary := range report {
+		fmt.Printf("\t%s\t\t%d\t\t%s\t%s\t%s\t%s\t%.1f\n",
+			summary.Provider,
+			summary.Messages,
+			summary.Mean.Round(time.Millisecond),
+			summary.P50.Round(time.Millisecond),
+			summary.P95.Round(time.Millisecond),
+			summary.Slowest.Round(time.Millisecond),
+			summary.TokensPerSecond)
+	}
+	return false, nil
+}
+
+func handleCleanup(conversation brunch.Conversation, args []string) (bool, error) {
+	if len(args) != 1 {
+		fmt.Println("usage: \\cleanup <days>")
+		return false, nil
+	}
+	days, err := strconv.Atoi(args[0])
+	if err != nil || days < 1 {
+		fmt.Println("days must be a positive number")
+		return false, nil
+	}
+	olderThan := time.Duration(days) * 24 * time.Hour
+
+	branches := conversation.AbandonedBranches(olderThan)
+	if len(branches) == 0 {
+		fmt.Printf("no branches have been untouched for %d days\n", days)
+		return false, nil
+	}
+	total := 0
+	fmt.Println("\tnodes\tlast activity\t\tbranch")
+	for _, branch := range branches {
+		total += branch.Nodes
+		fmt.Printf("\t%d\t%s\t%s\n", branch.Nodes, branch.LastActivity.Format("2006-01-02 15:04:05"), branch.Hash)
+	}
+	fmt.Printf("prune %d branches (%d nodes)? the chat is backed up first [y/N]: ", len(branches), total)
+	var answer string
+	fmt.Scanln(&answer)
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		fmt.Println("nothing was pruned")
+		return false, nil
+	}
+
+	backup, pruned, err := core.PruneAbandonedBranches(sessionId, olderThan)
+	if err != nil {
+		fmt.Println("failed to prune branches:", err)
+		return true, err
+	}
+	fmt.Printf("pruned %d branches, the chat before pruning was saved as %s\n", len(pruned), backup)
+	return false, nil
+}
+
+func handleRevisions(conversation brunch.Conversation, args []string) (bool, error) {
+	if len(args) == 2 && args[0] == "restore" {
+		idx, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Println("failed to parse index", err)
+			return true, err
+		}
+		if err := conversation.RestoreRevision(idx); err != nil {
+			fmt.Println("failed to restore revision", err)
+			return true, err
+		}
+		fmt.Println("restored revision", idx)
+		return false, nil
+	}
+	if len(args) != 0 {
+		fmt.Println("usage: \\revisions [restore <idx>]")
+		return false, nil
+	}
+
+	revisions := conversation.Revisions()
+	if len(revisions) == 0 {
+		fmt.Println("current node has no revisions")
+		return false, nil
+	}
+	for idx, revision := range revisions {
+		fmt.Printf("%d: from %s, replaced when the node was %s\n", idx, revision.Time.Format("2006-01-02 15:04:05"), revision.Reason)
+		if revision.User != nil {
+			fmt.Printf("\tuser> %s\n", revision.User.UnencodedContent())
+		}
+		if revision.Assistant != nil {
+			fmt.Printf("\tassistant> %s\n", revision.Assistant.UnencodedContent())
+		}
+	}
+	fmt.Println("\nuse \\revisions restore <idx> to put one back")
+	return false, nil
+}
+
+// \env [<NAME> <value> | -<NAME>]
+func handleEnv(conversation brunch.Conversation, args []string) (bool, error) {
+	switch {
+	case len(args) == 0:
+		env := conversation.Environment()
+		if len(env) == 0 {
+			fmt.Println("no environment variables are set, use \\env <NAME> <value>")
+			return false, nil
+		}
+		names := make([]string, 0, len(env))
+		for name := range env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("\t%s=%s\n", name, env[name])
+		}
+	case len(args) == 1 && strings.HasPrefix(args[0], "-"):
+		name := strings.TrimPrefix(args[0], "-")
+		if err := conversation.UnsetEnv(name); err != nil {
+			fmt.Println("failed to unset", err)
+			return false, nil
+		}
+		fmt.Println("unset", name)
+	case len(args) >= 2:
+		if err := conversation.SetEnv(args[0], strings.Join(args[1:], " ")); err != nil {
+			fmt.Println("failed to set", err)
+			return false, nil
+		}
+		fmt.Println("set", args[0])
+	default:
+		fmt.Println("usage: \\env [<NAME> <value> | -<NAME>]")
+	}
+	return false, nil
+}
+
+// \profile [on|off | set <key> <fact> | forget <key> | clear]
+func handleProfile(conversation brunch.Conversation, args []string) (bool, error) {
+	if len(args) == 0 {
+		profile := core.Profile()
+		state := "off"
+		if conversation.UsesProfile() {
+			state = "on"
+		}
+		fmt.Printf("profile is %s for this chat\n", state)
+		if len(profile) == 0 {
+			fmt.Println("the profile is empty, use \\profile set <key> <fact>")
+			return false, nil
+		}
+		keys := make([]string, 0, len(profile))
+		for key := range profile {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("\t%s: %s\n", key, profile[key])
+		}
+		return false, nil
+	}
+
+	switch {
+	case len(args) == 1 && (args[0] == "on" || args[0] == "off"):
+		if err := conversation.UseProfile(args[0] == "on"); err != nil {
+			fmt.Println("failed to change profile", err)
+			return true, err
+		}
+		fmt.Println("profile is", args[0], "for this chat")
+	case len(args) >= 3 && args[0] == "set":
+		if err := core.RememberProfile(args[1], strings.Join(args[2:], " ")); err != nil {
+			fmt.Println("failed to update profile", err)
+			return true, err
+		}
+		fmt.Println("added", args[1], "to the profile")
+	case len(args) == 2 && args[0] == "forget":
+		if err := core.ForgetProfile(args[1]); err != nil {
+			fmt.Println("failed to update profile", err)
+			return true, err
+		}
+		fmt.Println("removed", args[1], "from the profile")
+	case len(args) == 1 && args[0] == "clear":
+		if err := core.ClearProfile(); err != nil {
+			fmt.Println("failed to clear profile", err)
+			return true, err
+		}
+		fmt.Println("profile cleared")
+	default:
+		fmt.Println("usage: \\profile [on|off | set <key> <fact> | forget <key> | clear]")
+	}
+	return false, nil
+}
+
+// Nodes shown per page when the tree is printed with limits
+const treePageSize = 20
+
+// \t depth <n> limit <n> around <n> page <n>, any of them in any order
+// A point in time given as an age (2d, 1w, 6h, 30m) before now, or as a date
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, nil
+	}
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(value, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(value, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.Atoi(value[:len(value)-1])
+		if err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("invalid age: %s", value)
+		}
+		return now.Add(-time.Duration(n) * unit), nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return time.Time{}, fmt.Errorf("invalid age: %s", value)
+	}
+	return now.Add(-age), nil
+}
+
+func handleTreePaging(conversation brunch.Conversation, args []string) (bool, error) {
+	if len(args)%2 != 0 {
+		fmt.Println("usage: \\t [depth <n>] [limit <n>] [around <n>] [page <n>]")
+		return false, nil
+	}
+	opts := brunch.TreePrintOpts{PageSize: treePageSize, Plain: plainTree}
+	around := -1
+	page := 1
+	for i := 0; i < len(args); i += 2 {
+		value, err := strconv.Atoi(args[i+1])
+		if err != nil || value < 0 {
+			fmt.Println("invalid value for", args[i], ":", args[i+1])
+			return false, nil
+		}
+		switch args[i] {
+		case "depth":
+			opts.MaxDepth = value
+		case "limit":
+			opts.Limit = value
+		case "around":
+			around = value
+		case "page":
+			page = value
+		default:
+			fmt.Println("unknown tree option", args[i])
+			return false, nil
+		}
+	}
+
+	var pages []string
+	if around >= 0 {
+		pages = conversation.PrintBranchPages(around, opts)
+	} else {
+		pages = conversation.PrintTreePages(opts)
+	}
+	if page < 1 || page > len(pages) {
+		fmt.Printf("page %d does not exist, there are %d pages\n", page, len(pages))
+		return false, nil
+	}
+	fmt.Print(pages[page-1])
+	if len(pages) > 1 {
+		fmt.Printf("[page %d of %d]\n", page, len(pages))
+	}
+	return false, nil
+}
+
 func handleArtifacting(conversation brunch.Conversation, parts []string) (bool, error) {
 
 	artifacts := conversation.Artifacts()
@@ -494,3 +1579,104 @@ func infoCbDescribeChat(data string) {
 	fmt.Println("Chat:")
 	fmt.Println("\t", data)
 }
+
+func infoCbHistory(statements []string) {
+	fmt.Println("History:")
+	for idx, stmt := range statements {
+		fmt.Printf("\t%d:\t%s\n", idx, stmt)
+	}
+}
+
+func infoCbWhereUsed(name string, usage []brunch.ResourceUsage) {
+	if len(usage) == 0 {
+		fmt.Printf("%s is not used by any chat\n", name)
+		return
+	}
+	fmt.Printf("%s is used by:\n", name)
+	for _, u := range usage {
+		as := []string{}
+		if u.Provider {
+			as = append(as, "provider")
+		}
+		if u.Context {
+			as = append(as, "context")
+		}
+		fmt.Printf("\t%-20s %-18s %d nodes\n", u.Chat, strings.Join(as, ","), u.Nodes)
+	}
+}
+
+func infoCbCheckContext(health brunch.ContextHealth) {
+	if !health.Healthy {
+		fmt.Printf("%s (%s %s) is broken: %s\n", health.Name, health.Type, health.Value, health.Problem)
+		return
+	}
+	fmt.Printf("%s (%s %s) is healthy\n", health.Name, health.Type, health.Value)
+	if health.Files > 0 {
+		fmt.Printf("\tfiles:   %d\n", health.Files)
+	}
+	if health.Size > 0 {
+		fmt.Printf("\tsize:    %d bytes\n", health.Size)
+	}
+	if !health.Updated.IsZero() {
+		fmt.Printf("\tupdated: %s (%s ago)\n", health.Updated.Format(time.RFC3339), time.Since(health.Updated).Round(time.Second))
+	}
+	if health.Latency > 0 {
+		fmt.Printf("\tlatency: %s\n", health.Latency.Round(time.Millisecond))
+	}
+}
+
+func infoCbFsck(report brunch.VerifyReport) {
+	if report.Healthy() {
+		fmt.Printf("checked %d chats, no problems found\n", report.Checked)
+		return
+	}
+	fmt.Printf("checked %d chats, %d problems found\n", report.Checked, len(report.Problems))
+	for _, problem := range report.Problems {
+		switch {
+		case problem.Quarantined:
+			fmt.Printf("\t%s: %s (quarantined)\n", problem.Chat, problem.Problem)
+		case problem.Corrupt:
+			fmt.Printf("\t%s: %s (corrupt, \\fsck :quarantine true moves it out of the chat store)\n", problem.Chat, problem.Problem)
+		default:
+			fmt.Printf("\t%s: %s\n", problem.Chat, problem.Problem)
+		}
+	}
+}
+
+func infoCbTrash(items []brunch.TrashedItem) {
+	if len(items) == 0 {
+		fmt.Println("the trash is empty")
+		return
+	}
+	for _, item := range items {
+		fmt.Printf("\t%-20s %-9s deleted %s  id %s\n", item.Name, item.Kind, item.DeletedAt.Format(time.DateTime), item.ID)
+	}
+}
+
+func infoCbUsage(report brunch.UsageReport) {
+	if report.Total.Messages == 0 {
+		fmt.Println("no token usage recorded")
+		return
+	}
+	printEntry := func(entry brunch.UsageEntry) {
+		cost := "-"
+		if entry.Priced {
+			cost = fmt.Sprintf("$%.4f", entry.Cost)
+		}
+		estimated := ""
+		if entry.Estimated > 0 {
+			estimated = fmt.Sprintf(" (%d estimated)", entry.Estimated)
+		}
+		fmt.Printf("\t%s: %d messages%s, %d in, %d out, %s\n",
+			entry.Name, entry.Messages, estimated, entry.InputTokens, entry.OutputTokens, cost)
+	}
+	fmt.Println("chats:")
+	for _, entry := range report.Chats {
+		printEntry(entry)
+	}
+	fmt.Println("providers:")
+	for _, entry := range report.Providers {
+		printEntry(entry)
+	}
+	printEntry(report.Total)
+}
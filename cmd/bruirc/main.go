@@ -0,0 +1,377 @@
+/*
+This is an IRC bridge for a brunch install. It joins a channel and exposes a single chat to it
+so that people on a self-hosted network can talk to the chat and move around its tree.
+
+Messages addressed to the bot ("nick: message") are submitted to the chat, and the response is
+posted back into the channel. They are answered one at a time off the connection's read loop, so
+the bridge keeps answering the server while a reply is being generated. Messages starting with '!' are commands for navigating the tree and
+saving it, see !help.
+
+Each channel gets its own core session so the bridge can be restarted and resume where it was.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bosley/brunch"
+	"github.com/bosley/brunch/anthropic"
+)
+
+// IRC servers will cut us off if we send too much too quickly, and lines over 512
+// bytes (including the command) are truncated by the server
+const (
+	sendDelay     = 500 * time.Millisecond
+	maxLineLength = 400
+	maxReplyLines = 40
+)
+
+// Messages and commands waiting for the chat, more than this and they are turned away
+const workQueue = 8
+
+type bridge struct {
+	conn    net.Conn
+	writer  *bufio.Writer
+	sendMu  sync.Mutex
+	nick    string
+	channel string
+
+	// What is done to the chat, in the order it was asked for, see enqueue
+	work chan func()
+
+	core         *brunch.Core
+	sessionId    string
+	conversation brunch.Conversation
+}
+
+// A message received from the server, in the form ":prefix COMMAND params :trailing"
+type ircMessage struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+func main() {
+	loadDir := flag.String("load", filepath.Join(os.TempDir(), "brunch"), "brunch install directory")
+	server := flag.String("server", "localhost:6667", "IRC server address")
+	useTls := flag.Bool("tls", false, "Connect to the IRC server with TLS")
+	nick := flag.String("nick", "brunch", "Nickname for the bridge")
+	channel := flag.String("channel", "#brunch", "Channel to join")
+	chatName := flag.String("chat", "irc", "Name of the chat to expose to the channel")
+	provider := flag.String("provider", "anthropic", "Provider used if the chat has to be created")
+	flag.Parse()
+
+	b := &bridge{
+		nick:      *nick,
+		channel:   *channel,
+		sessionId: fmt.Sprintf("irc-%s", strings.TrimPrefix(*channel, "#")),
+		work:      make(chan func(), workQueue),
+	}
+
+	anthropicProvider, err := anthropic.InitialAnthropicProvider()
+	if err != nil {
+		slog.Error("failed to create anthropic provider", "error", err)
+		os.Exit(1)
+	}
+
+	b.core = brunch.NewCore(brunch.CoreOpts{
+		InstallDirectory: *loadDir,
+		BaseProviders: map[string]brunch.Provider{
+			"anthropic": anthropicProvider,
+		},
+		InfoHandler: brunch.InformationCallback{
+			OnListChats:       func([]string) {},
+			OnListProviders:   func([]string) {},
+			OnListContexts:    func([]string) {},
+			OnDescribeContext: func(string) {},
+			OnDescribeChat:    func(string) {},
+			OnHistory:         func([]string) {},
+			OnWhereUsed:       func(string, []brunch.ResourceUsage) {},
+			OnCheckContext:    func(brunch.ContextHealth) {},
+			OnFsck:            func(brunch.VerifyReport) {},
+			OnUsage:           func(brunch.UsageReport) {},
+			OnTrash:           func([]brunch.TrashedItem) {},
+		},
+		ChatStartHandler: func(conversation brunch.Conversation) error {
+			b.conversation = conversation
+			return nil
+		},
+	})
+
+	if err := b.openChat(*chatName, *provider); err != nil {
+		slog.Error("failed to open chat", "chat", *chatName, "error", err)
+		os.Exit(1)
+	}
+
+	var conn net.Conn
+	if *useTls {
+		conn, err = tls.Dial("tcp", *server, &tls.Config{})
+	} else {
+		conn, err = net.Dial("tcp", *server)
+	}
+	if err != nil {
+		slog.Error("failed to connect", "server", *server, "error", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	b.conn = conn
+	b.writer = bufio.NewWriter(conn)
+
+	if err := b.run(); err != nil {
+		slog.Error("bridge stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+// Load the chat into the channel's session, creating the chat first if this is a new install
+func (b *bridge) openChat(name string, provider string) error {
+	if !b.core.IsInstalled() {
+		if err := b.core.Install(); err != nil {
+			return err
+		}
+	} else {
+		if err := b.core.LoadProviders(); err != nil {
+			return err
+		}
+		if err := b.core.LoadContexts(); err != nil {
+			return err
+		}
+	}
+
+	if conversation, err := b.core.ResumeSession(b.sessionId); err == nil && conversation != nil {
+		b.conversation = conversation
+		return nil
+	}
+
+	load := brunch.NewStatement(fmt.Sprintf(`\chat "%s"`, name))
+	if err := b.core.ExecuteStatement(b.sessionId, load); err == nil {
+		return nil
+	}
+
+	create := brunch.NewStatement(fmt.Sprintf(`\new-chat "%s" :provider "%s"`, name, provider))
+	if err := b.core.ExecuteStatement(b.sessionId, create); err != nil {
+		return err
+	}
+	return b.core.ExecuteStatement(b.sessionId, brunch.NewStatement(fmt.Sprintf(`\chat "%s"`, name)))
+}
+
+func (b *bridge) run() error {
+	b.send("NICK %s", b.nick)
+	b.send("USER %s 0 * :brunch bridge", b.nick)
+
+	go func() {
+		for job := range b.work {
+			job()
+		}
+	}()
+	defer close(b.work)
+
+	reader := bufio.NewReader(b.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		msg := parseMessage(strings.TrimRight(line, "\r\n"))
+
+		switch msg.command {
+		case "PING":
+			b.send("PONG :%s", strings.Join(msg.params, " "))
+		case "001":
+			// Registered with the server
+			b.send("JOIN %s", b.channel)
+		case "433":
+			// Nickname in use
+			b.nick = b.nick + "_"
+			b.send("NICK %s", b.nick)
+		case "PRIVMSG":
+			if len(msg.params) < 2 || msg.params[0] != b.channel {
+				continue
+			}
+			b.handle(strings.TrimSpace(msg.params[1]))
+		}
+	}
+}
+
+func parseMessage(line string) ircMessage {
+	msg := ircMessage{}
+	if strings.HasPrefix(line, ":") {
+		msg.prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+
+	var trailing string
+	hasTrailing := false
+	if idx := strings.Index(line, " :"); idx >= 0 {
+		trailing = line[idx+2:]
+		line = line[:idx]
+		hasTrailing = true
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		msg.command = fields[0]
+		msg.params = fields[1:]
+	}
+	if hasTrailing {
+		msg.params = append(msg.params, trailing)
+	}
+	return msg
+}
+
+func (b *bridge) handle(text string) {
+	if strings.HasPrefix(text, "!") {
+		parts := strings.Fields(text[1:])
+		b.enqueue(func() { b.handleCommand(parts) })
+		return
+	}
+
+	for _, sep := range []string{":", ","} {
+		if rest, ok := strings.CutPrefix(text, b.nick+sep); ok {
+			message := strings.TrimSpace(rest)
+			b.enqueue(func() { b.submit(message) })
+			return
+		}
+	}
+}
+
+// Hand the job to the worker. Generating a reply takes a while and the read loop has to keep
+// answering PINGs, or the server drops the connection. Commands wait their turn as well, so
+// they don't move around the tree while a message is being answered
+func (b *bridge) enqueue(job func()) {
+	select {
+	case b.work <- job:
+	default:
+		b.say("busy, try again in a moment")
+	}
+}
+
+func (b *bridge) submit(message string) {
+	if message == "" {
+		return
+	}
+	response, err := b.conversation.SubmitMessage(message)
+	if err != nil {
+		b.say(fmt.Sprintf("error: %v", err))
+		return
+	}
+	b.say(response)
+	b.say(fmt.Sprintf("[%s]", b.currentHash()))
+}
+
+func (b *bridge) handleCommand(parts []string) {
+	if len(parts) == 0 {
+		return
+	}
+
+	var err error
+	switch parts[0] {
+	case "help":
+		b.say("!where | !children | !child <idx> | !parent | !root | !goto <hash> | !snapshot")
+		b.say(fmt.Sprintf("address me (%s: message) to talk to the chat", b.nick))
+		return
+	case "where":
+	case "children":
+		summaries := b.conversation.ChildSummaries()
+		children := b.conversation.ListChildren()
+		if len(children) == 0 {
+			b.say("no children")
+			return
+		}
+		lines := []string{}
+		for idx, child := range children {
+			line := fmt.Sprintf("%d: %s %s %s", idx, child.ShortHash, child.Time.Format("15:04"), child.Preview)
+			if summary := summaries[child.Hash]; summary != "" {
+				line += " (" + summary + ")"
+			}
+			lines = append(lines, line)
+		}
+		b.say(strings.Join(lines, "\n"))
+		return
+	case "child":
+		if len(parts) < 2 {
+			b.say("usage: !child <idx>")
+			return
+		}
+		var idx int
+		idx, err = strconv.Atoi(parts[1])
+		if err == nil {
+			err = b.conversation.Child(idx)
+		}
+	case "parent":
+		err = b.conversation.Parent()
+	case "root":
+		err = b.conversation.Root()
+	case "goto":
+		if len(parts) < 2 {
+			b.say("usage: !goto <hash>")
+			return
+		}
+		err = b.conversation.Goto(parts[1])
+	case "snapshot":
+		if err = b.core.SaveActiveChat(b.sessionId); err == nil {
+			b.say("snapshot saved")
+		}
+	default:
+		b.say("unknown command, try !help")
+		return
+	}
+
+	if err != nil {
+		b.say(fmt.Sprintf("error: %v", err))
+		return
+	}
+	b.say(fmt.Sprintf("[%s]", b.currentHash()))
+}
+
+func (b *bridge) currentHash() string {
+	return brunch.ShortHash(b.conversation.CurrentNode().Hash())
+}
+
+// Post text to the channel, splitting it into lines that IRC can carry
+func (b *bridge) say(text string) {
+	sent := 0
+	for _, line := range strings.Split(text, "\n") {
+		for len(line) > 0 {
+			if sent == maxReplyLines {
+				b.send("PRIVMSG %s :... (truncated)", b.channel)
+				return
+			}
+			chunk := line
+			if len(chunk) > maxLineLength {
+				cut := maxLineLength
+				for cut > 0 && !utf8.RuneStart(line[cut]) {
+					cut--
+				}
+				chunk = chunk[:cut]
+			}
+			line = line[len(chunk):]
+			b.send("PRIVMSG %s :%s", b.channel, chunk)
+			sent++
+		}
+	}
+}
+
+// Safe to call from the read loop and the worker at once, lines of a reply may have a PONG between them
+func (b *bridge) send(format string, args ...interface{}) {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	fmt.Fprintf(b.writer, format+"\r\n", args...)
+	if err := b.writer.Flush(); err != nil {
+		slog.Error("failed to send to server", "error", err)
+	}
+	time.Sleep(sendDelay)
+}
@@ -0,0 +1,60 @@
+package brunch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCore_CompanionProvider(t *testing.T) {
+	core := newTestCore(t)
+
+	require.Error(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "main" :host "mock" :companion "cheap"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "cheap" :host "mock" :system-prompt "be cheap"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "main" :host "mock" :companion "cheap"`)))
+	assert.Equal(t, "cheap", core.providers["main"].Settings().Companion)
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "main"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+
+	_, err = chat.SubmitMessage("hello")
+	require.NoError(t, err)
+
+	// Summaries go to the companion rather than the chat's provider
+	companion := &recordingProvider{mockProvider: newMockProvider("cheap")}
+	core.providers["cheap"] = companion
+	_, err = chat.Summarize(SummaryForTitle)
+	require.NoError(t, err)
+	assert.Equal(t, 1, companion.calls)
+
+	usage := chat.Usage()
+	assert.Equal(t, 1, usage.Main.Calls)
+	assert.Equal(t, 1, usage.Auxiliary.Calls)
+	assert.Greater(t, usage.Main.Tokens, 0)
+	assert.Greater(t, usage.Auxiliary.Tokens, 0)
+
+	// The companion can't be deleted out from under the provider using it
+	assert.ErrorContains(t, core.ExecuteStatement("s1", NewStatement(`\del-provider "cheap"`)), "companion of provider main")
+}
+
+func TestCore_RenameCompanionProvider(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "cheap" :host "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "main" :host "mock" :companion "cheap"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\rename-provider "cheap" :to "cheaper"`)))
+	assert.Equal(t, "cheaper", core.providers["main"].Settings().Companion)
+}
+
+type recordingProvider struct {
+	*mockProvider
+	calls int
+}
+
+func (rp *recordingProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	rp.calls++
+	return rp.mockProvider.ExtendFrom(ctx, node)
+}
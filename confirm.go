@@ -0,0 +1,108 @@
+package brunch
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// How long a confirmation token can be sent back for
+const confirmationLifetime = 5 * time.Minute
+
+// ConfirmationRequiredError is returned when one of the DestructiveCommands has to be confirmed. Sending
+// the same statement again, from the same session, with `:confirm "<token>"` executes it
+type ConfirmationRequiredError struct {
+	Command string
+	Name    string
+	Token   string
+}
+
+func (e *ConfirmationRequiredError) Error() string {
+	return fmt.Sprintf("%s %q has to be confirmed, send it again with :confirm %q", e.Command, e.Name, e.Token)
+}
+
+// A token handed out for one statement in one session. It can only be used once
+type pendingConfirmation struct {
+	session string
+	command string
+	name    string
+	expires time.Time
+}
+
+func newConfirmationToken() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Let the statement through if it isn't destructive, confirmations are off, or it carries the token
+// it was challenged with. Otherwise challenge it with a new token
+func (c *Core) checkConfirmation(sessionId string, stmt *Statement) error {
+	if !c.confirmDestructive {
+		return nil
+	}
+	if !stmt.IsPrepared() {
+		if err := stmt.Prepare(); err != nil {
+			return err
+		}
+	}
+	command := statementCommand(stmt)
+	if !slices.Contains(DestructiveCommands, command) {
+		return nil
+	}
+
+	c.confirmMu.Lock()
+	defer c.confirmMu.Unlock()
+
+	now := time.Now()
+	for token, pending := range c.confirmations {
+		if now.After(pending.expires) {
+			delete(c.confirmations, token)
+		}
+	}
+
+	if prop, given := stmt.cmd.properties["confirm"]; given {
+		pending, exists := c.confirmations[prop.prop]
+		if exists && pending.session == sessionId && pending.command == command && pending.name == stmt.cmd.nameGiven {
+			delete(c.confirmations, prop.prop)
+			return nil
+		}
+	}
+
+	token, err := newConfirmationToken()
+	if err != nil {
+		return fmt.Errorf("failed to create a confirmation token: %w", err)
+	}
+	c.confirmations[token] = pendingConfirmation{
+		session: sessionId,
+		command: command,
+		name:    stmt.cmd.nameGiven,
+		expires: now.Add(confirmationLifetime),
+	}
+	return &ConfirmationRequiredError{
+		Command: command,
+		Name:    stmt.cmd.nameGiven,
+		Token:   token,
+	}
+}
+
+// The statement as it goes into the history, without the token that confirmed it. A token is
+// only good once, so a replay of the statement is challenged again
+func withoutConfirmation(stmt *Statement) string {
+	content := strings.TrimSpace(stmt.content)
+	if stmt.cmd == nil {
+		return content
+	}
+	prop, given := stmt.cmd.properties["confirm"]
+	if !given {
+		return content
+	}
+	confirm := regexp.MustCompile(`\s*:confirm\s+"` + regexp.QuoteMeta(prop.prop) + `"`)
+	return strings.TrimSpace(confirm.ReplaceAllString(content, ""))
+}
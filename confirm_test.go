@@ -0,0 +1,79 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCore_ConfirmDestructive(t *testing.T) {
+	core := newTestCore(t)
+	chatFile := core.installDirectory + "/" + chatStoreDirectory + "/a.json"
+
+	// Off by default
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\del-chat "a"`)))
+	assert.NoFileExists(t, chatFile)
+
+	core.confirmDestructive = true
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+
+	err := core.ExecuteStatement("s1", NewStatement(`\del-chat "a"`))
+	var challenge *ConfirmationRequiredError
+	require.True(t, errors.As(err, &challenge))
+	assert.Equal(t, "del-chat", challenge.Command)
+	assert.Equal(t, "a", challenge.Name)
+	assert.FileExists(t, chatFile)
+
+	// Only the session it was given to can use the token, and only for the same statement
+	err = core.ExecuteStatement("s2", NewStatement(fmt.Sprintf(`\del-chat "a" :confirm %q`, challenge.Token)))
+	assert.ErrorAs(t, err, new(*ConfirmationRequiredError))
+	err = core.ExecuteStatement("s1", NewStatement(fmt.Sprintf(`\del-ctx "a" :confirm %q`, challenge.Token)))
+	assert.ErrorAs(t, err, new(*ConfirmationRequiredError))
+	err = core.ExecuteStatement("s1", NewStatement(`\del-chat "a" :confirm "nope"`))
+	assert.ErrorAs(t, err, new(*ConfirmationRequiredError))
+	assert.FileExists(t, chatFile)
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(fmt.Sprintf(`\del-chat "a" :confirm %q`, challenge.Token))))
+	assert.NoFileExists(t, chatFile)
+
+	// Tokens are used up
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	err = core.ExecuteStatement("s1", NewStatement(fmt.Sprintf(`\del-chat "a" :confirm %q`, challenge.Token)))
+	assert.ErrorAs(t, err, new(*ConfirmationRequiredError))
+	assert.FileExists(t, chatFile)
+
+	// Overwriting a chat has to be confirmed like deleting it
+	err = core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock" :overwrite true`))
+	require.True(t, errors.As(err, &challenge))
+	assert.Equal(t, OverwriteChatCommand, challenge.Command)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(fmt.Sprintf(`\new-chat "a" :provider "mock" :overwrite true :confirm %q`, challenge.Token))))
+
+	// Nothing else has to be confirmed
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\list-chat`)))
+}
+
+func TestCore_ConfirmationHistory(t *testing.T) {
+	core := newTestCore(t)
+	core.confirmDestructive = true
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+
+	var challenge *ConfirmationRequiredError
+	require.True(t, errors.As(core.ExecuteStatement("s1", NewStatement(`\del-chat "a"`)), &challenge))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(fmt.Sprintf(`\del-chat "a" :confirm %q`, challenge.Token))))
+
+	// The token isn't kept, it was used up
+	history := core.sessions["s1"].history
+	require.Len(t, history, 2)
+	assert.Equal(t, `\del-chat "a"`, history[1])
+
+	// Replaying it asks for a confirmation of its own
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\replay 0`)))
+	err := core.ExecuteStatement("s1", NewStatement(`\replay 1`))
+	require.True(t, errors.As(err, &challenge))
+	assert.Equal(t, "del-chat", challenge.Command)
+	assert.True(t, core.ChatExists("a"))
+}
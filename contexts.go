@@ -0,0 +1,295 @@
+package brunch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Check that what the context points at is there. This is cheap enough to do on every load,
+// the web and database contexts are only checked to be well formed
+func (ctx ContextSettings) checkResource() error {
+	switch ctx.Type {
+	case ContextTypeDirectory:
+		info, err := os.Stat(ctx.Value)
+		if err != nil {
+			return fmt.Errorf("directory %s is not available: %w", ctx.Value, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", ctx.Value)
+		}
+	case ContextTypeWeb:
+		u, err := url.Parse(ctx.Value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%s is not a url", ctx.Value)
+		}
+	case ContextTypeDatabase:
+		if ctx.Value == "" {
+			return errors.New("database connection string is empty")
+		}
+	}
+	return nil
+}
+
+// Attach a context the chat was saved with
+func (c *chatInstance) attachSavedContext(ctxName string) error {
+	ctx, exists := c.core.contexts[ctxName]
+	if !exists {
+		return fmt.Errorf("context %s not found in available contexts", ctxName)
+	}
+	if err := ctx.checkResource(); err != nil {
+		return fmt.Errorf("context %s: %w", ctxName, err)
+	}
+	if err := c.attachKnowledge(ctx); err != nil {
+		return fmt.Errorf("failed to attach context %s: %w", ctxName, err)
+	}
+	c.contexts[ctxName] = ctx
+	return nil
+}
+
+// The contexts the chat was saved with that couldn't be attached when it was loaded, and why.
+// They stay part of the chat until they are re-pointed or detached
+func (c *chatInstance) UnavailableContexts() map[string]string {
+	unavailable := make(map[string]string, len(c.unavailableContexts))
+	for name, reason := range c.unavailableContexts {
+		unavailable[name] = reason
+	}
+	return unavailable
+}
+
+// Point a context at somewhere else (the directory moved, the url changed) and attach it. The
+// context is changed for every chat that uses it
+func (c *chatInstance) RepointContext(ctxName string, value string) error {
+	if err := c.core.repointContext(ctxName, value); err != nil {
+		return err
+	}
+	if err := c.attachSavedContext(ctxName); err != nil {
+		return err
+	}
+	delete(c.unavailableContexts, ctxName)
+	return nil
+}
+
+// Stop using a context. Providers that attach contexts themselves can't let go of one, so it is
+// still known to such a provider until the chat is next loaded
+func (c *chatInstance) DetachContext(ctxName string) error {
+	_, attached := c.contexts[ctxName]
+	_, unavailable := c.unavailableContexts[ctxName]
+	if !attached && !unavailable {
+		return fmt.Errorf("context %s is not attached", ctxName)
+	}
+	delete(c.contexts, ctxName)
+	delete(c.unavailableContexts, ctxName)
+	delete(c.knowledge, ctxName)
+	return nil
+}
+
+func (c *Core) repointContext(name string, value string) error {
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+	ctx, exists := c.contexts[name]
+	if !exists {
+		return fmt.Errorf("context %s does not exist", name)
+	}
+
+	repointed := *ctx
+	repointed.Value = value
+	if err := repointed.checkResource(); err != nil {
+		return err
+	}
+	content, err := json.Marshal(repointed)
+	if err != nil {
+		return err
+	}
+	if err := c.AddToContextStore(fmt.Sprintf("%s.json", name), string(content)); err != nil {
+		return err
+	}
+	c.contexts[name] = &repointed
+	return nil
+}
+
+// How long a web or database context has to answer a health check
+const contextCheckTimeout = 5 * time.Second
+
+// What a health check found out about a context's backing resource. The size and freshness are
+// whatever the resource can tell, a web page only has them if the server sends them
+type ContextHealth struct {
+	Name    string        `json:"name"`
+	Type    ContextType   `json:"type"`
+	Value   string        `json:"value"`
+	Healthy bool          `json:"healthy"`
+	Problem string        `json:"problem,omitempty"`
+	Files   int           `json:"files,omitempty"`
+	Size    int64         `json:"size,omitempty"`    // bytes
+	Updated time.Time     `json:"updated"`           // the newest file, or the page's last modification
+	Latency time.Duration `json:"latency,omitempty"` // how long the web or database took to answer
+}
+
+// Check the named context's backing resource. Only a context that doesn't exist is an error,
+// a resource that can't be reached is reported in the health. Web and database checks stop
+// when the context is cancelled
+func (c *Core) CheckContext(ctx context.Context, name string) (ContextHealth, error) {
+	c.ctxMu.Lock()
+	settings, exists := c.contexts[name]
+	c.ctxMu.Unlock()
+	if !exists {
+		return ContextHealth{}, fmt.Errorf("context %s does not exist", name)
+	}
+
+	health := ContextHealth{
+		Name:  settings.Name,
+		Type:  settings.Type,
+		Value: settings.Value,
+	}
+	var err error
+	switch settings.Type {
+	case ContextTypeDirectory:
+		err = checkDirectory(&health)
+	case ContextTypeWeb:
+		err = checkWeb(ctx, &health)
+	case ContextTypeDatabase:
+		err = checkDatabase(ctx, &health)
+	default:
+		err = fmt.Errorf("unknown context type %s", settings.Type)
+	}
+	if err != nil {
+		health.Problem = err.Error()
+	} else {
+		health.Healthy = true
+	}
+	return health, nil
+}
+
+// Every file under the directory has to be readable
+func checkDirectory(health *ContextHealth) error {
+	if err := (ContextSettings{Type: ContextTypeDirectory, Value: health.Value}).checkResource(); err != nil {
+		return err
+	}
+	return filepath.WalkDir(health.Value, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s is not readable: %w", path, err)
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("%s is not readable: %w", path, err)
+		}
+		health.Files++
+		health.Size += info.Size()
+		if info.ModTime().After(health.Updated) {
+			health.Updated = info.ModTime()
+		}
+		return nil
+	})
+}
+
+func checkWeb(ctx context.Context, health *ContextHealth) error {
+	if err := (ContextSettings{Type: ContextTypeWeb, Value: health.Value}).checkResource(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, health.Value, nil)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid url: %w", health.Value, err)
+	}
+	client := http.Client{Timeout: contextCheckTimeout}
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s is not reachable: %w", health.Value, err)
+	}
+	defer resp.Body.Close()
+	health.Latency = time.Since(started)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s answered %s", health.Value, resp.Status)
+	}
+	if resp.ContentLength > 0 {
+		health.Size = resp.ContentLength
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		health.Updated = modified
+	}
+	return nil
+}
+
+// There are no database drivers here, so a database is healthy if its server accepts a
+// connection. A database that is a file (sqlite) only has to exist
+func checkDatabase(ctx context.Context, health *ContextHealth) error {
+	path := strings.TrimPrefix(health.Value, "file:")
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		health.Files = 1
+		health.Size = info.Size()
+		health.Updated = info.ModTime()
+		return nil
+	}
+
+	address, err := databaseAddress(health.Value)
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	dialer := net.Dialer{Timeout: contextCheckTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("database at %s is not reachable: %w", address, err)
+	}
+	conn.Close()
+	health.Latency = time.Since(started)
+	return nil
+}
+
+var defaultDatabasePorts = map[string]string{
+	"postgres":   "5432",
+	"postgresql": "5432",
+	"mysql":      "3306",
+	"mongodb":    "27017",
+	"redis":      "6379",
+}
+
+// Find the host and port in the common forms of connection string: a url
+// (postgres://user@host:5432/db), mysql's user@tcp(host:3306)/db, or key=value pairs
+// (host=localhost port=5432)
+func databaseAddress(dsn string) (string, error) {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.Host != "" {
+		if u.Port() != "" {
+			return u.Host, nil
+		}
+		port, known := defaultDatabasePorts[u.Scheme]
+		if !known {
+			return "", fmt.Errorf("no port given for %s database", u.Scheme)
+		}
+		return net.JoinHostPort(u.Hostname(), port), nil
+	}
+
+	if _, rest, found := strings.Cut(dsn, "@tcp("); found {
+		address, _, found := strings.Cut(rest, ")")
+		if found && address != "" {
+			return address, nil
+		}
+	}
+
+	host, port := "", defaultDatabasePorts["postgres"]
+	for _, field := range strings.Fields(dsn) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "host":
+			host = value
+		case "port":
+			port = value
+		}
+	}
+	if host == "" {
+		return "", errors.New("could not find a host in the database connection string")
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,126 @@
+package brunch
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChat_DegradedContextLoad(t *testing.T) {
+	core := newTestCore(t)
+	dir := filepath.Join(t.TempDir(), "docs")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-ctx "docs" :dir "`+dir+`"`)))
+
+	chat := newBranchTestChat(t, core, "a")
+	require.NoError(t, chat.AttachContext("docs"))
+	require.NoError(t, core.writeSnapshot("a", chat))
+
+	// The directory goes away, so the chat can't be loaded as it was
+	require.NoError(t, os.Remove(dir))
+	delete(core.activeChats, "a")
+	_, err := core.loadChat("a", nil)
+	assert.ErrorContains(t, err, "context docs")
+
+	// Unless the core is loading what it can
+	core.degradedContextLoad = true
+	loaded, err := core.loadChat("a", nil)
+	require.NoError(t, err)
+	assert.Empty(t, loaded.ListKnowledgeContexts())
+	assert.Contains(t, loaded.UnavailableContexts(), "docs")
+
+	// It is still part of the chat until something is done about it
+	snapshot, err := loaded.Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs"}, snapshot.Contexts)
+
+	assert.Error(t, loaded.RepointContext("docs", filepath.Join(t.TempDir(), "missing")))
+	moved := t.TempDir()
+	require.NoError(t, loaded.RepointContext("docs", moved))
+	assert.Empty(t, loaded.UnavailableContexts())
+	assert.Equal(t, []string{"docs"}, loaded.ListKnowledgeContexts())
+	assert.Equal(t, moved, core.contexts["docs"].Value)
+
+	require.NoError(t, loaded.DetachContext("docs"))
+	assert.Empty(t, loaded.ListKnowledgeContexts())
+	assert.Error(t, loaded.DetachContext("docs"))
+	snapshot, err = loaded.Snapshot()
+	require.NoError(t, err)
+	assert.Empty(t, snapshot.Contexts)
+}
+
+func TestCore_CheckContext(t *testing.T) {
+	core := newTestCore(t)
+	exec := func(stmt string) error { return core.ExecuteStatement("s1", NewStatement(stmt)) }
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("world!"), 0644))
+	require.NoError(t, exec(`\new-ctx "docs" :dir "`+dir+`"`))
+
+	var reported ContextHealth
+	core.infoHandler.OnCheckContext = func(health ContextHealth) { reported = health }
+	require.NoError(t, exec(`\check-ctx "docs"`))
+	assert.True(t, reported.Healthy)
+	assert.Equal(t, 2, reported.Files)
+	assert.Equal(t, int64(11), reported.Size)
+	assert.False(t, reported.Updated.IsZero())
+
+	assert.Error(t, exec(`\check-ctx "nope"`))
+
+	require.NoError(t, exec(`\new-ctx "gone" :dir "`+filepath.Join(dir, "missing")+`"`))
+	health, err := core.CheckContext(context.Background(), "gone")
+	require.NoError(t, err)
+	assert.False(t, health.Healthy)
+	assert.Contains(t, health.Problem, "not available")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	}))
+	defer server.Close()
+	require.NoError(t, exec(`\new-ctx "site" :web "`+server.URL+`"`))
+	health, err = core.CheckContext(context.Background(), "site")
+	require.NoError(t, err)
+	assert.True(t, health.Healthy)
+	assert.Equal(t, 2006, health.Updated.Year())
+	require.NoError(t, exec(`\new-ctx "broken-site" :web "`+server.URL+`/missing"`))
+	health, err = core.CheckContext(context.Background(), "broken-site")
+	require.NoError(t, err)
+	assert.False(t, health.Healthy)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	require.NoError(t, exec(`\new-ctx "db" :database "postgres://user@`+listener.Addr().String()+`/app"`))
+	health, err = core.CheckContext(context.Background(), "db")
+	require.NoError(t, err)
+	assert.True(t, health.Healthy, health.Problem)
+}
+
+func TestDatabaseAddress(t *testing.T) {
+	for dsn, expected := range map[string]string{
+		"postgres://user:pw@db.local:6543/app":  "db.local:6543",
+		"postgres://user@db.local/app":          "db.local:5432",
+		"user:pw@tcp(127.0.0.1:3306)/app":       "127.0.0.1:3306",
+		"host=db.local port=6000 dbname=app":    "db.local:6000",
+		"host=db.local dbname=app sslmode=none": "db.local:5432",
+	} {
+		address, err := databaseAddress(dsn)
+		require.NoError(t, err, dsn)
+		assert.Equal(t, expected, address, dsn)
+	}
+	_, err := databaseAddress("dbname=app")
+	assert.Error(t, err)
+}
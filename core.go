@@ -1,13 +1,18 @@
 package brunch
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -26,8 +31,12 @@ const (
 // branchable chats
 type Core struct {
 	installDirectory string
-	providers        map[string]Provider
-	provMu           sync.Mutex
+
+	// The directory of each store, keyed by the store's name
+	stores map[string]string
+
+	providers map[string]Provider
+	provMu    sync.Mutex
 
 	sessions map[string]*coreSession
 	sesMu    sync.Mutex
@@ -35,20 +44,159 @@ type Core struct {
 	activeChats map[string]*chatInstance
 	chatMu      sync.Mutex
 
+	// Held while a chat's name is checked and the chat is written, so two sessions creating
+	// a chat with the same name can't both find it free
+	chatNameMu sync.Mutex
+
 	baseProviders map[string]Provider
 
 	contexts map[string]*ContextSettings
 	ctxMu    sync.Mutex
 
+	refs referenceIndex
+
+	// Held to write snapshots (shared) and to collect the blobs they refer to, see blobs.go
+	blobMu sync.RWMutex
+
+	// Rate limits of the providers that have one, by provider name
+	limiters map[string]*rateLimiter
+	limitMu  sync.Mutex
+
+	// Guards the profile file in the data-store
+	profileMu sync.Mutex
+
+	// Guards the activity log in the data-store
+	activityMu sync.Mutex
+
+	// Guards the workspaces file in the data-store
+	workspaceMu sync.Mutex
+
+	// The tools offered to chats, see tools.go
+	tools   map[string]Tool
+	toolsMu sync.Mutex
+
+	// Whether providers' HTTP calls are logged, see raw.go
+	rawLogging atomic.Bool
+
+	// The key chat environments are sealed with, see env.go
+	envKey   []byte
+	envKeyMu sync.Mutex
+
 	chatStartHandler CoreChatStartHandler
 	infoHandler      InformationCallback
+	authorize        StatementAuthorizer
+	summarizer       Summarizer
+	logger           *slog.Logger
+	trashRetention   time.Duration
+
+	// Tokens handed out for destructive statements waiting to be confirmed
+	confirmDestructive bool
+	confirmations      map[string]pendingConfirmation
+	confirmMu          sync.Mutex
+
+	degradedContextLoad bool
+	compactOnOverflow   bool
+	chunkedInputTokens  int
+	requestTimeout      time.Duration
+	prices              map[string]TokenPrice
+	treeLimits          TreeLimits
+	embedder            Embedder
+	vectors             VectorStore
+
+	// Messages that can't reach the provider are queued, see pending.go
+	queueOffline bool
+
+	// What is done about secrets in what is sent, see secrets.go
+	secrets        SecretPolicy
+	secretPatterns []SecretPattern
 }
 
 type CoreOpts struct {
+	// Optional. Without it, and without a path for a store, the store goes under the XDG data
+	// directory ($XDG_DATA_HOME/brunch), or the XDG config directory for the provider-store
 	InstallDirectory string
+
+	// Optional. Puts individual stores somewhere other than the install directory
+	StorePaths StorePaths
+
 	BaseProviders    map[string]Provider
 	ChatStartHandler CoreChatStartHandler
 	InfoHandler      InformationCallback
+
+	// Optional. When set, every statement is checked with it before it is executed
+	Authorize StatementAuthorizer
+
+	// Optional. Used by every chat for summaries instead of the chat's own provider
+	Summarizer Summarizer
+
+	// Optional. Everything the core and its chats have to say goes here instead of
+	// slog's default logger
+	Logger *slog.Logger
+
+	// Optional. How long deleted chats, providers and contexts can be restored for,
+	// DefaultTrashRetention when not set
+	TrashRetention time.Duration
+
+	// Optional. When set, destructive statements aren't executed the first time they are sent.
+	// They fail with a ConfirmationRequiredError and have to be sent again with its token, so
+	// one stray line sent to a shared core can't delete anything
+	ConfirmDestructive bool
+
+	// Optional. When set, a chat whose contexts can't be attached (the context was deleted, its
+	// directory is gone) is loaded without them instead of failing to load. See
+	// Conversation.UnavailableContexts
+	DegradedContextLoad bool
+
+	// Optional. When a branch is too long for the provider, compact it and ask again instead of
+	// failing with a ContextOverflowError
+	CompactOnOverflow bool
+
+	// Optional. Directory and web contexts are embedded with it and retrieved by similarity,
+	// instead of by the words they share with a message
+	Embedder Embedder
+
+	// Optional. Where the embedded contexts are kept and searched, flat files in the
+	// context-store by default
+	VectorStore VectorStore
+
+	// Optional. A 32 byte key the environment variables of chats are sealed with in their
+	// snapshots. Without it one is generated and kept in the data-store
+	EnvironmentKey []byte
+
+	// Optional. Log the exact HTTP bodies providers send and get back for each message in the
+	// data-store, it can be turned on and off later with SetRawLogging
+	RawLogging bool
+
+	// Optional. Messages estimated to be longer than this many tokens are sent in parts and
+	// answered from notes on each (see chunked.go), DefaultChunkedInputTokens when not set
+	ChunkedInputTokens int
+
+	// Optional. Tools offered to the chats whose providers can call them, more can be added
+	// with RegisterTool. A tool that isn't valid is logged and left out
+	Tools []Tool
+
+	// Optional. What is done when a message, or a context chunk sent with it, contains a secret
+	// (see secrets.go). Warns by default
+	Secrets SecretPolicy
+
+	// Optional. Secrets to look for on top of DefaultSecretPatterns
+	SecretPatterns []SecretPattern
+
+	// Optional. When the provider can't be reached, queue the message on the node it was sent
+	// from instead of losing it (a MessageQueuedError is returned), see Conversation.Flush
+	QueueOffline bool
+
+	// Optional. How long a provider has to answer each request made for a message,
+	// DefaultRequestTimeout when not set
+	RequestTimeout time.Duration
+
+	// Optional. What the providers charge, by name, for the cost estimates of \usage. A derived
+	// provider costs what its host does unless it has a price of its own
+	Prices map[string]TokenPrice
+
+	// Optional. How far the trees of chats can grow, messages past a limit fail with
+	// ErrTreeLimit. Nothing is limited when not set
+	TreeLimits TreeLimits
 }
 
 type CoreInfo struct {
@@ -65,6 +213,44 @@ type CoreDescription struct {
 
 type CoreChatStartHandler func(req Conversation) error
 
+// A StatementAuthorizer decides if a session may execute a command (the keyword without
+// the leading '\', like "del-chat"). Returning an error refuses the statement. This lets
+// something embedding a core shared by many sessions keep destructive statements to
+// privileged sessions
+type StatementAuthorizer func(sessionId string, command string) error
+
+var ErrUnauthorized = errors.New("not authorized")
+
+// Overwriting a chat with \new-chat deletes the one that was there, so the statement is
+// authorized and confirmed as this command instead of new-chat
+const OverwriteChatCommand = "new-chat :overwrite"
+
+// The statements that destroy data
+var DestructiveCommands = []string{"del-chat", "del-ctx", "del-provider", OverwriteChatCommand}
+
+// The command a prepared statement is authorized and confirmed as
+func statementCommand(stmt *Statement) string {
+	if stmt.cmd.keyword == "new-chat" {
+		if prop, given := stmt.cmd.properties["overwrite"]; given && prop.prop == "true" {
+			return OverwriteChatCommand
+		}
+	}
+	return stmt.cmd.keyword
+}
+
+// RestrictDestructive builds an authorizer that only lets privileged sessions execute
+// destructive statements. Everything else is allowed for everyone
+func RestrictDestructive(isPrivileged func(sessionId string) bool) StatementAuthorizer {
+	return func(sessionId string, command string) error {
+		for _, destructive := range DestructiveCommands {
+			if command == destructive && !isPrivileged(sessionId) {
+				return ErrUnauthorized
+			}
+		}
+		return nil
+	}
+}
+
 // Create a new core instance with a set of
 // providers that can be selected from. We are attempting to be
 // entirely removed from the actual "chat" that the external
@@ -72,16 +258,69 @@ type CoreChatStartHandler func(req Conversation) error
 // manage instances of them, and add composability to the system
 // through branching and traversal of a session forest
 func NewCore(opts CoreOpts) *Core {
-	return &Core{
+
+	// Derived providers are added to the provider map as they are created, so it can't
+	// share the base provider map or every derived provider would become a base provider
+	providers := make(map[string]Provider, len(opts.BaseProviders))
+	baseProviders := make(map[string]Provider, len(opts.BaseProviders))
+	for name, p := range opts.BaseProviders {
+		providers[name] = p
+		baseProviders[name] = p
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	trashRetention := opts.TrashRetention
+	if trashRetention <= 0 {
+		trashRetention = DefaultTrashRetention
+	}
+
+	core := &Core{
 		installDirectory: opts.InstallDirectory,
-		providers:        opts.BaseProviders,
+		stores:           resolveStorePaths(opts.InstallDirectory, opts.StorePaths),
+		providers:        providers,
 		sessions:         make(map[string]*coreSession),
 		activeChats:      make(map[string]*chatInstance),
-		baseProviders:    opts.BaseProviders,
+		baseProviders:    baseProviders,
 		contexts:         make(map[string]*ContextSettings),
+		tools:            make(map[string]Tool),
 		chatStartHandler: opts.ChatStartHandler,
 		infoHandler:      opts.InfoHandler,
+		authorize:        opts.Authorize,
+		summarizer:       opts.Summarizer,
+		logger:           logger,
+		trashRetention:   trashRetention,
+
+		confirmDestructive: opts.ConfirmDestructive,
+		confirmations:      make(map[string]pendingConfirmation),
+		limiters:           make(map[string]*rateLimiter),
+
+		degradedContextLoad: opts.DegradedContextLoad,
+		compactOnOverflow:   opts.CompactOnOverflow,
+		chunkedInputTokens:  opts.ChunkedInputTokens,
+		requestTimeout:      opts.RequestTimeout,
+		prices:              opts.Prices,
+		treeLimits:          opts.TreeLimits,
+		embedder:            opts.Embedder,
+		vectors:             opts.VectorStore,
+		envKey:              opts.EnvironmentKey,
+		secrets:             opts.Secrets,
+		secretPatterns:      opts.SecretPatterns,
+		queueOffline:        opts.QueueOffline,
+	}
+	if core.vectors == nil {
+		core.vectors = NewFileVectorStore(core.storePath(contextStoreDirectory, vectorStoreDirectory))
+	}
+	core.rawLogging.Store(opts.RawLogging)
+	for _, tool := range opts.Tools {
+		if err := core.RegisterTool(tool); err != nil {
+			logger.Warn("tool left out", "tool", tool.Name, "error", err)
+		}
 	}
+	return core
 }
 
 func (c *Core) GetActiveChat(name string) (*chatInstance, error) {
@@ -98,26 +337,35 @@ func (c *Core) SetAvailableProviders(providers map[string]Provider) {
 	c.providers = providers
 }
 
-// Sets up the core into the given install directory. It can be called multiple times
-// and it wont overwrite the existing data store or chat store. It just makes sure that
-// the directories exist that we rely on
-func (c *Core) Install() error {
-	if c.installDirectory == "" {
-		return errors.New("install directory is required")
+// Register a base provider after the core has been created. This is how providers that
+// aren't compiled into the application (plugins) are made available. Like the base providers
+// given at construction, these are not saved to disk and must be registered on every start
+// before LoadProviders is called so that derived providers can find their host
+func (c *Core) RegisterBaseProvider(name string, p Provider) error {
+	c.provMu.Lock()
+	defer c.provMu.Unlock()
+	if _, exists := c.providers[name]; exists {
+		return fmt.Errorf("provider [%s] already exists", name)
 	}
+	c.baseProviders[name] = p
+	c.providers[name] = p
+	return nil
+}
 
-	if c.IsInstalled() {
-		return fmt.Errorf("target dir already exists: %s", c.installDirectory)
+// Sets up the core's stores. It wont overwrite an existing data store or chat store,
+// it just makes sure that the directories exist that we rely on
+func (c *Core) Install() error {
+	for _, dir := range c.stores {
+		if dir == "" {
+			return errors.New("install directory is required")
+		}
 	}
 
-	dirs := []string{
-		filepath.Join(c.installDirectory, dataStoreDirectory),
-		filepath.Join(c.installDirectory, chatStoreDirectory),
-		filepath.Join(c.installDirectory, providerStoreDirectory),
-		filepath.Join(c.installDirectory, contextStoreDirectory),
+	if c.IsInstalled() {
+		return fmt.Errorf("target dir already exists: %s", c.storePath(dataStoreDirectory))
 	}
 
-	for _, dir := range dirs {
+	for _, dir := range c.stores {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return err
 		}
@@ -125,12 +373,17 @@ func (c *Core) Install() error {
 	return nil
 }
 
+// Installed means every store's directory exists
 func (c *Core) IsInstalled() bool {
-	if c.installDirectory == "" {
-		return false
+	for _, dir := range c.stores {
+		if dir == "" {
+			return false
+		}
+		if _, err := os.Stat(dir); err != nil {
+			return false
+		}
 	}
-	_, err := os.Stat(c.installDirectory)
-	return err == nil
+	return true
 }
 
 // Retrive a list of all sessions
@@ -158,6 +411,11 @@ func (c *Core) EndSession(sessionId string) error {
 }
 
 func (c *Core) ExecuteStatement(sessionId string, stmt *Statement) error {
+	return c.ExecuteStatementContext(context.Background(), sessionId, stmt)
+}
+
+// Execute the statement, what it does over the network (like \check-ctx) stops when the context is cancelled
+func (c *Core) ExecuteStatementContext(ctx context.Context, sessionId string, stmt *Statement) error {
 
 	if stmt == nil {
 		return errors.New("statement is required")
@@ -169,35 +427,99 @@ func (c *Core) ExecuteStatement(sessionId string, stmt *Statement) error {
 	}
 	sessionId = sanitized
 
-	var session *coreSession
+	return c.executeInSession(ctx, c.getSession(sessionId), stmt, nil)
+}
 
-	{
-		var ok bool
-		c.sesMu.Lock()
-		session, ok = c.sessions[sessionId]
-		if !ok {
-			session = &coreSession{
-				id: sessionId,
-			}
-			c.sessions[sessionId] = session
+// Execute the statement against the session. If a transaction is given, everything the
+// statement changes is recorded to it so that it can be undone
+func (c *Core) executeInSession(ctx context.Context, session *coreSession, stmt *Statement, tx *transaction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.authorizeStatement(session.id, stmt); err != nil {
+		return err
+	}
+	if err := c.checkConfirmation(session.id, stmt); err != nil {
+		return err
+	}
+
+	callbacks := c.sessionCallbacks(ctx, session, tx)
+	if tx != nil {
+		callbacks = tx.wrap(callbacks)
+	}
+
+	// What the statement does to the workspaces is undone with the rest of the transaction
+	if tx != nil {
+		tx.record(tx.captureStoreFile(dataStoreDirectory, workspacesFile))
+	}
+
+	err := session.execute(stmt, callbacks)
+	if err != nil {
+		return err
+	}
+	if err := c.workspaceFollow(session, stmt); err != nil {
+		return err
+	}
+
+	// Querying or replaying history is not itself history
+	switch stmt.cmd.keyword {
+	case "history", "replay":
+		return nil
+	}
+	return c.recordStatement(session, stmt)
+}
+
+// Check the statement with the authorizer, if there is one. The statement is prepared
+// here as we need to know the command it is for
+func (c *Core) authorizeStatement(sessionId string, stmt *Statement) error {
+	if c.authorize == nil {
+		return nil
+	}
+	if !stmt.IsPrepared() {
+		if err := stmt.Prepare(); err != nil {
+			return err
 		}
-		c.sesMu.Unlock()
 	}
+	command := statementCommand(stmt)
+	if err := c.authorize(sessionId, command); err != nil {
+		return fmt.Errorf("session %s may not execute %s: %w", sessionId, command, err)
+	}
+	return nil
+}
 
-	callbacks := OperationalCallback{
+func (c *Core) sessionCallbacks(ctx context.Context, session *coreSession, tx *transaction) OperationalCallback {
+	return OperationalCallback{
 		OnNewChat:        c.NewChat,
 		OnNewProvider:    c.newProviderFromStatement,
 		OnNewContext:     c.newContext,
 		OnDeleteProvider: c.onDeleteProvider,
 		OnDeleteChat:     c.deleteChat,
 		OnDeleteContext:  c.deleteContext,
+		OnRenameContext:  c.renameContext,
+		OnRenameProvider: c.renameProvider,
+
+		OnFork: func(name string) error {
+			return c.forkChat(session, name)
+		},
+		OnImportMarkdown: c.importMarkdownFile,
+		OnExport:         c.exportChatFile,
+		OnRestore:        c.restoreFromTrash,
+		OnWorkspace: func(name string) error {
+			return c.enterWorkspace(session, name)
+		},
 
 		OnLoadChat: func(name string, hash *string) error {
 			ci, err := c.loadChat(name, hash)
 			if err != nil {
 				return err
 			}
+			c.sesMu.Lock()
 			session.activeChatId = name
+			session.activeBranch = ci.CurrentNode().Hash()
+			c.sesMu.Unlock()
+			if err := c.persistSession(session); err != nil {
+				return err
+			}
 			return c.chatStartHandler(ci)
 		},
 
@@ -206,6 +528,9 @@ func (c *Core) ExecuteStatement(sessionId string, stmt *Statement) error {
 			if err != nil {
 				return err
 			}
+			if data, err = c.inSessionWorkspace(session, TrashKindChat, data); err != nil {
+				return err
+			}
 			c.infoHandler.OnListChats(data)
 			return nil
 		},
@@ -214,6 +539,9 @@ func (c *Core) ExecuteStatement(sessionId string, stmt *Statement) error {
 			if err != nil {
 				return err
 			}
+			if data, err = c.inSessionWorkspace(session, TrashKindContext, data); err != nil {
+				return err
+			}
 			c.infoHandler.OnListContexts(data)
 			return nil
 		},
@@ -226,68 +554,285 @@ func (c *Core) ExecuteStatement(sessionId string, stmt *Statement) error {
 			return nil
 		},
 		OnDescribeChat: func(name string) error {
-			c.infoHandler.OnDescribeChat(name)
+			data, err := c.onDescribeChat(name)
+			if err != nil {
+				return err
+			}
+			c.infoHandler.OnDescribeChat(data)
+			return nil
+		},
+		OnWhereUsed: func(name string) error {
+			usage, err := c.WhereUsed(name)
+			if err != nil {
+				return err
+			}
+			c.infoHandler.OnWhereUsed(name, usage)
+			return nil
+		},
+		OnCheckContext: func(name string) error {
+			health, err := c.CheckContext(ctx, name)
+			if err != nil {
+				return err
+			}
+			c.infoHandler.OnCheckContext(health)
+			return nil
+		},
+		OnFsck: func(quarantine bool) error {
+			report, err := c.fsck(quarantine)
+			if err != nil {
+				return err
+			}
+			c.infoHandler.OnFsck(report)
+			return nil
+		},
+		OnUsage: func() error {
+			report, err := c.Usage()
+			if err != nil {
+				return err
+			}
+			c.infoHandler.OnUsage(report)
+			return nil
+		},
+		OnTrash: func() error {
+			items, err := c.Trash()
+			if err != nil {
+				return err
+			}
+			c.infoHandler.OnTrash(items)
 			return nil
 		},
 		OnListProviders: func() error {
-			data, err := c.onListProviders()
+			data, err := c.onListProviders(session)
 			if err != nil {
 				return err
 			}
 			c.infoHandler.OnListProviders(data)
 			return nil
 		},
+		OnHistory: func() error {
+			c.sesMu.Lock()
+			history := make([]string, len(session.history))
+			copy(history, session.history)
+			c.sesMu.Unlock()
+			c.infoHandler.OnHistory(history)
+			return nil
+		},
+		OnReplay: func(idx int) error {
+			c.sesMu.Lock()
+			if idx >= len(session.history) {
+				c.sesMu.Unlock()
+				return fmt.Errorf("no statement at index %d in session history", idx)
+			}
+			content := session.history[idx]
+			c.sesMu.Unlock()
+			return c.executeInSession(ctx, session, NewStatement(content), tx)
+		},
 	}
+}
 
-	err := session.execute(stmt, callbacks)
+// The session state is what we persist to the data-store so that a session can be
+// audited, replayed, and resumed after the process restarts
+type sessionState struct {
+	ActiveChat   string   `json:"active_chat"`
+	ActiveBranch string   `json:"active_branch"`
+	History      []string `json:"history"`
+	Workspace    string   `json:"workspace,omitempty"`
+}
+
+func sessionStateFile(sessionId string) string {
+	return fmt.Sprintf("session_%s.json", strings.ReplaceAll(sessionId, " ", "_"))
+}
+
+// Append an executed statement to the session's history and write it through to the data-store
+func (c *Core) recordStatement(session *coreSession, stmt *Statement) error {
+	c.sesMu.Lock()
+	session.history = append(session.history, withoutConfirmation(stmt))
+	c.sesMu.Unlock()
+	return c.persistSession(session)
+}
+
+func (c *Core) persistSession(session *coreSession) error {
+	c.sesMu.Lock()
+	content, err := json.Marshal(sessionState{
+		ActiveChat:   session.activeChatId,
+		ActiveBranch: session.activeBranch,
+		History:      session.history,
+		Workspace:    session.workspace,
+	})
+	c.sesMu.Unlock()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to marshal session state: %w", err)
 	}
-	return nil
+	return c.AddToDataStore(sessionStateFile(session.id), string(content))
+}
+
+// Sessions that existed before a restart pick up where they left off. If there is no
+// state on disk for the session it is created fresh
+func (c *Core) loadSession(sessionId string) (*coreSession, bool) {
+	session := &coreSession{
+		id:      sessionId,
+		history: []string{},
+	}
+	content, err := c.LoadFromDataStore(sessionStateFile(sessionId))
+	if err != nil {
+		return session, false
+	}
+	var state sessionState
+	if err := json.Unmarshal([]byte(content), &state); err != nil {
+		c.logger.Warn("failed to unmarshal session state", "session", sessionId, "error", err)
+		return session, false
+	}
+	session.activeChatId = state.ActiveChat
+	session.activeBranch = state.ActiveBranch
+	if state.History != nil {
+		session.history = state.History
+	}
+	session.workspace = state.Workspace
+	return session, true
+}
+
+// Retrieve the session by id, creating (or restoring from disk) if it isn't in memory yet
+func (c *Core) getSession(sessionId string) *coreSession {
+	c.sesMu.Lock()
+	defer c.sesMu.Unlock()
+	session, ok := c.sessions[sessionId]
+	if !ok {
+		session, _ = c.loadSession(sessionId)
+		c.sessions[sessionId] = session
+	}
+	return session
+}
+
+// ResumeSession restores a session that was persisted by a previous process, reloading
+// the chat that was active in it and moving the chat back to where the session left off.
+// If the session exists but never had an active chat, a nil conversation is returned
+func (c *Core) ResumeSession(sessionId string) (Conversation, error) {
+	sanitized := strings.TrimSpace(sessionId)
+	if sanitized == "" {
+		return nil, errors.New("session id is required")
+	}
+
+	c.sesMu.Lock()
+	session, ok := c.sessions[sanitized]
+	if !ok {
+		var persisted bool
+		session, persisted = c.loadSession(sanitized)
+		if !persisted {
+			c.sesMu.Unlock()
+			return nil, fmt.Errorf("session %s has no saved state", sanitized)
+		}
+		c.sessions[sanitized] = session
+	}
+	chatName := session.activeChatId
+	branch := session.activeBranch
+	c.sesMu.Unlock()
+
+	if chatName == "" {
+		return nil, nil
+	}
+
+	var hash *string
+	if branch != "" {
+		hash = &branch
+	}
+
+	chat, err := c.loadChat(chatName, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resume chat %s: %w", chatName, err)
+	}
+	return chat, nil
 }
 
 // When the statement execution is done, the user may have executed a statement to create a new provider
 // If this happens, we ensure that they are basing it off an existing (supported) provider, and then clone
 // the settings to store in provider map
-func (c *Core) newProviderFromStatement(name string, host string, baseUrl string, maxTokens int, temperature float64, systemPrompt string) error {
+func (c *Core) newProviderFromStatement(stmt ProviderStatement) error {
 
-	fmt.Println("name:", name, "host", host)
+	c.logger.Debug("creating provider", "name", stmt.Name, "host", stmt.Host)
 	var baseProvider Provider
 	{
 		var exists bool
 		c.provMu.Lock()
-		_, exists = c.providers[name]
+		_, exists = c.providers[stmt.Name]
 		if exists {
 			c.provMu.Unlock()
-			return fmt.Errorf("provider [%s] already exists", name)
+			return fmt.Errorf("provider [%s] already exists", stmt.Name)
 		}
 
-		baseProvider, exists = c.providers[host]
+		baseProvider, exists = c.providers[stmt.Host]
 		if !exists {
 			c.provMu.Unlock()
-			return fmt.Errorf("host provider (base provider) [%s] does not exist", host)
+			return fmt.Errorf("host provider (base provider) [%s] does not exist", stmt.Host)
+		}
+		if stmt.Companion != "" {
+			if _, exists = c.providers[stmt.Companion]; !exists {
+				c.provMu.Unlock()
+				return fmt.Errorf("companion provider [%s] does not exist", stmt.Companion)
+			}
+		}
+		if err := validateFallbacks(stmt.Name, stmt.Fallbacks, func(fallback string) bool {
+			_, exists := c.providers[fallback]
+			return exists
+		}); err != nil {
+			c.provMu.Unlock()
+			return err
 		}
 		c.provMu.Unlock()
 	}
-	if maxTokens == 0 || maxTokens > baseProvider.Settings().MaxTokens {
-		fmt.Println("maxTokens is 0, setting to default")
-		maxTokens = baseProvider.Settings().MaxTokens
+	host := baseProvider.Settings()
+	if stmt.MaxTokens == 0 || stmt.MaxTokens > host.MaxTokens {
+		c.logger.Debug("max tokens not given or above the host's, using the host's", "provider", stmt.Name)
+		stmt.MaxTokens = host.MaxTokens
 	}
 
-	if temperature == 0.0 || temperature > 1.0 {
-		fmt.Println("temperature is 0 or greater than 1, setting to default")
-		temperature = baseProvider.Settings().Temperature
+	if stmt.Temperature == 0.0 || stmt.Temperature > 1.0 {
+		c.logger.Debug("temperature not given or above 1, using the host's", "provider", stmt.Name)
+		stmt.Temperature = host.Temperature
+	}
+
+	// Derived providers sample, post-process, fail over and window like their host unless told otherwise.
+	// The host's rate limit isn't copied, requests are held to it along with the provider's own
+	if stmt.Seed == nil {
+		stmt.Seed = host.Seed
+	}
+	if stmt.PostProcess == nil {
+		stmt.PostProcess = host.PostProcess
+	} else if err := ValidatePostProcessors(stmt.PostProcess); err != nil {
+		return err
+	}
+	if stmt.Fallbacks == nil {
+		stmt.Fallbacks = host.Fallbacks
+	}
+	if stmt.Window == nil {
+		stmt.Window = host.Window
+	} else if err := ValidateContextWindow(stmt.Window); err != nil {
+		return err
+	}
+	if err := ValidateRateLimit(stmt.RateLimit); err != nil {
+		return err
 	}
 
 	// We "duplicate" checks, but who the fuck cares. Do this and save it to disk.
-	return c.AddProvider(name, baseProvider.CloneWithSettings(ProviderSettings{
-		Name:         name,
-		Host:         host,
-		BaseUrl:      baseUrl,
-		MaxTokens:    maxTokens,
-		Temperature:  temperature,
-		SystemPrompt: systemPrompt,
-	}))
+	provider, err := baseProvider.CloneWithSettings(ProviderSettings{
+		Name:         stmt.Name,
+		Host:         stmt.Host,
+		BaseUrl:      stmt.BaseUrl,
+		MaxTokens:    stmt.MaxTokens,
+		Temperature:  stmt.Temperature,
+		SystemPrompt: stmt.SystemPrompt,
+		Companion:    stmt.Companion,
+		PromptSuffix: host.PromptSuffix,
+		MaxAttempts:  host.MaxAttempts,
+		Seed:         stmt.Seed,
+		PostProcess:  stmt.PostProcess,
+		Fallbacks:    stmt.Fallbacks,
+		Window:       stmt.Window,
+		RateLimit:    stmt.RateLimit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create provider %s: %w", stmt.Name, err)
+	}
+	return c.AddProvider(stmt.Name, provider)
 }
 
 // Here we clone the provider handed to us and store in the provider map under a new name
@@ -295,7 +840,7 @@ func (c *Core) newProviderFromStatement(name string, host string, baseUrl string
 // in their chat sessions (host: is the base provider like "anthropic" or "openai" etc whatever is setup
 // by hand from config oin core init)
 func (c *Core) AddProvider(name string, p Provider) error {
-	fmt.Println("Adding provider", name)
+	c.logger.Info("adding provider", "name", name)
 
 	// WHY DO YOU IGNORE LEXICAL SCOPES GOLANG?!?!?
 	c.provMu.Lock()
@@ -323,23 +868,22 @@ func (c *Core) AddProvider(name string, p Provider) error {
 
 // Load all available providers from the provider store directory
 func (c *Core) LoadProviders() error {
-	dataStoreDir := filepath.Join(c.installDirectory, providerStoreDirectory)
+	dataStoreDir := c.storePath(providerStoreDirectory)
 	files, err := os.ReadDir(dataStoreDir)
 	if err != nil {
 		return fmt.Errorf("failed to read provider store directory: %w", err)
 	}
 
+	pending := []ProviderSettings{}
 	for _, file := range files {
 		if !strings.HasSuffix(file.Name(), ".json") {
 			continue
 		}
-		fmt.Println("attempting to load ", file.Name())
 		content, err := c.loadFromStore(providerStoreDirectory, file.Name())
 		if err != nil {
-			fmt.Println("failed to load provider file", file.Name())
 			return fmt.Errorf("failed to load provider file %s: %w", file.Name(), err)
 		}
-		fmt.Println("loaded provider file", file.Name())
+		c.logger.Debug("loaded provider file", "file", file.Name())
 
 		var settings ProviderSettings
 		if err := json.Unmarshal([]byte(content), &settings); err != nil {
@@ -348,13 +892,48 @@ func (c *Core) LoadProviders() error {
 		if _, exists := c.providers[settings.Name]; exists {
 			return fmt.Errorf("provider %s already exists", settings.Name)
 		}
-		c.providers[settings.Name] = c.baseProviders["anthropic"].CloneWithSettings(settings)
+		pending = append(pending, settings)
+	}
+
+	// Derived providers are cloned from their host, which may itself be a derived provider
+	// that hasn't been loaded yet, so keep going over what's left until nothing changes
+	for len(pending) > 0 {
+		remaining := []ProviderSettings{}
+		for _, settings := range pending {
+			host, exists := c.providers[settings.Host]
+			if !exists {
+				remaining = append(remaining, settings)
+				continue
+			}
+			provider, err := host.CloneWithSettings(settings)
+			if err != nil {
+				return fmt.Errorf("failed to create provider %s: %w", settings.Name, err)
+			}
+			c.providers[settings.Name] = provider
+		}
+		if len(remaining) == len(pending) {
+			break
+		}
+		pending = remaining
+	}
+
+	// Older installs only ever had anthropic
+	for _, settings := range pending {
+		host, exists := c.baseProviders["anthropic"]
+		if !exists {
+			return fmt.Errorf("host provider [%s] for %s is not available", settings.Host, settings.Name)
+		}
+		provider, err := host.CloneWithSettings(settings)
+		if err != nil {
+			return fmt.Errorf("failed to create provider %s: %w", settings.Name, err)
+		}
+		c.providers[settings.Name] = provider
 	}
 	return nil
 }
 
 func (c *Core) LoadContexts() error {
-	dataStoreDir := filepath.Join(c.installDirectory, contextStoreDirectory)
+	dataStoreDir := c.storePath(contextStoreDirectory)
 	files, err := os.ReadDir(dataStoreDir)
 	if err != nil {
 		return fmt.Errorf("failed to read context store directory: %w", err)
@@ -382,29 +961,79 @@ func (c *Core) LoadContexts() error {
 
 // This creates a chat instance, but it does not load it. It defines it so that the user can
 // load it later (think of it like making a db table)
-func (c *Core) NewChat(name string, providerName string) error {
-	var chat *chatInstance
-	{
-		c.provMu.Lock()
-		defer c.provMu.Unlock()
+// Create a chat on the named provider. With useProfile the chat includes the core's profile in its prompt.
+// A chat that already has the name is an error, unless overwrite is given to replace it
+func (c *Core) NewChat(name string, providerName string, useProfile bool, overwrite bool) error {
+	chat, err := c.newChatOnProvider(name, providerName)
+	if err != nil {
+		return err
+	}
+	chat.useProfile = useProfile
+	return c.claimChatName(name, overwrite, func() error {
+		return c.writeSnapshot(name, chat)
+	})
+}
 
-		provider, ok := c.providers[providerName]
+// Whether a chat with the name is saved or loaded
+func (c *Core) ChatExists(name string) bool {
+	c.chatMu.Lock()
+	_, active := c.activeChats[name]
+	c.chatMu.Unlock()
+	if active {
+		return true
+	}
+	_, err := os.Stat(c.storePath(chatStoreDirectory, fmt.Sprintf("%s.json", name)))
+	return err == nil
+}
 
-		if !ok {
-			for name, prov := range c.providers {
-				fmt.Println("PROVIDER", name, prov.Settings().Name)
-			}
-			return fmt.Errorf("provider [%s] not found", providerName)
+// The name if no chat has it, otherwise the name with the first number from 2 up that is free
+func (c *Core) UniqueChatName(name string) string {
+	return uniqueName(name, c.ChatExists)
+}
+
+func uniqueName(name string, taken func(string) bool) string {
+	unique := name
+	for i := 2; taken(unique); i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	return unique
+}
+
+// Write a new chat with the name while no other chat can take it. A chat that has the name is an
+// error, unless it is overwritten: then it goes to the trash first, and it can't be while it is open
+func (c *Core) claimChatName(name string, overwrite bool, write func() error) error {
+	c.chatNameMu.Lock()
+	defer c.chatNameMu.Unlock()
+	if c.ChatExists(name) {
+		if !overwrite {
+			return fmt.Errorf("chat %s already exists, give :overwrite true to replace it", name)
+		}
+		if err := c.deleteChat(name); err != nil {
+			return fmt.Errorf("failed to replace chat %s: %w", name, err)
 		}
+		c.logger.Info("replacing chat, the old one is in the trash", "chat", name)
+	}
+	return write()
+}
+
+// An empty chat hosted by the named provider, it isn't saved
+func (c *Core) newChatOnProvider(name string, providerName string) (*chatInstance, error) {
+	c.provMu.Lock()
+	defer c.provMu.Unlock()
 
-		chatSettings := provider.Settings()
-		chatSettings.Name = name
-		chatSettings.Host = providerName
-		cloned := provider.CloneWithSettings(chatSettings)
-		chat = newChatInstance(cloned)
+	provider, ok := c.providers[providerName]
+	if !ok {
+		return nil, fmt.Errorf("provider [%s] not found", providerName)
 	}
 
-	return c.writeSnapshot(name, chat)
+	chatSettings := provider.Settings()
+	chatSettings.Name = name
+	chatSettings.Host = providerName
+	cloned, err := provider.CloneWithSettings(chatSettings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider for chat %s: %w", name, err)
+	}
+	return newChatInstance(cloned), nil
 }
 
 func (c *Core) SaveActiveChat(sessionName string) error {
@@ -428,12 +1057,131 @@ func (c *Core) SaveActiveChat(sessionName string) error {
 		if !exists {
 			return fmt.Errorf("chat [%s] is not active", target)
 		}
+
+		// Remember where the session was in the chat so it can be resumed
+		c.sesMu.Lock()
+		session.activeBranch = chat.CurrentNode().Hash()
+		c.sesMu.Unlock()
+		if err := c.persistSession(session); err != nil {
+			return err
+		}
 	}
+	chat.submitMu.Lock()
+	defer chat.submitMu.Unlock()
 	return c.writeSnapshot(target, chat)
 }
 
+// Fork the session's current branch (the root down to the current node) into a new chat. The new
+// chat has the same provider, contexts and memory, and none of the branches that split off along the way
+func (c *Core) forkChat(session *coreSession, name string) error {
+	if c.ChatExists(name) {
+		return fmt.Errorf("chat %s already exists", name)
+	}
+
+	c.sesMu.Lock()
+	source := session.activeChatId
+	c.sesMu.Unlock()
+
+	c.chatMu.Lock()
+	chat, exists := c.activeChats[source]
+	c.chatMu.Unlock()
+	if !exists {
+		return errors.New("no chat is active in the session, there is nothing to fork")
+	}
+
+	chat.submitMu.Lock()
+	root, top, leaf := copyBranch(&chat.root, chat.currentNode)
+	contexts := make(map[string]*ContextSettings, len(chat.contexts))
+	for ctxName, ctx := range chat.contexts {
+		contexts[ctxName] = ctx
+	}
+	memory := make(map[string]string, len(chat.memory))
+	for key, fact := range chat.memory {
+		memory[key] = fact
+	}
+	env := make(map[string]string, len(chat.env))
+	for envName, value := range chat.env {
+		env[envName] = value
+	}
+	unopenedEnv := chat.unopenedEnv
+	provider := chat.provider
+	basePrompt := chat.basePrompt
+	useProfile := chat.useProfile
+	profile := copyFacts(chat.profile)
+	chat.submitMu.Unlock()
+
+	fork := &chatInstance{
+		core:         c,
+		provider:     provider,
+		root:         *root,
+		chatEnabled:  true,
+		queuedImages: []string{},
+		contexts:     contexts,
+		memory:       memory,
+		basePrompt:   basePrompt,
+		useProfile:   useProfile,
+		profile:      profile,
+		env:          env,
+		unopenedEnv:  unopenedEnv,
+	}
+	fork.currentNode = &fork.root
+	if top != nil {
+		top.Parent = &fork.root
+		fork.root.Children = []Node{top}
+		fork.currentNode = leaf
+	}
+	return c.claimChatName(name, false, func() error {
+		return c.writeSnapshot(name, fork)
+	})
+}
+
+// Copy the branch from the root down to the given node. The copied message pairs are returned as
+// a chain from the top (the pair under the root) to the leaf (the copy of the node), both nil if the
+// node is the root. The chain isn't attached to the copied root since the root is copied by value into its chat
+func copyBranch(root *RootNode, current Node) (rootCopy *RootNode, top *MessagePairNode, leaf *MessagePairNode) {
+	rootCopy = NewRootNode(RootOpt{
+		Provider:    root.Provider,
+		Model:       root.Model,
+		Prompt:      root.Prompt,
+		Temperature: root.Temperature,
+		MaxTokens:   root.MaxTokens,
+	})
+
+	for n := current; n != nil; n = nodeParent(n) {
+		mp, ok := n.(*MessagePairNode)
+		if !ok {
+			break
+		}
+		pair := mp.clone(nil)
+		if top != nil {
+			top.Parent = pair
+			pair.Children = []Node{top}
+		} else {
+			leaf = pair
+		}
+		top = pair
+	}
+	return rootCopy, top, leaf
+}
+
+func copyMessage(message *MessageData) *MessageData {
+	if message == nil {
+		return nil
+	}
+	copied := *message
+	if message.Images != nil {
+		copied.Images = append([]string{}, message.Images...)
+	}
+	if message.Translation != nil {
+		translation := *message.Translation
+		copied.Translation = &translation
+	}
+	return &copied
+}
+
+// Save the chat, the caller holds its lock or has the chat to itself
 func (c *Core) writeSnapshot(ssName string, chat *chatInstance) error {
-	ss, err := chat.Snapshot()
+	ss, err := chat.snapshot()
 	if err != nil {
 		return err
 	}
@@ -444,7 +1192,14 @@ func (c *Core) writeSnapshot(ssName string, chat *chatInstance) error {
 	if err := c.AddToChatStore(fmt.Sprintf("%s.json", ssName), string(data)); err != nil {
 		return err
 	}
-	return nil
+	return c.indexChat(ssName, chatReferences{
+		Provider: ss.ProviderName,
+		Contexts: ss.Contexts,
+		Nodes:    len(MapTree(&chat.root)),
+		Usage:    treeUsage(&chat.root, ss.ProviderName),
+
+		AuxiliaryUsage: copyUsage(ss.AuxiliaryUsage),
+	})
 }
 
 func (c *Core) loadChat(name string, hash *string) (*chatInstance, error) {
@@ -475,6 +1230,7 @@ func (c *Core) loadChat(name string, hash *string) (*chatInstance, error) {
 	if err != nil {
 		return nil, err
 	}
+	chat.name = name
 
 	// Restore to last point in chat
 	if hash != nil {
@@ -538,19 +1294,26 @@ func (c *Core) addData(filename string, content string) error {
 }
 
 func (c *Core) AddToDataStore(filename string, content string) error {
-	return c.addData(filepath.Join(c.installDirectory, dataStoreDirectory, filename), content)
+	return c.addData(c.storePath(dataStoreDirectory, filename), content)
 }
 
+// Snapshots are written with their large strings in blobs, see blobs.go
 func (c *Core) AddToChatStore(filename string, content string) error {
-	return c.addData(filepath.Join(c.installDirectory, chatStoreDirectory, filename), content)
+	c.blobMu.RLock()
+	defer c.blobMu.RUnlock()
+	stored, err := c.storeBlobs(content)
+	if err != nil {
+		return fmt.Errorf("failed to store blobs of %s: %w", filename, err)
+	}
+	return c.addData(c.storePath(chatStoreDirectory, filename), stored)
 }
 
 func (c *Core) addToProviderStore(filename string, content string) error {
-	return c.addData(filepath.Join(c.installDirectory, providerStoreDirectory, filename), content)
+	return c.addData(c.storePath(providerStoreDirectory, filename), content)
 }
 
 func (c *Core) loadFromStore(store string, filename string) (string, error) {
-	content, err := os.ReadFile(filepath.Join(c.installDirectory, store, filename))
+	content, err := os.ReadFile(c.storePath(store, filename))
 	if err != nil {
 		return "", err
 	}
@@ -562,7 +1325,11 @@ func (c *Core) LoadFromDataStore(filename string) (string, error) {
 }
 
 func (c *Core) LoadFromChatStore(filename string) (string, error) {
-	return c.loadFromStore(chatStoreDirectory, filename)
+	content, err := c.loadFromStore(chatStoreDirectory, filename)
+	if err != nil {
+		return "", err
+	}
+	return c.resolveBlobs(content)
 }
 
 func (c *Core) LoadFromContextStore(filename string) (string, error) {
@@ -570,40 +1337,34 @@ func (c *Core) LoadFromContextStore(filename string) (string, error) {
 }
 
 func (c *Core) AddToContextStore(filename string, content string) error {
-	return c.addData(filepath.Join(c.installDirectory, contextStoreDirectory, filename), content)
+	return c.addData(c.storePath(contextStoreDirectory, filename), content)
 }
 
-// isContextInUse checks if a context is being used by any chat by scanning all chat files
+// isContextInUse checks if a context is being used by any chat using the reference index
 func (c *Core) isContextInUse(contextName string) (bool, error) {
-	chatStoreDir := filepath.Join(c.installDirectory, chatStoreDirectory)
-	files, err := os.ReadDir(chatStoreDir)
+	usage, err := c.WhereUsed(contextName)
 	if err != nil {
-		return false, fmt.Errorf("failed to read chat store directory: %w", err)
+		return false, err
 	}
-
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".json") {
-			continue
-		}
-
-		content, err := c.LoadFromChatStore(file.Name())
-		if err != nil {
-			return false, fmt.Errorf("failed to load chat file %s: %w", file.Name(), err)
-		}
-
-		var snapshot Snapshot
-		if err := json.Unmarshal([]byte(content), &snapshot); err != nil {
-			return false, fmt.Errorf("failed to unmarshal chat snapshot from %s: %w", file.Name(), err)
+	for _, u := range usage {
+		if u.Context {
+			return true, nil
 		}
+	}
+	return false, nil
+}
 
-		// Check if this chat uses the context
-		for _, ctx := range snapshot.Contexts {
-			if ctx == contextName {
-				return true, nil
-			}
+// isProviderInUse checks if a provider is being used by any chat using the reference index
+func (c *Core) isProviderInUse(providerName string) (bool, error) {
+	usage, err := c.WhereUsed(providerName)
+	if err != nil {
+		return false, err
+	}
+	for _, u := range usage {
+		if u.Provider {
+			return true, nil
 		}
 	}
-
 	return false, nil
 }
 
@@ -632,12 +1393,11 @@ func (c *Core) deleteChat(name string) error {
 		chatFile = fmt.Sprintf("%s.json", name)
 	}
 
-	err := os.Remove(filepath.Join(c.installDirectory, chatStoreDirectory, chatFile))
-	if err != nil && !os.IsNotExist(err) {
+	if err := c.moveToTrash(chatStoreDirectory, chatFile); err != nil {
 		return fmt.Errorf("failed to delete chat file: %w", err)
 	}
 
-	return nil
+	return c.unindexChat(name)
 }
 
 func (c *Core) deleteContext(name string) error {
@@ -670,16 +1430,17 @@ func (c *Core) deleteContext(name string) error {
 		contextFile = fmt.Sprintf("%s.json", name)
 	}
 
-	err = os.Remove(filepath.Join(c.installDirectory, contextStoreDirectory, contextFile))
-	if err != nil && !os.IsNotExist(err) {
+	if err := c.moveToTrash(contextStoreDirectory, contextFile); err != nil {
 		return fmt.Errorf("failed to delete context file: %w", err)
 	}
 
+	// The index is rebuilt if the context is restored
+	c.removeKnowledgeIndex(name)
 	return nil
 }
 
 func (c *Core) getStorageJsons(store string) ([]string, error) {
-	storeDir := filepath.Join(c.installDirectory, store)
+	storeDir := c.storePath(store)
 	files, err := os.ReadDir(storeDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read %s store directory: %w", store, err)
@@ -712,40 +1473,26 @@ func (c *Core) onDeleteProvider(name string) error {
 	}
 
 	// Check if any chats are using this provider
-	inUse := false
-	chatStoreDir := filepath.Join(c.installDirectory, chatStoreDirectory)
-	files, err := os.ReadDir(chatStoreDir)
+	inUse, err := c.isProviderInUse(name)
 	if err != nil {
 		c.provMu.Unlock()
-		return fmt.Errorf("failed to read chat store directory: %w", err)
+		return fmt.Errorf("failed to check if provider is in use: %w", err)
 	}
 
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".json") {
-			continue
-		}
+	if inUse {
+		c.provMu.Unlock()
+		return fmt.Errorf("cannot delete provider %s: it is currently in use by one or more chats", name)
+	}
 
-		content, err := c.LoadFromChatStore(file.Name())
-		if err != nil {
+	for other, p := range c.providers {
+		if p.Settings().Companion == name {
 			c.provMu.Unlock()
-			return fmt.Errorf("failed to load chat file %s: %w", file.Name(), err)
+			return fmt.Errorf("cannot delete provider %s: it is the companion of provider %s", name, other)
 		}
-
-		var snapshot Snapshot
-		if err := json.Unmarshal([]byte(content), &snapshot); err != nil {
+		if slices.Contains(p.Settings().Fallbacks, name) {
 			c.provMu.Unlock()
-			return fmt.Errorf("failed to unmarshal chat snapshot from %s: %w", file.Name(), err)
+			return fmt.Errorf("cannot delete provider %s: it is a fallback of provider %s", name, other)
 		}
-
-		if snapshot.ProviderName == name {
-			inUse = true
-			break
-		}
-	}
-
-	if inUse {
-		c.provMu.Unlock()
-		return fmt.Errorf("cannot delete provider %s: it is currently in use by one or more chats", name)
 	}
 
 	// Remove from memory
@@ -758,14 +1505,216 @@ func (c *Core) onDeleteProvider(name string) error {
 		providerFile = fmt.Sprintf("%s.json", name)
 	}
 
-	err = os.Remove(filepath.Join(c.installDirectory, providerStoreDirectory, providerFile))
-	if err != nil && !os.IsNotExist(err) {
+	if err := c.moveToTrash(providerStoreDirectory, providerFile); err != nil {
 		return fmt.Errorf("failed to delete provider file: %w", err)
 	}
 
 	return nil
 }
 
+// Rewrite every chat snapshot on disk that the update function changes (returns true for)
+func (c *Core) updateSnapshots(update func(name string, snapshot *Snapshot) bool) error {
+	jsons, err := c.getStorageJsons(chatStoreDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range jsons {
+		content, err := c.LoadFromChatStore(file)
+		if err != nil {
+			return fmt.Errorf("failed to load chat file %s: %w", file, err)
+		}
+		snapshot, err := SnapshotFromJSON([]byte(content))
+		if err != nil {
+			return fmt.Errorf("failed to read chat file %s: %w", file, err)
+		}
+		if !update(strings.TrimSuffix(file, ".json"), snapshot) {
+			continue
+		}
+		data, err := snapshot.Marshal()
+		if err != nil {
+			return err
+		}
+		if err := c.AddToChatStore(file, string(data)); err != nil {
+			return fmt.Errorf("failed to write chat file %s: %w", file, err)
+		}
+
+		if err := c.reindexChatReferences(strings.TrimSuffix(file, ".json"), snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Renaming something an active chat holds would have the chat write the old name back
+// out the next time it is saved, so we don't allow it
+func (c *Core) activeChatUsing(uses func(chat *chatInstance) bool) (string, bool) {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+	for name, chat := range c.activeChats {
+		if uses(chat) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Rename a context on disk and in memory, and update every chat that references it
+func (c *Core) renameContext(name string, newName string) error {
+	c.ctxMu.Lock()
+	ctx, exists := c.contexts[name]
+	if !exists {
+		c.ctxMu.Unlock()
+		return fmt.Errorf("context %s does not exist", name)
+	}
+	if _, taken := c.contexts[newName]; taken {
+		c.ctxMu.Unlock()
+		return fmt.Errorf("context %s already exists", newName)
+	}
+	c.ctxMu.Unlock()
+
+	if chatName, active := c.activeChatUsing(func(chat *chatInstance) bool {
+		_, uses := chat.contexts[name]
+		return uses
+	}); active {
+		return fmt.Errorf("cannot rename context %s: it is in use by active chat %s", name, chatName)
+	}
+
+	renamed := *ctx
+	renamed.Name = newName
+	content, err := json.Marshal(renamed)
+	if err != nil {
+		return err
+	}
+	if err := c.AddToContextStore(fmt.Sprintf("%s.json", newName), string(content)); err != nil {
+		return err
+	}
+
+	err = c.updateSnapshots(func(_ string, snapshot *Snapshot) bool {
+		changed := false
+		for idx, ctxName := range snapshot.Contexts {
+			if ctxName == name {
+				snapshot.Contexts[idx] = newName
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update chats referencing context %s: %w", name, err)
+	}
+
+	c.ctxMu.Lock()
+	delete(c.contexts, name)
+	c.contexts[newName] = &renamed
+	c.ctxMu.Unlock()
+
+	err = os.Remove(c.storePath(contextStoreDirectory, fmt.Sprintf("%s.json", name)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete old context file: %w", err)
+	}
+	c.removeKnowledgeIndex(name)
+	return nil
+}
+
+// Rename a derived provider on disk and in memory. Chats using it and providers derived
+// from it are updated to reference the new name
+func (c *Core) renameProvider(name string, newName string) error {
+	c.provMu.Lock()
+	provider, exists := c.providers[name]
+	if !exists {
+		c.provMu.Unlock()
+		return fmt.Errorf("provider %s does not exist", name)
+	}
+	if _, isBase := c.baseProviders[name]; isBase {
+		c.provMu.Unlock()
+		return fmt.Errorf("cannot rename base provider %s", name)
+	}
+	if _, taken := c.providers[newName]; taken {
+		c.provMu.Unlock()
+		return fmt.Errorf("provider [%s] already exists", newName)
+	}
+	c.provMu.Unlock()
+
+	if chatName, active := c.activeChatUsing(func(chat *chatInstance) bool {
+		return chat.provider.Settings().Host == name
+	}); active {
+		return fmt.Errorf("cannot rename provider %s: it is in use by active chat %s", name, chatName)
+	}
+
+	writeSettings := func(settings ProviderSettings) error {
+		content, err := json.Marshal(&settings)
+		if err != nil {
+			return fmt.Errorf("failed to marshal provider settings: %w", err)
+		}
+		return c.addToProviderStore(fmt.Sprintf("%s.json", strings.ReplaceAll(settings.Name, " ", "_")), string(content))
+	}
+
+	settings := provider.Settings()
+	settings.Name = newName
+	renamed, err := provider.CloneWithSettings(settings)
+	if err != nil {
+		return fmt.Errorf("failed to rename provider %s: %w", name, err)
+	}
+	if err := writeSettings(settings); err != nil {
+		return err
+	}
+
+	err = c.updateSnapshots(func(_ string, snapshot *Snapshot) bool {
+		if snapshot.ProviderName != name {
+			return false
+		}
+		snapshot.ProviderName = newName
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update chats referencing provider %s: %w", name, err)
+	}
+
+	c.provMu.Lock()
+	delete(c.providers, name)
+	c.providers[newName] = renamed
+
+	// Providers derived from this one (or using it as their companion or fallback) refer to it by name
+	for derivedName, derived := range c.providers {
+		derivedSettings := derived.Settings()
+		fallback := slices.Index(derivedSettings.Fallbacks, name)
+		if derivedName == newName || (derivedSettings.Host != name && derivedSettings.Companion != name && fallback < 0) {
+			continue
+		}
+		if _, isBase := c.baseProviders[derivedName]; isBase {
+			continue
+		}
+		if derivedSettings.Host == name {
+			derivedSettings.Host = newName
+		}
+		if derivedSettings.Companion == name {
+			derivedSettings.Companion = newName
+		}
+		if fallback >= 0 {
+			derivedSettings.Fallbacks = slices.Clone(derivedSettings.Fallbacks)
+			derivedSettings.Fallbacks[fallback] = newName
+		}
+		updated, err := derived.CloneWithSettings(derivedSettings)
+		if err != nil {
+			c.provMu.Unlock()
+			return fmt.Errorf("failed to update provider %s: %w", derivedName, err)
+		}
+		if err := writeSettings(derivedSettings); err != nil {
+			c.provMu.Unlock()
+			return err
+		}
+		c.providers[derivedName] = updated
+	}
+	c.provMu.Unlock()
+
+	err = os.Remove(c.storePath(providerStoreDirectory, fmt.Sprintf("%s.json", strings.ReplaceAll(name, " ", "_"))))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete old provider file: %w", err)
+	}
+	return nil
+}
+
 func (c *Core) ListContexts() []string {
 	c.ctxMu.Lock()
 	defer c.ctxMu.Unlock()
@@ -817,34 +1766,151 @@ func (c *Core) onDescribeContext(name string) (string, error) {
 	return content, nil
 }
 
+// What can be known about a chat without loading its tree
+type ChatMetadata struct {
+	Name         string           `json:"name"`
+	Provider     string           `json:"provider"`
+	Settings     ProviderSettings `json:"settings"`
+	Contexts     []string         `json:"contexts"`
+	ActiveBranch string           `json:"active_branch"`
+	Nodes        int              `json:"nodes"`
+}
+
+// The snapshot with its contents left undecoded, so reading it doesn't build the tree
+type snapshotHeader struct {
+	ProviderName string          `json:"provider_name"`
+	ActiveBranch string          `json:"active_branch"`
+	Contexts     []string        `json:"contexts"`
+	Contents     json.RawMessage `json:"contents"`
+}
+
+// The settings the chat's root recorded, the ones the chat runs with (see reconcileRootSettings)
+type rootSettings struct {
+	Temperature float64 `json:"temperature"`
+	MaxTokens   int     `json:"max_tokens"`
+}
+
+// Only the root's own fields are decoded, its children are skipped over
+func (h snapshotHeader) rootSettings() (rootSettings, error) {
+	var root struct {
+		NodeData rootSettings `json:"node_data"`
+	}
+	contents := h.Contents
+	if len(contents) > 0 && contents[0] == '"' {
+		// Written before snapshots were canonical, base64
+		var decoded []byte
+		if err := json.Unmarshal(contents, &decoded); err != nil {
+			return root.NodeData, err
+		}
+		contents = decoded
+	}
+	if len(contents) == 0 {
+		return root.NodeData, nil
+	}
+	err := json.Unmarshal(contents, &root)
+	return root.NodeData, err
+}
+
+// ChatMetadata reads what a chat is set up with straight from its snapshot. Unlike loading
+// the chat, this doesn't build the tree, resolve its blobs, attach contexts, or make the chat active
+func (c *Core) ChatMetadata(name string) (ChatMetadata, error) {
+	content, err := c.loadFromStore(chatStoreDirectory, fmt.Sprintf("%s.json", strings.TrimSuffix(name, ".json")))
+	if err != nil {
+		return ChatMetadata{}, fmt.Errorf("failed to load chat from disk: %w", err)
+	}
+	var header snapshotHeader
+	if err := json.Unmarshal([]byte(content), &header); err != nil {
+		return ChatMetadata{}, fmt.Errorf("failed to unmarshal chat snapshot: %w", err)
+	}
+	root, err := header.rootSettings()
+	if err != nil {
+		return ChatMetadata{}, fmt.Errorf("failed to unmarshal chat root: %w", err)
+	}
+
+	meta := ChatMetadata{
+		Name:         strings.TrimSuffix(name, ".json"),
+		Provider:     header.ProviderName,
+		Contexts:     header.Contexts,
+		ActiveBranch: header.ActiveBranch,
+	}
+	if meta.Contexts == nil {
+		meta.Contexts = []string{}
+	}
+
+	// A chat's settings are its provider's, but it runs with the temperature and max tokens
+	// its root recorded when they differ
+	c.provMu.Lock()
+	if provider, exists := c.providers[header.ProviderName]; exists {
+		meta.Settings = provider.Settings()
+	}
+	c.provMu.Unlock()
+	if root.MaxTokens > 0 {
+		meta.Settings.Temperature = root.Temperature
+		meta.Settings.MaxTokens = root.MaxTokens
+	}
+
+	c.refs.mu.Lock()
+	if err := c.ensureReferenceIndex(""); err == nil {
+		meta.Nodes = c.refs.chats[meta.Name].Nodes
+	}
+	c.refs.mu.Unlock()
+	return meta, nil
+}
+
+// ListChatMetadata describes every chat in the chat store, ordered by name
+func (c *Core) ListChatMetadata() ([]ChatMetadata, error) {
+	names, err := c.onListChats()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	chats := make([]ChatMetadata, 0, len(names))
+	for _, name := range names {
+		meta, err := c.ChatMetadata(name)
+		if err != nil {
+			return nil, err
+		}
+		chats = append(chats, meta)
+	}
+	return chats, nil
+}
+
 func (c *Core) onDescribeChat(name string) (string, error) {
-	chat, err := c.loadChat(name, nil)
+	meta, err := c.ChatMetadata(name)
 	if err != nil {
-		return "", fmt.Errorf("failed to load chat from disk: %w", err)
+		return "", err
 	}
 
-	desc := fmt.Sprintf("%-15s %s\n", "Name:", name)
-	desc += fmt.Sprintf("%-15s %s\n", "Provider:", chat.provider.Settings().Name)
-	desc += fmt.Sprintf("%-15s %s\n", "Base URL:", chat.provider.Settings().BaseUrl)
-	desc += fmt.Sprintf("%-15s %d\n", "Max Tokens:", chat.provider.Settings().MaxTokens)
-	desc += fmt.Sprintf("%-15s %.2f\n", "Temperature:", chat.provider.Settings().Temperature)
-	desc += fmt.Sprintf("%-15s %s\n", "System Prompt:", chat.provider.Settings().SystemPrompt)
-	desc += fmt.Sprintf("%-15s %d\n", "Contexts:", len(chat.contexts))
-	for _, ctx := range chat.contexts {
-		desc += fmt.Sprintf("%-15s %s\n", "", ctx.Name)
+	desc := fmt.Sprintf("%-15s %s\n", "Name:", meta.Name)
+	desc += fmt.Sprintf("%-15s %s\n", "Provider:", meta.Provider)
+	desc += fmt.Sprintf("%-15s %s\n", "Base URL:", meta.Settings.BaseUrl)
+	desc += fmt.Sprintf("%-15s %d\n", "Max Tokens:", meta.Settings.MaxTokens)
+	desc += fmt.Sprintf("%-15s %.2f\n", "Temperature:", meta.Settings.Temperature)
+	desc += fmt.Sprintf("%-15s %s\n", "System Prompt:", meta.Settings.SystemPrompt)
+	desc += fmt.Sprintf("%-15s %d\n", "Contexts:", len(meta.Contexts))
+	for _, ctx := range meta.Contexts {
+		desc += fmt.Sprintf("%-15s %s\n", "", ctx)
 	}
-	desc += fmt.Sprintf("%-15s %s\n", "Active Hash:", chat.currentNode.Hash())
+	desc += fmt.Sprintf("%-15s %d\n", "Nodes:", meta.Nodes)
+	desc += fmt.Sprintf("%-15s %s\n", "Active Hash:", meta.ActiveBranch)
 	return desc, nil
 }
 
-func (c *Core) onListProviders() ([]string, error) {
-	c.provMu.Lock()
-	defer c.provMu.Unlock()
-
+func (c *Core) onListProviders(session *coreSession) ([]string, error) {
 	jsons, err := c.getStorageJsons(providerStoreDirectory)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get provider store jsons: %w", err)
 	}
+	derived := []string{}
+	for _, json := range jsons {
+		derived = append(derived, strings.TrimSuffix(json, ".json"))
+	}
+	if derived, err = c.inSessionWorkspace(session, TrashKindProvider, derived); err != nil {
+		return nil, err
+	}
+
+	c.provMu.Lock()
+	defer c.provMu.Unlock()
 
 	providers := []string{}
 	providers = append(providers, fmt.Sprintf("Base Providers (immutable): %d", len(c.baseProviders)))
@@ -853,8 +1919,7 @@ func (c *Core) onListProviders() ([]string, error) {
 	}
 
 	providers = append(providers, "\n\nDerived Providers:")
-	for _, json := range jsons {
-		name := strings.TrimSuffix(json, ".json")
+	for _, name := range derived {
 		providers = append(providers, fmt.Sprintf("\t%s", name))
 	}
 
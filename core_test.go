@@ -0,0 +1,645 @@
+package brunch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A provider that echoes the user message back so the core can be exercised without a network
+type mockProvider struct {
+	settings ProviderSettings
+
+	// When set, cloning fails with it (like a provider missing its credentials)
+	cloneErr error
+}
+
+func newMockProvider(name string) *mockProvider {
+	return &mockProvider{
+		settings: ProviderSettings{
+			Name:        name,
+			Host:        name,
+			MaxTokens:   1000,
+			Temperature: 0.5,
+		},
+	}
+}
+
+func (mp *mockProvider) NewConversationRoot() RootNode {
+	return *NewRootNode(RootOpt{
+		Provider:    mp.settings.Name,
+		Model:       "mock-model",
+		Prompt:      mp.settings.SystemPrompt,
+		Temperature: mp.settings.Temperature,
+		MaxTokens:   mp.settings.MaxTokens,
+	})
+}
+
+func (mp *mockProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	return func(userMessage string) (*MessagePairNode, error) {
+		msgPair := NewMessagePairNode(node)
+		msgPair.User = NewMessageData("user", userMessage)
+		msgPair.Assistant = NewMessageData("assistant", "echo: "+userMessage)
+		msgPair.Seed = mp.settings.Seed
+		switch parent := node.(type) {
+		case *RootNode:
+			parent.AddChild(msgPair)
+		case *MessagePairNode:
+			parent.AddChild(msgPair)
+		}
+		return msgPair, nil
+	}
+}
+
+func (mp *mockProvider) GetRoot(node Node) RootNode {
+	return mp.NewConversationRoot()
+}
+
+func (mp *mockProvider) GetHistory(node Node) []map[string]string {
+	return []map[string]string{}
+}
+
+func (mp *mockProvider) QueueImages(paths []string) error {
+	return nil
+}
+
+func (mp *mockProvider) Settings() ProviderSettings {
+	return mp.settings
+}
+
+func (mp *mockProvider) CloneWithSettings(settings ProviderSettings) (Provider, error) {
+	if mp.cloneErr != nil {
+		return nil, mp.cloneErr
+	}
+	return &mockProvider{settings: settings}, nil
+}
+
+func newTestCore(t *testing.T) *Core {
+	t.Helper()
+	core := NewCore(CoreOpts{
+		InstallDirectory: t.TempDir() + "/brunch",
+		BaseProviders: map[string]Provider{
+			"mock": newMockProvider("mock"),
+		},
+		ChatStartHandler: func(req Conversation) error { return nil },
+		InfoHandler: InformationCallback{
+			OnListChats:       func([]string) {},
+			OnListProviders:   func([]string) {},
+			OnListContexts:    func([]string) {},
+			OnDescribeContext: func(string) {},
+			OnDescribeChat:    func(string) {},
+			OnHistory:         func([]string) {},
+			OnWhereUsed:       func(string, []ResourceUsage) {},
+			OnCheckContext:    func(ContextHealth) {},
+			OnFsck:            func(VerifyReport) {},
+			OnUsage:           func(UsageReport) {},
+			OnTrash:           func([]TrashedItem) {},
+		},
+	})
+	require.NoError(t, core.Install())
+	return core
+}
+
+func TestCore_SessionHistory(t *testing.T) {
+	core := newTestCore(t)
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\list-chat`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\history`)))
+
+	assert.Equal(t, []string{`\new-chat "a" :provider "mock"`, `\list-chat`}, core.sessions["s1"].history)
+
+	// Replays are recorded as the statement they replayed
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\replay 1`)))
+	assert.Equal(t, `\list-chat`, core.sessions["s1"].history[2])
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\replay 10`)))
+
+	// A restarted core restores the history from the data-store
+	restarted := NewCore(CoreOpts{
+		InstallDirectory: core.installDirectory,
+		BaseProviders:    map[string]Provider{"mock": newMockProvider("mock")},
+		InfoHandler:      core.infoHandler,
+	})
+	require.NoError(t, restarted.ExecuteStatement("s1", NewStatement(`\history`)))
+	assert.Len(t, restarted.sessions["s1"].history, 3)
+}
+
+func TestCore_ResumeSession(t *testing.T) {
+	core := newTestCore(t)
+
+	_, err := core.ResumeSession("s1")
+	assert.Error(t, err, "nothing has been persisted for the session yet")
+
+	var conversation Conversation
+	core.chatStartHandler = func(req Conversation) error {
+		conversation = req
+		return nil
+	}
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	require.NotNil(t, conversation)
+
+	_, err = conversation.SubmitMessage("first")
+	require.NoError(t, err)
+	require.NoError(t, conversation.Parent())
+	_, err = conversation.SubmitMessage("second")
+	require.NoError(t, err)
+	require.NoError(t, conversation.Parent())
+	expected := conversation.CurrentNode().Hash()
+	require.NoError(t, core.SaveActiveChat("s1"))
+
+	restarted := NewCore(CoreOpts{
+		InstallDirectory: core.installDirectory,
+		BaseProviders:    map[string]Provider{"mock": newMockProvider("mock")},
+		InfoHandler:      core.infoHandler,
+	})
+	require.NoError(t, restarted.LoadProviders())
+
+	resumed, err := restarted.ResumeSession("s1")
+	require.NoError(t, err)
+	require.NotNil(t, resumed)
+	assert.Equal(t, expected, resumed.CurrentNode().Hash())
+	assert.Len(t, resumed.ListChildren(), 2)
+}
+
+func TestCore_Authorize(t *testing.T) {
+	core := newTestCore(t)
+	core.authorize = RestrictDestructive(func(sessionId string) bool {
+		return sessionId == "admin"
+	})
+
+	require.NoError(t, core.ExecuteStatement("guest", NewStatement(`\new-chat "a" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("guest", NewStatement(`\list-chat`)))
+
+	err := core.ExecuteStatement("guest", NewStatement(`\del-chat "a"`))
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.FileExists(t, core.installDirectory+"/"+chatStoreDirectory+"/a.json")
+
+	// Overwriting a chat deletes it all the same
+	err = core.ExecuteStatement("guest", NewStatement(`\new-chat "a" :provider "mock" :overwrite true`))
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.True(t, core.ChatExists("a"))
+
+	// Replaying a statement doesn't get around the check
+	require.NoError(t, core.ExecuteStatement("admin", NewStatement(`\new-chat "b" :provider "mock"`)))
+	core.sessions["guest"].history = append(core.sessions["guest"].history, `\del-chat "b"`)
+	assert.ErrorIs(t, core.ExecuteStatement("guest", NewStatement(`\replay 2`)), ErrUnauthorized)
+
+	// Nothing in a transaction runs if any of it is refused
+	err = core.ExecuteTransaction("guest", ParseStatements(`\new-ctx "docs" :dir "/tmp"; \del-chat "a"`))
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.NotContains(t, core.contexts, "docs")
+
+	require.NoError(t, core.ExecuteStatement("admin", NewStatement(`\del-chat "a"`)))
+	assert.NoFileExists(t, core.installDirectory+"/"+chatStoreDirectory+"/a.json")
+}
+
+func TestCore_Rename(t *testing.T) {
+	core := newTestCore(t)
+	exec := func(content string) error {
+		return core.ExecuteStatement("s1", NewStatement(content))
+	}
+
+	require.NoError(t, exec(`\new-provider "fast" :host "mock"`))
+	require.NoError(t, exec(`\new-provider "fast-derived" :host "fast"`))
+	require.NoError(t, exec(`\new-ctx "docs" :dir "/tmp"`))
+	require.NoError(t, exec(`\new-chat "a" :provider "fast"`))
+	require.NoError(t, core.updateSnapshots(func(_ string, snapshot *Snapshot) bool {
+		snapshot.Contexts = append(snapshot.Contexts, "docs")
+		return true
+	}))
+
+	assert.Error(t, exec(`\rename-provider "mock" :to "other"`), "base providers can't be renamed")
+	assert.Error(t, exec(`\rename-provider "fast" :to "fast-derived"`), "name is taken")
+	assert.Error(t, exec(`\rename-ctx "nope" :to "other"`))
+
+	require.NoError(t, exec(`\rename-ctx "docs" :to "manuals"`))
+	require.NoError(t, exec(`\rename-provider "fast" :to "faster"`))
+
+	assert.NotContains(t, core.contexts, "docs")
+	assert.Equal(t, "manuals", core.contexts["manuals"].Name)
+	assert.NoFileExists(t, core.installDirectory+"/"+contextStoreDirectory+"/docs.json")
+	assert.NotContains(t, core.providers, "fast")
+	assert.Equal(t, "faster", core.providers["faster"].Settings().Name)
+	assert.Equal(t, "faster", core.providers["fast-derived"].Settings().Host)
+	assert.NoFileExists(t, core.installDirectory+"/"+providerStoreDirectory+"/fast.json")
+
+	content, err := core.LoadFromChatStore("a.json")
+	require.NoError(t, err)
+	snapshot, err := SnapshotFromJSON([]byte(content))
+	require.NoError(t, err)
+	assert.Equal(t, "faster", snapshot.ProviderName)
+	assert.Equal(t, []string{"manuals"}, snapshot.Contexts)
+
+	// Everything still resolves after a restart
+	restarted := NewCore(CoreOpts{
+		InstallDirectory: core.installDirectory,
+		BaseProviders:    map[string]Provider{"mock": newMockProvider("mock")},
+		InfoHandler:      core.infoHandler,
+		ChatStartHandler: func(req Conversation) error { return nil },
+	})
+	require.NoError(t, restarted.LoadProviders())
+	require.NoError(t, restarted.LoadContexts())
+	require.NoError(t, restarted.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+
+	// Things held by an active chat can't be renamed out from under it
+	assert.ErrorContains(t, restarted.ExecuteStatement("s1", NewStatement(`\rename-ctx "manuals" :to "docs"`)), "active chat")
+}
+
+func TestCore_WhereUsed(t *testing.T) {
+	core := newTestCore(t)
+	exec := func(content string) error {
+		return core.ExecuteStatement("s1", NewStatement(content))
+	}
+
+	require.NoError(t, exec(`\new-provider "fast" :host "mock"`))
+	require.NoError(t, exec(`\new-ctx "docs" :dir "/tmp"`))
+	require.NoError(t, exec(`\new-chat "b" :provider "fast"`))
+	require.NoError(t, exec(`\new-chat "a" :provider "fast"`))
+	require.NoError(t, exec(`\new-chat "c" :provider "mock"`))
+	require.NoError(t, core.updateSnapshots(func(name string, snapshot *Snapshot) bool {
+		if name != "c" {
+			return false
+		}
+		snapshot.Contexts = append(snapshot.Contexts, "docs")
+		return true
+	}))
+
+	usage, err := core.WhereUsed("fast")
+	require.NoError(t, err)
+	assert.Equal(t, []ResourceUsage{
+		{Chat: "a", Provider: true, Nodes: 1},
+		{Chat: "b", Provider: true, Nodes: 1},
+	}, usage)
+
+	usage, err = core.WhereUsed("docs")
+	require.NoError(t, err)
+	assert.Equal(t, []ResourceUsage{{Chat: "c", Context: true, Nodes: 1}}, usage)
+
+	// The index follows chats as they grow, move and go away
+	var conversation Conversation
+	core.chatStartHandler = func(req Conversation) error {
+		conversation = req
+		return nil
+	}
+	require.NoError(t, exec(`\chat "a"`))
+	_, err = conversation.SubmitMessage("hello")
+	require.NoError(t, err)
+	require.NoError(t, core.SaveActiveChat("s1"))
+	require.NoError(t, core.EndSession("s1"))
+	core.activeChats = map[string]*chatInstance{}
+
+	require.NoError(t, exec(`\del-chat "b"`))
+	require.NoError(t, exec(`\rename-provider "fast" :to "faster"`))
+
+	usage, err = core.WhereUsed("faster")
+	require.NoError(t, err)
+	assert.Equal(t, []ResourceUsage{{Chat: "a", Provider: true, Nodes: 2}}, usage)
+
+	var reported []ResourceUsage
+	core.infoHandler.OnWhereUsed = func(name string, usage []ResourceUsage) {
+		reported = usage
+	}
+	require.NoError(t, exec(`\where-used "fast"`))
+	assert.Empty(t, reported)
+}
+
+func TestCore_ReferenceIndexPersisted(t *testing.T) {
+	core := newTestCore(t)
+	exec := func(content string) error {
+		return core.ExecuteStatement("s1", NewStatement(content))
+	}
+
+	require.NoError(t, exec(`\new-provider "fast" :host "mock"`))
+	require.NoError(t, exec(`\new-ctx "docs" :dir "/tmp"`))
+	require.NoError(t, exec(`\new-chat "a" :provider "fast"`))
+	require.NoError(t, core.updateSnapshots(func(_ string, snapshot *Snapshot) bool {
+		snapshot.Contexts = append(snapshot.Contexts, "docs")
+		return true
+	}))
+	assert.FileExists(t, core.installDirectory+"/"+dataStoreDirectory+"/"+referenceIndexFile)
+
+	assert.ErrorContains(t, exec(`\del-provider "fast"`), "in use")
+	assert.ErrorContains(t, exec(`\del-ctx "docs"`), "in use")
+
+	// A restarted core trusts the stored index, so an entry only it knows about shows up
+	restart := func() *Core {
+		restarted := NewCore(CoreOpts{
+			InstallDirectory: core.installDirectory,
+			BaseProviders:    map[string]Provider{"mock": newMockProvider("mock")},
+			InfoHandler:      core.infoHandler,
+		})
+		require.NoError(t, restarted.LoadProviders())
+		require.NoError(t, restarted.LoadContexts())
+		return restarted
+	}
+	stored, err := core.LoadFromDataStore(referenceIndexFile)
+	require.NoError(t, err)
+	require.NoError(t, core.AddToDataStore(referenceIndexFile, strings.Replace(stored, `"nodes":1`, `"nodes":7`, 1)))
+	usage, err := restart().WhereUsed("fast")
+	require.NoError(t, err)
+	assert.Equal(t, []ResourceUsage{{Chat: "a", Provider: true, Context: false, Nodes: 7}}, usage)
+
+	// Creating a chat after a restart extends the stored index rather than rebuilding it
+	restarted := restart()
+	require.NoError(t, restarted.ExecuteStatement("s1", NewStatement(`\new-chat "b" :provider "fast"`)))
+	usage, err = restarted.WhereUsed("fast")
+	require.NoError(t, err)
+	assert.Equal(t, 7, usage[0].Nodes)
+	assert.Len(t, usage, 2)
+
+	// A chat removed by hand no longer matches the stored index so it gets rebuilt
+	require.NoError(t, os.Remove(core.installDirectory+"/"+chatStoreDirectory+"/a.json"))
+	usage, err = restart().WhereUsed("fast")
+	require.NoError(t, err)
+	assert.Equal(t, []ResourceUsage{{Chat: "b", Provider: true, Nodes: 1}}, usage)
+}
+
+func TestCore_ChatMetadata(t *testing.T) {
+	core := newTestCore(t)
+	exec := func(content string) error {
+		return core.ExecuteStatement("s1", NewStatement(content))
+	}
+
+	require.NoError(t, exec(`\new-provider "fast" :host "mock" :max-tokens 10 :system-prompt "be quick"`))
+	require.NoError(t, exec(`\new-chat "b" :provider "fast"`))
+	require.NoError(t, exec(`\new-chat "a" :provider "mock"`))
+
+	meta, err := core.ChatMetadata("b")
+	require.NoError(t, err)
+	assert.Equal(t, "b", meta.Name)
+	assert.Equal(t, "fast", meta.Provider)
+	assert.Equal(t, 10, meta.Settings.MaxTokens)
+	assert.Equal(t, "be quick", meta.Settings.SystemPrompt)
+	assert.Equal(t, []string{}, meta.Contexts)
+	assert.Equal(t, 1, meta.Nodes)
+	assert.NotEmpty(t, meta.ActiveBranch)
+
+	all, err := core.ListChatMetadata()
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "a", all[0].Name)
+	assert.Equal(t, "b", all[1].Name)
+
+	var described string
+	core.infoHandler.OnDescribeChat = func(data string) {
+		described = data
+	}
+	require.NoError(t, exec(`\desc-chat "b"`))
+	assert.Contains(t, described, "be quick")
+
+	// Describing and listing never make a chat active
+	assert.Empty(t, core.activeChats)
+
+	_, err = core.ChatMetadata("nope")
+	assert.Error(t, err)
+}
+
+func TestCore_ChatMetadataLeavesBlobs(t *testing.T) {
+	core := newTestCore(t)
+	prompt := strings.Repeat("a long system prompt ", 100)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(fmt.Sprintf(`\new-provider "long" :host "mock" :system-prompt "%s"`, prompt))))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "long"`)))
+	require.NotZero(t, blobCount(t, core))
+
+	// The blobs aren't read, describing a chat costs the same however much it holds
+	require.NoError(t, os.RemoveAll(core.storePath(dataStoreDirectory, blobDirectory)))
+	meta, err := core.ChatMetadata("a")
+	require.NoError(t, err)
+	assert.Equal(t, "long", meta.Provider)
+	assert.Equal(t, 1, meta.Nodes)
+}
+
+func TestCore_ChatMetadataRootSettings(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+
+	// The provider changed after the chat was created, the chat still runs with its root's settings
+	changed := newMockProvider("mock")
+	changed.settings.Temperature = 0.9
+	changed.settings.MaxTokens = 2000
+	core.providers["mock"] = changed
+
+	meta, err := core.ChatMetadata("a")
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, meta.Settings.Temperature)
+	assert.Equal(t, 1000, meta.Settings.MaxTokens)
+
+	var described string
+	core.infoHandler.OnDescribeChat = func(data string) {
+		described = data
+	}
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\desc-chat "a"`)))
+	assert.Contains(t, described, "1000")
+	assert.Contains(t, described, "0.50")
+	assert.NotContains(t, described, "2000")
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	assert.Equal(t, meta.Settings.Temperature, chat.provider.Settings().Temperature)
+	assert.Equal(t, meta.Settings.MaxTokens, chat.provider.Settings().MaxTokens)
+}
+
+func TestCore_Fork(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+
+	// Nothing to fork without a chat
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\fork "b"`)))
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	_, err = chat.SubmitMessage("one")
+	require.NoError(t, err)
+	_, err = chat.SubmitMessage("two")
+	require.NoError(t, err)
+	require.NoError(t, chat.Parent())
+	_, err = chat.SubmitMessage("three")
+	require.NoError(t, err)
+	current := chat.currentNode.Hash()
+	require.NoError(t, chat.SetEnv("TOKEN", "hunter2"))
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\fork "b"`)))
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\fork "b"`)), "fork should not overwrite a chat")
+
+	meta, err := core.ChatMetadata("b")
+	require.NoError(t, err)
+	assert.Equal(t, 3, meta.Nodes, "only the root, one and three should be in the fork")
+	assert.Equal(t, current, meta.ActiveBranch)
+	assert.Equal(t, "mock", meta.Provider)
+
+	// The fork loads with the same history, and the original is untouched
+	require.NoError(t, core.ExecuteStatement("s2", NewStatement(`\chat "b"`)))
+	fork, err := core.GetActiveChat("b")
+	require.NoError(t, err)
+	assert.Equal(t, chat.PrintHistory(), fork.PrintHistory())
+	assert.Len(t, MapTree(&chat.root), 4)
+
+	// The environment goes with it, and setting it in the fork leaves the original's alone
+	assert.Equal(t, []string{"TOKEN=hunter2"}, fork.Environ())
+	require.NoError(t, fork.SetEnv("TOKEN", "other"))
+	assert.Equal(t, []string{"TOKEN=hunter2"}, chat.Environ())
+}
+
+func TestCore_Logger(t *testing.T) {
+	var out bytes.Buffer
+	core := NewCore(CoreOpts{
+		InstallDirectory: t.TempDir() + "/brunch",
+		BaseProviders:    map[string]Provider{"mock": newMockProvider("mock")},
+		ChatStartHandler: func(Conversation) error { return nil },
+		Logger:           slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	require.NoError(t, core.Install())
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "p" :host "mock"`)))
+	assert.Contains(t, out.String(), "adding provider")
+	assert.Contains(t, out.String(), "name=p")
+
+	// Without one the core falls back to slog's default
+	assert.Equal(t, slog.Default(), newTestCore(t).logger)
+}
+
+func TestCore_PromptSuffix(t *testing.T) {
+	core := newTestCore(t)
+	base := newMockProvider("decorated")
+	base.settings.PromptSuffix = "answer briefly"
+	require.NoError(t, core.RegisterBaseProvider("decorated", base))
+
+	// Derived providers keep their host's suffix, separate from their own prompt
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "p" :host "decorated" :system-prompt "be nice"`)))
+	settings := core.providers["p"].Settings()
+	assert.Equal(t, "answer briefly", settings.PromptSuffix)
+	assert.Equal(t, "be nice", settings.SystemPrompt)
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "q" :host "mock"`)))
+	assert.Empty(t, core.providers["q"].Settings().PromptSuffix)
+}
+
+func TestCore_Seed(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "seeded" :host "mock" :seed 42`)))
+	require.NotNil(t, core.providers["seeded"].Settings().Seed)
+	assert.Equal(t, int64(42), *core.providers["seeded"].Settings().Seed)
+
+	// Derived from a seeded provider it keeps the seed, unseeded providers stay unseeded
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "child" :host "seeded"`)))
+	assert.Equal(t, int64(42), *core.providers["child"].Settings().Seed)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "plain" :host "mock"`)))
+	assert.Nil(t, core.providers["plain"].Settings().Seed)
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "bad" :host "mock" :seed "x"`)))
+
+	// The seed is recorded on the nodes and survives the chat being saved and loaded
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "child"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	_, err = chat.SubmitMessage("hi")
+	require.NoError(t, err)
+	hash := chat.currentNode.Hash()
+	require.NoError(t, core.writeSnapshot("a", chat))
+
+	loaded, err := core.loadChat("a", &hash)
+	require.NoError(t, err)
+	pair, ok := loaded.currentNode.(*MessagePairNode)
+	require.True(t, ok)
+	require.NotNil(t, pair.Seed)
+	assert.Equal(t, int64(42), *pair.Seed)
+}
+
+func TestCore_ReconcileRootSettings(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	require.NoError(t, core.writeSnapshot("a", chat))
+
+	// The provider changed after the chat was created
+	var out bytes.Buffer
+	core.logger = slog.New(slog.NewTextHandler(&out, nil))
+	changed := newMockProvider("mock")
+	changed.settings.Temperature = 0.9
+	changed.settings.MaxTokens = 2000
+	core.providers["mock"] = changed
+	delete(core.activeChats, "a")
+
+	loaded, err := core.loadChat("a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, loaded.provider.Settings().Temperature)
+	assert.Equal(t, 1000, loaded.provider.Settings().MaxTokens)
+	assert.Contains(t, out.String(), "provider temperature differs")
+	assert.Contains(t, out.String(), "provider max tokens differ")
+
+	// Nothing to say when they match
+	out.Reset()
+	core.providers["mock"] = newMockProvider("mock")
+	delete(core.activeChats, "a")
+	_, err = core.loadChat("a", nil)
+	require.NoError(t, err)
+	assert.Empty(t, out.String())
+}
+
+func TestCore_ProviderCloneError(t *testing.T) {
+	core := newTestCore(t)
+	broken := newMockProvider("broken")
+	broken.cloneErr = errors.New("no api key")
+	require.NoError(t, core.RegisterBaseProvider("broken", broken))
+
+	// The statement fails, the core carries on
+	err := core.ExecuteStatement("s1", NewStatement(`\new-provider "p" :host "broken"`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no api key")
+	err = core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "broken"`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no api key")
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "b" :provider "mock"`)))
+	chats, err := core.onListChats()
+	require.NoError(t, err)
+	assert.NotContains(t, chats, "a")
+}
+
+func TestCore_NewChatNameCollision(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	_, err = chat.SubmitMessage("keep me")
+	require.NoError(t, err)
+	require.NoError(t, core.SaveActiveChat("s1"))
+
+	// The chat isn't replaced unless asked to, and not while it is open
+	assert.ErrorContains(t, core.ExecuteStatement("s2", NewStatement(`\new-chat "a" :provider "mock"`)), "already exists")
+	assert.ErrorContains(t, core.ValidateStatements(ParseStatements(`\new-chat "a" :provider "mock"`)), "already exists")
+	assert.NoError(t, core.ValidateStatements(ParseStatements(`\new-chat "a" :provider "mock" :overwrite true`)))
+	assert.ErrorContains(t, core.ExecuteStatement("s2", NewStatement(`\new-chat "a" :provider "mock" :overwrite true`)), "currently active")
+
+	assert.True(t, core.ChatExists("a"))
+	assert.False(t, core.ChatExists("b"))
+	assert.Equal(t, "a-2", core.UniqueChatName("a"))
+	assert.Equal(t, "b", core.UniqueChatName("b"))
+
+	// Replaced, the old one goes to the trash
+	require.NoError(t, core.NewChat("c", "mock", false, false))
+	require.NoError(t, core.ExecuteStatement("s2", NewStatement(`\new-chat "c" :provider "mock" :profile true :overwrite true`)))
+	_, err = core.findTrashed("c", TrashKindChat, "")
+	assert.NoError(t, err)
+	content, err := core.LoadFromChatStore("c.json")
+	require.NoError(t, err)
+	snapshot, err := SnapshotFromJSON([]byte(content))
+	require.NoError(t, err)
+	assert.True(t, snapshot.UseProfile)
+	assert.Equal(t, "c-2", core.UniqueChatName("c"))
+}
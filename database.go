@@ -0,0 +1,265 @@
+package brunch
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A database context gives the provider the whole schema with every message, and lets it look at
+// the data. A provider that can call tools is offered the query as a tool (query_database). Any
+// other can reply with only a <query context="name">SELECT ...</query>, which is run against the
+// database and the message is asked again with the rows, the tree only keeps the final answer
+const (
+	// How many queries one message can run before the provider has to answer with what it has
+	databaseQueryRounds = 3
+
+	// Rows given back for a query, the rest are left out
+	databaseQueryRows = 50
+
+	databaseQueryTimeout = 10 * time.Second
+)
+
+// Knowledge that can be queried, the chat offers it to the provider as a tool
+type queryableKnowledge interface {
+	KnowledgeProvider
+
+	// The whole schema, given with every message
+	Schema() string
+
+	// Run a read-only query and format the rows it returned
+	Query(query string) (string, error)
+}
+
+var databaseQueryTag = regexp.MustCompile(`(?s)<query context="([^"]+)">(.*?)</query>`)
+
+// Statements that only read. Anything else is refused before it gets to the database, and so are
+// queries with a word that changes data anywhere in them (WITH t AS (...) DELETE ..., SELECT INTO).
+// What is run still goes through a read-only connection and transaction that is rolled back
+var readOnlyStatements = []string{"select", "with", "explain", "show", "describe", "desc", "values"}
+
+var modifyingWords = map[string]bool{
+	"insert": true, "update": true, "delete": true, "merge": true, "upsert": true,
+	"create": true, "drop": true, "alter": true, "truncate": true, "rename": true, "grant": true,
+	"revoke": true, "attach": true, "detach": true, "pragma": true, "vacuum": true, "reindex": true,
+	"copy": true, "call": true, "exec": true, "execute": true, "lock": true, "set": true, "into": true,
+}
+
+// Quoted strings and identifiers, their words aren't keywords
+var quotedSQL = regexp.MustCompile(`'(?:[^']|'')*'|"(?:[^"]|"")*"|` + "`[^`]*`")
+
+var sqlWord = regexp.MustCompile(`[a-z_][a-z0-9_]*`)
+
+func checkReadOnlyQuery(query string) error {
+	query = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if query == "" {
+		return errors.New("the query is empty")
+	}
+	if strings.Contains(query, ";") {
+		return errors.New("only one statement can be run at a time")
+	}
+	fields := strings.Fields(strings.ToLower(query))
+	reads := false
+	for _, statement := range readOnlyStatements {
+		reads = reads || fields[0] == statement
+	}
+	if !reads {
+		return fmt.Errorf("only queries that read can be run, not %s", strings.ToUpper(fields[0]))
+	}
+	for _, word := range sqlWord.FindAllString(quotedSQL.ReplaceAllString(strings.ToLower(query), "''"), -1) {
+		if modifyingWords[word] {
+			return fmt.Errorf("only queries that read can be run, this one has %s", strings.ToUpper(word))
+		}
+	}
+	return nil
+}
+
+func (d *databaseKnowledge) Schema() string {
+	tables := make([]string, len(d.chunks))
+	for i, chunk := range d.chunks {
+		tables[i] = chunk.Content
+	}
+	return strings.Join(tables, "\n")
+}
+
+func (d *databaseKnowledge) Query(query string) (string, error) {
+	if err := checkReadOnlyQuery(query); err != nil {
+		return "", err
+	}
+	db, _, err := openDatabase(d.dsn)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), databaseQueryTimeout)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return "", fmt.Errorf("failed to start a read-only transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	return formatRows(rows)
+}
+
+// The rows as tab separated lines under a header
+func formatRows(rows *sql.Rows) (string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString(strings.Join(columns, "\t"))
+
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	count := 0
+	for rows.Next() {
+		if count == databaseQueryRows {
+			fmt.Fprintf(&sb, "\n(only the first %d rows are shown)", databaseQueryRows)
+			break
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return "", err
+		}
+		cells := make([]string, len(values))
+		for i, value := range values {
+			switch v := value.(type) {
+			case nil:
+				cells[i] = "NULL"
+			case []byte:
+				cells[i] = string(v)
+			default:
+				cells[i] = fmt.Sprint(v)
+			}
+		}
+		sb.WriteString("\n")
+		sb.WriteString(strings.Join(cells, "\t"))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if count == 0 {
+		sb.WriteString("\n(no rows)")
+	}
+	return sb.String(), nil
+}
+
+// The chat's databases, by context name
+func (c *chatInstance) databases() ([]string, map[string]queryableKnowledge) {
+	names := []string{}
+	databases := map[string]queryableKnowledge{}
+	for name, knowledge := range c.knowledge {
+		if queryable, ok := knowledge.(queryableKnowledge); ok {
+			names = append(names, name)
+			databases[name] = queryable
+		}
+	}
+	sort.Strings(names)
+	return names, databases
+}
+
+// The schemas of the chat's databases and how to query them, empty if it has none. A provider
+// offered the query tool is told to use it instead of the query tag
+func (c *chatInstance) databasePrompt(queryTool bool) string {
+	names, databases := c.databases()
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "<database context=%q>\n%s\n</database>\n", name, databases[name].Schema())
+	}
+	if queryTool {
+		fmt.Fprintf(&sb, "To look at the data in a database, call the %s tool with the database's context ", databaseToolName)
+		sb.WriteString("and a read-only query.\n\n")
+		return sb.String()
+	}
+	sb.WriteString("To look at the data in a database, reply with nothing but a read-only query in a query tag ")
+	sb.WriteString("naming the database's context, like <query context=\"context name\">SELECT ...</query>. ")
+	sb.WriteString("The rows will be sent back to you to answer with.\n\n")
+	return sb.String()
+}
+
+const databaseToolName = "query_database"
+
+// The tool that queries the chat's databases, for providers that can call tools. It is only
+// there when the chat has a database
+func (c *chatInstance) databaseTool() (Tool, bool) {
+	names, _ := c.databases()
+	if len(names) == 0 {
+		return Tool{}, false
+	}
+	schema, _ := json.Marshal(map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"context": map[string]any{"type": "string", "enum": names, "description": "the database's context"},
+			"query":   map[string]any{"type": "string", "description": "a single read-only SQL query"},
+		},
+		"required": []string{"context", "query"},
+	})
+	return Tool{
+		Name:        databaseToolName,
+		Description: "Run a read-only SQL query against one of the databases whose schema was given, and get back the rows.",
+		Schema:      schema,
+		Call: func(input json.RawMessage, _ map[string]string) (string, error) {
+			var args struct {
+				Context string `json:"context"`
+				Query   string `json:"query"`
+			}
+			if err := json.Unmarshal(input, &args); err != nil {
+				return "", fmt.Errorf("invalid input: %w", err)
+			}
+			_, databases := c.databases()
+			queryable, ok := databases[args.Context]
+			if !ok {
+				return "", fmt.Errorf("there is no database context named %s", args.Context)
+			}
+			return queryable.Query(args.Query)
+		},
+	}, true
+}
+
+// The query the reply asks for, if it asks for one of the chat's databases
+func (c *chatInstance) requestedQuery(reply string) (queryableKnowledge, string, string, bool) {
+	match := databaseQueryTag.FindStringSubmatch(reply)
+	if match == nil {
+		return nil, "", "", false
+	}
+	queryable, ok := c.knowledge[match[1]].(queryableKnowledge)
+	if !ok {
+		return nil, "", "", false
+	}
+	return queryable, match[1], strings.TrimSpace(match[2]), true
+}
+
+// Run the query the reply asked for and add what it returned to the message, so the provider
+// can be asked again. A query that fails is given back too, the provider can fix it
+func (c *chatInstance) answerQuery(sent string, reply string) (string, bool) {
+	queryable, name, query, requested := c.requestedQuery(reply)
+	if !requested {
+		return sent, false
+	}
+	result, err := queryable.Query(query)
+	if err != nil {
+		c.logger().Debug("database query failed", "context", name, "error", err)
+		result = "error: " + err.Error()
+	}
+	return fmt.Sprintf("%s\n\n<query context=%q>%s</query>\n<result>\n%s\n</result>", sent, name, query, result), true
+}
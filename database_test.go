@@ -0,0 +1,245 @@
+package brunch
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A sqlite driver that has one table with two rows, whatever it is asked
+type fakeSQLite struct {
+	mu       sync.Mutex
+	readOnly bool
+	source   string
+}
+
+var fakeDatabase = &fakeSQLite{}
+var registerFakeSQLite sync.Once
+
+func (f *fakeSQLite) Close() error              { return nil }
+func (f *fakeSQLite) Begin() (driver.Tx, error) { return f, nil }
+func (f *fakeSQLite) Commit() error             { return nil }
+func (f *fakeSQLite) Rollback() error           { return nil }
+
+func (f *fakeSQLite) Open(source string) (driver.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.source = source
+	return f, nil
+}
+
+func (f *fakeSQLite) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readOnly = opts.ReadOnly
+	return f, nil
+}
+
+func (f *fakeSQLite) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt(query), nil
+}
+
+type fakeStmt string
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("read only")
+}
+
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	if strings.Contains(string(s), "sqlite_master") {
+		return &fakeRows{
+			columns: []string{"name", "sql", ""},
+			values:  [][]driver.Value{{"users", "CREATE TABLE users (id INTEGER, name TEXT)", ""}},
+		}, nil
+	}
+	return &fakeRows{
+		columns: []string{"id", "name"},
+		values:  [][]driver.Value{{int64(1), "ada"}, {int64(2), nil}},
+	}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func newFakeDatabaseKnowledge(t *testing.T) *databaseKnowledge {
+	t.Helper()
+	registerFakeSQLite.Do(func() {
+		sql.Register("sqlite", fakeDatabase)
+	})
+	knowledge := &databaseKnowledge{dsn: "file:app.db"}
+	require.NoError(t, knowledge.Index())
+	return knowledge
+}
+
+func TestCheckReadOnlyQuery(t *testing.T) {
+	for _, query := range []string{"SELECT 1", " select * from users; ", "WITH t AS (SELECT 1) SELECT * FROM t", "explain select 1"} {
+		assert.NoError(t, checkReadOnlyQuery(query), query)
+	}
+	for _, query := range []string{"", "DELETE FROM users", "drop table users", "SELECT 1; DELETE FROM users", "PRAGMA journal_mode = off",
+		"WITH t AS (SELECT 1) DELETE FROM users", "with gone as (delete from users returning *) select * from gone",
+		"SELECT * INTO copied FROM users", "explain update users set name = 'x'"} {
+		assert.Error(t, checkReadOnlyQuery(query), query)
+	}
+
+	// Words in strings and quoted names aren't statements
+	assert.NoError(t, checkReadOnlyQuery(`SELECT * FROM users WHERE name = 'drop it''s update' AND "delete" = 1`))
+}
+
+func TestReadOnlySource(t *testing.T) {
+	assert.Equal(t, "file:app.db?mode=ro", readOnlySource("sqlite", "app.db"))
+	assert.Equal(t, "file:app.db?cache=shared&mode=ro", readOnlySource("sqlite", "file:app.db?mode=rwc&cache=shared"))
+	assert.Equal(t, "postgres://user@host/app?options=-c+default_transaction_read_only%3Don&sslmode=disable",
+		readOnlySource("postgres", "postgres://user@host/app?sslmode=disable"))
+	assert.Equal(t, "dbname=app options='-c default_transaction_read_only=on'", readOnlySource("postgres", "dbname=app"))
+	assert.Equal(t, "user:pass@tcp(host:3306)/app?parseTime=true&transaction_read_only=1",
+		readOnlySource("mysql", "user:pass@tcp(host:3306)/app?parseTime=true"))
+}
+
+func TestDatabaseKnowledge_Query(t *testing.T) {
+	knowledge := newFakeDatabaseKnowledge(t)
+	assert.Equal(t, "CREATE TABLE users (id INTEGER, name TEXT)", knowledge.Schema())
+
+	rows, err := knowledge.Query("SELECT id, name FROM users;")
+	require.NoError(t, err)
+	assert.Equal(t, "id\tname\n1\tada\n2\tNULL", rows)
+	assert.True(t, fakeDatabase.readOnly, "queries should run in a read-only transaction")
+	assert.Equal(t, "file:app.db?mode=ro", fakeDatabase.source, "the connection should be read-only")
+
+	_, err = knowledge.Query("UPDATE users SET name = 'x'")
+	assert.ErrorContains(t, err, "only queries that read")
+}
+
+// Replies with a query first, then with an answer made from what the query returned
+type queryingProvider struct {
+	mockProvider
+	sent []string
+}
+
+func (qp *queryingProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	return func(userMessage string) (*MessagePairNode, error) {
+		qp.sent = append(qp.sent, userMessage)
+		reply := `<query context="db">SELECT id, name FROM users</query>`
+		if strings.Contains(userMessage, "<result>") {
+			reply = "there are 2 users"
+		}
+		msgPair := NewMessagePairNode(node)
+		msgPair.User = NewMessageData("user", userMessage)
+		msgPair.Assistant = NewMessageData("assistant", reply)
+		holder, _ := treeNode(node)
+		holder.AddChild(msgPair)
+		return msgPair, nil
+	}
+}
+
+func TestChat_DatabaseQuery(t *testing.T) {
+	provider := &queryingProvider{mockProvider: *newMockProvider("mock")}
+	chat := &chatInstance{
+		provider:    provider,
+		root:        provider.NewConversationRoot(),
+		knowledge:   map[string]KnowledgeProvider{"db": newFakeDatabaseKnowledge(t)},
+		chatEnabled: true,
+	}
+	chat.currentNode = &chat.root
+
+	reply, err := chat.SubmitMessage("how many users are there?")
+	require.NoError(t, err)
+	assert.Equal(t, "there are 2 users", reply)
+
+	require.Len(t, provider.sent, 2)
+	assert.Contains(t, provider.sent[0], "CREATE TABLE users", "the schema should be sent with the message")
+	assert.Contains(t, provider.sent[1], "1\tada", "the rows should be sent when the provider asks again")
+
+	// Only the final answer is kept, with what the user said
+	require.Len(t, chat.root.Children, 1)
+	pair := chat.root.Children[0].(*MessagePairNode)
+	assert.Equal(t, "how many users are there?", pair.User.UnencodedContent())
+	assert.Equal(t, "there are 2 users", pair.Assistant.UnencodedContent())
+}
+
+// Queries the database with the tool, then answers with the rows it got
+type queryToolProvider struct {
+	mockProvider
+	offered []string
+	sent    []string
+}
+
+func (qp *queryToolProvider) ExtendWithTools(ctx context.Context, node Node, tools []Tool) MessageCreator {
+	for _, tool := range tools {
+		qp.offered = append(qp.offered, tool.Name)
+	}
+	return func(userMessage string) (*MessagePairNode, error) {
+		qp.sent = append(qp.sent, userMessage)
+		pair, err := qp.mockProvider.ExtendFrom(ctx, node)(userMessage)
+		if err != nil {
+			return nil, err
+		}
+		if previous, ok := node.(*MessagePairNode); ok && len(previous.ToolCalls) > 0 {
+			pair.Assistant = NewMessageData("assistant", "rows: "+previous.ToolCalls[0].Output+previous.ToolCalls[0].Error)
+			return pair, nil
+		}
+		pair.Assistant = NewMessageData("assistant", "let me look")
+		pair.ToolCalls = []ToolCall{{ID: "toolu_1", Name: databaseToolName, Input: json.RawMessage(`{"context":"db","query":"SELECT id, name FROM users"}`)}}
+		return pair, nil
+	}
+}
+
+func TestChat_DatabaseQueryTool(t *testing.T) {
+	provider := &queryToolProvider{mockProvider: *newMockProvider("mock")}
+	chat := newChatInstance(provider)
+	chat.knowledge = map[string]KnowledgeProvider{"db": newFakeDatabaseKnowledge(t)}
+
+	reply, err := chat.SubmitMessage("how many users are there?")
+	require.NoError(t, err)
+	assert.Equal(t, "rows: id\tname\n1\tada\n2\tNULL", reply)
+	assert.Equal(t, []string{databaseToolName, databaseToolName}, provider.offered)
+	assert.Contains(t, provider.sent[0], "call the query_database tool")
+	assert.NotContains(t, provider.sent[0], "<query context")
+
+	// The call stays in the tree like any other tool call
+	require.Len(t, chat.root.Children, 1)
+	call := chat.root.Children[0].(*MessagePairNode)
+	require.Len(t, call.ToolCalls, 1)
+	assert.Same(t, chat.currentNode, call.Children[0])
+
+	// Queries that change data are refused
+	tool, ok := chat.databaseTool()
+	require.True(t, ok)
+	_, err = tool.Call(json.RawMessage(`{"context":"db","query":"WITH t AS (SELECT 1) DELETE FROM users"}`), nil)
+	assert.ErrorContains(t, err, "DELETE")
+	_, err = tool.Call(json.RawMessage(`{"context":"other","query":"SELECT 1"}`), nil)
+	assert.Error(t, err)
+}
+
+func TestChat_DatabasePromptOrder(t *testing.T) {
+	chat := newChatInstance(newMockProvider("mock"))
+	knowledge := newFakeDatabaseKnowledge(t)
+	chat.knowledge = map[string]KnowledgeProvider{"c": knowledge, "a": knowledge, "b": knowledge}
+	prompt := chat.databasePrompt(false)
+	a, b, c := strings.Index(prompt, `context="a"`), strings.Index(prompt, `context="b"`), strings.Index(prompt, `context="c"`)
+	assert.True(t, a < b && b < c, prompt)
+	assert.Equal(t, prompt, chat.databasePrompt(false))
+}
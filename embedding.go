@@ -0,0 +1,210 @@
+package brunch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// An Embedder turns text into vectors that are close together when the texts mean similar
+// things. It is given to the core (CoreOpts.Embedder) and used to index directory and web
+// contexts, there is none built in as every embedding model is behind someone's API
+type Embedder interface {
+
+	// Name identifies the model. Embeddings from different models can't be compared, so an
+	// index made with another model is embedded again
+	Name() string
+
+	// Embed returns a vector for each text, in the same order
+	Embed(texts []string) ([][]float32, error)
+}
+
+// Directory indexes are kept in the context-store, in a directory of their own so they aren't
+// mistaken for contexts
+const knowledgeIndexDirectory = "index"
+
+// How many chunks are given to the embedder at once
+const embedBatchSize = 64
+
+// Indexes from before the vectors were moved to the vector store, or before chunks kept where
+// they start in their file, are read again from scratch
+const directoryIndexVersion = 3
+
+type indexedChunk struct {
+	Source  string `json:"source"`
+	Offset  int    `json:"offset"`
+	Content string `json:"content"`
+}
+
+// A file as it was when it was indexed, it is only read again once it has changed
+type indexedFile struct {
+	ModTime time.Time      `json:"mod_time"`
+	Size    int64          `json:"size"`
+	Chunks  []indexedChunk `json:"chunks"`
+}
+
+// What was indexed from a directory. The embeddings are in the vector store, in the context's
+// collection, so the index is only what is needed to tell which files changed
+type directoryIndex struct {
+	Version  int                    `json:"version"`
+	Dir      string                 `json:"dir"`
+	Embedder string                 `json:"embedder,omitempty"`
+	Files    map[string]indexedFile `json:"files"`
+}
+
+// Chunks embedded into a vector store collection, and searched by similarity to the query
+type embeddedKnowledge struct {
+	embedder   Embedder
+	store      VectorStore
+	collection string
+}
+
+// The knowledge provider for a context with what the core adds to it. Directories and web pages
+// are embedded with the core's embedder, if it has one, into its vector store, and the index
+// of a directory is kept in the context-store
+func (c *Core) knowledgeProvider(ctx *ContextSettings) (KnowledgeProvider, error) {
+	var embedded *embeddedKnowledge
+	if c.embedder != nil {
+		embedded = &embeddedKnowledge{
+			embedder:   c.embedder,
+			store:      c.vectors,
+			collection: ctx.Name,
+		}
+	}
+	switch ctx.Type {
+	case ContextTypeDirectory:
+		return &directoryKnowledge{
+			dir:       ctx.Value,
+			indexPath: c.storePath(contextStoreDirectory, knowledgeIndexDirectory, fmt.Sprintf("%s.json", ctx.Name)),
+			embedded:  embedded,
+		}, nil
+	case ContextTypeWeb:
+		return &webKnowledge{url: ctx.Value, embedded: embedded}, nil
+	}
+	return ctx.KnowledgeProvider()
+}
+
+// Remove what was indexed for a context, its directory index and its vectors
+func (c *Core) removeKnowledgeIndex(name string) {
+	path := c.storePath(contextStoreDirectory, knowledgeIndexDirectory, fmt.Sprintf("%s.json", name))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		c.logger.Warn("failed to remove context index", "context", name, "error", err)
+	}
+	if err := c.vectors.Drop(name); err != nil {
+		c.logger.Warn("failed to remove context vectors", "context", name, "error", err)
+	}
+}
+
+func (d *directoryKnowledge) embedderName() string {
+	if d.embedded == nil {
+		return ""
+	}
+	return d.embedded.embedder.Name()
+}
+
+// The files from the last time the directory was indexed. Nothing is reused if it was the index
+// of another directory (the context was re-pointed) or made with another embedder
+func (d *directoryKnowledge) loadIndex() map[string]indexedFile {
+	if d.files != nil {
+		return d.files
+	}
+	if d.indexPath == "" {
+		return map[string]indexedFile{}
+	}
+	content, err := os.ReadFile(d.indexPath)
+	if err != nil {
+		return map[string]indexedFile{}
+	}
+	var idx directoryIndex
+	if err := json.Unmarshal(content, &idx); err != nil || idx.Version != directoryIndexVersion ||
+		idx.Dir != d.dir || idx.Embedder != d.embedderName() {
+		return map[string]indexedFile{}
+	}
+	return idx.Files
+}
+
+func (d *directoryKnowledge) saveIndex() error {
+	if d.indexPath == "" {
+		return nil
+	}
+	content, err := json.Marshal(directoryIndex{
+		Version:  directoryIndexVersion,
+		Dir:      d.dir,
+		Embedder: d.embedderName(),
+		Files:    d.files,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.indexPath), 0755); err != nil {
+		return fmt.Errorf("failed to create index directory: %w", err)
+	}
+	if err := os.WriteFile(d.indexPath, content, 0644); err != nil {
+		return fmt.Errorf("failed to save index of %s: %w", d.dir, err)
+	}
+	return nil
+}
+
+// Embed the source's chunks and replace what the store had for it
+func (e *embeddedKnowledge) upsert(source string, chunks []indexedChunk) error {
+	vectors := make([]Vector, len(chunks))
+	for start := 0; start < len(chunks); start += embedBatchSize {
+		batch := chunks[start:min(start+embedBatchSize, len(chunks))]
+		texts := make([]string, len(batch))
+		for i, chunk := range batch {
+			texts[i] = chunk.Content
+		}
+		embeddings, err := e.embedder.Embed(texts)
+		if err != nil {
+			return fmt.Errorf("failed to embed %s: %w", source, err)
+		}
+		if len(embeddings) != len(batch) {
+			return fmt.Errorf("embedder returned %d vectors for %d chunks", len(embeddings), len(batch))
+		}
+		for i, chunk := range batch {
+			vectors[start+i] = Vector{Source: chunk.Source, Offset: chunk.Offset, Content: chunk.Content, Embedding: embeddings[i]}
+		}
+	}
+	return e.store.Upsert(e.collection, source, vectors)
+}
+
+func (e *embeddedKnowledge) retrieve(query string, limit int) ([]Knowledge, error) {
+	if limit <= 0 {
+		return []Knowledge{}, nil
+	}
+	embeddings, err := e.embedder.Embed([]string{query})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+	if len(embeddings) != 1 {
+		return nil, fmt.Errorf("embedder returned %d vectors for 1 query", len(embeddings))
+	}
+	matches, err := e.store.Search(e.collection, embeddings[0], limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %s: %w", e.collection, err)
+	}
+	found := make([]Knowledge, len(matches))
+	for i, match := range matches {
+		found[i] = Knowledge{Source: match.Source, Offset: match.Offset, Content: match.Content, Score: match.Score}
+	}
+	return found, nil
+}
+
+func cosineSimilarity(a []float32, b []float32) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
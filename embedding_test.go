@@ -0,0 +1,108 @@
+package brunch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Embeds by counting a few words, which is enough to be similar to the right things
+type wordEmbedder struct {
+	name     string
+	embedded int
+}
+
+var embedderWords = []string{"backup", "deploy", "invoice", "password"}
+
+func (e *wordEmbedder) Name() string { return e.name }
+
+func (e *wordEmbedder) Embed(texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = make([]float32, len(embedderWords))
+		for j, word := range embedderWords {
+			vectors[i][j] = float32(strings.Count(strings.ToLower(text), word))
+		}
+	}
+	e.embedded += len(texts)
+	return vectors, nil
+}
+
+func TestCosineSimilarity(t *testing.T) {
+	assert.InDelta(t, 1.0, cosineSimilarity([]float32{1, 2}, []float32{2, 4}), 0.0001)
+	assert.InDelta(t, 0.0, cosineSimilarity([]float32{1, 0}, []float32{0, 1}), 0.0001)
+	assert.Zero(t, cosineSimilarity([]float32{1}, []float32{1, 2}))
+	assert.Zero(t, cosineSimilarity([]float32{0, 0}, []float32{1, 2}))
+}
+
+func TestDirectoryKnowledge_Embedded(t *testing.T) {
+	core := newTestCore(t)
+	embedder := &wordEmbedder{name: "words-v1"}
+	core.embedder = embedder
+
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	write("ops.md", "Backups are taken every night, a backup is kept for a week")
+	write("billing.md", "Every invoice is sent on the first")
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-ctx "docs" :dir "`+dir+`"`)))
+	ctx := core.contexts["docs"]
+
+	knowledge, err := core.knowledgeProvider(ctx)
+	require.NoError(t, err)
+	require.NoError(t, knowledge.Index())
+	assert.Equal(t, 2, embedder.embedded)
+	assert.Contains(t, knowledge.Describe(), "embedded with words-v1")
+
+	found, err := knowledge.Retrieve("where is the latest backup", 1)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "ops.md", found[0].Source)
+
+	// The index survives a restart, and only what changed is embedded again
+	indexPath := core.storePath(contextStoreDirectory, knowledgeIndexDirectory, "docs.json")
+	assert.FileExists(t, indexPath)
+	embedder.embedded = 0
+	later := time.Now().Add(time.Minute)
+	write("billing.md", "Every invoice is sent on the first, overdue invoice reminders weekly")
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "billing.md"), later, later))
+	knowledge, err = core.knowledgeProvider(ctx)
+	require.NoError(t, err)
+	require.NoError(t, knowledge.Index())
+	assert.Equal(t, 1, embedder.embedded)
+	found, err = knowledge.Retrieve("invoice", 1)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Contains(t, found[0].Content, "overdue")
+
+	// Embeddings from another model can't be used
+	core.embedder = &wordEmbedder{name: "words-v2"}
+	knowledge, err = core.knowledgeProvider(ctx)
+	require.NoError(t, err)
+	require.NoError(t, knowledge.Index())
+	assert.Equal(t, 2, core.embedder.(*wordEmbedder).embedded)
+
+	// It goes with the context
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\del-ctx "docs"`)))
+	assert.NoFileExists(t, indexPath)
+}
+
+func TestChat_EmbeddedKnowledge(t *testing.T) {
+	core := newTestCore(t)
+	core.embedder = &wordEmbedder{name: "words-v1"}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secrets.md"), []byte("the password is in the vault"), 0644))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-ctx "docs" :dir "`+dir+`"`)))
+
+	chat := newBranchTestChat(t, core, "a")
+	require.NoError(t, chat.AttachContext("docs"))
+	reply, err := chat.SubmitMessage("what was the password again?")
+	require.NoError(t, err)
+	assert.Contains(t, reply, "[secrets.md]\nthe password is in the vault")
+}
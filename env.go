@@ -0,0 +1,188 @@
+package brunch
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"sort"
+)
+
+// A chat's environment variables (API endpoints, repo paths) are given to the tools and shell
+// commands run for it. They can hold secrets, so the snapshot only keeps them sealed with the
+// core's environment key. Without CoreOpts.EnvironmentKey the key is generated and kept in the
+// data-store, which keeps them safe when chats are exported or the chat-store is shared
+const environmentKeyFile = "environment.key"
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// The key environments are sealed with, generated the first time it is needed
+func (c *Core) environmentKey() ([]byte, error) {
+	c.envKeyMu.Lock()
+	defer c.envKeyMu.Unlock()
+	if c.envKey != nil {
+		return c.envKey, nil
+	}
+
+	path := c.storePath(dataStoreDirectory, environmentKeyFile)
+	key, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate environment key: %w", err)
+		}
+		if err := os.WriteFile(path, key, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save environment key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read environment key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("environment key must be 32 bytes, it is %d", len(key))
+	}
+	c.envKey = key
+	return key, nil
+}
+
+func sealEnvironment(key []byte, env map[string]string) (string, error) {
+	plain, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func openEnvironment(key []byte, sealed string) (map[string]string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("sealed environment is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("environment was sealed with another key")
+	}
+	env := map[string]string{}
+	if err := json.Unmarshal(plain, &env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// Seal the chat's environment for its snapshot, empty if it has none
+func (c *chatInstance) sealedEnvironment() (string, error) {
+	if c.unopenedEnv != "" {
+		return c.unopenedEnv, nil
+	}
+	if len(c.env) == 0 {
+		return "", nil
+	}
+	if c.core == nil {
+		return "", errors.New("the environment can't be saved without a core")
+	}
+	if c.sealedEnv != "" && maps.Equal(c.env, c.sealedFrom) {
+		return c.sealedEnv, nil
+	}
+	key, err := c.core.environmentKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := sealEnvironment(key, c.env)
+	if err != nil {
+		return "", err
+	}
+	c.sealedEnv, c.sealedFrom = sealed, maps.Clone(c.env)
+	return sealed, nil
+}
+
+// Open the environment the chat was saved with. A chat saved by an install with another key
+// is still loaded, only without its environment
+func (c *chatInstance) openSavedEnvironment(sealed string) error {
+	key, err := c.core.environmentKey()
+	if err != nil {
+		return err
+	}
+	env, err := openEnvironment(key, sealed)
+	if err != nil {
+		return err
+	}
+	c.env = env
+	c.sealedEnv, c.sealedFrom = sealed, maps.Clone(env)
+	return nil
+}
+
+func (c *chatInstance) SetEnv(name string, value string) error {
+	if !envNamePattern.MatchString(name) {
+		return fmt.Errorf("%s is not a valid environment variable name", name)
+	}
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	if c.unopenedEnv != "" {
+		c.logger().Warn("setting the environment replaces the one the chat was saved with, it couldn't be opened")
+		c.unopenedEnv = ""
+	}
+	if c.env == nil {
+		c.env = map[string]string{}
+	}
+	c.env[name] = value
+	return nil
+}
+
+func (c *chatInstance) UnsetEnv(name string) error {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	if _, set := c.env[name]; !set {
+		return fmt.Errorf("%s is not set", name)
+	}
+	delete(c.env, name)
+	return nil
+}
+
+func (c *chatInstance) Environment() map[string]string {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	env := make(map[string]string, len(c.env))
+	for name, value := range c.env {
+		env[name] = value
+	}
+	return env
+}
+
+// The environment as NAME=value pairs, sorted, ready to be added to a command's environment
+func (c *chatInstance) Environ() []string {
+	env := c.Environment()
+	environ := make([]string, 0, len(env))
+	for name, value := range env {
+		environ = append(environ, name+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
@@ -0,0 +1,90 @@
+package brunch
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealEnvironment(t *testing.T) {
+	key := make([]byte, 32)
+	env := map[string]string{"API_URL": "http://localhost:8080", "TOKEN": "hunter2"}
+
+	sealed, err := sealEnvironment(key, env)
+	require.NoError(t, err)
+	assert.NotContains(t, sealed, "hunter2")
+
+	opened, err := openEnvironment(key, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, env, opened)
+
+	other := make([]byte, 32)
+	other[0] = 1
+	_, err = openEnvironment(other, sealed)
+	assert.Error(t, err)
+}
+
+func TestChat_Environment(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "p" :host "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "p"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+
+	assert.Error(t, chat.SetEnv("1BAD", "x"))
+	assert.Error(t, chat.SetEnv("NO SPACES", "x"))
+	require.NoError(t, chat.SetEnv("API_URL", "http://localhost:8080"))
+	require.NoError(t, chat.SetEnv("TOKEN", "hunter2"))
+	require.NoError(t, chat.UnsetEnv("API_URL"))
+	assert.Error(t, chat.UnsetEnv("API_URL"))
+	require.NoError(t, chat.SetEnv("API_URL", "http://localhost:9090"))
+	assert.Equal(t, []string{"API_URL=http://localhost:9090", "TOKEN=hunter2"}, chat.Environ())
+
+	// The snapshot only has the environment sealed
+	require.NoError(t, core.SaveActiveChat("s1"))
+	content, err := core.loadFromStore(chatStoreDirectory, "a.json")
+	require.NoError(t, err)
+	assert.False(t, strings.Contains(content, "hunter2"), "the environment should not be saved in the clear")
+	_, err = os.Stat(core.storePath(dataStoreDirectory, environmentKeyFile))
+	require.NoError(t, err)
+
+	delete(core.activeChats, "a")
+	require.NoError(t, core.ExecuteStatement("s2", NewStatement(`\chat "a"`)))
+	loaded, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	assert.Equal(t, chat.Environment(), loaded.Environment())
+
+	// An install with another key still loads the chat, without its environment
+	other := make([]byte, 32)
+	restarted := NewCore(CoreOpts{
+		InstallDirectory: core.installDirectory,
+		BaseProviders:    map[string]Provider{"mock": newMockProvider("mock")},
+		InfoHandler:      core.infoHandler,
+		ChatStartHandler: func(Conversation) error { return nil },
+		EnvironmentKey:   other,
+	})
+	require.NoError(t, restarted.LoadProviders())
+	require.NoError(t, restarted.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	foreign, err := restarted.GetActiveChat("a")
+	require.NoError(t, err)
+	assert.Empty(t, foreign.Environment())
+
+	// It is saved back as it was, so the install with the key can still open it
+	sealed := chat.sealedEnv
+	snap, err := foreign.Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, sealed, snap.Environment)
+
+	// Until the environment is set again
+	require.NoError(t, foreign.SetEnv("TOKEN", "other"))
+	snap, err = foreign.Snapshot()
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, snap.Environment)
+	opened, err := openEnvironment(other, snap.Environment)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"TOKEN": "other"}, opened)
+}
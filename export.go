@@ -0,0 +1,331 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A chat can be rendered for people to read outside of brunch: Markdown and HTML for sharing
+// and reading, and a Graphviz DOT graph of its shape. The whole tree is rendered, or a single
+// branch from the root down to one node. Nodes are numbered by where they are in the tree, 1.2
+// is the second child of the first message, so the branches can be followed in the flat formats
+type ExportFormat string
+
+const (
+	ExportMarkdown ExportFormat = "markdown"
+	ExportHTML     ExportFormat = "html"
+	ExportDOT      ExportFormat = "dot"
+)
+
+func (f ExportFormat) valid() bool {
+	switch f {
+	case ExportMarkdown, ExportHTML, ExportDOT:
+		return true
+	}
+	return false
+}
+
+// The format a file should be exported in, by its extension. Markdown when it isn't known
+func ExportFormatForFile(file string) ExportFormat {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".html", ".htm":
+		return ExportHTML
+	case ".dot", ".gv":
+		return ExportDOT
+	}
+	return ExportMarkdown
+}
+
+// A node to be rendered, with its number and how deep it is under the root (the root's
+// children are at depth 1)
+type exportNode struct {
+	node   Node
+	number string
+	depth  int
+}
+
+// The nodes of the tree in the order they are rendered, parents before their children
+func exportTreeNodes(root Node) []exportNode {
+	nodes := []exportNode{}
+	var walk func(n Node, number string, depth int)
+	walk = func(n Node, number string, depth int) {
+		nodes = append(nodes, exportNode{node: n, number: number, depth: depth})
+		for i, child := range nodeChildren(n) {
+			childNumber := strconv.Itoa(i + 1)
+			if number != "" {
+				childNumber = number + "." + childNumber
+			}
+			walk(child, childNumber, depth+1)
+		}
+	}
+	walk(root, "", 0)
+	return nodes
+}
+
+// The nodes from the root down to the node, numbered along the branch. Nothing splits off of a
+// branch so they are all rendered at the same depth
+func exportBranchNodes(leaf Node) []exportNode {
+	path := pathFromRoot(leaf)
+	nodes := make([]exportNode, len(path))
+	for i, n := range path {
+		nodes[i] = exportNode{node: n}
+		if i > 0 {
+			nodes[i].number = strconv.Itoa(i)
+			nodes[i].depth = 1
+		}
+	}
+	return nodes
+}
+
+// Render the nodes (from exportTreeNodes or exportBranchNodes, starting with the root)
+func renderExport(title string, nodes []exportNode, format ExportFormat) ([]byte, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("there is nothing to export")
+	}
+	root, ok := nodes[0].node.(*RootNode)
+	if !ok {
+		return nil, errors.New("an export has to start at the root")
+	}
+	switch format {
+	case ExportMarkdown:
+		return []byte(renderMarkdown(title, root, nodes[1:])), nil
+	case ExportHTML:
+		return []byte(renderHTML(title, root, nodes[1:])), nil
+	case ExportDOT:
+		return []byte(renderDOT(title, nodes)), nil
+	}
+	return nil, fmt.Errorf("unknown export format %q, expected %s, %s or %s", format, ExportMarkdown, ExportHTML, ExportDOT)
+}
+
+// What a pair is called in an export
+func exportLabel(mp *MessagePairNode) string {
+	switch {
+	case mp.Annotation != nil:
+		label := string(mp.Annotation.Kind)
+		if label != "" {
+			label = strings.ToUpper(label[:1]) + label[1:]
+		}
+		if mp.Annotation.InHistory {
+			label += " (sent)"
+		}
+		return label
+	case mp.ChunkStep != nil:
+		return fmt.Sprintf("Notes on part %d of %d", mp.ChunkStep.Part, mp.ChunkStep.Parts)
+	}
+	return "Message"
+}
+
+func renderMarkdown(title string, root *RootNode, nodes []exportNode) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# %s\n\n", title)
+	fmt.Fprintf(&sb, "Provider: %s, model: %s\n\n", root.Provider, root.Model)
+	if root.Prompt != "" {
+		fmt.Fprintf(&sb, "> %s\n\n", strings.ReplaceAll(root.Prompt, "\n", "\n> "))
+	}
+	for _, en := range nodes {
+		mp, ok := en.node.(*MessagePairNode)
+		if !ok {
+			continue
+		}
+		level := min(en.depth+1, 6)
+		fmt.Fprintf(&sb, "%s %s %s\n\n", strings.Repeat("#", level), en.number, exportLabel(mp))
+		fmt.Fprintf(&sb, "`%s` %s\n\n", ShortHash(mp.Hash()), mp.Time.Format("2006-01-02 15:04:05"))
+		if mp.Annotation != nil {
+			fmt.Fprintf(&sb, "%s\n\n", mp.Annotation.Content)
+			continue
+		}
+		if mp.User != nil {
+			fmt.Fprintf(&sb, "**User:**\n\n%s\n\n", mp.User.UnencodedContent())
+		}
+		for _, call := range mp.ToolCalls {
+			fmt.Fprintf(&sb, "- tool `%s` called with `%s`\n", call.Name, string(call.Input))
+		}
+		if len(mp.ToolCalls) > 0 {
+			sb.WriteString("\n")
+		}
+		if mp.Assistant != nil {
+			fmt.Fprintf(&sb, "**Assistant:**\n\n%s\n\n", mp.Assistant.UnencodedContent())
+		}
+		for _, citation := range mp.Citations {
+			fmt.Fprintf(&sb, "- source `%s`\n", citation)
+		}
+		if len(mp.Citations) > 0 {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+const exportHTMLStyle = `body{font-family:sans-serif;max-width:60em;margin:auto;padding:1em}
+.node{border-left:2px solid #ccc;margin:.5em 0 .5em 1em;padding-left:1em}
+.meta{color:#777;font-size:.85em}
+pre{white-space:pre-wrap;background:#f6f6f6;padding:.5em}
+.annotation pre{background:#fff8dc}`
+
+func renderHTML(title string, root *RootNode, nodes []exportNode) string {
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&sb, "<title>%s</title>\n<style>\n%s\n</style>\n</head>\n<body>\n", html.EscapeString(title), exportHTMLStyle)
+	fmt.Fprintf(&sb, "<h1>%s</h1>\n", html.EscapeString(title))
+	fmt.Fprintf(&sb, "<p class=\"meta\">Provider: %s, model: %s</p>\n", html.EscapeString(root.Provider), html.EscapeString(root.Model))
+	if root.Prompt != "" {
+		fmt.Fprintf(&sb, "<blockquote>%s</blockquote>\n", html.EscapeString(root.Prompt))
+	}
+
+	// Each node's section holds its children's, so the branches nest like the tree
+	depth := 0
+	for _, en := range nodes {
+		mp, ok := en.node.(*MessagePairNode)
+		if !ok {
+			continue
+		}
+		for ; depth >= en.depth; depth-- {
+			sb.WriteString("</div>\n")
+		}
+		depth = en.depth
+		class := "node"
+		if mp.Annotation != nil {
+			class += " annotation"
+		}
+		fmt.Fprintf(&sb, "<div class=\"%s\" id=\"%s\">\n", class, mp.Hash())
+		fmt.Fprintf(&sb, "<h3>%s %s</h3>\n", en.number, html.EscapeString(exportLabel(mp)))
+		fmt.Fprintf(&sb, "<p class=\"meta\">%s %s</p>\n", ShortHash(mp.Hash()), mp.Time.Format("2006-01-02 15:04:05"))
+		if mp.Annotation != nil {
+			fmt.Fprintf(&sb, "<pre>%s</pre>\n", html.EscapeString(mp.Annotation.Content))
+			continue
+		}
+		if mp.User != nil {
+			fmt.Fprintf(&sb, "<p><b>User</b></p>\n<pre>%s</pre>\n", html.EscapeString(mp.User.UnencodedContent()))
+		}
+		for _, call := range mp.ToolCalls {
+			fmt.Fprintf(&sb, "<p class=\"meta\">tool <code>%s</code> called with <code>%s</code></p>\n", html.EscapeString(call.Name), html.EscapeString(string(call.Input)))
+		}
+		if mp.Assistant != nil {
+			fmt.Fprintf(&sb, "<p><b>Assistant</b></p>\n<pre>%s</pre>\n", html.EscapeString(mp.Assistant.UnencodedContent()))
+		}
+		for _, citation := range mp.Citations {
+			fmt.Fprintf(&sb, "<p class=\"meta\">source <code>%s</code></p>\n", html.EscapeString(citation.String()))
+		}
+	}
+	for ; depth > 0; depth-- {
+		sb.WriteString("</div>\n")
+	}
+	sb.WriteString("</body>\n</html>\n")
+	return sb.String()
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
+
+// Only the shape of the tree and a preview of each node, the whole conversation would make a
+// graph nobody can read
+func renderDOT(title string, nodes []exportNode) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "digraph %s {\n", dotQuote(title))
+	sb.WriteString("  node [shape=box, fontname=\"sans-serif\"];\n")
+	for _, en := range nodes {
+		var label string
+		switch n := en.node.(type) {
+		case *RootNode:
+			label = fmt.Sprintf("root\n%s / %s", n.Provider, n.Model)
+		case *MessagePairNode:
+			label = en.number + " " + exportLabel(n)
+			if n.Annotation != nil {
+				label += "\n" + contentPreview(n.Annotation.Content)
+			} else {
+				if n.User != nil {
+					label += "\nuser: " + contentPreview(n.User.UnencodedContent())
+				}
+				if n.Assistant != nil {
+					label += "\nassistant: " + contentPreview(n.Assistant.UnencodedContent())
+				}
+			}
+		default:
+			continue
+		}
+		fmt.Fprintf(&sb, "  %s [label=%s];\n", dotQuote(ShortHash(en.node.Hash())), dotQuote(label))
+		if parent := nodeParent(en.node); parent != nil {
+			fmt.Fprintf(&sb, "  %s -> %s;\n", dotQuote(ShortHash(parent.Hash())), dotQuote(ShortHash(en.node.Hash())))
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// Render the chat's whole tree in the format
+func (c *Core) ExportChat(name string, format ExportFormat) ([]byte, error) {
+	return c.exportChat(name, format, "")
+}
+
+// Render the branch of the chat from the root down to the node with the hash
+func (c *Core) ExportChatBranch(name string, hash string, format ExportFormat) ([]byte, error) {
+	return c.exportChat(name, format, hash)
+}
+
+// A chat that isn't active is read from the chat store, an active one is rendered as it is now
+func (c *Core) exportChat(name string, format ExportFormat, hash string) ([]byte, error) {
+	if !format.valid() {
+		return nil, fmt.Errorf("unknown export format %q, expected %s, %s or %s", format, ExportMarkdown, ExportHTML, ExportDOT)
+	}
+
+	c.chatMu.Lock()
+	chat, active := c.activeChats[name]
+	c.chatMu.Unlock()
+
+	var root *RootNode
+	if active {
+		chat.submitMu.Lock()
+		defer chat.submitMu.Unlock()
+		root = &chat.root
+	} else {
+		content, err := c.LoadFromChatStore(fmt.Sprintf("%s.json", name))
+		if err != nil {
+			return nil, fmt.Errorf("chat %s does not exist", name)
+		}
+		snapshot, err := SnapshotFromJSON([]byte(content))
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := unmarshalNode(snapshot.Contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal chat %s: %w", name, err)
+		}
+		var ok bool
+		if root, ok = decoded.(*RootNode); !ok {
+			return nil, fmt.Errorf("chat %s does not contain a valid root node", name)
+		}
+	}
+
+	if hash == "" {
+		return renderExport(name, exportTreeNodes(root), format)
+	}
+	leaf, exists := MapTree(root)[hash]
+	if !exists {
+		return nil, fmt.Errorf("node %s not found in chat %s", hash, name)
+	}
+	return renderExport(name, exportBranchNodes(leaf), format)
+}
+
+// Export the chat to a file, in the format given or the one its extension is for
+func (c *Core) exportChatFile(name string, file string, format string, hash string) error {
+	exportFormat := ExportFormat(format)
+	if format == "" {
+		exportFormat = ExportFormatForFile(file)
+	}
+	content, err := c.exportChat(name, exportFormat, hash)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	return nil
+}
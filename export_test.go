@@ -0,0 +1,81 @@
+package brunch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCore_ExportChat(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ImportMarkdownTranscript("notes", "mock", "User: hi\nAssistant: hello <there>\nUser: how are you\nAssistant: fine"))
+
+	// A chat that isn't active is read from the store
+	md, err := core.ExportChat("notes", ExportMarkdown)
+	require.NoError(t, err)
+	assert.Contains(t, string(md), "# notes\n")
+	assert.Contains(t, string(md), "## 1 Message\n")
+	assert.Contains(t, string(md), "### 1.1 Message\n")
+	assert.Contains(t, string(md), "**Assistant:**\n\nfine\n")
+
+	// Branch from the first message so the tree splits
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "notes"`)))
+	chat, err := core.GetActiveChat("notes")
+	require.NoError(t, err)
+	first := nodeChildren(&chat.root)[0]
+	chat.currentNode = first
+	_, err = chat.SubmitMessage("something else")
+	require.NoError(t, err)
+	branch := chat.currentNode.Hash()
+
+	page, err := core.ExportChat("notes", ExportHTML)
+	require.NoError(t, err)
+	assert.Contains(t, string(page), "hello &lt;there&gt;")
+	assert.Contains(t, string(page), "<h3>1.2 Message</h3>")
+	assert.Equal(t, strings.Count(string(page), "<div"), strings.Count(string(page), "</div>"))
+
+	dot, err := core.ExportChat("notes", ExportDOT)
+	require.NoError(t, err)
+	assert.Contains(t, string(dot), `"`+first.Hash()[:8]+`" -> "`+branch[:8]+`"`)
+	assert.Equal(t, 3, strings.Count(string(dot), " -> "))
+
+	// Only the branch, numbered along it
+	md, err = core.ExportChatBranch("notes", branch, ExportMarkdown)
+	require.NoError(t, err)
+	assert.Contains(t, string(md), "## 2 Message\n")
+	assert.Contains(t, string(md), "something else")
+	assert.NotContains(t, string(md), "how are you")
+
+	_, err = core.ExportChat("notes", "pdf")
+	assert.Error(t, err)
+	_, err = core.ExportChatBranch("notes", "nope", ExportMarkdown)
+	assert.Error(t, err)
+	_, err = core.ExportChat("missing", ExportMarkdown)
+	assert.Error(t, err)
+}
+
+func TestCore_ExportStatement(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ImportMarkdownTranscript("notes", "mock", "User: hi\nAssistant: hello"))
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "notes.html")
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\export "notes" :file "`+file+`"`)))
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(content), "<!DOCTYPE html>"), "the format is picked by the extension")
+
+	file = filepath.Join(dir, "notes.txt")
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\export "notes" :file "`+file+`" :format "dot"`)))
+	content, err = os.ReadFile(file)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(content), "digraph"))
+
+	assert.Error(t, core.ValidateStatement(NewStatement(`\export "missing" :file "x.md"`)))
+	assert.Error(t, core.ValidateStatement(NewStatement(`\export "notes" :file "x.md" :format "pdf"`)))
+	assert.NoError(t, core.ValidateStatement(NewStatement(`\export "notes" :file "x.md"`)))
+}
@@ -0,0 +1,86 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A provider can name fallbacks (ProviderSettings.Fallbacks, :fallbacks on \new-provider) that
+// are asked in order when it can't answer, anthropic -> openai -> a local model. Only errors
+// another provider could do better with fail over: the provider couldn't be reached, or said
+// it is rate limited or overloaded. Providers wrap ErrProviderUnavailable in those. A fallback
+// answers with the chat's system prompt and the pair records which one it was
+var ErrProviderUnavailable = errors.New("provider is unavailable")
+
+// Whether another provider may be able to answer where this one failed
+func IsRetryable(err error) bool {
+	return err != nil && (errors.Is(err, ErrProviderUnavailable) || isNetworkError(err))
+}
+
+// A provider can't fall back to itself or to the same provider twice, and its fallbacks have to exist
+func validateFallbacks(name string, fallbacks []string, exists func(string) bool) error {
+	seen := map[string]bool{}
+	for _, fallback := range fallbacks {
+		switch {
+		case fallback == name:
+			return fmt.Errorf("provider [%s] can't be its own fallback", name)
+		case seen[fallback]:
+			return fmt.Errorf("fallback provider [%s] is listed twice", fallback)
+		case !exists(fallback):
+			return fmt.Errorf("fallback provider [%s] does not exist", fallback)
+		}
+		seen[fallback] = true
+	}
+	return nil
+}
+
+// The named provider set up to answer for the chat. It keeps its own model and sampling, only
+// the system prompt is the chat's. Its own fallbacks aren't followed, the chain is the chat's
+func (c *chatInstance) fallbackProvider(name string) (Provider, error) {
+	c.core.provMu.Lock()
+	provider, exists := c.core.providers[name]
+	c.core.provMu.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("fallback provider [%s] does not exist", name)
+	}
+	settings := provider.Settings()
+	settings.Name = c.provider.Settings().Name
+	settings.SystemPrompt = c.provider.Settings().SystemPrompt
+	settings.Fallbacks = nil
+	return provider.CloneWithSettings(settings)
+}
+
+// Ask the chat's fallbacks in order after its provider failed with the cause. Images queued on
+// the chat's provider stay with it. When none of them answer the cause is returned, so it is
+// still seen as the provider being unreachable
+func (c *chatInstance) failover(parent Node, tools []Tool, message string, cause error) (*MessagePairNode, error) {
+	fallbacks := c.provider.Settings().Fallbacks
+	if len(fallbacks) == 0 || c.core == nil {
+		return nil, cause
+	}
+	failed := []string{}
+	for _, name := range fallbacks {
+		c.logger().Warn("provider can't answer, trying its fallback", "fallback", name, "error", cause)
+		provider, err := c.fallbackProvider(name)
+		if err != nil {
+			c.logger().Warn("fallback provider is unavailable", "fallback", name, "error", err)
+			failed = append(failed, name)
+			continue
+		}
+		ctx, cancel := c.requestContext()
+		pair, err := c.limited(ctx, name, parent, message, func() (*MessagePairNode, error) {
+			return creatorFor(ctx, provider, parent, tools)(message)
+		})
+		cancel()
+		if err == nil {
+			pair.AnsweredBy = name
+			return pair, nil
+		}
+		if !IsRetryable(err) {
+			return nil, fmt.Errorf("fallback provider %s failed: %w", name, err)
+		}
+		failed = append(failed, name)
+	}
+	return nil, fmt.Errorf("%w (fallbacks failed too: %s)", cause, strings.Join(failed, ", "))
+}
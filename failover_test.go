@@ -0,0 +1,102 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Fails with whatever err points at, clones share it so a chat's provider can be taken down
+type failingProvider struct {
+	*mockProvider
+	err *error
+}
+
+func newFailingProvider(name string, err *error) *failingProvider {
+	return &failingProvider{mockProvider: newMockProvider(name), err: err}
+}
+
+func (fp *failingProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	return func(userMessage string) (*MessagePairNode, error) {
+		if *fp.err != nil {
+			return nil, *fp.err
+		}
+		return fp.mockProvider.ExtendFrom(ctx, node)(userMessage)
+	}
+}
+
+func (fp *failingProvider) CloneWithSettings(settings ProviderSettings) (Provider, error) {
+	return &failingProvider{mockProvider: &mockProvider{settings: settings}, err: fp.err}, nil
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, IsRetryable(fmt.Errorf("%w: status 529", ErrProviderUnavailable)))
+	assert.True(t, IsRetryable(fmt.Errorf("failed to send request: %w", &net.OpError{Op: "dial", Err: errors.New("refused")})))
+	assert.False(t, IsRetryable(errors.New("status 400: bad request")))
+	assert.False(t, IsRetryable(nil))
+}
+
+func TestCore_FailoverProviders(t *testing.T) {
+	core := newTestCore(t)
+	var primaryErr, secondErr, thirdErr error
+	require.NoError(t, core.RegisterBaseProvider("primary", newFailingProvider("primary", &primaryErr)))
+	require.NoError(t, core.RegisterBaseProvider("second", newFailingProvider("second", &secondErr)))
+	require.NoError(t, core.RegisterBaseProvider("third", newFailingProvider("third", &thirdErr)))
+
+	assert.ErrorContains(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "main" :host "primary" :fallbacks "missing"`)), "does not exist")
+	assert.ErrorContains(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "main" :host "primary" :fallbacks "main"`)), "own fallback")
+	assert.ErrorContains(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "main" :host "primary" :fallbacks "second", "second"`)), "twice")
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "main" :host "primary" :system-prompt "be brief" :fallbacks "second", "third"`)))
+	assert.Equal(t, []string{"second", "third"}, core.providers["main"].Settings().Fallbacks)
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "main"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+
+	// Answered by the chat's own provider, nothing is recorded
+	_, err = chat.SubmitMessage("one")
+	require.NoError(t, err)
+	assert.Empty(t, chat.currentNode.(*MessagePairNode).AnsweredBy)
+
+	// The first fallback is overloaded too, the second answers
+	primaryErr = fmt.Errorf("%w: status 529", ErrProviderUnavailable)
+	secondErr = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	response, err := chat.SubmitMessage("two")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: two", response)
+	pair := chat.currentNode.(*MessagePairNode)
+	assert.Equal(t, "third", pair.AnsweredBy)
+	assert.Equal(t, "third", pair.Latency.Provider)
+	assert.Contains(t, chat.PrintTree(), "Answered by fallback: third")
+
+	data, err := marshalNode(&chat.root)
+	require.NoError(t, err)
+	restored, err := unmarshalNode(data)
+	require.NoError(t, err)
+	assert.Equal(t, "third", MapTree(restored)[pair.Hash()].(*MessagePairNode).AnsweredBy)
+
+	// Errors a fallback couldn't help with are returned as they are
+	primaryErr = errors.New("status 400: bad request")
+	_, err = chat.SubmitMessage("three")
+	assert.ErrorContains(t, err, "bad request")
+
+	// When nothing answers the chat's own error is kept
+	primaryErr = fmt.Errorf("%w: status 529", ErrProviderUnavailable)
+	thirdErr = primaryErr
+	_, err = chat.SubmitMessage("four")
+	assert.ErrorIs(t, err, ErrProviderUnavailable)
+	assert.ErrorContains(t, err, "fallbacks failed too: second, third")
+
+	// Fallbacks follow renames and can't be deleted while they are used
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "fourth" :host "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "other" :host "mock" :fallbacks "fourth"`)))
+	assert.ErrorContains(t, core.ExecuteStatement("s1", NewStatement(`\del-provider "fourth"`)), "fallback of provider other")
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\rename-provider "fourth" :to "fifth"`)))
+	assert.Equal(t, []string{"fifth"}, core.providers["other"].Settings().Fallbacks)
+}
@@ -0,0 +1,218 @@
+package brunch
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Snapshots are plain files, a crash in the middle of a write or a hand edit can leave one that
+// can't be loaded, and one can point at a provider or context that is gone. Verify reads every
+// chat in the chat store and reports what is wrong with it. A snapshot that can't be read at all
+// is corrupt, it can be moved into the quarantine (in the data-store) so it stops breaking
+// everything that reads the whole store. Quarantined files are kept until they are removed by hand
+const quarantineDirectory = "quarantine"
+
+// Something wrong with a stored chat
+type ChatProblem struct {
+	Chat    string `json:"chat"`
+	Problem string `json:"problem"`
+
+	// The snapshot can't be read at all, anything else only affects part of the chat
+	Corrupt     bool `json:"corrupt,omitempty"`
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+type VerifyReport struct {
+	Checked  int           `json:"checked"`
+	Problems []ChatProblem `json:"problems"`
+}
+
+func (r VerifyReport) Healthy() bool {
+	return len(r.Problems) == 0
+}
+
+func (c *Core) quarantinePath(store string, filename string) string {
+	return c.storePath(dataStoreDirectory, quarantineDirectory, store, filename)
+}
+
+// Check every chat in the chat store: the snapshot has to unmarshal into a tree, every message
+// in it has to have a hash that leads to it alone, the node it and any session were left on has
+// to be in it, and the provider and contexts it uses have to exist
+func (c *Core) Verify() (VerifyReport, error) {
+	files, err := c.getStorageJsons(chatStoreDirectory)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	sort.Strings(files)
+
+	sessions, err := c.storedSessions()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	report := VerifyReport{Problems: []ChatProblem{}}
+	for _, file := range files {
+		name := strings.TrimSuffix(file, ".json")
+		report.Checked++
+		report.Problems = append(report.Problems, c.verifyChat(name, sessions)...)
+	}
+	return report, nil
+}
+
+// The sessions saved in the data-store, by id
+func (c *Core) storedSessions() (map[string]sessionState, error) {
+	files, err := c.getStorageJsons(dataStoreDirectory)
+	if err != nil {
+		return nil, err
+	}
+	sessions := map[string]sessionState{}
+	for _, file := range files {
+		if !strings.HasPrefix(file, "session_") {
+			continue
+		}
+		content, err := c.LoadFromDataStore(file)
+		if err != nil {
+			continue
+		}
+		var state sessionState
+		if json.Unmarshal([]byte(content), &state) != nil {
+			continue
+		}
+		sessions[strings.TrimSuffix(strings.TrimPrefix(file, "session_"), ".json")] = state
+	}
+	return sessions, nil
+}
+
+func (c *Core) verifyChat(name string, sessions map[string]sessionState) []ChatProblem {
+	corrupt := func(format string, args ...any) []ChatProblem {
+		return []ChatProblem{{Chat: name, Problem: fmt.Sprintf(format, args...), Corrupt: true}}
+	}
+	content, err := c.LoadFromChatStore(fmt.Sprintf("%s.json", name))
+	if err != nil {
+		return corrupt("failed to read snapshot: %v", err)
+	}
+	snapshot, err := SnapshotFromJSON([]byte(content))
+	if err != nil {
+		return corrupt("snapshot is not valid: %v", err)
+	}
+	decoded, err := unmarshalNode(snapshot.Contents)
+	if err != nil {
+		return corrupt("tree is not valid: %v", err)
+	}
+	root, ok := decoded.(*RootNode)
+	if !ok {
+		return corrupt("tree does not start with a root node")
+	}
+
+	problems := []ChatProblem{}
+	report := func(format string, args ...any) {
+		problems = append(problems, ChatProblem{Chat: name, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	// Nodes are found by their hash, one that has none or shares it with another can't be gone to
+	hashes := map[string]int{}
+	var walk func(n Node, path string)
+	walk = func(n Node, path string) {
+		for i, child := range nodeChildren(n) {
+			childPath := fmt.Sprintf("%s%d", path, i+1)
+			hash := child.Hash()
+			if hash == "" {
+				report("message %s has no user or assistant message", childPath)
+			} else {
+				hashes[hash]++
+				if hashes[hash] == 2 {
+					report("message %s has the same hash as another message, %s", childPath, ShortHash(hash))
+				}
+			}
+			walk(child, childPath+".")
+		}
+	}
+	walk(root, "")
+
+	resolves := func(hash string) bool {
+		return hash == "" || hash == root.Hash() || hashes[hash] > 0
+	}
+	if !resolves(snapshot.ActiveBranch) {
+		report("the node the chat was left on, %s, is not in the tree", ShortHash(snapshot.ActiveBranch))
+	}
+	ids := make([]string, 0, len(sessions))
+	for id := range sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		state := sessions[id]
+		if state.ActiveChat == name && !resolves(state.ActiveBranch) {
+			report("session %s is on node %s, which is not in the tree", id, ShortHash(state.ActiveBranch))
+		}
+	}
+
+	c.provMu.Lock()
+	_, providerExists := c.providers[snapshot.ProviderName]
+	c.provMu.Unlock()
+	if !providerExists {
+		report("provider %s does not exist", snapshot.ProviderName)
+	}
+	c.ctxMu.Lock()
+	for _, ctx := range snapshot.Contexts {
+		if _, exists := c.contexts[ctx]; !exists {
+			report("context %s does not exist", ctx)
+		}
+	}
+	c.ctxMu.Unlock()
+	return problems
+}
+
+// Move the corrupt chats of the report into the quarantine, marking them as quarantined. Chats
+// that are open are left alone, the copy in memory may be fine and would be saved over it
+func (c *Core) Quarantine(report *VerifyReport) error {
+	quarantined := false
+	for i := range report.Problems {
+		problem := &report.Problems[i]
+		if !problem.Corrupt || problem.Quarantined {
+			continue
+		}
+		c.chatMu.Lock()
+		_, active := c.activeChats[problem.Chat]
+		c.chatMu.Unlock()
+		if active {
+			continue
+		}
+
+		filename := fmt.Sprintf("%s.json", problem.Chat)
+		dst := c.quarantinePath(chatStoreDirectory, filename)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("failed to create quarantine directory: %w", err)
+		}
+		if err := moveFile(c.storePath(chatStoreDirectory, filename), dst); err != nil {
+			return fmt.Errorf("failed to quarantine chat %s: %w", problem.Chat, err)
+		}
+		c.logger.Warn("quarantined corrupt chat", "chat", problem.Chat, "file", dst, "problem", problem.Problem)
+		problem.Quarantined = true
+		quarantined = true
+	}
+
+	// The index may have been built from the chats that were taken out
+	if quarantined {
+		c.invalidateReferenceIndex()
+	}
+	return nil
+}
+
+// Verify the chat store for a statement, quarantining what is corrupt if asked to
+func (c *Core) fsck(quarantine bool) (VerifyReport, error) {
+	report, err := c.Verify()
+	if err != nil {
+		return report, err
+	}
+	if quarantine {
+		if err := c.Quarantine(&report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,89 @@
+package brunch
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Rewrite a stored chat's snapshot
+func editSnapshot(t *testing.T, core *Core, name string, edit func(snapshot *Snapshot)) {
+	t.Helper()
+	content, err := core.LoadFromChatStore(name + ".json")
+	require.NoError(t, err)
+	snapshot, err := SnapshotFromJSON([]byte(content))
+	require.NoError(t, err)
+	edit(snapshot)
+	data, err := snapshot.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(core.storePath(chatStoreDirectory, name+".json"), data, 0644))
+}
+
+func TestCore_Verify(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.NewChat("good", "mock", false, false))
+	require.NoError(t, core.NewChat("orphaned", "mock", false, false))
+	require.NoError(t, core.NewChat("lost", "mock", false, false))
+
+	report, err := core.Verify()
+	require.NoError(t, err)
+	assert.True(t, report.Healthy())
+	assert.Equal(t, 3, report.Checked)
+
+	editSnapshot(t, core, "orphaned", func(snapshot *Snapshot) {
+		snapshot.ProviderName = "gone"
+		snapshot.Contexts = []string{"missing"}
+	})
+	editSnapshot(t, core, "lost", func(snapshot *Snapshot) {
+		snapshot.ActiveBranch = "0123456789abcdef"
+	})
+	require.NoError(t, os.WriteFile(core.storePath(chatStoreDirectory, "broken.json"), []byte(`{"contents": "trunc`), 0644))
+
+	report, err = core.Verify()
+	require.NoError(t, err)
+	assert.False(t, report.Healthy())
+	assert.Equal(t, 4, report.Checked)
+
+	byChat := map[string][]ChatProblem{}
+	for _, problem := range report.Problems {
+		byChat[problem.Chat] = append(byChat[problem.Chat], problem)
+	}
+	assert.NotContains(t, byChat, "good")
+	require.Len(t, byChat["broken"], 1)
+	assert.True(t, byChat["broken"][0].Corrupt)
+	require.Len(t, byChat["orphaned"], 2)
+	assert.Contains(t, byChat["orphaned"][0].Problem, "provider gone does not exist")
+	assert.Contains(t, byChat["orphaned"][1].Problem, "context missing does not exist")
+	require.Len(t, byChat["lost"], 1)
+	assert.False(t, byChat["lost"][0].Corrupt)
+	assert.Contains(t, byChat["lost"][0].Problem, "is not in the tree")
+}
+
+func TestCore_FsckQuarantine(t *testing.T) {
+	core := newTestCore(t)
+	var reported VerifyReport
+	core.infoHandler.OnFsck = func(report VerifyReport) { reported = report }
+
+	require.NoError(t, core.NewChat("good", "mock", false, false))
+	require.NoError(t, os.WriteFile(core.storePath(chatStoreDirectory, "broken.json"), []byte("not json"), 0644))
+
+	// Only reported until asked to quarantine
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\fsck`)))
+	require.Len(t, reported.Problems, 1)
+	assert.False(t, reported.Problems[0].Quarantined)
+	assert.FileExists(t, core.storePath(chatStoreDirectory, "broken.json"))
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\fsck :quarantine true`)))
+	require.Len(t, reported.Problems, 1)
+	assert.True(t, reported.Problems[0].Quarantined)
+	assert.NoFileExists(t, core.storePath(chatStoreDirectory, "broken.json"))
+	assert.FileExists(t, core.quarantinePath(chatStoreDirectory, "broken.json"))
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\fsck`)))
+	assert.True(t, reported.Healthy())
+	assert.Equal(t, 1, reported.Checked)
+
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\fsck :quarantine "yes"`)))
+}
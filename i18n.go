@@ -0,0 +1,92 @@
+package brunch
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A catalog localizes a front-end. Messages are looked up by their English text (the text the
+// front-end would print without a catalog) so a catalog only needs the messages it translates,
+// and anything missing is shown in English. Keywords are aliases for statement commands that
+// are registered with the parser, and commands are aliases a front-end can take for its own
+// commands (like the chat commands of the CLI). A catalog file is JSON:
+//
+//	{
+//	  "language": "es",
+//	  "messages": {"Chat started. Press Ctrl+C to exit and view conversation tree.": "Chat iniciado. ..."},
+//	  "keywords": {"\\nuevo-chat": "\\new-chat"},
+//	  "commands": {"\\arbol": "\\t"}
+//	}
+type Catalog struct {
+	Language string            `json:"language"`
+	Messages map[string]string `json:"messages"`
+	Keywords map[string]string `json:"keywords"`
+	Commands map[string]string `json:"commands"`
+}
+
+func LoadCatalog(path string) (*Catalog, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	var catalog Catalog
+	if err := json.Unmarshal(content, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog %s: %w", path, err)
+	}
+	return &catalog, nil
+}
+
+// The message in the catalog's language, or as it was given if it isn't translated. A nil
+// catalog translates nothing, so a front-end without one can still call it
+func (c *Catalog) Text(message string) string {
+	if c == nil {
+		return message
+	}
+	if translated, ok := c.Messages[message]; ok && translated != "" {
+		return translated
+	}
+	return message
+}
+
+// Like Text, for a format string. The translation has to take the same verbs in the same order
+func (c *Catalog) Textf(format string, args ...interface{}) string {
+	return fmt.Sprintf(c.Text(format), args...)
+}
+
+// The front-end command the alias stands for, or the command itself if it isn't an alias
+func (c *Catalog) Command(command string) string {
+	if c == nil {
+		return command
+	}
+	if aliased, ok := c.Commands[command]; ok {
+		return aliased
+	}
+	return command
+}
+
+// Register the catalog's keywords with the parser. Every alias is tried, and the ones that
+// couldn't be registered are reported together
+func (c *Catalog) RegisterKeywords() error {
+	if c == nil {
+		return nil
+	}
+	aliases := make([]string, 0, len(c.Keywords))
+	for alias := range c.Keywords {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	failed := []string{}
+	for _, alias := range aliases {
+		if err := RegisterKeywordAlias(alias, c.Keywords[alias]); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to register keywords: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
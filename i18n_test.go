@@ -0,0 +1,42 @@
+package brunch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "es.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"language": "es",
+		"messages": {"invalid branch statement": "sentencia no válida", "context %s is unavailable": "el contexto %s no está disponible"},
+		"keywords": {"\\lista-chat": "\\list-chat", "\\roto": "\\nope"},
+		"commands": {"\\arbol": "\\t"}
+	}`), 0644))
+
+	catalog, err := LoadCatalog(path)
+	require.NoError(t, err)
+	assert.Equal(t, "es", catalog.Language)
+	assert.Equal(t, "sentencia no válida", catalog.Text("invalid branch statement"))
+	assert.Equal(t, "el contexto docs no está disponible", catalog.Textf("context %s is unavailable", "docs"))
+	assert.Equal(t, "Chat started", catalog.Text("Chat started"), "untranslated messages are left in English")
+	assert.Equal(t, `\t`, catalog.Command(`\arbol`))
+	assert.Equal(t, `\l`, catalog.Command(`\l`))
+
+	// The keywords that can be registered are, the broken one is reported
+	defer UnregisterKeywordAlias(`\lista-chat`)
+	assert.ErrorContains(t, catalog.RegisterKeywords(), `\nope`)
+	assert.NoError(t, NewStatement(`\lista-chat`).Prepare())
+
+	var none *Catalog
+	assert.Equal(t, "hello", none.Text("hello"))
+	assert.Equal(t, `\l`, none.Command(`\l`))
+	assert.NoError(t, none.RegisterKeywords())
+
+	_, err = LoadCatalog(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,371 @@
+package brunch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Conversations can be brought over from the exports of other chat apps. A ChatGPT export
+// (conversations.json) holds every conversation as a tree of messages, edits and regenerated
+// replies are branches of it, and those become branches here too. A Claude export holds a
+// list of messages per conversation, which are chained one after the other unless they say
+// what they answer
+type ImportFormat string
+
+const (
+	ImportChatGPT ImportFormat = "chatgpt"
+	ImportClaude  ImportFormat = "claude"
+)
+
+func (f ImportFormat) valid() bool {
+	switch f {
+	case ImportChatGPT, ImportClaude:
+		return true
+	}
+	return false
+}
+
+// A conversation from an export. The root names the app it came from, the chat it is imported
+// into replaces that with its own provider
+type ImportedConversation struct {
+	Title   string
+	Created time.Time
+	Root    *RootNode
+	Current Node // where the conversation was left, the root when the export doesn't say
+	Pairs   int
+}
+
+// A message of an export, before the user messages are paired up with their replies
+type importMessage struct {
+	role     string
+	text     string
+	time     time.Time
+	model    string
+	children []*importMessage
+}
+
+// Convert the conversations of an export into trees. A reply is paired with the user message
+// it answers, anything that isn't a user or assistant message with text (system prompts, tool
+// calls, images) is passed over, replies that follow a reply are added to it, and a user message
+// that was never answered is left out
+func ImportConversation(data []byte, format ImportFormat) ([]ImportedConversation, error) {
+	if !format.valid() {
+		return nil, fmt.Errorf("unknown import format %q, must be %s or %s", format, ImportChatGPT, ImportClaude)
+	}
+	if format == ImportClaude {
+		return importClaude(data)
+	}
+	return importChatGPT(data)
+}
+
+// Exports hold a list of conversations, but a single one is taken as well
+func importList(data []byte, v any) error {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "{") {
+		trimmed = "[" + trimmed + "]"
+	}
+	if err := json.Unmarshal([]byte(trimmed), v); err != nil {
+		return fmt.Errorf("failed to unmarshal export: %w", err)
+	}
+	return nil
+}
+
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+	CurrentNode string                 `json:"current_node"`
+}
+
+type chatGPTNode struct {
+	ID       string          `json:"id"`
+	Message  *chatGPTMessage `json:"message"`
+	Parent   string          `json:"parent"`
+	Children []string        `json:"children"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime *float64 `json:"create_time"`
+	Content    struct {
+		ContentType string            `json:"content_type"`
+		Parts       []json.RawMessage `json:"parts"`
+	} `json:"content"`
+	Metadata struct {
+		ModelSlug string `json:"model_slug"`
+	} `json:"metadata"`
+}
+
+// Zero when the export didn't say
+func unixSeconds(seconds float64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)).UTC()
+}
+
+// Only the text of a message is kept, image and file parts are objects instead of strings
+func (m *chatGPTMessage) text() string {
+	if m.Content.ContentType != "text" && m.Content.ContentType != "multimodal_text" {
+		return ""
+	}
+	parts := []string{}
+	for _, raw := range m.Content.Parts {
+		var part string
+		if json.Unmarshal(raw, &part) == nil && strings.TrimSpace(part) != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func importChatGPT(data []byte) ([]ImportedConversation, error) {
+	var exported []chatGPTConversation
+	if err := importList(data, &exported); err != nil {
+		return nil, err
+	}
+
+	conversations := []ImportedConversation{}
+	for idx, conv := range exported {
+		if len(conv.Mapping) == 0 {
+			return nil, fmt.Errorf("conversation %d has no messages", idx)
+		}
+		messages := make(map[string]*importMessage, len(conv.Mapping))
+		for id, n := range conv.Mapping {
+			m := &importMessage{}
+			if n.Message != nil {
+				m.role = n.Message.Author.Role
+				m.text = n.Message.text()
+				m.model = n.Message.Metadata.ModelSlug
+				if n.Message.CreateTime != nil {
+					m.time = unixSeconds(*n.Message.CreateTime)
+				}
+			}
+			messages[id] = m
+		}
+
+		// The children are listed in the order they were made, the tops are sorted so the
+		// import doesn't depend on the order of the map
+		tops := []string{}
+		for id, n := range conv.Mapping {
+			for _, child := range n.Children {
+				if m, ok := messages[child]; ok {
+					messages[id].children = append(messages[id].children, m)
+				}
+			}
+			if _, ok := conv.Mapping[n.Parent]; n.Parent == "" || !ok {
+				tops = append(tops, id)
+			}
+		}
+		sort.Strings(tops)
+		roots := []*importMessage{}
+		for _, id := range tops {
+			roots = append(roots, messages[id])
+		}
+
+		conversations = append(conversations, buildImported(ImportChatGPT, conv.Title, unixSeconds(conv.CreateTime), roots, messages[conv.CurrentNode]))
+	}
+	return conversations, nil
+}
+
+type claudeConversation struct {
+	UUID         string          `json:"uuid"`
+	Name         string          `json:"name"`
+	CreatedAt    time.Time       `json:"created_at"`
+	ChatMessages []claudeMessage `json:"chat_messages"`
+}
+
+type claudeMessage struct {
+	UUID    string    `json:"uuid"`
+	Text    string    `json:"text"`
+	Sender  string    `json:"sender"`
+	Created time.Time `json:"created_at"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Parent string `json:"parent_message_uuid"`
+}
+
+func importClaude(data []byte) ([]ImportedConversation, error) {
+	var exported []claudeConversation
+	if err := importList(data, &exported); err != nil {
+		return nil, err
+	}
+
+	conversations := []ImportedConversation{}
+	for _, conv := range exported {
+		messages := make(map[string]*importMessage, len(conv.ChatMessages))
+		roots := []*importMessage{}
+		var previous *importMessage
+		for _, cm := range conv.ChatMessages {
+			role := cm.Sender
+			if role == "human" {
+				role = "user"
+			}
+			text := cm.Text
+			if strings.TrimSpace(text) == "" {
+				blocks := []string{}
+				for _, block := range cm.Content {
+					if block.Type == "text" && strings.TrimSpace(block.Text) != "" {
+						blocks = append(blocks, block.Text)
+					}
+				}
+				text = strings.Join(blocks, "\n")
+			}
+			m := &importMessage{role: role, text: text, time: cm.Created.UTC()}
+			if cm.UUID != "" {
+				messages[cm.UUID] = m
+			}
+
+			// Without a parent the message follows the one before it
+			parent := previous
+			if cm.Parent != "" {
+				parent = messages[cm.Parent]
+			}
+			if parent != nil {
+				parent.children = append(parent.children, m)
+			} else {
+				roots = append(roots, m)
+			}
+			previous = m
+		}
+
+		// The conversation is left at its last message
+		conversations = append(conversations, buildImported(ImportClaude, conv.Name, conv.CreatedAt.UTC(), roots, previous))
+	}
+	return conversations, nil
+}
+
+func buildImported(format ImportFormat, title string, created time.Time, roots []*importMessage, current *importMessage) ImportedConversation {
+	root := NewRootNode(RootOpt{Provider: string(format)})
+	imported := ImportedConversation{Title: title, Created: created, Root: root, Current: root}
+	placed := map[*importMessage]Node{}
+
+	var walk func(m *importMessage, parent Node, user *importMessage)
+	walk = func(m *importMessage, parent Node, user *importMessage) {
+		// Exports are only as good as whatever wrote them, a message listed under one of its own
+		// descendants (or under two parents) is only placed the first time it is reached
+		if _, seen := placed[m]; seen {
+			return
+		}
+		placed[m] = parent
+		text := strings.TrimSpace(m.text)
+		switch {
+		case m.role == "user" && text != "":
+			if user != nil {
+				user = &importMessage{text: user.text + "\n\n" + text, time: user.time}
+			} else {
+				user = &importMessage{text: text, time: m.time}
+			}
+		case m.role == "assistant" && text != "" && user != nil:
+			pair := NewMessagePairNode(parent)
+			pair.User = NewMessageData("user", user.text)
+			pair.Assistant = NewMessageData("assistant", text)
+			switch {
+			case !m.time.IsZero():
+				pair.Time = m.time
+			case !user.time.IsZero():
+				pair.Time = user.time
+			case !created.IsZero():
+				pair.Time = created
+			}
+			holder, _ := treeNode(parent)
+			holder.AddChild(pair)
+			if root.Model == "" {
+				root.Model = m.model
+			}
+			imported.Pairs++
+			placed[m] = pair
+			parent, user = pair, nil
+		case m.role == "assistant" && text != "":
+			if mp, ok := parent.(*MessagePairNode); ok {
+				mp.Assistant = NewMessageData("assistant", mp.Assistant.UnencodedContent()+"\n\n"+text)
+			}
+		}
+		for _, child := range m.children {
+			walk(child, parent, user)
+		}
+	}
+	for _, m := range roots {
+		walk(m, root, nil)
+	}
+
+	if at, ok := placed[current]; ok {
+		imported.Current = at
+	}
+	return imported
+}
+
+// A chat name made from a conversation's title
+func importedChatName(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteRune('-')
+			dash = true
+		}
+		if b.Len() >= 40 {
+			break
+		}
+	}
+	if name := strings.Trim(b.String(), "-"); name != "" {
+		return name
+	}
+	return "imported"
+}
+
+// Import the conversations of an export as new chats hosted by the named provider, and save them.
+// Each chat is named after its conversation's title, with a number added when the name is taken,
+// so nothing that is already there is replaced. Conversations without any messages are passed
+// over. The names of the new chats are returned
+func (c *Core) ImportConversations(providerName string, data []byte, format ImportFormat) ([]string, error) {
+	conversations, err := ImportConversation(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, conv := range conversations {
+		if conv.Pairs == 0 {
+			continue
+		}
+		name := c.UniqueChatName(importedChatName(conv.Title))
+		chat, err := c.newChatOnProvider(name, providerName)
+		if err != nil {
+			return names, err
+		}
+
+		// The tree moves under the chat's own root
+		for _, child := range conv.Root.Children {
+			holder, _ := treeNode(child)
+			holder.Parent = &chat.root
+			chat.root.AddChild(child)
+		}
+		if conv.Current != Node(conv.Root) {
+			chat.currentNode = conv.Current
+		}
+		if err := c.claimChatName(name, false, func() error { return c.writeSnapshot(name, chat) }); err != nil {
+			return names, fmt.Errorf("failed to save imported chat %s: %w", name, err)
+		}
+		c.logger.Info("imported conversation", "chat", name, "format", format, "messages", conv.Pairs)
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("the export has no conversations with messages")
+	}
+	return names, nil
+}
@@ -0,0 +1,142 @@
+package brunch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A user message that was edited, so there are two branches off of the system message, and
+// a reply that was followed by a second one
+const chatGPTExport = `[{
+	"title": "Go generics",
+	"create_time": 1700000000.5,
+	"current_node": "a2",
+	"mapping": {
+		"root": {"id": "root", "message": null, "parent": null, "children": ["sys"]},
+		"sys": {"id": "sys", "parent": "root", "children": ["u1", "u2"],
+			"message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": [""]}}},
+		"u1": {"id": "u1", "parent": "sys", "children": ["a1"],
+			"message": {"author": {"role": "user"}, "create_time": 1700000001, "content": {"content_type": "text", "parts": ["what are generics"]}}},
+		"a1": {"id": "a1", "parent": "u1", "children": ["a1b"],
+			"message": {"author": {"role": "assistant"}, "create_time": 1700000002, "content": {"content_type": "text", "parts": ["type parameters"]}, "metadata": {"model_slug": "gpt-4o"}}},
+		"a1b": {"id": "a1b", "parent": "a1", "children": [],
+			"message": {"author": {"role": "assistant"}, "create_time": 1700000003, "content": {"content_type": "text", "parts": ["and constraints"]}}},
+		"u2": {"id": "u2", "parent": "sys", "children": ["a2"],
+			"message": {"author": {"role": "user"}, "create_time": 1700000004, "content": {"content_type": "multimodal_text", "parts": [{"content_type": "image_asset_pointer"}, "what are go generics"]}}},
+		"a2": {"id": "a2", "parent": "u2", "children": ["u3"],
+			"message": {"author": {"role": "assistant"}, "create_time": 1700000005, "content": {"content_type": "text", "parts": ["go 1.18 type parameters"]}}},
+		"u3": {"id": "u3", "parent": "a2", "children": [],
+			"message": {"author": {"role": "user"}, "create_time": 1700000006, "content": {"content_type": "text", "parts": ["never answered"]}}}
+	}
+}]`
+
+const claudeExport = `{
+	"uuid": "c1",
+	"name": "Trip plans",
+	"created_at": "2024-05-01T10:00:00Z",
+	"chat_messages": [
+		{"uuid": "m1", "sender": "human", "text": "plan a trip", "created_at": "2024-05-01T10:00:01Z"},
+		{"uuid": "m2", "sender": "assistant", "text": "", "content": [{"type": "text", "text": "where to?"}], "created_at": "2024-05-01T10:00:02Z"},
+		{"uuid": "m3", "sender": "human", "text": "lisbon", "created_at": "2024-05-01T10:00:03Z"},
+		{"uuid": "m4", "sender": "assistant", "text": "go in may", "created_at": "2024-05-01T10:00:04Z"},
+		{"uuid": "m5", "sender": "human", "text": "porto", "parent_message_uuid": "m2", "created_at": "2024-05-01T10:00:05Z"},
+		{"uuid": "m6", "sender": "assistant", "text": "go in june", "created_at": "2024-05-01T10:00:06Z"}
+	]
+}`
+
+func TestImportConversation_ChatGPT(t *testing.T) {
+	conversations, err := ImportConversation([]byte(chatGPTExport), ImportChatGPT)
+	require.NoError(t, err)
+	require.Len(t, conversations, 1)
+	conv := conversations[0]
+	assert.Equal(t, "Go generics", conv.Title)
+	assert.Equal(t, int64(1700000000), conv.Created.Unix())
+	assert.Equal(t, "chatgpt", conv.Root.Provider)
+	assert.Equal(t, "gpt-4o", conv.Root.Model)
+	assert.Equal(t, 2, conv.Pairs)
+
+	// The edit is a second branch off of the root
+	require.Len(t, conv.Root.Children, 2)
+	first := conv.Root.Children[0].(*MessagePairNode)
+	assert.Equal(t, "what are generics", first.User.UnencodedContent())
+	assert.Equal(t, "type parameters\n\nand constraints", first.Assistant.UnencodedContent())
+	assert.Equal(t, int64(1700000002), first.Time.Unix())
+
+	second := conv.Root.Children[1].(*MessagePairNode)
+	assert.Equal(t, "what are go generics", second.User.UnencodedContent())
+	assert.Empty(t, second.Children)
+	assert.Same(t, second, conv.Current)
+}
+
+func TestImportConversation_Claude(t *testing.T) {
+	conversations, err := ImportConversation([]byte(claudeExport), ImportClaude)
+	require.NoError(t, err)
+	require.Len(t, conversations, 1)
+	conv := conversations[0]
+	assert.Equal(t, "Trip plans", conv.Title)
+	assert.Equal(t, 3, conv.Pairs)
+
+	require.Len(t, conv.Root.Children, 1)
+	first := conv.Root.Children[0].(*MessagePairNode)
+	assert.Equal(t, "where to?", first.Assistant.UnencodedContent())
+	require.Len(t, first.Children, 2)
+	assert.Equal(t, "lisbon", first.Children[0].(*MessagePairNode).User.UnencodedContent())
+	assert.Equal(t, "go in june", first.Children[1].(*MessagePairNode).Assistant.UnencodedContent())
+	assert.Same(t, first.Children[1], conv.Current)
+}
+
+func TestImportConversation_Cycle(t *testing.T) {
+	cyclic := `{"mapping":{"r":{"parent":"","children":["a"]},"a":{"parent":"r","children":["r"]}}}`
+	conversations, err := ImportConversation([]byte(cyclic), ImportChatGPT)
+	require.NoError(t, err)
+	require.Len(t, conversations, 1)
+	assert.Zero(t, conversations[0].Pairs)
+
+	// A cycle below answered messages keeps them, once
+	cyclic = `{"mapping":{
+		"u":{"parent":"","children":["a"],"message":{"author":{"role":"user"},"content":{"content_type":"text","parts":["hi"]}}},
+		"a":{"parent":"u","children":["u","a"],"message":{"author":{"role":"assistant"},"content":{"content_type":"text","parts":["hello"]}}}}}`
+	conversations, err = ImportConversation([]byte(cyclic), ImportChatGPT)
+	require.NoError(t, err)
+	require.Len(t, conversations[0].Root.Children, 1)
+	assert.Equal(t, 1, conversations[0].Pairs)
+	assert.Empty(t, conversations[0].Root.Children[0].(*MessagePairNode).Children)
+}
+
+func TestImportConversation_Invalid(t *testing.T) {
+	_, err := ImportConversation([]byte(claudeExport), "bard")
+	assert.Error(t, err)
+	_, err = ImportConversation([]byte("not json"), ImportChatGPT)
+	assert.Error(t, err)
+}
+
+func TestCore_ImportConversations(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.NewChat("trip-plans", "mock", false, false))
+
+	names, err := core.ImportConversations("mock", []byte(claudeExport), ImportClaude)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"trip-plans-2"}, names)
+
+	names, err = core.ImportConversations("mock", []byte(chatGPTExport), ImportChatGPT)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"go-generics"}, names)
+
+	chat, err := core.loadChat("trip-plans-2", nil)
+	require.NoError(t, err)
+	assert.Len(t, MapTree(&chat.root), 4)
+	assert.Equal(t, "go in june", chat.currentNode.(*MessagePairNode).Assistant.UnencodedContent())
+	assert.Equal(t, "where to?", nodeParent(chat.currentNode).(*MessagePairNode).Assistant.UnencodedContent())
+
+	// Messages can be sent from where the conversation was left
+	response, err := chat.SubmitMessage("and food?")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: and food?", response)
+
+	_, err = core.ImportConversations("missing", []byte(claudeExport), ImportClaude)
+	assert.Error(t, err)
+	_, err = core.ImportConversations("mock", []byte(`[{"name": "empty", "chat_messages": []}]`), ImportClaude)
+	assert.Error(t, err)
+}
@@ -0,0 +1,230 @@
+package brunch
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Where the reference index is kept in the data-store
+const referenceIndexFile = "reference_index.json"
+
+// How a chat uses a provider or context, so deletions and renames can be planned
+type ResourceUsage struct {
+	Chat     string `json:"chat"`
+	Provider bool   `json:"provider"` // the chat talks to the provider
+	Context  bool   `json:"context"`  // the context is attached to the chat
+	Nodes    int    `json:"nodes"`    // size of the chat's tree, to judge what would be affected
+}
+
+// What a single chat refers to
+type chatReferences struct {
+	Provider string   `json:"provider"`
+	Contexts []string `json:"contexts"`
+	Nodes    int      `json:"nodes"`
+
+	// The tokens the chat used by the provider that answered, see usage.go
+	Usage map[string]UsageTotals `json:"usage,omitempty"`
+
+	// And those of the auxiliary work done for it, by the provider that was asked
+	AuxiliaryUsage map[string]UsageTotals `json:"auxiliary_usage,omitempty"`
+}
+
+// The reference index maps chats to the providers and contexts they use so we don't have to
+// read every snapshot to answer who uses what. It is persisted to the data-store and written
+// through as snapshots are saved, so it is only rebuilt from the chat store when it is missing
+// or doesn't cover the chats on disk. A nil map means it isn't loaded
+type referenceIndex struct {
+	mu    sync.Mutex
+	chats map[string]chatReferences
+}
+
+func referencesFromSnapshot(snapshot *Snapshot) (chatReferences, error) {
+	root, err := unmarshalNode(snapshot.Contents)
+	if err != nil {
+		return chatReferences{}, fmt.Errorf("failed to unmarshal chat contents: %w", err)
+	}
+	contexts := make([]string, len(snapshot.Contexts))
+	copy(contexts, snapshot.Contexts)
+	return chatReferences{
+		Provider: snapshot.ProviderName,
+		Contexts: contexts,
+		Nodes:    len(MapTree(root)),
+		Usage:    treeUsage(root, snapshot.ProviderName),
+
+		AuxiliaryUsage: copyUsage(snapshot.AuxiliaryUsage),
+	}, nil
+}
+
+// Load the index from the data-store, or build it from the chat store if the stored one can't
+// be trusted. If a chat is being indexed or removed, it is expected to differ between the
+// two. The index lock must be held
+func (c *Core) ensureReferenceIndex(changing string) error {
+	if c.refs.chats != nil {
+		return nil
+	}
+
+	jsons, err := c.getStorageJsons(chatStoreDirectory)
+	if err != nil {
+		return err
+	}
+
+	if chats, ok := c.loadReferenceIndex(jsons, changing); ok {
+		c.refs.chats = chats
+		return nil
+	}
+
+	chats := make(map[string]chatReferences, len(jsons))
+	for _, file := range jsons {
+		content, err := c.LoadFromChatStore(file)
+		if err != nil {
+			return fmt.Errorf("failed to load chat file %s: %w", file, err)
+		}
+		snapshot, err := SnapshotFromJSON([]byte(content))
+		if err != nil {
+			return fmt.Errorf("failed to read chat file %s: %w", file, err)
+		}
+		refs, err := referencesFromSnapshot(snapshot)
+		if err != nil {
+			return fmt.Errorf("failed to index chat file %s: %w", file, err)
+		}
+		chats[strings.TrimSuffix(file, ".json")] = refs
+	}
+	c.refs.chats = chats
+	return c.persistReferenceIndex()
+}
+
+// The stored index is only used if it has exactly the chats that are on disk. Chats copied in or
+// removed by hand would otherwise go unnoticed
+func (c *Core) loadReferenceIndex(chatFiles []string, changing string) (map[string]chatReferences, bool) {
+	content, err := c.LoadFromDataStore(referenceIndexFile)
+	if err != nil {
+		return nil, false
+	}
+	var chats map[string]chatReferences
+	if err := json.Unmarshal([]byte(content), &chats); err != nil {
+		c.logger.Warn("failed to unmarshal reference index, rebuilding", "error", err)
+		return nil, false
+	}
+	if chats == nil {
+		return nil, false
+	}
+
+	onDisk := make(map[string]bool, len(chatFiles))
+	for _, file := range chatFiles {
+		onDisk[strings.TrimSuffix(file, ".json")] = true
+	}
+	delete(onDisk, changing)
+
+	stored := len(chats)
+	if _, indexed := chats[changing]; indexed {
+		stored--
+	}
+	if stored != len(onDisk) {
+		return nil, false
+	}
+	for name := range onDisk {
+		if _, indexed := chats[name]; !indexed {
+			return nil, false
+		}
+	}
+	return chats, true
+}
+
+// Write the index through to the data-store. The index lock must be held
+func (c *Core) persistReferenceIndex() error {
+	content, err := json.Marshal(c.refs.chats)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reference index: %w", err)
+	}
+	return c.AddToDataStore(referenceIndexFile, string(content))
+}
+
+// Record what a chat refers to after its snapshot was written
+func (c *Core) indexChat(name string, refs chatReferences) error {
+	c.refs.mu.Lock()
+	defer c.refs.mu.Unlock()
+	if err := c.ensureReferenceIndex(name); err != nil {
+		return err
+	}
+	c.refs.chats[name] = refs
+	return c.persistReferenceIndex()
+}
+
+// Update what a chat refers to when its snapshot was rewritten without its tree changing
+func (c *Core) reindexChatReferences(name string, snapshot *Snapshot) error {
+	c.refs.mu.Lock()
+	defer c.refs.mu.Unlock()
+	if err := c.ensureReferenceIndex(""); err != nil {
+		return err
+	}
+	refs := c.refs.chats[name]
+
+	// A renamed provider takes what it answered with it
+	if usage, ok := refs.Usage[refs.Provider]; ok && refs.Provider != snapshot.ProviderName {
+		delete(refs.Usage, refs.Provider)
+		refs.Usage[snapshot.ProviderName] = usage
+	}
+	refs.Provider = snapshot.ProviderName
+	refs.Contexts = append([]string{}, snapshot.Contexts...)
+	refs.AuxiliaryUsage = copyUsage(snapshot.AuxiliaryUsage)
+	c.refs.chats[name] = refs
+	return c.persistReferenceIndex()
+}
+
+func (c *Core) unindexChat(name string) error {
+	c.refs.mu.Lock()
+	defer c.refs.mu.Unlock()
+	if err := c.ensureReferenceIndex(name); err != nil {
+		return err
+	}
+	delete(c.refs.chats, name)
+	return c.persistReferenceIndex()
+}
+
+// Throw the index away when the chat store was changed behind its back (like a rollback)
+// so it is rebuilt the next time it is needed
+func (c *Core) invalidateReferenceIndex() {
+	c.refs.mu.Lock()
+	defer c.refs.mu.Unlock()
+	c.refs.chats = nil
+	err := os.Remove(c.storePath(dataStoreDirectory, referenceIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		c.logger.Warn("failed to remove reference index", "error", err)
+	}
+}
+
+// WhereUsed reports the chats that use the named provider or context (a name can be both),
+// ordered by chat name
+func (c *Core) WhereUsed(name string) ([]ResourceUsage, error) {
+	c.refs.mu.Lock()
+	defer c.refs.mu.Unlock()
+	if err := c.ensureReferenceIndex(""); err != nil {
+		return nil, err
+	}
+
+	usage := []ResourceUsage{}
+	for chat, refs := range c.refs.chats {
+		entry := ResourceUsage{
+			Chat:     chat,
+			Provider: refs.Provider == name,
+			Nodes:    refs.Nodes,
+		}
+		for _, ctx := range refs.Contexts {
+			if ctx == name {
+				entry.Context = true
+				break
+			}
+		}
+		if entry.Provider || entry.Context {
+			usage = append(usage, entry)
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Chat < usage[j].Chat
+	})
+	return usage, nil
+}
@@ -0,0 +1,688 @@
+package brunch
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A KnowledgeProvider is what a context resolves to. It reads the context's backing resource
+// and hands back the pieces of it that are relevant to a message, which the chat sends along
+// with the message. Any provider can use a context this way, providers that can do better
+// implement KnowledgeAttacher and are given the context instead
+type KnowledgeProvider interface {
+
+	// Index reads the backing resource, again if it has been read before
+	Index() error
+
+	// Retrieve returns up to limit pieces of knowledge relevant to the query, most relevant first
+	Retrieve(query string, limit int) ([]Knowledge, error)
+
+	// Describe says what the context holds
+	Describe() string
+}
+
+// A piece of knowledge from a context, and where it came from (a file, a url, a table). The
+// offset is where the piece starts in the source, in bytes
+type Knowledge struct {
+	Source  string  `json:"source"`
+	Offset  int     `json:"offset"`
+	Content string  `json:"content"`
+	Score   float64 `json:"score"`
+}
+
+// A piece of knowledge that was sent with a message, recorded on the pair so the answer can be
+// checked against what it was given
+type Citation struct {
+	Context string `json:"context"`
+	Source  string `json:"source"`
+	Offset  int    `json:"offset"`
+}
+
+func (c Citation) String() string {
+	return fmt.Sprintf("%s: %s@%d", c.Context, c.Source, c.Offset)
+}
+
+const (
+	// Files and pages are split into chunks of about this many characters
+	knowledgeChunkSize = 1500
+
+	// Files bigger than this are skipped when a directory is indexed
+	knowledgeMaxFileSize = 1 << 20
+
+	// How much of a page is read when a web context is indexed
+	knowledgeMaxPageSize = 5 << 20
+
+	knowledgeFetchTimeout = 30 * time.Second
+
+	// How many pieces each of a chat's contexts adds to a message
+	knowledgePerMessage = 3
+)
+
+// Resolve the context to the built-in knowledge provider for its type
+func (ctx ContextSettings) KnowledgeProvider() (KnowledgeProvider, error) {
+	switch ctx.Type {
+	case ContextTypeDirectory:
+		return &directoryKnowledge{dir: ctx.Value}, nil
+	case ContextTypeWeb:
+		return &webKnowledge{url: ctx.Value}, nil
+	case ContextTypeDatabase:
+		return &databaseKnowledge{dsn: ctx.Value}, nil
+	}
+	return nil, fmt.Errorf("unknown context type %s", ctx.Type)
+}
+
+// The pieces of knowledge the built-in providers keep. Retrieval is by the words they share
+// with the query, which needs nothing but the text
+type chunkIndex []Knowledge
+
+func (idx chunkIndex) retrieve(query string, limit int) []Knowledge {
+	terms := knowledgeTerms(query)
+	if len(terms) == 0 || limit <= 0 {
+		return []Knowledge{}
+	}
+
+	found := []Knowledge{}
+	for _, chunk := range idx {
+		words := map[string]int{}
+		for _, word := range knowledgeTerms(chunk.Content) {
+			words[word]++
+		}
+		score := 0.0
+		for _, term := range uniqueTerms(terms) {
+			if count := words[term]; count > 0 {
+				// Matching more of the query counts for more than matching one word often
+				score += 1 + float64(count)/float64(count+1)
+			}
+		}
+		if score > 0 {
+			chunk.Score = score
+			found = append(found, chunk)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Score > found[j].Score
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// Lowercased words, leaving out the short ones that match everything
+func knowledgeTerms(text string) []string {
+	terms := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if utf8.RuneCountInString(word) >= 3 {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func uniqueTerms(terms []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
+
+// Split text into chunks at paragraph breaks, and paragraphs that are too big on their own
+// at the size. Every chunk is a piece of the text, in order, so it is found where the last one ended
+func chunkText(source string, text string) []Knowledge {
+	chunks := []Knowledge{}
+	offset := 0
+	for _, content := range splitText(text, knowledgeChunkSize) {
+		if at := strings.Index(text[offset:], content); at >= 0 {
+			offset += at
+		}
+		chunks = append(chunks, Knowledge{Source: source, Offset: offset, Content: content})
+		offset = min(offset+len(content), len(text))
+	}
+	return chunks
+}
+
+// Split text into pieces of at most the size (in bytes) at paragraph breaks, cutting paragraphs
+// that are bigger than that on their own
+func splitText(text string, size int) []string {
+	pieces := []string{}
+	var current strings.Builder
+	flush := func() {
+		if content := strings.TrimSpace(current.String()); content != "" {
+			pieces = append(pieces, content)
+		}
+		current.Reset()
+	}
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if current.Len() > 0 && current.Len()+len(paragraph) > size {
+			flush()
+		}
+		for len(paragraph) > size {
+			cut := size
+			for cut > 0 && !utf8.RuneStart(paragraph[cut]) {
+				cut--
+			}
+			current.WriteString(paragraph[:cut])
+			flush()
+			paragraph = paragraph[cut:]
+		}
+		current.WriteString(paragraph)
+		current.WriteString("\n\n")
+	}
+	flush()
+	return pieces
+}
+
+// Text files under a directory. Hidden directories (.git and the like), big files and
+// anything that isn't text are left out. When embedded the chunks go into a vector store
+// and are retrieved by similarity, and given an index path what was indexed is kept there
+// so only the files that changed are read (and embedded) again
+type directoryKnowledge struct {
+	dir       string
+	indexPath string
+	embedded  *embeddedKnowledge
+
+	files  map[string]indexedFile
+	chunks []indexedChunk
+}
+
+func (d *directoryKnowledge) Index() error {
+	previous := d.loadIndex()
+	files := map[string]indexedFile{}
+	changed := []string{}
+
+	err := filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != d.dir && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() > knowledgeMaxFileSize {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			rel = path
+		}
+		if known, exists := previous[rel]; exists && known.Size == info.Size() && known.ModTime.Equal(info.ModTime()) {
+			files[rel] = known
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil || !isText(content) {
+			return nil
+		}
+		file := indexedFile{ModTime: info.ModTime(), Size: info.Size()}
+		for _, chunk := range chunkText(rel, string(content)) {
+			file.Chunks = append(file.Chunks, indexedChunk{Source: rel, Offset: chunk.Offset, Content: chunk.Content})
+		}
+		files[rel] = file
+		changed = append(changed, rel)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index %s: %w", d.dir, err)
+	}
+	if err := d.embed(previous, files, changed); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	chunks := []indexedChunk{}
+	for _, path := range paths {
+		chunks = append(chunks, files[path].Chunks...)
+	}
+	d.files, d.chunks = files, chunks
+	return d.saveIndex()
+}
+
+// Bring the vector store up to date with the files: what changed is embedded again and what is
+// gone is deleted. Without a previous index the store can't be trusted, it starts over
+func (d *directoryKnowledge) embed(previous map[string]indexedFile, files map[string]indexedFile, changed []string) error {
+	if d.embedded == nil {
+		return nil
+	}
+	if len(previous) == 0 {
+		if err := d.embedded.store.Drop(d.embedded.collection); err != nil {
+			return err
+		}
+	}
+	for _, path := range changed {
+		if err := d.embedded.upsert(path, files[path].Chunks); err != nil {
+			return err
+		}
+	}
+	for path := range previous {
+		if _, exists := files[path]; exists {
+			continue
+		}
+		if err := d.embedded.store.Delete(d.embedded.collection, path); err != nil {
+			return fmt.Errorf("failed to remove %s from the vector store: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (d *directoryKnowledge) Retrieve(query string, limit int) ([]Knowledge, error) {
+	if d.embedded == nil {
+		idx := make(chunkIndex, len(d.chunks))
+		for i, chunk := range d.chunks {
+			idx[i] = Knowledge{Source: chunk.Source, Offset: chunk.Offset, Content: chunk.Content}
+		}
+		return idx.retrieve(query, limit), nil
+	}
+	return d.embedded.retrieve(query, limit)
+}
+
+func (d *directoryKnowledge) Describe() string {
+	description := fmt.Sprintf("directory %s: %d files in %d chunks", d.dir, len(d.files), len(d.chunks))
+	if d.embedded != nil {
+		description += fmt.Sprintf(", embedded with %s", d.embedderName())
+	}
+	return description
+}
+
+func isText(content []byte) bool {
+	head := content
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	return !strings.ContainsRune(string(head), 0) && utf8.Valid(content)
+}
+
+// A web page, read as text. When embedded the page is embedded again every time it is indexed,
+// as there is no telling whether it changed
+type webKnowledge struct {
+	url      string
+	embedded *embeddedKnowledge
+	chunks   chunkIndex
+}
+
+var (
+	htmlHidden = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+	htmlBlock  = regexp.MustCompile(`(?i)</?(p|div|br|li|tr|h[1-6]|section|article)[^>]*>`)
+	htmlTag    = regexp.MustCompile(`<[^>]+>`)
+	blankLines = regexp.MustCompile(`\n\s*\n\s*`)
+)
+
+func (w *webKnowledge) Index() error {
+	client := http.Client{Timeout: knowledgeFetchTimeout}
+	resp, err := client.Get(w.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", w.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("failed to fetch %s: %s", w.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, knowledgeMaxPageSize))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", w.url, err)
+	}
+
+	text := string(body)
+	if strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		text = htmlToText(text)
+	}
+	w.chunks = chunkText(w.url, text)
+	if w.embedded == nil {
+		return nil
+	}
+	chunks := make([]indexedChunk, len(w.chunks))
+	for i, chunk := range w.chunks {
+		chunks[i] = indexedChunk{Source: chunk.Source, Offset: chunk.Offset, Content: chunk.Content}
+	}
+	return w.embedded.upsert(w.url, chunks)
+}
+
+func htmlToText(page string) string {
+	page = htmlHidden.ReplaceAllString(page, "")
+	page = htmlBlock.ReplaceAllString(page, "\n\n")
+	page = html.UnescapeString(htmlTag.ReplaceAllString(page, ""))
+	return strings.TrimSpace(blankLines.ReplaceAllString(page, "\n\n"))
+}
+
+func (w *webKnowledge) Retrieve(query string, limit int) ([]Knowledge, error) {
+	if w.embedded != nil {
+		return w.embedded.retrieve(query, limit)
+	}
+	return w.chunks.retrieve(query, limit), nil
+}
+
+func (w *webKnowledge) Describe() string {
+	return fmt.Sprintf("web page %s: %d chunks", w.url, len(w.chunks))
+}
+
+// A database's schema, a table to a chunk. The chat sends all of it and lets the provider query the
+// data (see database.go). It goes through database/sql, so the application has to import a driver
+// for the database (lib/pq or pgx, go-sql-driver/mysql, mattn/go-sqlite3 or modernc sqlite)
+type databaseKnowledge struct {
+	dsn    string
+	kind   string
+	chunks chunkIndex
+}
+
+// The drivers that can open each kind of database, by the names they register
+var databaseDrivers = map[string][]string{
+	"postgres": {"postgres", "pgx"},
+	"mysql":    {"mysql"},
+	"sqlite":   {"sqlite3", "sqlite"},
+}
+
+// Work out what kind of database the connection string is for, and the form the driver wants it in
+func databaseKind(dsn string) (string, string) {
+	if strings.HasPrefix(dsn, "file:") || strings.HasSuffix(dsn, ".db") || strings.HasSuffix(dsn, ".sqlite") {
+		return "sqlite", dsn
+	}
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		switch u.Scheme {
+		case "postgres", "postgresql":
+			return "postgres", dsn
+		case "mysql":
+			// The mysql driver doesn't take a url
+			return "mysql", strings.TrimPrefix(dsn, "mysql://")
+		case "sqlite", "sqlite3":
+			return "sqlite", strings.TrimPrefix(dsn, u.Scheme+"://")
+		}
+	}
+	if strings.Contains(dsn, "@tcp(") {
+		return "mysql", dsn
+	}
+	return "postgres", dsn
+}
+
+// The connection string with the connection made read-only, nothing brunch runs should change
+// the database. Queries still go through a read-only transaction as well
+func readOnlySource(kind string, source string) string {
+	switch kind {
+	case "sqlite":
+		if !strings.HasPrefix(source, "file:") {
+			source = "file:" + source
+		}
+		return withParameter(source, "mode", "ro")
+	case "postgres":
+		const readOnly = "-c default_transaction_read_only=on"
+		if u, err := url.Parse(source); err == nil && u.Scheme != "" {
+			query := u.Query()
+			query.Set("options", readOnly)
+			u.RawQuery = query.Encode()
+			return u.String()
+		}
+		return source + " options='" + readOnly + "'"
+	case "mysql":
+		// The driver sets parameters it doesn't know as session variables
+		return withParameter(source, "transaction_read_only", "1")
+	}
+	return source
+}
+
+// The source with the parameter set in its query, replacing what it had
+func withParameter(source string, key string, value string) string {
+	path, rawQuery, _ := strings.Cut(source, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		query = url.Values{}
+	}
+	query.Set(key, value)
+	return path + "?" + query.Encode()
+}
+
+func openDatabase(dsn string) (*sql.DB, string, error) {
+	kind, source := databaseKind(dsn)
+	source = readOnlySource(kind, source)
+	registered := map[string]bool{}
+	for _, driver := range sql.Drivers() {
+		registered[driver] = true
+	}
+	for _, driver := range databaseDrivers[kind] {
+		if registered[driver] {
+			db, err := sql.Open(driver, source)
+			return db, kind, err
+		}
+	}
+	return nil, kind, fmt.Errorf("no %s driver is registered, the application has to import one", kind)
+}
+
+func (d *databaseKnowledge) Index() error {
+	db, kind, err := openDatabase(d.dsn)
+	d.kind = kind
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var rows *sql.Rows
+	if kind == "sqlite" {
+		rows, err = db.Query(`SELECT name, sql, '' FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	} else {
+		rows, err = db.Query(`SELECT table_name, column_name, data_type FROM information_schema.columns
+			WHERE table_schema NOT IN ('pg_catalog', 'information_schema', 'mysql', 'performance_schema', 'sys')
+			ORDER BY table_name, ordinal_position`)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the database schema: %w", err)
+	}
+	defer rows.Close()
+
+	tables := []string{}
+	columns := map[string][]string{}
+	for rows.Next() {
+		var table, column, typ string
+		if err := rows.Scan(&table, &column, &typ); err != nil {
+			return fmt.Errorf("failed to read the database schema: %w", err)
+		}
+		if _, seen := columns[table]; !seen {
+			tables = append(tables, table)
+		}
+		columns[table] = append(columns[table], strings.TrimSpace(column+" "+typ))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read the database schema: %w", err)
+	}
+
+	chunks := chunkIndex{}
+	for _, table := range tables {
+		content := fmt.Sprintf("table %s (%s)", table, strings.Join(columns[table], ", "))
+		if kind == "sqlite" {
+			// sqlite keeps the statement that made the table, which says it best
+			content = columns[table][0]
+		}
+		chunks = append(chunks, Knowledge{Source: table, Content: content})
+	}
+	d.chunks = chunks
+	return nil
+}
+
+func (d *databaseKnowledge) Retrieve(query string, limit int) ([]Knowledge, error) {
+	return d.chunks.retrieve(query, limit), nil
+}
+
+func (d *databaseKnowledge) Describe() string {
+	return fmt.Sprintf("%s database: %d tables", d.kind, len(d.chunks))
+}
+
+// Give the chat's provider the context, or index it for the chat if the provider doesn't take contexts
+func (c *chatInstance) attachKnowledge(ctx *ContextSettings) error {
+	if attacher, ok := c.provider.(KnowledgeAttacher); ok {
+		return attacher.AttachKnowledgeContext(*ctx)
+	}
+	var knowledge KnowledgeProvider
+	var err error
+	if c.core != nil {
+		knowledge, err = c.core.knowledgeProvider(ctx)
+	} else {
+		knowledge, err = ctx.KnowledgeProvider()
+	}
+	if err != nil {
+		return err
+	}
+	if err := knowledge.Index(); err != nil {
+		return err
+	}
+	if c.knowledge == nil {
+		c.knowledge = map[string]KnowledgeProvider{}
+	}
+	c.knowledge[ctx.Name] = knowledge
+	return nil
+}
+
+// The message with whatever the chat's contexts know about it in front, and where each piece
+// came from. A context that fails to retrieve is left out, the message is still worth sending
+func (c *chatInstance) withKnowledge(message string, queryTool bool) (string, []Citation) {
+	type cited struct {
+		Knowledge
+		context string
+	}
+	found := []cited{}
+	for name, knowledge := range c.knowledge {
+		if _, queryable := knowledge.(queryableKnowledge); queryable {
+			// Databases give their whole schema instead
+			continue
+		}
+		pieces, err := knowledge.Retrieve(message, knowledgePerMessage)
+		if err != nil {
+			c.logger().Warn("failed to retrieve knowledge", "context", name, "error", err)
+			continue
+		}
+		for _, piece := range pieces {
+			if err := c.checkSecrets(piece.Content, piece.Source); err != nil {
+				c.logger().Warn("context chunk left out", "context", name, "error", err)
+				continue
+			}
+			found = append(found, cited{Knowledge: piece, context: name})
+		}
+	}
+	databases := c.databasePrompt(queryTool)
+	if len(found) == 0 {
+		return databases + message, nil
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Score != found[j].Score {
+			return found[i].Score > found[j].Score
+		}
+		// The contexts are in no particular order, ties are put in one so the citations are too
+		return found[i].context < found[j].context
+	})
+
+	var sb strings.Builder
+	citations := make([]Citation, len(found))
+	sb.WriteString("<knowledge>\n")
+	for i, piece := range found {
+		fmt.Fprintf(&sb, "[%s]\n%s\n\n", piece.Source, piece.Content)
+		citations[i] = Citation{Context: piece.context, Source: piece.Source, Offset: piece.Offset}
+	}
+	sb.WriteString("</knowledge>\n\n")
+	sb.WriteString(databases)
+	sb.WriteString(message)
+	return sb.String(), citations
+}
+
+// Ask the provider, sending the knowledge along with the message. The knowledge is looked up
+// again for every message, so the tree only keeps what the user said and where the knowledge
+// came from (the pair's citations). Replies that query one of
+// the chat's databases with the query tag are taken back out of the tree and the message is asked
+// again with the rows, providers offered the query tool call it like any other.
+// Replies that call tools stay in the tree with the calls, and the provider is asked again from
+// them with the results (see tools.go), the pair that is returned is the one that answered
+func (c *chatInstance) ask(parent Node, message string, tools []Tool) (*MessagePairNode, error) {
+	asked, sent := message, message
+	queryTool := offersTool(tools, databaseToolName)
+	var citations []Citation
+	if !calledTools(parent) {
+		// The results of tools are sent as they are, the knowledge went with the message before them
+		sent, citations = c.withKnowledge(message, queryTool)
+	}
+	started := time.Now()
+	logRaw := c.recordRaw()
+	var pair *MessagePairNode
+	for round, toolRound := 0, 0; ; round++ {
+		children := 0
+		holder, ok := treeNode(parent)
+		if ok {
+			children = len(holder.Children)
+		}
+		var err error
+		pair, err = c.extend(parent, sent, tools)
+		if err != nil {
+			logRaw(parent, true)
+			return nil, err
+		}
+		if toolRound == 0 {
+			// The knowledge went with the user's message, not with the results of tools
+			pair.Citations = citations
+		}
+		if len(pair.ToolCalls) > 0 {
+			c.callTools(pair, tools, toolRound < toolCallRounds)
+			restoreUser(pair, asked, sent)
+			if toolRound > toolCallRounds {
+				break
+			}
+			if err := c.checkGrowth(pair, 1); err != nil {
+				c.logger().Warn("tool results were not sent", "error", err)
+				break
+			}
+			toolRound++
+			parent = pair
+			asked = ToolResults(pair.ToolCalls)
+			sent = asked
+			continue
+		}
+		if queryTool || round == databaseQueryRounds || pair.Assistant == nil {
+			break
+		}
+		var queried bool
+		if sent, queried = c.answerQuery(sent, pair.Assistant.UnencodedContent()); !queried {
+			break
+		}
+		if ok {
+			holder.Children = holder.Children[:children]
+		}
+	}
+	if pair.Assistant != nil {
+		host := c.provider.Settings().Host
+		if pair.AnsweredBy != "" {
+			host = pair.AnsweredBy
+		}
+		pair.Latency = newLatency(host, time.Since(started), pair.Assistant.UnencodedContent())
+	}
+	restoreUser(pair, asked, sent)
+	logRaw(pair, false)
+	return pair, nil
+}
+
+// Put back what the pair's message was before the knowledge or query results were added to it
+func restoreUser(pair *MessagePairNode, asked string, sent string) {
+	if sent != asked && pair.User != nil {
+		pair.User.RawContent = asked
+		pair.User.B64EncodedContent = base64.StdEncoding.EncodeToString([]byte(asked))
+	}
+}
@@ -0,0 +1,180 @@
+package brunch
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkText(t *testing.T) {
+	chunks := chunkText("a.txt", "first paragraph\n\nsecond paragraph")
+	require.Len(t, chunks, 1)
+	assert.Equal(t, "first paragraph\n\nsecond paragraph", chunks[0].Content)
+
+	long := strings.Repeat("word ", knowledgeChunkSize)
+	chunks = chunkText("b.txt", "intro\n\n"+long)
+	require.Greater(t, len(chunks), 2)
+	assert.Equal(t, "intro", chunks[0].Content)
+	text := "intro\n\n" + long
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, len(chunk.Content), knowledgeChunkSize)
+		assert.Equal(t, "b.txt", chunk.Source)
+		assert.True(t, strings.HasPrefix(text[chunk.Offset:], chunk.Content), "a chunk starts at its offset")
+	}
+	assert.Zero(t, chunks[0].Offset)
+	assert.Equal(t, len("intro\n\n"), chunks[1].Offset)
+}
+
+func TestChunkIndex_Retrieve(t *testing.T) {
+	idx := chunkIndex{
+		{Source: "a", Content: "the deploy script pushes images"},
+		{Source: "b", Content: "deploy deploy deploy"},
+		{Source: "c", Content: "nothing relevant"},
+	}
+	found := idx.retrieve("how does the deploy script work?", 5)
+	require.Len(t, found, 2)
+	assert.Equal(t, "a", found[0].Source, "matching more of the query ranks higher")
+	assert.Equal(t, "b", found[1].Source)
+
+	assert.Len(t, idx.retrieve("deploy", 1), 1)
+	assert.Empty(t, idx.retrieve("a b", 5))
+}
+
+func TestDirectoryKnowledge(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.md"), []byte("the api key rotates monthly"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "image.png"), []byte{0x89, 'P', 'N', 'G', 0, 0}, 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, ".git"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".git", "config"), []byte("api key"), 0644))
+
+	knowledge, err := ContextSettings{Type: ContextTypeDirectory, Value: dir}.KnowledgeProvider()
+	require.NoError(t, err)
+	require.NoError(t, knowledge.Index())
+	assert.Contains(t, knowledge.Describe(), "1 files")
+
+	found, err := knowledge.Retrieve("when does the api key rotate?", 3)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "notes.md", found[0].Source)
+
+	_, err = ContextSettings{Type: "tape"}.KnowledgeProvider()
+	assert.Error(t, err)
+}
+
+func TestWebKnowledge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>x</title><script>var secret = 1</script></head>
+			<body><h1>Pricing</h1><p>The basic plan costs &pound;5 a month.</p></body></html>`))
+	}))
+	defer server.Close()
+
+	knowledge, err := ContextSettings{Type: ContextTypeWeb, Value: server.URL}.KnowledgeProvider()
+	require.NoError(t, err)
+	require.NoError(t, knowledge.Index())
+	found, err := knowledge.Retrieve("what does the basic plan cost", 3)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Contains(t, found[0].Content, "The basic plan costs £5 a month.")
+	assert.NotContains(t, found[0].Content, "secret")
+	assert.NotContains(t, found[0].Content, "<p>")
+}
+
+func TestDatabaseKnowledge_NoDriver(t *testing.T) {
+	knowledge, err := ContextSettings{Type: ContextTypeDatabase, Value: "postgres://user@localhost/app"}.KnowledgeProvider()
+	require.NoError(t, err)
+	assert.ErrorContains(t, knowledge.Index(), "no postgres driver")
+
+	for dsn, kind := range map[string]string{
+		"postgres://user@localhost/app":  "postgres",
+		"host=localhost dbname=app":      "postgres",
+		"user:pw@tcp(127.0.0.1:3306)/db": "mysql",
+		"file:app.db":                    "sqlite",
+		"sqlite://data/app.sqlite":       "sqlite",
+	} {
+		got, _ := databaseKind(dsn)
+		assert.Equal(t, kind, got, dsn)
+	}
+}
+
+func TestChat_Knowledge(t *testing.T) {
+	core := newTestCore(t)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ops.md"), []byte("backups run nightly at two"), 0644))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-ctx "ops" :dir "`+dir+`"`)))
+
+	chat := newBranchTestChat(t, core, "a")
+	require.NoError(t, chat.AttachContext("ops"))
+
+	// The mock echoes what it was sent, which had the knowledge in front of it
+	reply, err := chat.SubmitMessage("when do backups run?")
+	require.NoError(t, err)
+	assert.Contains(t, reply, "<knowledge>\n[ops.md]\nbackups run nightly at two")
+	assert.True(t, strings.HasSuffix(reply, "when do backups run?"))
+
+	// The tree keeps what the user said
+	pair := chat.currentNode.(*MessagePairNode)
+	assert.Equal(t, "when do backups run?", pair.User.UnencodedContent())
+
+	// Nothing relevant, nothing added
+	reply, err = chat.SubmitMessage("hello there")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello there", reply)
+
+	require.NoError(t, chat.DetachContext("ops"))
+	reply, err = chat.SubmitMessage("when do backups run?")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: when do backups run?", reply)
+}
+
+func TestChat_Citations(t *testing.T) {
+	core := newTestCore(t)
+	dir := t.TempDir()
+	notes := "restores are tested monthly\n\n" + strings.Repeat("filler ", knowledgeChunkSize/7) + "\n\nbackups run nightly at two"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ops.md"), []byte(notes), 0644))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-ctx "ops" :dir "`+dir+`"`)))
+
+	chat := newBranchTestChat(t, core, "a")
+	require.NoError(t, chat.AttachContext("ops"))
+
+	// The pair records which piece of which file went with the message
+	_, err := chat.SubmitMessage("when do backups run?")
+	require.NoError(t, err)
+	pair := chat.currentNode.(*MessagePairNode)
+	require.Len(t, pair.Citations, 1)
+	citation := pair.Citations[0]
+	assert.Equal(t, "ops", citation.Context)
+	assert.Equal(t, "ops.md", citation.Source)
+	assert.True(t, strings.HasPrefix(notes[citation.Offset:], "backups run nightly"))
+	assert.Equal(t, fmt.Sprintf("ops: ops.md@%d", citation.Offset), citation.String())
+
+	// They are saved with the chat, and a new answer keeps the old one's with its revision
+	require.NoError(t, core.SaveActiveChat("s-a"))
+	delete(core.activeChats, "a")
+	require.NoError(t, core.ExecuteStatement("s2", NewStatement(`\chat "a"`)))
+	loaded, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	assert.Equal(t, pair.Citations, loaded.currentNode.(*MessagePairNode).Citations)
+
+	_, err = loaded.Edit("hello there")
+	require.NoError(t, err)
+	edited := loaded.currentNode.(*MessagePairNode)
+	assert.Empty(t, edited.Citations)
+	require.Len(t, edited.Revisions, 1)
+	assert.Equal(t, pair.Citations, edited.Revisions[0].Citations)
+
+	exported, err := core.ExportChat("a", ExportMarkdown)
+	require.NoError(t, err)
+	assert.NotContains(t, string(exported), "source `ops: ops.md")
+	require.NoError(t, loaded.RestoreRevision(0))
+	exported, err = core.ExportChat("a", ExportMarkdown)
+	require.NoError(t, err)
+	assert.Contains(t, string(exported), "- source `"+citation.String()+"`")
+}
@@ -0,0 +1,125 @@
+package brunch
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Latency is how long the provider took to answer a message. It is only the provider's call,
+// what the chat does around it (knowledge, post-processing, verification) isn't counted
+type Latency struct {
+	Provider        string        `json:"provider"`
+	Duration        time.Duration `json:"duration"`
+	Tokens          int           `json:"tokens"` // estimated, of the answer
+	TokensPerSecond float64       `json:"tokens_per_second"`
+}
+
+func newLatency(provider string, took time.Duration, answer string) *Latency {
+	latency := &Latency{
+		Provider: provider,
+		Duration: took,
+		Tokens:   estimateTokens(answer),
+	}
+	if took > 0 {
+		latency.TokensPerSecond = float64(latency.Tokens) / took.Seconds()
+	}
+	return latency
+}
+
+// The latency of a message on the current branch
+type MessageLatency struct {
+	Node    string    `json:"node"`
+	Time    time.Time `json:"time"`
+	Latency Latency   `json:"latency"`
+}
+
+// LatencySummary sums up the latencies of one provider's answers
+type LatencySummary struct {
+	Provider        string        `json:"provider"`
+	Messages        int           `json:"messages"`
+	Mean            time.Duration `json:"mean"`
+	P50             time.Duration `json:"p50"`
+	P95             time.Duration `json:"p95"`
+	Slowest         time.Duration `json:"slowest"`
+	TokensPerSecond float64       `json:"tokens_per_second"` // mean
+}
+
+// Sum up latencies by provider, sorted by provider name
+func SummarizeLatency(latencies []Latency) []LatencySummary {
+	byProvider := map[string][]Latency{}
+	for _, latency := range latencies {
+		byProvider[latency.Provider] = append(byProvider[latency.Provider], latency)
+	}
+
+	summaries := make([]LatencySummary, 0, len(byProvider))
+	for provider, measured := range byProvider {
+		durations := make([]time.Duration, len(measured))
+		var total time.Duration
+		var rate float64
+		for i, latency := range measured {
+			durations[i] = latency.Duration
+			total += latency.Duration
+			rate += latency.TokensPerSecond
+		}
+		sort.Slice(durations, func(i, j int) bool {
+			return durations[i] < durations[j]
+		})
+		summaries = append(summaries, LatencySummary{
+			Provider:        provider,
+			Messages:        len(measured),
+			Mean:            total / time.Duration(len(measured)),
+			P50:             percentile(durations, 0.50),
+			P95:             percentile(durations, 0.95),
+			Slowest:         durations[len(durations)-1],
+			TokensPerSecond: rate / float64(len(measured)),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Provider < summaries[j].Provider
+	})
+	return summaries
+}
+
+// Nearest rank, the durations have to be sorted
+func percentile(durations []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(durations)))) - 1
+	return durations[max(rank, 0)]
+}
+
+// The latencies of the messages on the current branch, from the root down
+func (c *chatInstance) Latencies() []MessageLatency {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	latencies := []MessageLatency{}
+	for node := c.currentNode; node != nil; {
+		mp, isPair := node.(*MessagePairNode)
+		if !isPair {
+			break
+		}
+		if mp.Latency != nil {
+			latencies = append(latencies, MessageLatency{Node: mp.Hash(), Time: mp.Time, Latency: *mp.Latency})
+		}
+		node = mp.Parent
+	}
+	for i, j := 0, len(latencies)-1; i < j; i, j = i+1, j-1 {
+		latencies[i], latencies[j] = latencies[j], latencies[i]
+	}
+	return latencies
+}
+
+// Sum up the latency of every answer recorded in the activity log since the given time, by
+// provider. Comparing a recent window with everything shows when a provider got slower
+func (c *Core) LatencyReport(since time.Time) ([]LatencySummary, error) {
+	entries, err := c.RecentActivity(0)
+	if err != nil {
+		return nil, err
+	}
+	latencies := []Latency{}
+	for _, entry := range entries {
+		if entry.Latency != nil && !entry.Time.Before(since) {
+			latencies = append(latencies, *entry.Latency)
+		}
+	}
+	return SummarizeLatency(latencies), nil
+}
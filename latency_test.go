@@ -0,0 +1,77 @@
+package brunch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarizeLatency(t *testing.T) {
+	latencies := []Latency{}
+	for i := 1; i <= 20; i++ {
+		latencies = append(latencies, Latency{Provider: "slow", Duration: time.Duration(i) * time.Second, TokensPerSecond: 10})
+	}
+	latencies = append(latencies, Latency{Provider: "fast", Duration: 100 * time.Millisecond, TokensPerSecond: 200})
+
+	summaries := SummarizeLatency(latencies)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, LatencySummary{
+		Provider:        "fast",
+		Messages:        1,
+		Mean:            100 * time.Millisecond,
+		P50:             100 * time.Millisecond,
+		P95:             100 * time.Millisecond,
+		Slowest:         100 * time.Millisecond,
+		TokensPerSecond: 200,
+	}, summaries[0])
+	assert.Equal(t, "slow", summaries[1].Provider)
+	assert.Equal(t, 20, summaries[1].Messages)
+	assert.Equal(t, 10500*time.Millisecond, summaries[1].Mean)
+	assert.Equal(t, 10*time.Second, summaries[1].P50)
+	assert.Equal(t, 19*time.Second, summaries[1].P95)
+	assert.Equal(t, 20*time.Second, summaries[1].Slowest)
+
+	assert.Empty(t, SummarizeLatency(nil))
+}
+
+func TestChat_Latency(t *testing.T) {
+	core := newTestCore(t)
+	chat := newBranchTestChat(t, core, "a")
+	_, err := chat.SubmitMessage("one")
+	require.NoError(t, err)
+	_, err = chat.SubmitMessage("two")
+	require.NoError(t, err)
+
+	latencies := chat.Latencies()
+	require.Len(t, latencies, 2)
+	assert.Equal(t, chat.currentNode.Hash(), latencies[1].Node)
+	assert.Equal(t, "mock", latencies[1].Latency.Provider)
+	assert.Greater(t, latencies[1].Latency.Tokens, 0)
+
+	// Regenerating times the new answer
+	previous := chat.currentNode.(*MessagePairNode).Latency
+	_, err = chat.Regenerate()
+	require.NoError(t, err)
+	assert.NotSame(t, previous, chat.currentNode.(*MessagePairNode).Latency)
+
+	// The latency is saved with the tree
+	data, err := marshalNode(&chat.root)
+	require.NoError(t, err)
+	root, err := unmarshalNode(data)
+	require.NoError(t, err)
+	pair := root.(*RootNode).Children[0].(*MessagePairNode)
+	require.NotNil(t, pair.Latency)
+	assert.Equal(t, "mock", pair.Latency.Provider)
+
+	report, err := core.LatencyReport(time.Time{})
+	require.NoError(t, err)
+	require.Len(t, report, 1)
+	assert.Equal(t, "mock", report[0].Provider)
+	assert.Equal(t, 3, report[0].Messages)
+
+	report, err = core.LatencyReport(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, report)
+}
@@ -0,0 +1,82 @@
+package brunch
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Where each store lives. Any left empty go under the install directory with their usual
+// name, or when there is no install directory, under the XDG data and config directories.
+// The data-store can get bulky, so it is the one most worth putting on its own volume
+type StorePaths struct {
+	Data      string
+	Chats     string
+	Providers string
+	Contexts  string
+}
+
+// The name brunch's directories have under the XDG locations
+const xdgApplicationName = "brunch"
+
+// $XDG_DATA_HOME, or where it defaults to. Windows has no such thing, so there it is
+// the same as the config directory (%AppData%)
+func xdgDataHome() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return dir
+	}
+	if runtime.GOOS == "windows" {
+		return xdgConfigHome()
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".local", "share")
+}
+
+// $XDG_CONFIG_HOME, or the platform's equivalent
+func xdgConfigHome() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// Work out the directory of every store. Providers are configuration, everything else is data.
+// A store with no directory (the XDG locations couldn't be found) is left empty
+func resolveStorePaths(installDirectory string, paths StorePaths) map[string]string {
+	dataRoot := installDirectory
+	configRoot := installDirectory
+	if installDirectory == "" {
+		if home := xdgDataHome(); home != "" {
+			dataRoot = filepath.Join(home, xdgApplicationName)
+		}
+		if home := xdgConfigHome(); home != "" {
+			configRoot = filepath.Join(home, xdgApplicationName)
+		}
+	}
+
+	resolve := func(override string, root string, store string) string {
+		if override != "" {
+			return override
+		}
+		if root == "" {
+			return ""
+		}
+		return filepath.Join(root, store)
+	}
+
+	return map[string]string{
+		dataStoreDirectory:     resolve(paths.Data, dataRoot, dataStoreDirectory),
+		chatStoreDirectory:     resolve(paths.Chats, dataRoot, chatStoreDirectory),
+		providerStoreDirectory: resolve(paths.Providers, configRoot, providerStoreDirectory),
+		contextStoreDirectory:  resolve(paths.Contexts, dataRoot, contextStoreDirectory),
+	}
+}
+
+// The path of a file (or the directory itself with no elements) in one of the stores
+func (c *Core) storePath(store string, elem ...string) string {
+	return filepath.Join(append([]string{c.stores[store]}, elem...)...)
+}
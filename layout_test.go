@@ -0,0 +1,61 @@
+package brunch
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveStorePaths(t *testing.T) {
+	install := filepath.Join("srv", "brunch")
+	assert.Equal(t, map[string]string{
+		dataStoreDirectory:     filepath.Join(install, dataStoreDirectory),
+		chatStoreDirectory:     filepath.Join(install, chatStoreDirectory),
+		providerStoreDirectory: filepath.Join(install, providerStoreDirectory),
+		contextStoreDirectory:  filepath.Join(install, contextStoreDirectory),
+	}, resolveStorePaths(install, StorePaths{}))
+
+	blobs := filepath.Join("mnt", "bulk", "brunch-data")
+	stores := resolveStorePaths(install, StorePaths{Data: blobs})
+	assert.Equal(t, blobs, stores[dataStoreDirectory])
+	assert.Equal(t, filepath.Join(install, chatStoreDirectory), stores[chatStoreDirectory])
+}
+
+func TestResolveStorePaths_XDG(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" || runtime.GOOS == "plan9" {
+		t.Skip("the config directory only follows XDG_CONFIG_HOME on unix")
+	}
+	data := t.TempDir()
+	config := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", data)
+	t.Setenv("XDG_CONFIG_HOME", config)
+
+	stores := resolveStorePaths("", StorePaths{Chats: filepath.Join(data, "elsewhere")})
+	assert.Equal(t, filepath.Join(data, "brunch", dataStoreDirectory), stores[dataStoreDirectory])
+	assert.Equal(t, filepath.Join(data, "elsewhere"), stores[chatStoreDirectory])
+	assert.Equal(t, filepath.Join(config, "brunch", providerStoreDirectory), stores[providerStoreDirectory])
+	assert.Equal(t, filepath.Join(data, "brunch", contextStoreDirectory), stores[contextStoreDirectory])
+}
+
+func TestCore_StorePaths(t *testing.T) {
+	install := filepath.Join(t.TempDir(), "brunch")
+	blobs := filepath.Join(t.TempDir(), "blobs")
+	core := NewCore(CoreOpts{
+		InstallDirectory: install,
+		StorePaths:       StorePaths{Data: blobs},
+		BaseProviders:    map[string]Provider{"mock": newMockProvider("mock")},
+		ChatStartHandler: func(Conversation) error { return nil },
+	})
+	assert.False(t, core.IsInstalled())
+	require.NoError(t, core.Install())
+	assert.True(t, core.IsInstalled())
+	assert.Error(t, core.Install())
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	assert.FileExists(t, filepath.Join(install, chatStoreDirectory, "a.json"))
+	assert.FileExists(t, filepath.Join(blobs, sessionStateFile("s1")))
+	assert.NoDirExists(t, filepath.Join(install, dataStoreDirectory))
+}
@@ -0,0 +1,70 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Limits on how far a chat's tree can grow, so an automated agent that keeps on sending can't
+// grow it without end. A limit that isn't set (zero) isn't enforced
+type TreeLimits struct {
+	MaxDepth    int `json:"max_depth,omitempty"`    // message pairs from the root to the deepest node
+	MaxChildren int `json:"max_children,omitempty"` // replies under any one node
+	MaxNodes    int `json:"max_nodes,omitempty"`    // nodes in the whole tree, the root included
+}
+
+// Wrapped by the error a message gets when answering it would take the tree past a limit. The
+// message isn't sent
+var ErrTreeLimit = errors.New("the chat's tree is at its limit")
+
+func (c *chatInstance) treeLimits() TreeLimits {
+	if c.core != nil {
+		return c.core.treeLimits
+	}
+	return TreeLimits{}
+}
+
+func nodeDepth(node Node) int {
+	depth := 0
+	for parent := nodeParent(node); parent != nil; parent = nodeParent(parent) {
+		depth++
+	}
+	return depth
+}
+
+func countNodes(node Node) int {
+	count := 1
+	for _, child := range nodeChildren(node) {
+		count += countNodes(child)
+	}
+	return count
+}
+
+// Check that a chain of nodes can be added under the parent
+func (c *chatInstance) checkGrowth(parent Node, adding int) error {
+	return c.treeLimits().check(&c.root, parent, adding, adding, 1)
+}
+
+// Check that nodes can be added under the parent in the tree of the root: height of them deep,
+// nodes of them in all, with at most widest under any one of them
+func (limits TreeLimits) check(root Node, parent Node, height int, nodes int, widest int) error {
+	if limits.MaxDepth > 0 {
+		if depth := nodeDepth(parent) + height; depth > limits.MaxDepth {
+			return fmt.Errorf("%w: the branch would be %d messages deep, the most allowed is %d", ErrTreeLimit, depth, limits.MaxDepth)
+		}
+	}
+	if limits.MaxChildren > 0 {
+		if children := len(nodeChildren(parent)); children >= limits.MaxChildren {
+			return fmt.Errorf("%w: the node already has %d replies, the most allowed is %d", ErrTreeLimit, children, limits.MaxChildren)
+		}
+		if widest > limits.MaxChildren {
+			return fmt.Errorf("%w: a node would have %d replies, the most allowed is %d", ErrTreeLimit, widest, limits.MaxChildren)
+		}
+	}
+	if limits.MaxNodes > 0 {
+		if total := countNodes(root) + nodes; total > limits.MaxNodes {
+			return fmt.Errorf("%w: the tree would have %d nodes, the most allowed is %d", ErrTreeLimit, total, limits.MaxNodes)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package brunch
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func limitedChat(limits TreeLimits) *chatInstance {
+	chat := newChatInstance(newMockProvider("mock"))
+	chat.core = &Core{treeLimits: limits}
+	return chat
+}
+
+func TestChat_MaxDepth(t *testing.T) {
+	chat := limitedChat(TreeLimits{MaxDepth: 3})
+	for i := 0; i < 3; i++ {
+		_, err := chat.SubmitMessage("hello")
+		require.NoError(t, err)
+	}
+	before := chat.currentNode
+	_, err := chat.SubmitMessage("one too many")
+	assert.ErrorIs(t, err, ErrTreeLimit)
+	assert.ErrorContains(t, err, "4 messages deep, the most allowed is 3")
+	assert.Same(t, before, chat.currentNode)
+	assert.Empty(t, nodeChildren(before), "nothing was sent")
+
+	_, err = chat.Annotate(Annotation{Kind: AK_NOTE, Content: "note"})
+	assert.ErrorIs(t, err, ErrTreeLimit)
+
+	// Branching from higher up is fine
+	require.NoError(t, chat.Parent())
+	_, err = chat.SubmitMessage("another way")
+	assert.NoError(t, err)
+}
+
+func TestChat_MaxChildren(t *testing.T) {
+	chat := limitedChat(TreeLimits{MaxChildren: 2})
+	for i := 0; i < 2; i++ {
+		_, err := chat.SubmitMessage("hello")
+		require.NoError(t, err)
+		require.NoError(t, chat.Root())
+	}
+	_, err := chat.SubmitMessage("hello")
+	assert.ErrorIs(t, err, ErrTreeLimit)
+	assert.ErrorContains(t, err, "already has 2 replies")
+	assert.Len(t, chat.root.Children, 2)
+
+	// Asking again replaces the answer, it doesn't add one
+	require.NoError(t, chat.Child(0))
+	_, err = chat.Regenerate()
+	assert.NoError(t, err)
+}
+
+func TestChat_MaxNodes(t *testing.T) {
+	chat := limitedChat(TreeLimits{MaxNodes: 3})
+	for i := 0; i < 2; i++ {
+		_, err := chat.SubmitMessage("hello")
+		require.NoError(t, err)
+		require.NoError(t, chat.Root())
+	}
+	_, err := chat.SubmitMessage("hello")
+	assert.ErrorIs(t, err, ErrTreeLimit)
+	assert.ErrorContains(t, err, "would have 4 nodes")
+
+	// Without a core nothing is limited
+	chat.core = nil
+	_, err = chat.SubmitMessage("hello")
+	assert.NoError(t, err)
+}
+
+func TestChat_ChunkedInputLimits(t *testing.T) {
+	message := strings.Repeat("a long line of the message\n\n", 40)
+	send := func(limits TreeLimits) (*chatInstance, error) {
+		chat := newChatInstance(newMockProvider("mock"))
+		chat.core = newTestCore(t)
+		chat.core.treeLimits, chat.core.chunkedInputTokens = limits, 100
+		_, err := chat.SubmitMessage(message)
+		return chat, err
+	}
+	chat, err := send(TreeLimits{})
+	require.NoError(t, err)
+	parts := chat.currentNode.(*MessagePairNode).Chunked.Parts
+	require.Greater(t, parts, 1)
+
+	// The notes under the answer count like the answer does
+	for _, limits := range []TreeLimits{{MaxNodes: parts + 1}, {MaxDepth: 1}, {MaxChildren: parts - 1}} {
+		chat, err = send(limits)
+		assert.ErrorIs(t, err, ErrTreeLimit, "%+v", limits)
+		assert.Empty(t, chat.root.Children)
+	}
+	_, err = send(TreeLimits{MaxNodes: parts + 2, MaxDepth: 2, MaxChildren: parts})
+	assert.NoError(t, err)
+}
+
+func TestCore_ImportLimits(t *testing.T) {
+	core := newTestCore(t)
+	source := newBranchTestChat(t, core, "source")
+	for _, message := range []string{"one", "two", "three"} {
+		_, err := source.SubmitMessage(message)
+		require.NoError(t, err)
+	}
+	data, err := source.ExportBranch("")
+	require.NoError(t, err)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "target" :provider "mock"`)))
+
+	// Only what the import adds is counted, the start that is already there isn't
+	core.treeLimits = TreeLimits{MaxNodes: 3}
+	_, err = core.ImportBranch("target", data)
+	assert.ErrorIs(t, err, ErrTreeLimit)
+	_, err = core.ImportBranch("source", data)
+	assert.NoError(t, err)
+	meta, err := core.ChatMetadata("target")
+	require.NoError(t, err)
+	assert.Equal(t, 1, meta.Nodes, "nothing was added")
+
+	core.treeLimits = TreeLimits{MaxDepth: 2}
+	_, err = core.ImportBranch("source", data)
+	assert.NoError(t, err)
+	var export BranchExport
+	require.NoError(t, json.Unmarshal(data, &export))
+	export.Messages[2].User = "something else"
+	changed, err := json.Marshal(export)
+	require.NoError(t, err)
+	_, err = core.ImportBranch("source", changed)
+	assert.ErrorIs(t, err, ErrTreeLimit)
+	assert.Len(t, MapTree(&source.root), 4)
+
+	// A transcript is imported whole or not at all
+	file := filepath.Join(t.TempDir(), "notes.md")
+	require.NoError(t, os.WriteFile(file, []byte("User: hi\nAssistant: hello\nUser: how are you\nAssistant: fine\nUser: bye\nAssistant: bye"), 0644))
+	assert.ErrorIs(t, core.ImportMarkdownTranscript("notes", "mock", "User: hi\nAssistant: hello\nUser: how are you\nAssistant: fine\nUser: bye\nAssistant: bye"), ErrTreeLimit)
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\import-md "notes" :provider "mock" :file "`+file+`"`)))
+	assert.False(t, core.ChatExists("notes"))
+	core.treeLimits = TreeLimits{MaxDepth: 3}
+	assert.NoError(t, core.ExecuteStatement("s1", NewStatement(`\import-md "notes" :provider "mock" :file "`+file+`"`)))
+}
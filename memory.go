@@ -0,0 +1,102 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fold remembered facts into a system prompt. Keys are sorted so the prompt is the same every
+// time for the same memory
+func promptWithMemory(prompt string, heading string, memory map[string]string) string {
+	if len(memory) == 0 {
+		return prompt
+	}
+	keys := make([]string, 0, len(memory))
+	for key := range memory {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(prompt)
+	if prompt != "" {
+		sb.WriteString("\n\n")
+	}
+	sb.WriteString(heading)
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "\n- %s: %s", key, memory[key])
+	}
+	return sb.String()
+}
+
+const chatMemoryHeading = "Facts the user has established in this conversation:"
+
+// The chat's provider is cloned with the profile and memory in its system prompt, and the contexts that
+// were attached to the old provider are attached to the new one if it attaches them itself. The
+// submit lock must be held
+func (c *chatInstance) applyMemory() error {
+	settings := c.provider.Settings()
+	settings.SystemPrompt = composePrompt(c.basePrompt, c.profile, c.memory)
+	provider, err := c.provider.CloneWithSettings(settings)
+	if err != nil {
+		return fmt.Errorf("failed to clone provider: %w", err)
+	}
+	if attacher, ok := provider.(KnowledgeAttacher); ok {
+		for name, ctx := range c.contexts {
+			if err := attacher.AttachKnowledgeContext(*ctx); err != nil {
+				return fmt.Errorf("failed to attach context %s: %w", name, err)
+			}
+		}
+	}
+	c.provider = provider
+	return nil
+}
+
+func (c *chatInstance) Remember(key string, fact string) error {
+	key = strings.TrimSpace(key)
+	fact = strings.TrimSpace(fact)
+	if key == "" || fact == "" {
+		return errors.New("both a key and a fact are required")
+	}
+
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	previous, had := c.memory[key]
+	c.memory[key] = fact
+	if err := c.applyMemory(); err != nil {
+		if had {
+			c.memory[key] = previous
+		} else {
+			delete(c.memory, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *chatInstance) Forget(key string) error {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	previous, had := c.memory[key]
+	if !had {
+		return fmt.Errorf("nothing is remembered as %s", key)
+	}
+	delete(c.memory, key)
+	if err := c.applyMemory(); err != nil {
+		c.memory[key] = previous
+		return err
+	}
+	return nil
+}
+
+func (c *chatInstance) Memory() map[string]string {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	memory := make(map[string]string, len(c.memory))
+	for key, fact := range c.memory {
+		memory[key] = fact
+	}
+	return memory
+}
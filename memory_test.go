@@ -0,0 +1,60 @@
+package brunch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromptWithMemory(t *testing.T) {
+	assert.Equal(t, "be nice", promptWithMemory("be nice", "Facts:", nil))
+	assert.Equal(t, "be nice\n\nFacts:\n- a: one\n- b: two",
+		promptWithMemory("be nice", "Facts:", map[string]string{"b": "two", "a": "one"}))
+	assert.Equal(t, "Facts:\n- a: one", promptWithMemory("", "Facts:", map[string]string{"a": "one"}))
+}
+
+func TestChat_Memory(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "p" :host "mock" :system-prompt "be nice"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "p"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+
+	assert.Error(t, chat.Remember("lang", " "))
+	require.NoError(t, chat.Remember("lang", "my API is written in Go"))
+	require.NoError(t, chat.Remember("db", "postgres"))
+	assert.Equal(t, "be nice\n\n"+chatMemoryHeading+"\n- db: postgres\n- lang: my API is written in Go", chat.provider.Settings().SystemPrompt)
+	assert.Equal(t, "p", chat.provider.Settings().Host, "the chat should still point at its provider")
+
+	require.NoError(t, chat.Forget("db"))
+	assert.Error(t, chat.Forget("db"))
+	assert.Equal(t, map[string]string{"lang": "my API is written in Go"}, chat.Memory())
+
+	// Memory is saved with the chat and in the prompt again when it is loaded
+	require.NoError(t, core.SaveActiveChat("s1"))
+	restarted := NewCore(CoreOpts{
+		InstallDirectory: core.installDirectory,
+		BaseProviders:    map[string]Provider{"mock": newMockProvider("mock")},
+		InfoHandler:      core.infoHandler,
+		ChatStartHandler: func(Conversation) error { return nil },
+	})
+	require.NoError(t, restarted.LoadProviders())
+	require.NoError(t, restarted.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	loaded, err := restarted.GetActiveChat("a")
+	require.NoError(t, err)
+	assert.Equal(t, chat.Memory(), loaded.Memory())
+	assert.Equal(t, chat.provider.Settings().SystemPrompt, loaded.provider.Settings().SystemPrompt)
+
+	// Forgetting everything puts the provider's own prompt back
+	require.NoError(t, loaded.Forget("lang"))
+	assert.Equal(t, "be nice", loaded.provider.Settings().SystemPrompt)
+
+	// Forks take the memory with them
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\fork "b"`)))
+	require.NoError(t, core.ExecuteStatement("s2", NewStatement(`\chat "b"`)))
+	fork, err := core.GetActiveChat("b")
+	require.NoError(t, err)
+	assert.Equal(t, chat.Memory(), fork.Memory())
+}
@@ -0,0 +1,109 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Merging brings what two branches found back together. Each branch is taken from where they
+// split (the closest node they share) down to the node given for it, and both are put into a merge
+// annotation under the node they split from. The annotation is sent with the history, so what is
+// asked from it knows the results of both. Branches short enough are put in as they are, longer
+// ones are summarized first (SummaryForMerge)
+const mergeConcatenateTokens = 4000
+
+// The nodes from the root down to the node
+func pathFromRoot(n Node) []Node {
+	path := []Node{}
+	for ; n != nil; n = nodeParent(n) {
+		path = append([]Node{n}, path...)
+	}
+	return path
+}
+
+// The exchanges of the pairs on the path, as they are sent to a provider
+func exchangesText(path []Node) string {
+	lines := []string{}
+	for _, n := range path {
+		mp, ok := n.(*MessagePairNode)
+		if !ok {
+			continue
+		}
+		if user, assistant, ok := mp.Exchange(); ok {
+			lines = append(lines, messageToString(user), messageToString(assistant))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Merge the branches down to the two nodes into a new node under the node they split from,
+// and move to it. The hash of the new node is returned
+func (c *chatInstance) Merge(hashA, hashB string) (string, error) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+
+	nodes := MapTree(&c.root)
+	a, exists := nodes[hashA]
+	if !exists {
+		return "", fmt.Errorf("node %s not found", hashA)
+	}
+	b, exists := nodes[hashB]
+	if !exists {
+		return "", fmt.Errorf("node %s not found", hashB)
+	}
+
+	pathA, pathB := pathFromRoot(a), pathFromRoot(b)
+	split := 0
+	for split < len(pathA) && split < len(pathB) && pathA[split] == pathB[split] {
+		split++
+	}
+	if split == len(pathA) || split == len(pathB) {
+		return "", errors.New("one node is on the branch of the other, there is nothing to merge")
+	}
+	ancestor := pathA[split-1]
+	holder, ok := treeNode(ancestor)
+	if !ok {
+		return "", errors.New("the branches split from a node that can't be extended")
+	}
+	if err := c.checkGrowth(ancestor, 1); err != nil {
+		return "", err
+	}
+
+	branches := []string{exchangesText(pathA[split:]), exchangesText(pathB[split:])}
+	if branches[0] == "" || branches[1] == "" {
+		return "", errors.New("a branch has no messages to merge")
+	}
+	summarized := estimateTokens(branches[0])+estimateTokens(branches[1]) > mergeConcatenateTokens
+	if summarized {
+		for i, content := range branches {
+			ctx, cancel := c.requestContext()
+			summary, err := c.getSummarizer().Summarize(ctx, SummaryForMerge, content)
+			cancel()
+			if err != nil {
+				return "", fmt.Errorf("failed to summarize branch to merge: %w", err)
+			}
+			c.estimateAuxiliary(ctx, content, summary)
+			branches[i] = summary
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("The conversation went two ways from here, these are the results of both")
+	if summarized {
+		sb.WriteString(", summarized")
+	}
+	sb.WriteString(":\n")
+	for i, branch := range branches {
+		fmt.Fprintf(&sb, "<branch number=\"%d\">\n%s\n</branch>\n", i+1, branch)
+	}
+
+	merged := NewAnnotationNode(ancestor, Annotation{
+		Kind:      AK_MERGE,
+		Content:   strings.TrimSuffix(sb.String(), "\n"),
+		InHistory: true,
+	})
+	holder.AddChild(merged)
+	c.currentNode = merged
+	return merged.Hash(), nil
+}
@@ -0,0 +1,70 @@
+package brunch
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChat_Merge(t *testing.T) {
+	chat := newChatInstance(newMockProvider("mock"))
+	_, err := chat.SubmitMessage("plan the trip")
+	require.NoError(t, err)
+	start := chat.currentNode
+
+	_, err = chat.SubmitMessage("go by train")
+	require.NoError(t, err)
+	_, err = chat.SubmitMessage("which train")
+	require.NoError(t, err)
+	train := chat.currentNode.Hash()
+
+	chat.currentNode = start
+	_, err = chat.SubmitMessage("go by car")
+	require.NoError(t, err)
+	car := chat.currentNode.Hash()
+
+	hash, err := chat.Merge(train, car)
+	require.NoError(t, err)
+	merged := chat.currentNode.(*MessagePairNode)
+	assert.Equal(t, hash, merged.Hash())
+	assert.Same(t, start, merged.Parent)
+	require.NotNil(t, merged.Annotation)
+	assert.Equal(t, AK_MERGE, merged.Annotation.Kind)
+	assert.True(t, merged.Annotation.InHistory)
+
+	// Both branches are in it from where they split, and what comes after is sent it
+	assert.Contains(t, merged.Annotation.Content, "user: which train")
+	assert.Contains(t, merged.Annotation.Content, "assistant: echo: go by car")
+	assert.NotContains(t, merged.Annotation.Content, "plan the trip")
+	_, err = chat.SubmitMessage("so which is better")
+	require.NoError(t, err)
+	assert.Contains(t, branchHistory(chat.currentNode), "<branch number=\"2\">")
+
+	_, err = chat.Merge(start.Hash(), car)
+	assert.Error(t, err, "a node can't be merged with one on its own branch")
+	_, err = chat.Merge("nope", car)
+	assert.Error(t, err)
+}
+
+func TestChat_MergeSummarizes(t *testing.T) {
+	chat := newChatInstance(newMockProvider("mock"))
+	summarizer := &fixedSummarizer{}
+	chat.SetSummarizer(summarizer)
+
+	long := strings.Repeat("word ", mergeConcatenateTokens)
+	_, err := chat.SubmitMessage(long)
+	require.NoError(t, err)
+	a := chat.currentNode.Hash()
+	chat.currentNode = &chat.root
+	_, err = chat.SubmitMessage("short")
+	require.NoError(t, err)
+
+	_, err = chat.Merge(a, chat.currentNode.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, 2, summarizer.calls)
+	content := chat.currentNode.(*MessagePairNode).Annotation.Content
+	assert.Contains(t, content, "summary for merge")
+	assert.NotContains(t, content, "word word")
+}
@@ -0,0 +1,183 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// When a branch gets too long for the provider the message fails with an overflow. The chat
+// can then ask again with the branch compacted: the older pairs are summarized and the provider
+// is sent the summary and the last few pairs instead. The tree isn't changed, the reply is added
+// where it would have been. A core made with CompactOnOverflow does that on its own, otherwise
+// the overflow is returned as a ContextOverflowError so the user can be offered it
+// (Conversation.SubmitCompacted). Providers wrap ErrContextOverflow in the error they return
+// when the prompt doesn't fit the model
+var ErrContextOverflow = errors.New("prompt is too long for the model's context window")
+
+// How many of the most recent pairs are sent as they are when a branch is compacted
+const compactionKeepPairs = 2
+
+// What providers say when the prompt doesn't fit, for those that don't wrap ErrContextOverflow
+var overflowPhrases = []string{
+	"prompt is too long",
+	"context length",
+	"context window",
+	"maximum context",
+	"context_length_exceeded",
+	"too many tokens",
+	"input is too long",
+}
+
+func IsContextOverflow(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrContextOverflow) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, phrase := range overflowPhrases {
+		if strings.Contains(message, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// The message didn't fit, it can be sent again compacted
+type ContextOverflowError struct {
+	Err error
+}
+
+func (e *ContextOverflowError) Error() string {
+	return fmt.Sprintf("the branch is too long for the provider, it can be sent compacted: %v", e.Err)
+}
+
+func (e *ContextOverflowError) Unwrap() error {
+	return e.Err
+}
+
+// Ask the provider from the parent. A branch over the provider's context window is shortened
+// first (window.go). An overflow is compacted away if the chat is compacting, and what the
+// failed attempt left in the tree is taken back out either way
+func (c *chatInstance) extend(parent Node, sent string, tools []Tool) (*MessagePairNode, error) {
+	if last, err := c.fitWindow(parent, sent); err != nil {
+		return nil, err
+	} else if last != nil {
+		return c.extendDetached(parent, last, sent, tools)
+	}
+
+	holder, ok := treeNode(parent)
+	children := 0
+	if ok {
+		children = len(holder.Children)
+	}
+	pair, err := c.creator(parent, tools)(sent)
+	if err == nil || !IsContextOverflow(err) {
+		return pair, err
+	}
+	if ok {
+		holder.Children = holder.Children[:children]
+	}
+	if !c.compacting && (c.core == nil || !c.core.compactOnOverflow) {
+		return nil, &ContextOverflowError{Err: err}
+	}
+	c.logger().Info("branch is too long for the provider, compacting it", "error", err)
+	return c.extendCompacted(parent, sent, tools)
+}
+
+// Ask with the branch down to the parent compacted, and put the reply under the parent
+func (c *chatInstance) extendCompacted(parent Node, sent string, tools []Tool) (*MessagePairNode, error) {
+	root, pairs, err := branchPairs(parent)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("the message alone is too long: %w", ErrContextOverflow)
+	}
+
+	keep := min(compactionKeepPairs, len(pairs)-1)
+	older, kept := pairs[:len(pairs)-keep], pairs[len(pairs)-keep:]
+	summaryPair, err := c.summaryPair(older)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compact the branch: %w", err)
+	}
+	return c.extendDetached(parent, detachedBranch(root, append([]*MessagePairNode{summaryPair}, kept...)), sent, tools)
+}
+
+// The root of the branch down to the node and its pairs that were answered, oldest first
+func branchPairs(node Node) (*RootNode, []*MessagePairNode, error) {
+	pairs := []*MessagePairNode{}
+	for node != nil {
+		if root, isRoot := node.(*RootNode); isRoot {
+			return root, pairs, nil
+		}
+		mp, isPair := node.(*MessagePairNode)
+		if !isPair {
+			break
+		}
+		if _, _, exchanged := mp.Exchange(); exchanged {
+			pairs = append([]*MessagePairNode{mp}, pairs...)
+		}
+		node = mp.Parent
+	}
+	return nil, nil, errors.New("the branch has no root, it can't be compacted")
+}
+
+// A pair with the summary of the older pairs, for the start of a detached branch
+func (c *chatInstance) summaryPair(older []*MessagePairNode) (*MessagePairNode, error) {
+	content := branchHistory(older[len(older)-1])
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	summary, err := c.getSummarizer().Summarize(ctx, SummaryForCompaction, content)
+	if err != nil {
+		return nil, err
+	}
+	c.estimateAuxiliary(ctx, content, summary)
+
+	pair := NewMessagePairNode(nil)
+	pair.User = NewMessageData("user", "Summarize our conversation so far.")
+	pair.Assistant = NewMessageData("assistant", summary)
+	return pair, nil
+}
+
+// A branch of its own, made of copies of the pairs under a copy of the root, for the provider
+// to read the history from. The last node of it is returned
+func detachedBranch(root *RootNode, pairs []*MessagePairNode) Node {
+	detached := NewRootNode(RootOpt{
+		Provider:    root.Provider,
+		Model:       root.Model,
+		Prompt:      root.Prompt,
+		Temperature: root.Temperature,
+		MaxTokens:   root.MaxTokens,
+	})
+	var last Node = detached
+	for _, mp := range pairs {
+		copied := mp.clone(last)
+		if holder, ok := treeNode(last); ok {
+			holder.AddChild(copied)
+		}
+		last = copied
+	}
+	return last
+}
+
+// Ask from the detached branch, and put the reply under the parent
+func (c *chatInstance) extendDetached(parent Node, last Node, sent string, tools []Tool) (*MessagePairNode, error) {
+	pair, err := c.creator(last, tools)(sent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send the compacted branch: %w", err)
+	}
+	pair.Parent = parent
+	if holder, ok := treeNode(parent); ok {
+		holder.AddChild(pair)
+	}
+	return pair, nil
+}
+
+// Send the message, compacting the branch if it doesn't fit
+func (c *chatInstance) SubmitCompacted(message string) (string, error) {
+	return c.submitOrQueue(context.Background(), message, true)
+}
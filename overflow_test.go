@@ -0,0 +1,97 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Refuses branches longer than its limit, the way an API refuses a prompt over the context window
+type overflowProvider struct {
+	mockProvider
+	limit int
+	seen  []string // the history of every branch it accepted
+}
+
+func (op *overflowProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	return func(userMessage string) (*MessagePairNode, error) {
+		history := branchHistory(node)
+		if len(history)+len(userMessage) > op.limit {
+			return nil, fmt.Errorf("API request failed with status 400: prompt is too long: %d > %d", len(history)+len(userMessage), op.limit)
+		}
+		op.seen = append(op.seen, history)
+		return op.mockProvider.ExtendFrom(ctx, node)(userMessage)
+	}
+}
+
+func TestIsContextOverflow(t *testing.T) {
+	assert.True(t, IsContextOverflow(fmt.Errorf("send: %w", ErrContextOverflow)))
+	assert.True(t, IsContextOverflow(errors.New(`{"type":"invalid_request_error","message":"prompt is too long: 210000 tokens > 200000 maximum"}`)))
+	assert.True(t, IsContextOverflow(errors.New("This model's maximum context length is 8192 tokens")))
+	assert.False(t, IsContextOverflow(errors.New("rate limited")))
+	assert.False(t, IsContextOverflow(nil))
+}
+
+func TestChat_ContextOverflow(t *testing.T) {
+	provider := &overflowProvider{mockProvider: *newMockProvider("mock"), limit: 10000}
+	chat := newChatInstance(provider)
+	summarizer := &fixedSummarizer{}
+	chat.SetSummarizer(summarizer)
+
+	for i := 0; i < 4; i++ {
+		_, err := chat.SubmitMessage(fmt.Sprintf("message number %d, with some padding to fill the window", i))
+		require.NoError(t, err)
+	}
+	before := chat.currentNode
+	provider.limit = len(branchHistory(before))
+
+	_, err := chat.SubmitMessage("one more")
+	var overflow *ContextOverflowError
+	require.ErrorAs(t, err, &overflow)
+	assert.Same(t, before, chat.currentNode)
+	assert.Len(t, before.(*MessagePairNode).Children, 0, "the failed attempt should leave nothing in the tree")
+
+	reply, err := chat.SubmitCompacted("one more")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: one more", reply)
+
+	// The reply is where it would have been, and the provider was sent the summary and the last pairs
+	assert.Same(t, before, chat.currentNode.(*MessagePairNode).Parent)
+	require.Len(t, before.(*MessagePairNode).Children, 1)
+	require.Equal(t, 1, summarizer.calls)
+	assert.Contains(t, summarizer.content, "message number 1")
+	assert.NotContains(t, summarizer.content, "message number 2")
+	sent := provider.seen[len(provider.seen)-1]
+	assert.Contains(t, sent, "summary for compaction")
+	assert.Contains(t, sent, "message number 3")
+	assert.False(t, strings.Contains(sent, "message number 0"))
+}
+
+func TestCore_CompactOnOverflow(t *testing.T) {
+	core := newTestCore(t)
+	core.compactOnOverflow = true
+	provider := &overflowProvider{mockProvider: *newMockProvider("mock"), limit: 10000}
+	chat := newChatInstance(provider)
+	chat.core = core
+	chat.SetSummarizer(&fixedSummarizer{})
+
+	for i := 0; i < 6; i++ {
+		_, err := chat.SubmitMessage(fmt.Sprintf("message number %d, with some padding to fill the window", i))
+		require.NoError(t, err)
+	}
+	provider.limit = len(branchHistory(chat.currentNode))
+	_, err := chat.SubmitMessage("one more")
+	require.NoError(t, err)
+	assert.Equal(t, 7, ComputeTreeStats(&chat.root).MaxDepth)
+
+	// A message that is too long on its own can't be helped, it isn't offered to be compacted again
+	_, err = chat.SubmitMessage(strings.Repeat("x", provider.limit))
+	assert.True(t, IsContextOverflow(err))
+	var overflow *ContextOverflowError
+	assert.False(t, errors.As(err, &overflow))
+}
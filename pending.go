@@ -0,0 +1,130 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// When the provider can't be reached, a core made with CoreOpts.QueueOffline keeps the message
+// instead of losing it. It is queued on the node it was sent from as pending, saved with the
+// tree, and sent from there by Flush once the provider can be reached again
+type PendingMessage struct {
+	Message string    `json:"message"`
+	Queued  time.Time `json:"queued"`
+
+	// Why it couldn't be sent
+	Error string `json:"error,omitempty"`
+}
+
+// Returned in place of the reply when the message was queued, see Flush
+type MessageQueuedError struct {
+	Node string
+	Err  error
+}
+
+func (e *MessageQueuedError) Error() string {
+	return fmt.Sprintf("the provider can't be reached, the message was queued on node %s to send later: %v", ShortHash(e.Node), e.Err)
+}
+
+func (e *MessageQueuedError) Unwrap() error {
+	return e.Err
+}
+
+// A queued message that was sent, and what it was answered with
+type FlushedMessage struct {
+	Message  string
+	Response string
+	Node     string // where the reply went
+}
+
+// Whether the provider couldn't be reached at all, as opposed to answering with an error
+func isNetworkError(err error) bool {
+	// Given up on by whoever sent it, the provider may be fine
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (c *chatInstance) queuesOffline() bool {
+	return c.core != nil && c.core.queueOffline
+}
+
+// Send the message, or queue it if the provider can't be reached and the core queues messages
+func (c *chatInstance) submitOrQueue(ctx context.Context, message string, compact bool) (string, error) {
+	response, err := c.submit(ctx, message, compact)
+	if err == nil || !c.queuesOffline() || !isNetworkError(err) {
+		return response, err
+	}
+
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	holder, ok := treeNode(c.currentNode)
+	if !ok {
+		return "", err
+	}
+	holder.Pending = append(holder.Pending, PendingMessage{
+		Message: message,
+		Queued:  time.Now(),
+		Error:   err.Error(),
+	})
+	c.logger().Info("provider unreachable, message queued", "node", c.currentNode.Hash())
+	return "", &MessageQueuedError{Node: c.currentNode.Hash(), Err: err}
+}
+
+// The nodes that have messages queued on them, in tree order
+func pendingNodes(n Node) []Node {
+	found := []Node{}
+	if holder, ok := treeNode(n); ok && len(holder.Pending) > 0 {
+		found = append(found, n)
+	}
+	for _, child := range nodeChildren(n) {
+		found = append(found, pendingNodes(child)...)
+	}
+	return found
+}
+
+// Flush sends the queued messages from the nodes they were queued on, oldest first on each node.
+// Messages queued on the same node were typed one after the other so each one follows the reply
+// to the one before it, and the chat ends up on the last reply. A message is only taken off of the queue once it is
+// answered, so flushing stops at the first one that fails and the rest stay queued
+func (c *chatInstance) Flush() ([]FlushedMessage, error) {
+	if !c.chatEnabled {
+		return nil, errors.New("chat is disabled, nothing can be sent")
+	}
+	c.submitMu.Lock()
+	nodes := pendingNodes(&c.root)
+	c.submitMu.Unlock()
+
+	flushed := []FlushedMessage{}
+	for _, n := range nodes {
+		holder, _ := treeNode(n)
+		c.submitMu.Lock()
+		c.currentNode = n
+		c.submitMu.Unlock()
+		for len(holder.Pending) > 0 {
+			pending := holder.Pending[0]
+
+			response, err := c.submit(context.Background(), pending.Message, false)
+			if err != nil {
+				return flushed, fmt.Errorf("failed to send message queued on %s, it is still queued: %w", ShortHash(n.Hash()), err)
+			}
+			c.submitMu.Lock()
+			holder.Pending = holder.Pending[1:]
+			if len(holder.Pending) == 0 {
+				holder.Pending = nil
+			}
+			flushed = append(flushed, FlushedMessage{
+				Message:  pending.Message,
+				Response: response,
+				Node:     c.currentNode.Hash(),
+			})
+			c.submitMu.Unlock()
+		}
+	}
+	return flushed, nil
+}
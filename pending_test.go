@@ -0,0 +1,81 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Can't be reached while offline is set, otherwise it echoes
+type offlineProvider struct {
+	mockProvider
+	offline bool
+}
+
+func (op *offlineProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	return func(userMessage string) (*MessagePairNode, error) {
+		if op.offline {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		return op.mockProvider.ExtendFrom(ctx, node)(userMessage)
+	}
+}
+
+func TestChat_QueueOffline(t *testing.T) {
+	core := newTestCore(t)
+	core.queueOffline = true
+	provider := &offlineProvider{mockProvider: *newMockProvider("mock")}
+	chat := newChatInstance(provider)
+	chat.core = core
+
+	_, err := chat.SubmitMessage("first")
+	require.NoError(t, err)
+	first := chat.currentNode
+
+	provider.offline = true
+	_, err = chat.SubmitMessage("second")
+	var queued *MessageQueuedError
+	require.True(t, errors.As(err, &queued))
+	assert.Equal(t, first.Hash(), queued.Node)
+	_, err = chat.SubmitMessage("third")
+	require.Error(t, err)
+
+	holder, _ := treeNode(first)
+	require.Len(t, holder.Pending, 2)
+	assert.Equal(t, "second", holder.Pending[0].Message)
+	assert.Contains(t, chat.PrintTree(), "Pending: 2 messages waiting to be sent")
+
+	// The queue is saved with the tree
+	snap, err := chat.Snapshot()
+	require.NoError(t, err)
+	restored, err := unmarshalNode(snap.Contents)
+	require.NoError(t, err)
+	assert.Len(t, pendingNodes(restored), 1)
+
+	// Still offline, nothing is lost
+	flushed, err := chat.Flush()
+	assert.Error(t, err)
+	assert.Empty(t, flushed)
+	assert.Len(t, holder.Pending, 2)
+
+	provider.offline = false
+	flushed, err = chat.Flush()
+	require.NoError(t, err)
+	require.Len(t, flushed, 2)
+	assert.Equal(t, "echo: second", flushed[0].Response)
+	assert.Equal(t, "echo: third", flushed[1].Response)
+	assert.Empty(t, holder.Pending)
+	assert.Equal(t, flushed[1].Node, chat.currentNode.Hash())
+	assert.Same(t, first, chat.currentNode.(*MessagePairNode).Parent.(*MessagePairNode).Parent)
+
+	// Without the option the error is returned as it is
+	core.queueOffline = false
+	provider.offline = true
+	_, err = chat.SubmitMessage("lost")
+	assert.False(t, errors.As(err, &queued))
+	assert.Empty(t, pendingNodes(&chat.root))
+}
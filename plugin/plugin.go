@@ -0,0 +1,260 @@
+/*
+Package plugin lets providers that live outside of the brunch binary be registered with a core at
+runtime. A plugin is any executable that speaks the protocol below over its stdin/stdout, so it can
+be written in any language and swapped without recompiling brunch.
+
+The protocol is newline delimited JSON. Brunch writes one request per line and the plugin answers
+each with exactly one response line carrying the same id, in order:
+
+	-> {"id":1,"method":"describe"}
+	<- {"id":1,"result":{"model":"my-model","settings":{"name":"my-plugin",...}}}
+
+	-> {"id":2,"method":"generate","params":{"settings":{...},"history":[...],"message":"hi","images":[]}}
+	<- {"id":2,"result":{"content":"hello!"}}
+
+	-> {"id":3,"method":"attach_context","params":{"name":"docs","type":"directory","value":"/docs"}}
+	<- {"id":3,"error":"not supported"}
+
+Go plugins can use Serve to handle the protocol for them.
+*/
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/bosley/brunch"
+)
+
+const (
+	MethodDescribe      = "describe"
+	MethodGenerate      = "generate"
+	MethodAttachContext = "attach_context"
+)
+
+type request struct {
+	Id     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	Id     int             `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// What a plugin reports about itself when it is started. The settings are used as the
+// defaults for the base provider, the same as a compiled-in provider would set them
+type Description struct {
+	Model    string                  `json:"model"`
+	Settings brunch.ProviderSettings `json:"settings"`
+}
+
+// A request for the plugin to generate the assistant's side of a message pair
+type GenerateRequest struct {
+	Settings brunch.ProviderSettings `json:"settings"`
+	History  []map[string]string     `json:"history"`
+	Message  string                  `json:"message"`
+	Images   []string                `json:"images"`
+}
+
+type generateResult struct {
+	Content string `json:"content"`
+}
+
+// The client owns the connection to a plugin. Calls are serialized as the protocol
+// is strictly request->response
+type Client struct {
+	mu      sync.Mutex
+	nextId  int
+	encoder *json.Encoder
+	scanner *bufio.Scanner
+	closer  io.Closer
+	cmd     *exec.Cmd
+}
+
+// NewClient speaks the plugin protocol over the given reader and writer
+func NewClient(r io.Reader, w io.Writer) *Client {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	client := &Client{
+		encoder: json.NewEncoder(w),
+		scanner: scanner,
+	}
+	if closer, ok := w.(io.Closer); ok {
+		client.closer = closer
+	}
+	return client
+}
+
+// Launch starts the plugin executable and connects to it over its stdio. The plugin's
+// stderr is passed through so it can log
+func Launch(command string, args ...string) (*Client, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plugin stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plugin stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin %s: %w", command, err)
+	}
+
+	client := NewClient(stdout, stdin)
+	client.cmd = cmd
+	return client, nil
+}
+
+// Close the connection to the plugin and wait for it to exit if we launched it
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closer != nil {
+		c.closer.Close()
+	}
+	if c.cmd != nil {
+		return c.cmd.Wait()
+	}
+	return nil
+}
+
+func (c *Client) call(method string, params interface{}, result interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextId++
+	req := request{
+		Id:     c.nextId,
+		Method: method,
+	}
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s params: %w", method, err)
+		}
+		req.Params = raw
+	}
+
+	if err := c.encoder.Encode(&req); err != nil {
+		return fmt.Errorf("failed to send %s request to plugin: %w", method, err)
+	}
+
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read %s response from plugin: %w", method, err)
+		}
+		return fmt.Errorf("plugin closed the connection during %s", method)
+	}
+
+	var resp response
+	if err := json.Unmarshal(c.scanner.Bytes(), &resp); err != nil {
+		return fmt.Errorf("failed to unmarshal %s response from plugin: %w", method, err)
+	}
+	if resp.Id != req.Id {
+		return fmt.Errorf("plugin answered request %d with response %d", req.Id, resp.Id)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("failed to unmarshal %s result from plugin: %w", method, err)
+	}
+	return nil
+}
+
+func (c *Client) Describe() (Description, error) {
+	var desc Description
+	err := c.call(MethodDescribe, nil, &desc)
+	return desc, err
+}
+
+func (c *Client) Generate(req GenerateRequest) (string, error) {
+	var result generateResult
+	if err := c.call(MethodGenerate, req, &result); err != nil {
+		return "", err
+	}
+	return result.Content, nil
+}
+
+func (c *Client) AttachContext(ctx brunch.ContextSettings) error {
+	return c.call(MethodAttachContext, ctx, nil)
+}
+
+// A Handler is implemented by Go plugins and handed to Serve
+type Handler interface {
+	Describe() (Description, error)
+	Generate(req GenerateRequest) (string, error)
+	AttachContext(ctx brunch.ContextSettings) error
+}
+
+// Serve answers plugin protocol requests from r on w until r is exhausted.
+// A plugin's main is expected to be little more than Serve(handler, os.Stdin, os.Stdout)
+func Serve(h Handler, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	encoder := json.NewEncoder(w)
+
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return fmt.Errorf("failed to unmarshal request: %w", err)
+		}
+
+		result, err := dispatch(h, req)
+		resp := response{Id: req.Id}
+		if err != nil {
+			resp.Error = err.Error()
+		} else if result != nil {
+			raw, err := json.Marshal(result)
+			if err != nil {
+				resp.Error = fmt.Sprintf("failed to marshal result: %v", err)
+			} else {
+				resp.Result = raw
+			}
+		}
+
+		if err := encoder.Encode(&resp); err != nil {
+			return fmt.Errorf("failed to write response: %w", err)
+		}
+	}
+	return scanner.Err()
+}
+
+func dispatch(h Handler, req request) (interface{}, error) {
+	switch req.Method {
+	case MethodDescribe:
+		return h.Describe()
+	case MethodGenerate:
+		var params GenerateRequest
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, fmt.Errorf("invalid generate params: %w", err)
+		}
+		content, err := h.Generate(params)
+		if err != nil {
+			return nil, err
+		}
+		return generateResult{Content: content}, nil
+	case MethodAttachContext:
+		var ctx brunch.ContextSettings
+		if err := json.Unmarshal(req.Params, &ctx); err != nil {
+			return nil, fmt.Errorf("invalid attach_context params: %w", err)
+		}
+		return nil, h.AttachContext(ctx)
+	}
+	return nil, fmt.Errorf("unknown method: %s", req.Method)
+}
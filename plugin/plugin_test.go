@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/bosley/brunch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type echoHandler struct {
+	lastRequest GenerateRequest
+}
+
+func (h *echoHandler) Describe() (Description, error) {
+	return Description{
+		Model: "echo-1",
+		Settings: brunch.ProviderSettings{
+			Name:        "echo",
+			MaxTokens:   100,
+			Temperature: 0.3,
+		},
+	}, nil
+}
+
+func (h *echoHandler) Generate(req GenerateRequest) (string, error) {
+	h.lastRequest = req
+	return strings.ToUpper(req.Message), nil
+}
+
+func (h *echoHandler) AttachContext(ctx brunch.ContextSettings) error {
+	return errors.New("contexts are not supported")
+}
+
+func connect(t *testing.T, h Handler) *Client {
+	t.Helper()
+	toPlugin, pluginIn := io.Pipe()
+	pluginOut, fromPlugin := io.Pipe()
+	go func() {
+		Serve(h, toPlugin, fromPlugin)
+		fromPlugin.Close()
+	}()
+	client := NewClient(pluginOut, pluginIn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestPluginProvider(t *testing.T) {
+	handler := &echoHandler{}
+	provider, err := NewPluginProvider("my-echo", connect(t, handler))
+	require.NoError(t, err)
+
+	settings := provider.Settings()
+	assert.Equal(t, "my-echo", settings.Name)
+	assert.Equal(t, 100, settings.MaxTokens)
+
+	root := provider.NewConversationRoot()
+	assert.Equal(t, "echo-1", root.Model)
+
+	first, err := provider.ExtendFrom(context.Background(), &root)("hello")
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO", first.Assistant.UnencodedContent())
+	assert.Len(t, root.Children, 1)
+
+	require.NoError(t, provider.QueueImages([]string{"a.png"}))
+	second, err := provider.ExtendFrom(context.Background(), first)("again")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.png"}, second.User.Images)
+	assert.Equal(t, []map[string]string{
+		{"role": "user", "content": "hello"},
+		{"role": "assistant", "content": "HELLO"},
+	}, handler.lastRequest.History)
+
+	clone, err := provider.CloneWithSettings(brunch.ProviderSettings{Name: "derived", SystemPrompt: "be loud"})
+	require.NoError(t, err)
+	_, err = clone.ExtendFrom(context.Background(), second)("third")
+	require.NoError(t, err)
+	assert.Equal(t, "be loud", handler.lastRequest.Settings.SystemPrompt)
+
+	seed := int64(7)
+	seeded, err := provider.CloneWithSettings(brunch.ProviderSettings{Name: "seeded", Seed: &seed})
+	require.NoError(t, err)
+	pair, err := seeded.ExtendFrom(context.Background(), second)("fourth")
+	require.NoError(t, err)
+	assert.Equal(t, &seed, handler.lastRequest.Settings.Seed)
+	assert.Equal(t, &seed, pair.Seed)
+
+	err = provider.AttachKnowledgeContext(brunch.ContextSettings{Name: "docs"})
+	assert.EqualError(t, err, "contexts are not supported")
+}
+
+func TestServe_UnknownMethod(t *testing.T) {
+	client := connect(t, &echoHandler{})
+	err := client.call("bogus", nil, nil)
+	assert.EqualError(t, err, "unknown method: bogus")
+}
+
+func TestPluginProvider_HistoryAnnotations(t *testing.T) {
+	provider, err := NewPluginProvider("my-echo", connect(t, &echoHandler{}))
+	require.NoError(t, err)
+	root := provider.NewConversationRoot()
+	first, err := provider.ExtendFrom(context.Background(), &root)("hello")
+	require.NoError(t, err)
+
+	kept := brunch.NewAnnotationNode(first, brunch.Annotation{Kind: brunch.AK_NOTE, Content: "private"})
+	sent := brunch.NewAnnotationNode(kept, brunch.Annotation{Kind: brunch.AK_NOTE, Content: "shared", InHistory: true})
+	history := provider.GetHistory(sent)
+	require.Len(t, history, 4)
+	assert.Equal(t, "hello", history[0]["content"])
+	assert.Equal(t, "<note>\nshared\n</note>", history[2]["content"])
+	assert.Equal(t, "assistant", history[3]["role"])
+}
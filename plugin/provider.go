@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bosley/brunch"
+)
+
+// A PluginProvider is a brunch provider whose messages are generated by a plugin process.
+// The tree is managed here, only the generation is handed off to the plugin
+type PluginProvider struct {
+	client        *Client
+	model         string
+	settings      brunch.ProviderSettings
+	pendingImages []string
+}
+
+var _ brunch.Provider = (*PluginProvider)(nil)
+var _ brunch.KnowledgeAttacher = (*PluginProvider)(nil)
+
+// NewPluginProvider asks the plugin to describe itself and builds a base provider from it.
+// The name given overrides whatever the plugin calls itself so it is addressable in the core
+func NewPluginProvider(name string, client *Client) (*PluginProvider, error) {
+	desc, err := client.Describe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe plugin %s: %w", name, err)
+	}
+	desc.Settings.Name = name
+	desc.Settings.Host = name
+	return &PluginProvider{
+		client:        client,
+		model:         desc.Model,
+		settings:      desc.Settings,
+		pendingImages: []string{},
+	}, nil
+}
+
+// LaunchProvider starts the plugin executable and wraps it as a provider
+func LaunchProvider(name string, command string, args ...string) (*PluginProvider, error) {
+	client, err := Launch(command, args...)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := NewPluginProvider(name, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return provider, nil
+}
+
+func (pp *PluginProvider) NewConversationRoot() brunch.RootNode {
+	return *brunch.NewRootNode(brunch.RootOpt{
+		Provider:    pp.settings.Name,
+		Model:       pp.model,
+		Prompt:      pp.settings.SystemPrompt,
+		Temperature: pp.settings.Temperature,
+		MaxTokens:   pp.settings.MaxTokens,
+	})
+}
+
+func (pp *PluginProvider) ExtendFrom(ctx context.Context, node brunch.Node) brunch.MessageCreator {
+	return func(userMessage string) (*brunch.MessagePairNode, error) {
+
+		// The protocol has no way to take back a request once it is sent, so the context can
+		// only stop one from being sent
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		images := pp.pendingImages
+		resp, err := pp.client.Generate(GenerateRequest{
+			Settings: pp.settings,
+			History:  pp.GetHistory(node),
+			Message:  userMessage,
+			Images:   images,
+		})
+		if err != nil {
+			return nil, err
+		}
+		pp.pendingImages = []string{}
+
+		msgPair := brunch.NewMessagePairNode(node)
+		msgPair.User = brunch.NewMessageData("user", userMessage)
+		msgPair.Assistant = brunch.NewMessageData("assistant", resp)
+		if len(images) > 0 {
+			msgPair.User.Images = images
+		}
+
+		// The seed goes to the plugin with the settings, so it is recorded as what the answer was generated with
+		if pp.settings.Seed != nil {
+			seed := *pp.settings.Seed
+			msgPair.Seed = &seed
+		}
+
+		switch parent := node.(type) {
+		case *brunch.RootNode:
+			parent.AddChild(msgPair)
+		case *brunch.MessagePairNode:
+			parent.AddChild(msgPair)
+		}
+		return msgPair, nil
+	}
+}
+
+func (pp *PluginProvider) GetRoot(node brunch.Node) brunch.RootNode {
+	current := node
+	for {
+		if root, ok := current.(*brunch.RootNode); ok {
+			return *root
+		}
+		if msgPair, ok := current.(*brunch.MessagePairNode); ok && msgPair.Parent != nil {
+			current = msgPair.Parent
+			continue
+		}
+		return pp.NewConversationRoot()
+	}
+}
+
+func (pp *PluginProvider) GetHistory(node brunch.Node) []map[string]string {
+	history := []map[string]string{}
+	current := node
+	for {
+		msgPair, ok := current.(*brunch.MessagePairNode)
+		if !ok {
+			break
+		}
+		if user, assistant, ok := msgPair.Exchange(); ok {
+			history = append([]map[string]string{
+				{
+					"role":    user.Role,
+					"content": user.UnencodedContent(),
+				},
+				{
+					"role":    assistant.Role,
+					"content": assistant.UnencodedContent(),
+				},
+			}, history...)
+		}
+		if msgPair.Parent == nil {
+			break
+		}
+		current = msgPair.Parent
+	}
+	return history
+}
+
+func (pp *PluginProvider) QueueImages(paths []string) error {
+	pp.pendingImages = append(pp.pendingImages, paths...)
+	return nil
+}
+
+func (pp *PluginProvider) Settings() brunch.ProviderSettings {
+	return pp.settings
+}
+
+// Clones share the plugin process, only the settings sent along with each request differ
+func (pp *PluginProvider) CloneWithSettings(settings brunch.ProviderSettings) (brunch.Provider, error) {
+	return &PluginProvider{
+		client:        pp.client,
+		model:         pp.model,
+		settings:      settings,
+		pendingImages: []string{},
+	}, nil
+}
+
+func (pp *PluginProvider) AttachKnowledgeContext(ctx brunch.ContextSettings) error {
+	return pp.client.AttachContext(ctx)
+}
@@ -0,0 +1,133 @@
+package brunch
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The post-processors a provider can list in its settings. They run over the assistant's reply,
+// in the order given, before the message pair is stored:
+//
+//	strip-thinking  removes <thinking> and <think> blocks some models reason in
+//	trim            removes leading and trailing whitespace
+//	code-only       keeps only the contents of the reply's fenced code blocks
+//	max-length:N    cuts the reply down to N characters
+//	speech          keeps only what should be said out loud, for providers read by text-to-speech (see speech.go)
+const (
+	PostProcessStripThinking = "strip-thinking"
+	PostProcessTrim          = "trim"
+	PostProcessCodeOnly      = "code-only"
+	PostProcessMaxLength     = "max-length"
+	PostProcessSpeech        = "speech"
+)
+
+type postProcessor func(string) string
+
+var thinkingBlock = regexp.MustCompile(`(?is)<(thinking|think)>.*?</(thinking|think)>`)
+
+func stripThinking(content string) string {
+	return thinkingBlock.ReplaceAllString(content, "")
+}
+
+// The code of every fenced block, separated by blank lines. A reply without any code is left alone
+func codeOnly(content string) string {
+	blocks := []string{}
+	var current []string
+	inFence := false
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inFence {
+				blocks = append(blocks, strings.Join(current, "\n"))
+				current = nil
+			}
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			current = append(current, line)
+		}
+	}
+	if len(blocks) == 0 {
+		return content
+	}
+	return strings.Join(blocks, "\n\n")
+}
+
+func maxLength(limit int) postProcessor {
+	return func(content string) string {
+		runes := []rune(content)
+		if len(runes) <= limit {
+			return content
+		}
+		return string(runes[:limit])
+	}
+}
+
+func parsePostProcessor(spec string) (postProcessor, error) {
+	name, arg, hasArg := strings.Cut(strings.TrimSpace(spec), ":")
+	switch name {
+	case PostProcessStripThinking, PostProcessTrim, PostProcessCodeOnly, PostProcessSpeech:
+		if hasArg {
+			return nil, fmt.Errorf("post-processor %s does not take an argument", name)
+		}
+	}
+	switch name {
+	case PostProcessStripThinking:
+		return stripThinking, nil
+	case PostProcessTrim:
+		return strings.TrimSpace, nil
+	case PostProcessCodeOnly:
+		return codeOnly, nil
+	case PostProcessSpeech:
+		return SpeechText, nil
+	case PostProcessMaxLength:
+		limit, err := strconv.Atoi(arg)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("post-processor %s needs a positive length, like %s:2000", name, name)
+		}
+		return maxLength(limit), nil
+	}
+	return nil, fmt.Errorf("unknown post-processor: %s", spec)
+}
+
+// Check that every spec names a post-processor, so a provider can't be saved with one that
+// would fail on every reply
+func ValidatePostProcessors(specs []string) error {
+	for _, spec := range specs {
+		if _, err := parsePostProcessor(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run the content through the post-processors in order. A step that would leave nothing of the
+// reply is skipped, an empty answer is never better than the unprocessed one
+func applyPostProcessors(specs []string, content string) (string, error) {
+	for _, spec := range specs {
+		process, err := parsePostProcessor(spec)
+		if err != nil {
+			return "", err
+		}
+		if processed := process(content); strings.TrimSpace(processed) != "" {
+			content = processed
+		}
+	}
+	return content, nil
+}
+
+// Apply the chat's provider's post-processors to a fresh reply
+func (c *chatInstance) postProcess(pair *MessagePairNode) error {
+	specs := c.provider.Settings().PostProcess
+	if len(specs) == 0 || pair.Assistant == nil {
+		return nil
+	}
+	content, err := applyPostProcessors(specs, pair.Assistant.UnencodedContent())
+	if err != nil {
+		return fmt.Errorf("failed to post-process reply: %w", err)
+	}
+	pair.Assistant = NewMessageData(pair.Assistant.Role, content)
+	return nil
+}
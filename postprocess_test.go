@@ -0,0 +1,88 @@
+package brunch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyPostProcessors(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{name: "none", content: " as is ", want: " as is "},
+		{name: "trim", specs: []string{"trim"}, content: "\n  hello \n", want: "hello"},
+		{
+			name:    "strip thinking",
+			specs:   []string{"strip-thinking", "trim"},
+			content: "<thinking>\nthey want a greeting\n</thinking>\nhello <THINK>again</THINK>there",
+			want:    "hello there",
+		},
+		{
+			name:    "code only",
+			specs:   []string{"code-only"},
+			content: "here you go:\n```go\nfmt.Println(1)\n```\nand\n```\nls\n```\nenjoy",
+			want:    "fmt.Println(1)\n\nls",
+		},
+		{name: "code only without code", specs: []string{"code-only"}, content: "no code", want: "no code"},
+		{name: "max length", specs: []string{"max-length:5"}, content: "héllo world", want: "héllo"},
+		{name: "order matters", specs: []string{"max-length:6", "trim"}, content: "   abc def", want: "abc"},
+		{
+			name:    "a step that would empty the reply is skipped",
+			specs:   []string{"strip-thinking"},
+			content: "<think>only thoughts</think>",
+			want:    "<think>only thoughts</think>",
+		},
+		{name: "unknown", specs: []string{"shout"}, content: "x", wantErr: true},
+		{name: "bad length", specs: []string{"max-length:zero"}, content: "x", wantErr: true},
+		{name: "argument where none is taken", specs: []string{"trim:1"}, content: "x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyPostProcessors(tt.specs, tt.content)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Error(t, ValidatePostProcessors(tt.specs))
+				return
+			}
+			require.NoError(t, err)
+			assert.NoError(t, ValidatePostProcessors(tt.specs))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCore_PostProcess(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "short" :host "mock" :post-process "code-only", "max-length:6"`)))
+	assert.Equal(t, []string{"code-only", "max-length:6"}, core.providers["short"].Settings().PostProcess)
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "bad" :host "mock" :post-process "shout"`)))
+
+	// Derived providers inherit them
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "shorter" :host "short"`)))
+	assert.Equal(t, []string{"code-only", "max-length:6"}, core.providers["shorter"].Settings().PostProcess)
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "shorter"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+
+	reply, err := chat.SubmitMessage("run\n```\nls -la\n```")
+	require.NoError(t, err)
+	assert.Equal(t, "ls -la", reply)
+	assert.Equal(t, "ls -la", chat.currentNode.(*MessagePairNode).Assistant.UnencodedContent())
+
+	// Regenerated replies go through them too
+	reply, err = chat.Regenerate()
+	require.NoError(t, err)
+	assert.Equal(t, "ls -la", reply)
+
+	reply, err = chat.SubmitMessage("no code here")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: ", reply)
+}
@@ -0,0 +1,174 @@
+package brunch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The profile is what the user wants every conversation to know about them (preferences, common
+// facts). It lives in the data-store, and only chats that opt in to it have it in their prompt
+const profileFile = "profile.json"
+
+const profileHeading = "Facts the user has shared about themselves:"
+
+// The profile goes ahead of the chat's own memory so that what was said in the conversation
+// reads as the more specific of the two
+func composePrompt(base string, profile map[string]string, memory map[string]string) string {
+	return promptWithMemory(promptWithMemory(base, profileHeading, profile), chatMemoryHeading, memory)
+}
+
+func (c *Core) readProfile() (map[string]string, error) {
+	content, err := c.LoadFromDataStore(profileFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return map[string]string{}, nil
+		}
+		return nil, fmt.Errorf("failed to read profile: %w", err)
+	}
+	profile := map[string]string{}
+	if err := json.Unmarshal([]byte(content), &profile); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal profile: %w", err)
+	}
+	return profile, nil
+}
+
+func (c *Core) writeProfile(profile map[string]string) error {
+	if len(profile) == 0 {
+		err := os.Remove(c.storePath(dataStoreDirectory, profileFile))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove profile: %w", err)
+		}
+		return nil
+	}
+	content, err := json.Marshal(profile)
+	if err != nil {
+		return fmt.Errorf("failed to marshal profile: %w", err)
+	}
+	return c.AddToDataStore(profileFile, string(content))
+}
+
+// Everything in the profile. An unreadable profile is logged and treated as empty so that
+// chats still load
+func (c *Core) Profile() map[string]string {
+	c.profileMu.Lock()
+	defer c.profileMu.Unlock()
+	profile, err := c.readProfile()
+	if err != nil {
+		c.logger.Warn("failed to load profile", "error", err)
+		return map[string]string{}
+	}
+	return profile
+}
+
+func (c *Core) RememberProfile(key string, fact string) error {
+	key = strings.TrimSpace(key)
+	fact = strings.TrimSpace(fact)
+	if key == "" || fact == "" {
+		return errors.New("both a key and a fact are required")
+	}
+	return c.updateProfile(func(profile map[string]string) error {
+		profile[key] = fact
+		return nil
+	})
+}
+
+func (c *Core) ForgetProfile(key string) error {
+	return c.updateProfile(func(profile map[string]string) error {
+		if _, had := profile[key]; !had {
+			return fmt.Errorf("nothing in the profile is remembered as %s", key)
+		}
+		delete(profile, key)
+		return nil
+	})
+}
+
+func (c *Core) ClearProfile() error {
+	return c.updateProfile(func(profile map[string]string) error {
+		for key := range profile {
+			delete(profile, key)
+		}
+		return nil
+	})
+}
+
+// Change the profile on disk, then hand the new profile to every active chat that uses it
+// so the change doesn't wait for the chat to be loaded again
+func (c *Core) updateProfile(change func(profile map[string]string) error) error {
+	c.profileMu.Lock()
+	profile, err := c.readProfile()
+	if err == nil {
+		err = change(profile)
+	}
+	if err == nil {
+		err = c.writeProfile(profile)
+	}
+	c.profileMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.chatMu.Lock()
+	chats := make([]*chatInstance, 0, len(c.activeChats))
+	for _, chat := range c.activeChats {
+		chats = append(chats, chat)
+	}
+	c.chatMu.Unlock()
+
+	for _, chat := range chats {
+		if err := chat.refreshProfile(profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFacts(facts map[string]string) map[string]string {
+	copied := make(map[string]string, len(facts))
+	for key, fact := range facts {
+		copied[key] = fact
+	}
+	return copied
+}
+
+func (c *chatInstance) refreshProfile(profile map[string]string) error {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	if !c.useProfile {
+		return nil
+	}
+	previous := c.profile
+	c.profile = copyFacts(profile)
+	if err := c.applyMemory(); err != nil {
+		c.profile = previous
+		return err
+	}
+	return nil
+}
+
+// Turn the profile on or off for the chat. The choice is saved with the chat
+func (c *chatInstance) UseProfile(on bool) error {
+	var profile map[string]string
+	if on && c.core != nil {
+		profile = c.core.Profile()
+	}
+
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	previousUse, previous := c.useProfile, c.profile
+	c.useProfile = on
+	c.profile = profile
+	if err := c.applyMemory(); err != nil {
+		c.useProfile, c.profile = previousUse, previous
+		return err
+	}
+	return nil
+}
+
+func (c *chatInstance) UsesProfile() bool {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	return c.useProfile
+}
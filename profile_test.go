@@ -0,0 +1,69 @@
+package brunch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCore_Profile(t *testing.T) {
+	core := newTestCore(t)
+	assert.Empty(t, core.Profile())
+
+	assert.Error(t, core.RememberProfile("", "fact"))
+	require.NoError(t, core.RememberProfile("name", "Sam"))
+	require.NoError(t, core.RememberProfile("editor", "vim"))
+	assert.Equal(t, map[string]string{"name": "Sam", "editor": "vim"}, core.Profile())
+
+	require.NoError(t, core.ForgetProfile("editor"))
+	assert.Error(t, core.ForgetProfile("editor"))
+	assert.Equal(t, map[string]string{"name": "Sam"}, core.Profile())
+
+	require.NoError(t, core.ClearProfile())
+	assert.Empty(t, core.Profile())
+	require.NoError(t, core.ClearProfile(), "clearing an empty profile is fine")
+}
+
+func TestChat_Profile(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.RememberProfile("name", "Sam"))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "p" :host "mock" :system-prompt "be nice"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "with" :provider "p" :profile true`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "without" :provider "p"`)))
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "with"`)))
+	with, err := core.GetActiveChat("with")
+	require.NoError(t, err)
+	assert.True(t, with.UsesProfile())
+	assert.Equal(t, "be nice\n\n"+profileHeading+"\n- name: Sam", with.provider.Settings().SystemPrompt)
+
+	// The chat's own memory comes after the profile
+	require.NoError(t, with.Remember("lang", "Go"))
+	assert.Equal(t, "be nice\n\n"+profileHeading+"\n- name: Sam\n\n"+chatMemoryHeading+"\n- lang: Go", with.provider.Settings().SystemPrompt)
+
+	require.NoError(t, core.ExecuteStatement("s2", NewStatement(`\chat "without"`)))
+	without, err := core.GetActiveChat("without")
+	require.NoError(t, err)
+	assert.False(t, without.UsesProfile())
+	assert.Equal(t, "be nice", without.provider.Settings().SystemPrompt)
+
+	// Changes reach active chats that use the profile, and only those
+	require.NoError(t, core.RememberProfile("tz", "UTC"))
+	assert.Equal(t, "be nice\n\n"+profileHeading+"\n- name: Sam\n- tz: UTC\n\n"+chatMemoryHeading+"\n- lang: Go", with.provider.Settings().SystemPrompt)
+	assert.Equal(t, "be nice", without.provider.Settings().SystemPrompt)
+
+	require.NoError(t, without.UseProfile(true))
+	assert.Equal(t, "be nice\n\n"+profileHeading+"\n- name: Sam\n- tz: UTC", without.provider.Settings().SystemPrompt)
+	require.NoError(t, with.UseProfile(false))
+	assert.Equal(t, "be nice\n\n"+chatMemoryHeading+"\n- lang: Go", with.provider.Settings().SystemPrompt)
+
+	// The choice is saved with the chat
+	require.NoError(t, core.SaveActiveChat("s2"))
+	snapshot, err := without.Snapshot()
+	require.NoError(t, err)
+	assert.True(t, snapshot.UseProfile)
+
+	require.NoError(t, core.ClearProfile())
+	assert.Equal(t, "be nice", without.provider.Settings().SystemPrompt)
+}
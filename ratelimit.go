@@ -0,0 +1,212 @@
+package brunch
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// A provider with a rate limit has what is sent to it held back so that the chats using it,
+// together, stay under what the API key is allowed. Each named provider has its own buckets,
+// shared by every chat on it and by the providers derived from it. Everything sent counts,
+// the auxiliary work done for a chat (summaries, translations, verification) as well. Requests
+// and tokens refill evenly over the minute and start full, so a burst up to the limit goes
+// through at once
+type RateLimit struct {
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	TokensPerMinute   int `json:"tokens_per_minute,omitempty"` // estimated when sent, settled with the usage
+}
+
+func ValidateRateLimit(limit *RateLimit) error {
+	if limit == nil {
+		return nil
+	}
+	if limit.RequestsPerMinute < 0 {
+		return fmt.Errorf("rpm must be a positive number of requests")
+	}
+	if limit.TokensPerMinute < 0 {
+		return fmt.Errorf("tpm must be a positive number of tokens")
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	capacity  float64
+	available float64
+	perSecond float64
+	updated   time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		capacity:  float64(perMinute),
+		available: float64(perMinute),
+		perSecond: float64(perMinute) / 60,
+		updated:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.available = min(b.capacity, b.available+now.Sub(b.updated).Seconds()*b.perSecond)
+	b.updated = now
+}
+
+// How long until the amount can be taken. More than the bucket holds is waited for as if it
+// were all of it, it would never be there otherwise
+func (b *tokenBucket) delay(amount float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	missing := min(amount, b.capacity) - b.available
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.perSecond * float64(time.Second))
+}
+
+func (b *tokenBucket) take(amount float64) {
+	if b != nil {
+		b.available -= amount
+	}
+}
+
+type rateLimiter struct {
+	limit    RateLimit
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	now := time.Now()
+	return &rateLimiter{
+		limit:    limit,
+		requests: newTokenBucket(limit.RequestsPerMinute, now),
+		tokens:   newTokenBucket(limit.TokensPerMinute, now),
+	}
+}
+
+// The limiter for the named provider, nil when it has no limit. It is made over when the
+// provider's limit changed
+func (c *Core) rateLimiter(name string, limit *RateLimit) *rateLimiter {
+	if limit == nil || (limit.RequestsPerMinute <= 0 && limit.TokensPerMinute <= 0) {
+		return nil
+	}
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	limiter, exists := c.limiters[name]
+	if !exists || limiter.limit != *limit {
+		limiter = newRateLimiter(*limit)
+		c.limiters[name] = limiter
+	}
+	return limiter
+}
+
+// The limiters a request to the named provider is held to, its own and those of the hosts it
+// derives from. Derived providers send with their host's API key, so they all share its buckets
+func (c *Core) rateLimiters(name string) []*rateLimiter {
+	limits := map[string]*RateLimit{}
+	c.provMu.Lock()
+	for seen := map[string]bool{}; name != "" && !seen[name]; {
+		seen[name] = true
+		provider, exists := c.providers[name]
+		if !exists {
+			break
+		}
+		limits[name] = provider.Settings().RateLimit
+		name = provider.Settings().Host
+	}
+	c.provMu.Unlock()
+
+	limiters := []*rateLimiter{}
+	for name, limit := range limits {
+		if limiter := c.rateLimiter(name, limit); limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	return limiters
+}
+
+// Wait until a request of the estimated tokens can be sent to the named provider and take it
+// from its buckets, returning how long that was
+func (c *Core) waitForRateLimit(ctx context.Context, name string, tokens int) (time.Duration, error) {
+	limiters := c.rateLimiters(name)
+	if len(limiters) == 0 {
+		return 0, nil
+	}
+	var waited time.Duration
+	for {
+		c.limitMu.Lock()
+		now := time.Now()
+		var delay time.Duration
+		for _, limiter := range limiters {
+			delay = max(delay, limiter.requests.delay(1, now), limiter.tokens.delay(float64(tokens), now))
+		}
+		if delay == 0 {
+			for _, limiter := range limiters {
+				limiter.requests.take(1)
+				limiter.tokens.take(float64(tokens))
+			}
+			c.limitMu.Unlock()
+			return waited, nil
+		}
+		c.limitMu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return waited, fmt.Errorf("gave up waiting for the rate limit of %s: %w", name, ctx.Err())
+		case <-timer.C:
+			waited += delay
+		}
+	}
+}
+
+// Take what the request really used in place of its estimate. Going over leaves the bucket
+// short, the next request waits for it
+func (c *Core) settleRateLimit(name string, estimated int, used int) {
+	limiters := c.rateLimiters(name)
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	for _, limiter := range limiters {
+		limiter.tokens.take(float64(used - estimated))
+	}
+}
+
+// Hold the request to the named provider to its rate limit, then settle it with what the
+// pair says it used
+func (c *chatInstance) limited(ctx context.Context, name string, parent Node, message string, send func() (*MessagePairNode, error)) (*MessagePairNode, error) {
+	if c.core == nil || name == "" {
+		return send()
+	}
+	estimated := estimateTokens(branchHistory(parent) + "\n" + message)
+	waited, err := c.core.waitForRateLimit(ctx, name, estimated)
+	if err != nil {
+		return nil, err
+	}
+	if waited > 0 {
+		c.logger().Info("held back by the provider's rate limit", "provider", name, "waited", waited)
+	}
+	pair, err := send()
+	if err == nil {
+		estimateUsage(pair, parent, message)
+		c.core.settleRateLimit(name, estimated, pair.Usage.InputTokens+pair.Usage.OutputTokens)
+	}
+	return pair, err
+}
+
+// The name an auxiliary provider of the chat is registered under, empty for one that isn't the
+// chat's own or its companion (a summarizer given its own provider), which isn't limited
+func (c *chatInstance) auxiliaryName(provider Provider) string {
+	if provider == c.provider {
+		return c.provider.Settings().Host
+	}
+	if companion, ok := c.companion(); ok && provider == companion {
+		return c.provider.Settings().Companion
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+package brunch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(60, now)
+	assert.Zero(t, bucket.delay(60, now))
+
+	bucket.take(60)
+	assert.Equal(t, time.Second, bucket.delay(1, now))
+	assert.Zero(t, bucket.delay(1, now.Add(time.Second)))
+
+	// More than it holds is waited for as a full bucket
+	assert.Equal(t, 59*time.Second, bucket.delay(1000, now.Add(time.Second)))
+	assert.Nil(t, newTokenBucket(0, now))
+	assert.Zero(t, (*tokenBucket)(nil).delay(1000, now))
+}
+
+func rateLimitedChat(t *testing.T, limit RateLimit) (*chatInstance, *Core) {
+	core := newTestCore(t)
+	provider := core.providers["mock"].(*mockProvider)
+	provider.settings.RateLimit = &limit
+	chat := newChatInstance(provider)
+	chat.core = core
+	return chat, core
+}
+
+func TestChat_RateLimitRequests(t *testing.T) {
+	chat, core := rateLimitedChat(t, RateLimit{RequestsPerMinute: 1200})
+	_, err := chat.SubmitMessage("first")
+	require.NoError(t, err)
+
+	// One request refills every 50ms
+	limiter := core.limiters["mock"]
+	require.NotNil(t, limiter)
+	limiter.requests.available = 0
+	started := time.Now()
+	_, err = chat.SubmitMessage("second")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(started), 40*time.Millisecond)
+
+	// Other chats on the provider share it
+	other := newChatInstance(chat.provider)
+	other.core = core
+	_, err = other.SubmitMessage("third")
+	require.NoError(t, err)
+	assert.Same(t, limiter, core.limiters["mock"])
+	assert.Len(t, core.limiters, 1)
+}
+
+func TestChat_RateLimitTokens(t *testing.T) {
+	chat, core := rateLimitedChat(t, RateLimit{TokensPerMinute: 100000})
+	_, err := chat.SubmitMessage("count what this takes")
+	require.NoError(t, err)
+
+	// The estimate taken when sent is settled with what the pair used
+	usage := chat.currentNode.(*MessagePairNode).Usage
+	require.NotNil(t, usage)
+	limiter := core.limiters["mock"]
+	assert.InDelta(t, 100000-usage.InputTokens-usage.OutputTokens, limiter.tokens.available, 10)
+	assert.Nil(t, limiter.requests)
+}
+
+func TestChat_RateLimitCancelled(t *testing.T) {
+	chat, core := rateLimitedChat(t, RateLimit{RequestsPerMinute: 1})
+	core.rateLimiter("mock", chat.provider.Settings().RateLimit).requests.available = 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := chat.SubmitMessageContext(ctx, "hello")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, nodeChildren(&chat.root))
+}
+
+func TestCore_ProviderRateLimit(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "limited" :host "mock" :rpm 50 :tpm 40000`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "derived" :host "limited" :rpm 10`)))
+	assert.Equal(t, &RateLimit{RequestsPerMinute: 50, TokensPerMinute: 40000}, core.providers["limited"].Settings().RateLimit)
+	assert.Equal(t, &RateLimit{RequestsPerMinute: 10}, core.providers["derived"].Settings().RateLimit)
+	assert.Nil(t, core.providers["mock"].Settings().RateLimit)
+
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "bad" :host "mock" :rpm "fast"`)))
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "bad" :host "mock" :tpm -5`)))
+
+	// Changing a provider's limit starts its buckets over
+	limiter := core.rateLimiter("limited", &RateLimit{RequestsPerMinute: 50})
+	assert.Same(t, limiter, core.rateLimiter("limited", &RateLimit{RequestsPerMinute: 50}))
+	assert.NotSame(t, limiter, core.rateLimiter("limited", &RateLimit{RequestsPerMinute: 60}))
+	assert.Nil(t, core.rateLimiter("mock", nil))
+}
+
+func TestChat_RateLimitAuxiliary(t *testing.T) {
+	chat, core := rateLimitedChat(t, RateLimit{RequestsPerMinute: 1200})
+	_, err := chat.SubmitMessage("first")
+	require.NoError(t, err)
+
+	// Summaries wait for the bucket like messages do
+	limiter := core.limiters["mock"]
+	limiter.requests.available = 0
+	started := time.Now()
+	_, err = chat.Summarize(SummaryForTitle)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(started), 40*time.Millisecond)
+	assert.Less(t, limiter.requests.available, 1.0)
+
+	// A summarizer given its own provider isn't one of the chat's, it isn't held back
+	chat.SetSummarizer(NewProviderSummarizer(newMockProvider("mock")))
+	limiter.requests.available = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = chat.SubmitMessageContext(ctx, "held back")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = chat.Summarize(SummaryForTitle)
+	assert.NoError(t, err)
+}
+
+func TestCore_DerivedRateLimit(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "limited" :host "mock" :rpm 50`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "derived" :host "limited" :tpm 40000`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "other" :host "limited"`)))
+
+	// Derived providers share the buckets of their host
+	host := core.rateLimiters("limited")
+	require.Len(t, host, 1)
+	derived := core.rateLimiters("derived")
+	require.Len(t, derived, 2)
+	assert.Contains(t, derived, host[0])
+	assert.Equal(t, host, core.rateLimiters("other"))
+	assert.Empty(t, core.rateLimiters("mock"))
+
+	_, err := core.waitForRateLimit(context.Background(), "other", 100)
+	require.NoError(t, err)
+	assert.InDelta(t, 49, host[0].requests.available, 0.1)
+}
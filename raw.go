@@ -0,0 +1,125 @@
+package brunch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Raw logging keeps the exact bodies a provider sent and got back for each message, for when
+// something is lost between the chat and the API (an image, the system prompt). They are kept
+// in the data-store under raw/<chat>/<node>.json, one file per node with every call made for it
+const rawLogDirectory = "raw"
+
+// One HTTP call a provider made
+type RawExchange struct {
+	Time     time.Time         `json:"time"`
+	Endpoint string            `json:"endpoint"`
+	Headers  map[string]string `json:"headers"` // secrets redacted
+	Request  string            `json:"request"`
+	Status   int               `json:"status"`
+	Response string            `json:"response"`
+}
+
+// Providers that make HTTP calls implement RawRecorder so their calls can be logged. While raw
+// logging is on (Core.SetRawLogging) the chat gives the provider a recorder before each message
+// and takes it away (nil) after
+type RawRecorder interface {
+	RecordRaw(record func(RawExchange))
+}
+
+var secretHeaderWords = []string{"authorization", "key", "token", "secret", "cookie"}
+
+// Copy the headers with anything that looks like a credential redacted
+func RedactHeaders(headers http.Header) map[string]string {
+	redacted := make(map[string]string, len(headers))
+	for name, values := range headers {
+		value := strings.Join(values, ", ")
+		lower := strings.ToLower(name)
+		for _, word := range secretHeaderWords {
+			if strings.Contains(lower, word) {
+				value = "[redacted]"
+				break
+			}
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+// Turn raw logging on or off for every chat, it takes effect from the next message
+func (c *Core) SetRawLogging(on bool) {
+	c.rawLogging.Store(on)
+}
+
+func (c *Core) RawLogging() bool {
+	return c.rawLogging.Load()
+}
+
+// The calls logged for a node of a chat, in the order they were made
+func (c *Core) RawExchanges(chat string, node string) ([]RawExchange, error) {
+	content, err := os.ReadFile(c.storePath(dataStoreDirectory, rawLogDirectory, chat, fmt.Sprintf("%s.json", node)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("nothing was logged for %s in %s", node, chat)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var exchanges []RawExchange
+	if err := json.Unmarshal(content, &exchanges); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal raw log: %w", err)
+	}
+	return exchanges, nil
+}
+
+// Give the provider a recorder if raw logging is on. The returned func takes it away again and
+// logs what was recorded under the node that was made, or under <parent>-failed when the message
+// failed as those are the calls most worth looking at. A log that fails to write never fails the message
+func (c *chatInstance) recordRaw() func(node Node, failed bool) {
+	recorder, ok := c.provider.(RawRecorder)
+	if !ok || c.core == nil || c.name == "" || !c.core.RawLogging() {
+		return func(Node, bool) {}
+	}
+	exchanges := []RawExchange{}
+	recorder.RecordRaw(func(exchange RawExchange) {
+		exchanges = append(exchanges, exchange)
+	})
+	return func(node Node, failed bool) {
+		recorder.RecordRaw(nil)
+		if node == nil || len(exchanges) == 0 {
+			return
+		}
+		name := node.Hash()
+		if failed {
+			name += "-failed"
+		}
+		if err := c.core.writeRawLog(c.name, name, exchanges); err != nil {
+			c.logger().Warn("failed to write raw log", "error", err)
+		}
+	}
+}
+
+// The calls logged for the current node
+func (c *chatInstance) RawExchanges() ([]RawExchange, error) {
+	if c.core == nil || c.name == "" {
+		return nil, errors.New("the chat isn't saved, nothing is logged for it")
+	}
+	return c.core.RawExchanges(c.name, c.currentNode.Hash())
+}
+
+func (c *Core) writeRawLog(chat string, node string, exchanges []RawExchange) error {
+	content, err := json.MarshalIndent(exchanges, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := c.storePath(dataStoreDirectory, rawLogDirectory, chat, fmt.Sprintf("%s.json", node))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
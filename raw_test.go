@@ -0,0 +1,81 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Records a call for every message, and fails the ones that say "fail"
+type rawProvider struct {
+	mockProvider
+	record func(RawExchange)
+}
+
+func (rp *rawProvider) RecordRaw(record func(RawExchange)) {
+	rp.record = record
+}
+
+func (rp *rawProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	return func(userMessage string) (*MessagePairNode, error) {
+		if rp.record != nil {
+			rp.record(RawExchange{Endpoint: "http://api", Request: userMessage, Status: http.StatusOK})
+		}
+		if userMessage == "fail" {
+			return nil, errors.New("bad request")
+		}
+		return rp.mockProvider.ExtendFrom(ctx, node)(userMessage)
+	}
+}
+
+func (rp *rawProvider) CloneWithSettings(settings ProviderSettings) (Provider, error) {
+	return &rawProvider{mockProvider: mockProvider{settings: settings}}, nil
+}
+
+func TestRedactHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+	headers.Set("X-Api-Key", "sk-secret")
+	headers.Set("Authorization", "Bearer sk-secret")
+	assert.Equal(t, map[string]string{
+		"Content-Type":  "application/json",
+		"X-Api-Key":     "[redacted]",
+		"Authorization": "[redacted]",
+	}, RedactHeaders(headers))
+}
+
+func TestChat_RawLogging(t *testing.T) {
+	core := newTestCore(t)
+	core.providers["rec"] = &rawProvider{mockProvider: *newMockProvider("rec")}
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "rec"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+
+	// Nothing is logged until it is turned on
+	_, err = chat.SubmitMessage("one")
+	require.NoError(t, err)
+	_, err = chat.RawExchanges()
+	assert.Error(t, err)
+
+	core.SetRawLogging(true)
+	_, err = chat.SubmitMessage("two")
+	require.NoError(t, err)
+	exchanges, err := chat.RawExchanges()
+	require.NoError(t, err)
+	require.Len(t, exchanges, 1)
+	assert.Equal(t, "two", exchanges[0].Request)
+
+	// Failed messages are logged under the node they were sent from
+	parent := chat.currentNode.Hash()
+	_, err = chat.SubmitMessage("fail")
+	require.Error(t, err)
+	exchanges, err = core.RawExchanges("a", parent+"-failed")
+	require.NoError(t, err)
+	assert.Equal(t, "fail", exchanges[0].Request)
+	assert.Nil(t, chat.provider.(*rawProvider).record, "the recorder should be taken away after the message")
+}
@@ -0,0 +1,187 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Why a message pair's content was replaced
+type RevisionReason string
+
+const (
+	RevisionRegenerated RevisionReason = "regenerated" // the same message was asked again
+	RevisionEdited      RevisionReason = "edited"      // the message was changed and asked again
+	RevisionRestored    RevisionReason = "restored"    // an older revision was put back
+)
+
+// Revision is content a message pair had before it was replaced. Alternatives are kept on the
+// node itself so they don't have to be found as sibling branches
+type Revision struct {
+	User      *MessageData   `json:"user"`
+	Assistant *MessageData   `json:"assistant"`
+	Time      time.Time      `json:"time"`
+	Seed      *int64         `json:"seed,omitempty"`
+	Usage     *TokenUsage    `json:"usage,omitempty"`
+	Response  *ResponseMeta  `json:"response,omitempty"`
+	Citations []Citation     `json:"citations,omitempty"`
+	Reason    RevisionReason `json:"reason"` // why this content was replaced
+}
+
+// Move the pair's content into its revisions and replace it. The hash of the pair changes with
+// its content, but nothing else in the tree depends on it
+// A verdict, latency and the fallback that answered were about the old answer so they are dropped,
+// the tokens it took, what the provider said about it and the knowledge it was given go with it
+func (m *MessagePairNode) revise(user *MessageData, assistant *MessageData, at time.Time, seed *int64, reason RevisionReason) {
+	m.Revisions = append(m.Revisions, Revision{
+		User:      m.User,
+		Assistant: m.Assistant,
+		Time:      m.Time,
+		Seed:      m.Seed,
+		Usage:     m.Usage,
+		Response:  m.Response,
+		Citations: m.Citations,
+		Reason:    reason,
+	})
+	m.User = user
+	m.Assistant = assistant
+	m.Time = at
+	m.Seed = seed
+	m.Verdict = nil
+	m.Latency = nil
+	m.AnsweredBy = ""
+	m.Usage = nil
+	m.Response = nil
+	m.Citations = nil
+}
+
+// The part of a root or message pair that holds its children
+func treeNode(n Node) (*node, bool) {
+	switch n := n.(type) {
+	case *RootNode:
+		return &n.node, true
+	case *MessagePairNode:
+		return &n.node, true
+	}
+	return nil, false
+}
+
+func (c *chatInstance) currentPair() (*MessagePairNode, error) {
+	mp, ok := c.currentNode.(*MessagePairNode)
+	if !ok || mp.Parent == nil || mp.Annotation != nil {
+		return nil, errors.New("the current node is not a message, move to one first")
+	}
+	return mp, nil
+}
+
+// Ask the provider for a new reply to the message as if it was sent from the pair's parent.
+// Providers add what they create to the parent, so that is taken back out as it only
+// becomes the new content of the existing pair
+func (c *chatInstance) reask(mp *MessagePairNode, message string) (*MessagePairNode, error) {
+	parent, ok := treeNode(mp.Parent)
+	if !ok {
+		return nil, errors.New("message has an unknown parent")
+	}
+
+	if len(mp.ToolCalls) > 0 {
+		// The calls and everything after them hang off the pair, a new reply couldn't keep them
+		return nil, errors.New("the message called tools, branch from its parent to ask it again")
+	}
+	if mp.Chunked != nil || mp.ChunkStep != nil {
+		return nil, errors.New("the message was sent in parts, send it again to ask it again")
+	}
+
+	children := len(parent.Children)
+	fresh, err := c.ask(mp.Parent, message, nil)
+	parent.Children = parent.Children[:children]
+	if err != nil {
+		return nil, err
+	}
+	if fresh == nil || fresh.Assistant == nil {
+		return nil, errors.New("provider did not reply")
+	}
+	if err := c.postProcess(fresh); err != nil {
+		return nil, err
+	}
+	c.usage.addMain(fresh)
+	return fresh, nil
+}
+
+func (c *chatInstance) Regenerate() (string, error) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	mp, err := c.currentPair()
+	if err != nil {
+		return "", err
+	}
+	before, started := c.usage.get(), time.Now()
+	fresh, err := c.reask(mp, mp.User.UnencodedContent())
+	if err != nil {
+		return "", err
+	}
+	mp.revise(fresh.User, fresh.Assistant, fresh.Time, fresh.Seed, RevisionRegenerated)
+	mp.Latency, mp.AnsweredBy, mp.Usage, mp.Response = fresh.Latency, fresh.AnsweredBy, fresh.Usage, fresh.Response
+	mp.Citations = fresh.Citations
+	c.recordActivity(ActivityRegenerate, mp, before, started)
+	if c.verification != nil {
+		c.verifyReply(mp)
+	}
+	return mp.Assistant.UnencodedContent(), nil
+}
+
+func (c *chatInstance) Edit(message string) (string, error) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	mp, err := c.currentPair()
+	if err != nil {
+		return "", err
+	}
+	if err := c.checkSecrets(message, "message"); err != nil {
+		return "", err
+	}
+	before, started := c.usage.get(), time.Now()
+	fresh, err := c.reask(mp, message)
+	if err != nil {
+		return "", err
+	}
+	mp.revise(fresh.User, fresh.Assistant, fresh.Time, fresh.Seed, RevisionEdited)
+	mp.Latency, mp.AnsweredBy, mp.Usage, mp.Response = fresh.Latency, fresh.AnsweredBy, fresh.Usage, fresh.Response
+	mp.Citations = fresh.Citations
+	c.recordActivity(ActivityEdit, mp, before, started)
+	if c.verification != nil {
+		c.verifyReply(mp)
+	}
+	return mp.Assistant.UnencodedContent(), nil
+}
+
+func (c *chatInstance) Revisions() []Revision {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	mp, err := c.currentPair()
+	if err != nil {
+		return []Revision{}
+	}
+	revisions := make([]Revision, len(mp.Revisions))
+	copy(revisions, mp.Revisions)
+	return revisions
+}
+
+func (c *chatInstance) RestoreRevision(idx int) error {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	mp, err := c.currentPair()
+	if err != nil {
+		return err
+	}
+	if idx < 0 || idx >= len(mp.Revisions) {
+		return fmt.Errorf("revision %d does not exist, the node has %d", idx, len(mp.Revisions))
+	}
+
+	// The restored revision leaves the list and what it replaces goes on the end,
+	// so restoring never loses anything
+	restored := mp.Revisions[idx]
+	mp.Revisions = append(mp.Revisions[:idx], mp.Revisions[idx+1:]...)
+	mp.revise(restored.User, restored.Assistant, restored.Time, restored.Seed, RevisionRestored)
+	mp.Usage, mp.Response, mp.Citations = restored.Usage, restored.Response, restored.Citations
+	return nil
+}
@@ -0,0 +1,105 @@
+package brunch
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChat_Revisions(t *testing.T) {
+	chat := newChatInstance(newMockProvider("mock"))
+
+	_, err := chat.Regenerate()
+	assert.Error(t, err, "the root can't be regenerated")
+
+	_, err = chat.SubmitMessage("hello")
+	require.NoError(t, err)
+	_, err = chat.SubmitMessage("again")
+	require.NoError(t, err)
+	require.NoError(t, chat.Parent())
+	pair := chat.currentNode.(*MessagePairNode)
+	child := pair.Children[0]
+
+	reply, err := chat.Regenerate()
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello", reply)
+
+	reply, err = chat.Edit("goodbye")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: goodbye", reply)
+
+	// Still the same node with the same child, the old content is kept on it
+	assert.Same(t, pair, chat.currentNode)
+	assert.Len(t, chat.root.Children, 1)
+	assert.Equal(t, []Node{child}, pair.Children)
+	revisions := chat.Revisions()
+	require.Len(t, revisions, 2)
+	assert.Equal(t, RevisionRegenerated, revisions[0].Reason)
+	assert.Equal(t, "hello", revisions[1].User.UnencodedContent())
+	assert.Equal(t, RevisionEdited, revisions[1].Reason)
+
+	require.NoError(t, chat.RestoreRevision(0))
+	assert.Equal(t, "hello", pair.User.UnencodedContent())
+	revisions = chat.Revisions()
+	require.Len(t, revisions, 2)
+	assert.Equal(t, "goodbye", revisions[1].User.UnencodedContent())
+	assert.Equal(t, RevisionRestored, revisions[1].Reason)
+	assert.Error(t, chat.RestoreRevision(2))
+
+	// Revisions are saved with the tree
+	data, err := marshalNode(&chat.root)
+	require.NoError(t, err)
+	loaded, err := unmarshalNode(data)
+	require.NoError(t, err)
+	saved := MapTree(loaded)[pair.Hash()].(*MessagePairNode)
+	require.Len(t, saved.Revisions, 2)
+	assert.Equal(t, "goodbye", saved.Revisions[1].User.UnencodedContent())
+	assert.Contains(t, PrintTree(loaded), "Revisions: 2")
+}
+
+// Answers the way an API does, with an id for every response
+type tracedProvider struct {
+	*mockProvider
+	responses int
+}
+
+func (tp *tracedProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	creator := tp.mockProvider.ExtendFrom(ctx, node)
+	return func(userMessage string) (*MessagePairNode, error) {
+		pair, err := creator(userMessage)
+		if err == nil {
+			tp.responses++
+			pair.Response = &ResponseMeta{ID: fmt.Sprintf("msg_%d", tp.responses), Model: "mock-model-20250101", StopReason: "end_turn"}
+		}
+		return pair, err
+	}
+}
+
+func TestChat_ResponseMeta(t *testing.T) {
+	chat := newChatInstance(&tracedProvider{mockProvider: newMockProvider("mock")})
+	_, err := chat.SubmitMessage("hello")
+	require.NoError(t, err)
+	pair := chat.currentNode.(*MessagePairNode)
+	assert.Equal(t, &ResponseMeta{ID: "msg_1", Model: "mock-model-20250101", StopReason: "end_turn"}, pair.Response)
+
+	// The old answer's response goes with it into the revisions, and comes back with it
+	_, err = chat.Regenerate()
+	require.NoError(t, err)
+	assert.Equal(t, "msg_2", pair.Response.ID)
+	assert.Equal(t, "msg_1", pair.Revisions[0].Response.ID)
+	require.NoError(t, chat.RestoreRevision(0))
+	assert.Equal(t, "msg_1", pair.Response.ID)
+
+	// It is saved with the tree
+	data, err := marshalNode(&chat.root)
+	require.NoError(t, err)
+	loaded, err := unmarshalNode(data)
+	require.NoError(t, err)
+	saved := MapTree(loaded)[pair.Hash()].(*MessagePairNode)
+	assert.Equal(t, pair.Response, saved.Response)
+	assert.Equal(t, "msg_2", saved.Revisions[0].Response.ID)
+	assert.Contains(t, PrintTree(loaded), "Response: msg_1 (model mock-model-20250101, stopped: end_turn)")
+}
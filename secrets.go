@@ -0,0 +1,125 @@
+package brunch
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Before anything is sent to a provider, the user's message and the context chunks retrieved
+// for it are scanned for secrets (API keys, private keys, cloud credentials). What happens when
+// one is found is up to the core (CoreOpts.Secrets): it is logged as a warning, or the message
+// isn't sent at all and the chunk is left out
+type SecretPolicy int
+
+const (
+	// Log a warning and send it anyway
+	SecretsWarn SecretPolicy = iota
+
+	// Fail the message with a SecretsError, and leave chunks with secrets out of the knowledge
+	SecretsBlock
+
+	// Don't scan
+	SecretsOff
+)
+
+// A kind of secret and how to find it
+type SecretPattern struct {
+	Kind    string
+	Pattern *regexp.Regexp
+}
+
+// The secrets looked for unless the core is given more (CoreOpts.SecretPatterns)
+var DefaultSecretPatterns = []SecretPattern{
+	{Kind: "private key", Pattern: regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)},
+	{Kind: "aws access key", Pattern: regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{Kind: "aws secret key", Pattern: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}`)},
+	{Kind: "anthropic api key", Pattern: regexp.MustCompile(`\bsk-ant-[A-Za-z0-9_-]{20,}`)},
+	{Kind: "openai api key", Pattern: regexp.MustCompile(`\bsk-(proj-)?[A-Za-z0-9]{32,}`)},
+	{Kind: "github token", Pattern: regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{60,})`)},
+	{Kind: "slack token", Pattern: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{Kind: "google api key", Pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`)},
+	{Kind: "credential", Pattern: regexp.MustCompile(`(?i)\b(api[_-]?key|secret[_-]?key|access[_-]?token|auth[_-]?token|password)["']?\s*[:=]\s*["']?[A-Za-z0-9_\-+/=.]{16,}`)},
+}
+
+// A secret that was found, and where. The secret itself is never kept, only its first few
+// characters so it can be recognized
+type SecretFinding struct {
+	Kind   string
+	Where  string // "message", or the source of the context chunk
+	Prefix string
+}
+
+func (f SecretFinding) String() string {
+	return fmt.Sprintf("%s in %s (%s...)", f.Kind, f.Where, f.Prefix)
+}
+
+// Returned when a message isn't sent because it contains secrets
+type SecretsError struct {
+	Findings []SecretFinding
+}
+
+func (e *SecretsError) Error() string {
+	found := make([]string, len(e.Findings))
+	for i, finding := range e.Findings {
+		found[i] = finding.String()
+	}
+	return "message was not sent, it contains secrets: " + strings.Join(found, ", ")
+}
+
+// The secrets in the text, found with the given patterns. A secret matched by more than one
+// pattern is only found by the first, so the specific patterns go before the general ones
+func ScanSecrets(text string, where string, patterns []SecretPattern) []SecretFinding {
+	findings := []SecretFinding{}
+	found := [][]int{}
+	for _, pattern := range patterns {
+	matches:
+		for _, match := range pattern.Pattern.FindAllStringIndex(text, -1) {
+			for _, span := range found {
+				if match[0] < span[1] && span[0] < match[1] {
+					continue matches
+				}
+			}
+			found = append(found, match)
+			findings = append(findings, SecretFinding{
+				Kind:   pattern.Kind,
+				Where:  where,
+				Prefix: excerpt(text[match[0]:match[1]], 6, false),
+			})
+		}
+	}
+	return findings
+}
+
+func (c *chatInstance) secretPolicy() SecretPolicy {
+	if c.core != nil {
+		return c.core.secrets
+	}
+	return SecretsWarn
+}
+
+func (c *chatInstance) secretPatterns() []SecretPattern {
+	if c.core != nil && len(c.core.secretPatterns) > 0 {
+		return append(append([]SecretPattern{}, DefaultSecretPatterns...), c.core.secretPatterns...)
+	}
+	return DefaultSecretPatterns
+}
+
+// Scan what is about to be sent. It is an error only when the core blocks secrets
+func (c *chatInstance) checkSecrets(text string, where string) error {
+	policy := c.secretPolicy()
+	if policy == SecretsOff {
+		return nil
+	}
+	findings := ScanSecrets(text, where, c.secretPatterns())
+	if len(findings) == 0 {
+		return nil
+	}
+	if policy == SecretsBlock {
+		return &SecretsError{Findings: findings}
+	}
+	for _, finding := range findings {
+		c.logger().Warn("sending a secret to the provider", "kind", finding.Kind, "where", finding.Where, "prefix", finding.Prefix)
+	}
+	return nil
+}
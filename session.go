@@ -6,17 +6,42 @@ import (
 	"strconv"
 )
 
+// ProviderStatement is what a new-provider statement asks for. What it doesn't give is left at
+// its zero value, the core takes it from the host
+type ProviderStatement struct {
+	Name         string
+	Host         string
+	BaseUrl      string
+	MaxTokens    int
+	Temperature  float64
+	SystemPrompt string
+	Companion    string
+	Seed         *int64
+	PostProcess  []string
+	Fallbacks    []string
+	Window       *ContextWindow
+	RateLimit    *RateLimit
+}
+
 // An operational callback is used when a session with a user (pre-chat interface) is in process.
 // When they submit a commmand via the core, it will use these callbacks to receive instructions
 // based on the command when `execucte` is called (below)
 type OperationalCallback struct {
 	OnLoadChat       func(name string, hash *string) error
-	OnNewChat        func(name string, provider string) error
-	OnNewProvider    func(name string, host string, baseUrl string, maxTokens int, temperature float64, systemPrompt string) error
+	OnNewChat        func(name string, provider string, useProfile bool, overwrite bool) error
+	OnNewProvider    func(provider ProviderStatement) error
 	OnNewContext     func(name string, dir *string, database *string, web *string) error
 	OnDeleteChat     func(name string) error
 	OnDeleteContext  func(name string) error
 	OnDeleteProvider func(name string) error
+	OnReplay         func(idx int) error
+	OnRenameContext  func(name string, newName string) error
+	OnRenameProvider func(name string, newName string) error
+	OnFork           func(name string) error
+	OnImportMarkdown func(name string, provider string, file string) error
+	OnRestore        func(name string, kind string, id string) error
+	OnWorkspace      func(name string) error
+	OnExport         func(name string, file string, format string, branch string) error
 
 	// These operational callbacks may be user to get information and forward to the InformationCallback,
 	// BUT not NECESARILY. The InformationCallback is offered as a means to pipe informational data to a user
@@ -26,6 +51,12 @@ type OperationalCallback struct {
 	OnListContexts    func() error
 	OnDescribeContext func(name string) error
 	OnDescribeChat    func(name string) error
+	OnHistory         func() error
+	OnWhereUsed       func(name string) error
+	OnCheckContext    func(name string) error
+	OnFsck            func(quarantine bool) error
+	OnUsage           func() error
+	OnTrash           func() error
 }
 
 // Informational callbacks are given to the core so that the user of the core can
@@ -38,11 +69,25 @@ type InformationCallback struct {
 	OnListContexts    func(contexts []string)
 	OnDescribeContext func(data string)
 	OnDescribeChat    func(data string)
+	OnHistory         func(statements []string)
+	OnWhereUsed       func(name string, usage []ResourceUsage)
+	OnCheckContext    func(health ContextHealth)
+	OnFsck            func(report VerifyReport)
+	OnUsage           func(report UsageReport)
+	OnTrash           func(items []TrashedItem)
 }
 
 type coreSession struct {
 	id           string
 	activeChatId string
+	activeBranch string
+
+	// Statements that were successfully executed in this session, in order.
+	// This is persisted to the data-store so sessions can be audited and replayed
+	history []string
+
+	// The workspace the session is scoped to, if any (see workspace.go)
+	workspace string
 }
 
 // Send a statement to the session (called by the core)
@@ -89,6 +134,34 @@ func (s *coreSession) execute(stmt *Statement, callbacks OperationalCallback) er
 		return s.describeChat(stmt.cmd.nameGiven, callbacks)
 	case "list-provider":
 		return s.listProviders(callbacks)
+	case "history":
+		return s.listHistory(callbacks)
+	case "replay":
+		return s.replay(stmt.cmd.nameGiven, callbacks)
+	case "where-used":
+		return s.whereUsed(stmt.cmd.nameGiven, callbacks)
+	case "workspace":
+		return callbacks.OnWorkspace(stmt.cmd.nameGiven)
+	case "check-ctx":
+		return s.checkContext(stmt.cmd.nameGiven, callbacks)
+	case "fsck":
+		return s.fsck(propertyMap, callbacks)
+	case "usage":
+		return callbacks.OnUsage()
+	case "trash":
+		return callbacks.OnTrash()
+	case "fork":
+		return s.fork(stmt.cmd.nameGiven, callbacks)
+	case "import-md":
+		return s.importMarkdown(stmt.cmd.nameGiven, propertyMap, callbacks)
+	case "export":
+		return s.export(stmt.cmd.nameGiven, propertyMap, callbacks)
+	case "restore":
+		return s.restore(stmt.cmd.nameGiven, propertyMap, callbacks)
+	case "rename-ctx":
+		return s.rename(stmt.cmd.nameGiven, propertyMap, callbacks.OnRenameContext)
+	case "rename-provider":
+		return s.rename(stmt.cmd.nameGiven, propertyMap, callbacks.OnRenameProvider)
 	}
 
 	return errors.New("not implemented")
@@ -113,6 +186,18 @@ func (s *coreSession) isPropertyValid(p *property) bool {
 	case PropertyTypeReal:
 		_, err := strconv.ParseFloat(p.prop, 64)
 		return err == nil
+	case PropertyTypeBoolean:
+		return p.prop == "true" || p.prop == "false"
+	case PropertyTypeList:
+		if len(p.values) == 0 {
+			return false
+		}
+		for _, v := range p.values {
+			if v == "" {
+				return false
+			}
+		}
+		return true
 	}
 	return false
 }
@@ -120,11 +205,8 @@ func (s *coreSession) isPropertyValid(p *property) bool {
 func (s *coreSession) newProvider(name string, propertyMap map[string]*property, callbacks OperationalCallback) error {
 
 	var err error
-	var host string
-	var baseUrl string
-	var maxTokens int
-	var temperature float64
-	var systemPrompt string
+	var windowStrategy string
+	provider := ProviderStatement{Name: name}
 
 	for key, prop := range propertyMap {
 		switch key {
@@ -132,17 +214,17 @@ func (s *coreSession) newProvider(name string, propertyMap map[string]*property,
 			if prop.typ != PropertyTypeString {
 				return fmt.Errorf("host must be a string")
 			}
-			host = prop.prop
+			provider.Host = prop.prop
 		case "base-url":
 			if prop.typ != PropertyTypeString {
 				return fmt.Errorf("base-url must be a string")
 			}
-			baseUrl = prop.prop
+			provider.BaseUrl = prop.prop
 		case "max-tokens":
 			if prop.typ != PropertyTypeInteger {
 				return fmt.Errorf("max-tokens must be an integer")
 			}
-			maxTokens, err = strconv.Atoi(prop.prop)
+			provider.MaxTokens, err = strconv.Atoi(prop.prop)
 			if err != nil {
 				return fmt.Errorf("max-tokens must be an integer")
 			}
@@ -150,7 +232,7 @@ func (s *coreSession) newProvider(name string, propertyMap map[string]*property,
 			if prop.typ != PropertyTypeReal {
 				return fmt.Errorf("temperature must be a real number")
 			}
-			temperature, err = strconv.ParseFloat(prop.prop, 64)
+			provider.Temperature, err = strconv.ParseFloat(prop.prop, 64)
 			if err != nil {
 				return fmt.Errorf("temperature must be a real number")
 			}
@@ -158,7 +240,61 @@ func (s *coreSession) newProvider(name string, propertyMap map[string]*property,
 			if prop.typ != PropertyTypeString {
 				return fmt.Errorf("system-prompt must be a string")
 			}
-			systemPrompt = prop.prop
+			provider.SystemPrompt = prop.prop
+		case "companion":
+			if prop.typ != PropertyTypeString {
+				return fmt.Errorf("companion must be a string")
+			}
+			provider.Companion = prop.prop
+		case "seed":
+			if prop.typ != PropertyTypeInteger {
+				return fmt.Errorf("seed must be an integer")
+			}
+			value, err := strconv.ParseInt(prop.prop, 10, 64)
+			if err != nil {
+				return fmt.Errorf("seed must be an integer")
+			}
+			provider.Seed = &value
+		case "post-process":
+			if prop.typ != PropertyTypeList {
+				return fmt.Errorf("post-process must be a list of strings")
+			}
+			provider.PostProcess = prop.values
+		case "fallbacks":
+			if prop.typ != PropertyTypeList {
+				return fmt.Errorf("fallbacks must be a list of provider names")
+			}
+			provider.Fallbacks = prop.values
+		case "context-window":
+			if prop.typ != PropertyTypeInteger {
+				return fmt.Errorf("context-window must be an integer")
+			}
+			tokens, err := strconv.Atoi(prop.prop)
+			if err != nil {
+				return fmt.Errorf("context-window must be an integer")
+			}
+			provider.Window = &ContextWindow{Tokens: tokens}
+		case "window-strategy":
+			if prop.typ != PropertyTypeString {
+				return fmt.Errorf("window-strategy must be a string")
+			}
+			windowStrategy = prop.prop
+		case "rpm", "tpm":
+			if prop.typ != PropertyTypeInteger {
+				return fmt.Errorf("%s must be an integer", key)
+			}
+			perMinute, err := strconv.Atoi(prop.prop)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer", key)
+			}
+			if provider.RateLimit == nil {
+				provider.RateLimit = &RateLimit{}
+			}
+			if key == "rpm" {
+				provider.RateLimit.RequestsPerMinute = perMinute
+			} else {
+				provider.RateLimit.TokensPerMinute = perMinute
+			}
 		default:
 			return fmt.Errorf("invalid, unknown property: %s", key)
 		}
@@ -167,22 +303,42 @@ func (s *coreSession) newProvider(name string, propertyMap map[string]*property,
 	if name == "" {
 		return fmt.Errorf("name must be specified")
 	}
+	if windowStrategy != "" {
+		if provider.Window == nil {
+			return fmt.Errorf("window-strategy needs a context-window")
+		}
+		provider.Window.Strategy = windowStrategy
+	}
 
 	// We have to call into the core to create the provider it is the one that hosts
 	// the controlled map of providers that can be selected from as we have a hard
 	// seperation between provider implementations and the core
 	// the core will validate the properties data
-	return callbacks.OnNewProvider(name, host, baseUrl, maxTokens, temperature, systemPrompt)
+	return callbacks.OnNewProvider(provider)
 }
 
 func (s *coreSession) newChat(name string, propertyMap map[string]*property, callbacks OperationalCallback) error {
 
 	var provider string
+	var useProfile bool
+	var overwrite bool
 
 	for key, prop := range propertyMap {
 		switch key {
 		case "provider":
 			provider = prop.prop
+		case "profile":
+			if prop.typ != PropertyTypeBoolean {
+				return fmt.Errorf("profile must be a boolean")
+			}
+			useProfile = prop.prop == "true"
+		case "overwrite":
+			if prop.typ != PropertyTypeBoolean {
+				return fmt.Errorf("overwrite must be a boolean")
+			}
+			overwrite = prop.prop == "true"
+		case "confirm":
+			// Checked by the core before the statement gets here, see confirm.go
 		default:
 			return fmt.Errorf("invalid, unknown property: %s", key)
 		}
@@ -196,7 +352,7 @@ func (s *coreSession) newChat(name string, propertyMap map[string]*property, cal
 		return fmt.Errorf("name must be specified")
 	}
 
-	return callbacks.OnNewChat(name, provider)
+	return callbacks.OnNewChat(name, provider, useProfile, overwrite)
 }
 
 func (s *coreSession) chat(name string, propertyMap map[string]*property, callbacks OperationalCallback) error {
@@ -252,6 +408,101 @@ func (s *coreSession) deleteChat(name string, callbacks OperationalCallback) err
 	return callbacks.OnDeleteChat(name)
 }
 
+// Fork the session's current branch into a new chat with the given name
+func (s *coreSession) fork(name string, callbacks OperationalCallback) error {
+	if name == "" {
+		return fmt.Errorf("name must be specified")
+	}
+	return callbacks.OnFork(name)
+}
+
+// Create a chat from a markdown transcript on disk
+func (s *coreSession) importMarkdown(name string, propertyMap map[string]*property, callbacks OperationalCallback) error {
+
+	var provider string
+	var file string
+
+	for key, prop := range propertyMap {
+		switch key {
+		case "provider":
+			provider = prop.prop
+		case "file":
+			file = prop.prop
+		default:
+			return fmt.Errorf("invalid, unknown property: %s", key)
+		}
+	}
+
+	if name == "" {
+		return fmt.Errorf("name must be specified")
+	}
+
+	if provider == "" || file == "" {
+		return fmt.Errorf("provider and file must be specified")
+	}
+
+	return callbacks.OnImportMarkdown(name, provider, file)
+}
+
+// Render a chat to a file (see export.go), the format is picked by the file's extension if it isn't given
+func (s *coreSession) export(name string, propertyMap map[string]*property, callbacks OperationalCallback) error {
+
+	var file string
+	var format string
+	var branch string
+
+	for key, prop := range propertyMap {
+		switch key {
+		case "file":
+			file = prop.prop
+		case "format":
+			format = prop.prop
+		case "branch":
+			branch = prop.prop
+		default:
+			return fmt.Errorf("invalid, unknown property: %s", key)
+		}
+	}
+
+	if name == "" {
+		return fmt.Errorf("name must be specified")
+	}
+
+	if file == "" {
+		return fmt.Errorf("file must be specified")
+	}
+
+	return callbacks.OnExport(name, file, format, branch)
+}
+
+// Put a deleted chat, provider or context back from the trash
+func (s *coreSession) restore(name string, propertyMap map[string]*property, callbacks OperationalCallback) error {
+
+	var kind string
+	var id string
+
+	for key, prop := range propertyMap {
+		switch key {
+		case "kind":
+			kind = prop.prop
+		case "id":
+			id = prop.prop
+		default:
+			return fmt.Errorf("invalid, unknown property: %s", key)
+		}
+	}
+
+	if name == "" {
+		return fmt.Errorf("name must be specified")
+	}
+
+	if kind == "" {
+		return fmt.Errorf("kind must be specified")
+	}
+
+	return callbacks.OnRestore(name, kind, id)
+}
+
 func (s *coreSession) deleteContext(name string, callbacks OperationalCallback) error {
 	if name == "" {
 		return fmt.Errorf("name must be specified")
@@ -291,3 +542,76 @@ func (s *coreSession) deleteProvider(name string, callbacks OperationalCallback)
 	}
 	return callbacks.OnDeleteProvider(name)
 }
+
+func (s *coreSession) whereUsed(name string, callbacks OperationalCallback) error {
+	if name == "" {
+		return fmt.Errorf("name must be specified")
+	}
+	return callbacks.OnWhereUsed(name)
+}
+
+func (s *coreSession) checkContext(name string, callbacks OperationalCallback) error {
+	if name == "" {
+		return fmt.Errorf("name must be specified")
+	}
+	return callbacks.OnCheckContext(name)
+}
+
+func (s *coreSession) fsck(propertyMap map[string]*property, callbacks OperationalCallback) error {
+	var quarantine bool
+	for key, prop := range propertyMap {
+		switch key {
+		case "quarantine":
+			if prop.typ != PropertyTypeBoolean {
+				return fmt.Errorf("quarantine must be a boolean")
+			}
+			quarantine = prop.prop == "true"
+		default:
+			return fmt.Errorf("invalid, unknown property: %s", key)
+		}
+	}
+	return callbacks.OnFsck(quarantine)
+}
+
+func (s *coreSession) listHistory(callbacks OperationalCallback) error {
+	return callbacks.OnHistory()
+}
+
+func (s *coreSession) replay(idx string, callbacks OperationalCallback) error {
+	n, err := strconv.Atoi(idx)
+	if err != nil {
+		return fmt.Errorf("replay index must be an integer")
+	}
+	if n < 0 {
+		return fmt.Errorf("replay index must not be negative")
+	}
+	return callbacks.OnReplay(n)
+}
+
+func (s *coreSession) rename(name string, propertyMap map[string]*property, onRename func(name string, newName string) error) error {
+
+	var newName string
+
+	for key, prop := range propertyMap {
+		switch key {
+		case "to":
+			newName = prop.prop
+		default:
+			return fmt.Errorf("invalid, unknown property: %s", key)
+		}
+	}
+
+	if name == "" {
+		return fmt.Errorf("name must be specified")
+	}
+
+	if newName == "" {
+		return fmt.Errorf("new name must be specified")
+	}
+
+	if name == newName {
+		return fmt.Errorf("new name must differ from the current name")
+	}
+
+	return onRename(name, newName)
+}
@@ -59,8 +59,8 @@ func TestSession_Execute(t *testing.T) {
 				if !*called {
 					t.Error("OnNewChat callback was not called")
 				}
-				if len(args) != 2 {
-					t.Errorf("expected 2 args, got %d", len(args))
+				if len(args) != 3 {
+					t.Errorf("expected 3 args, got %d", len(args))
 				}
 				name := args[0].(string)
 				name = strings.Trim(name, `"`)
@@ -72,6 +72,21 @@ func TestSession_Execute(t *testing.T) {
 				if provider != "test-provider" {
 					t.Errorf("expected provider 'test-provider', got %s", provider)
 				}
+				if args[2].(bool) {
+					t.Error("expected the profile to be off unless asked for")
+				}
+			},
+		},
+		{
+			name:    "new chat command with the profile",
+			content: `\new-chat "test-chat" :provider "test-provider" :profile true`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnNewChat callback was not called")
+				}
+				if !args[2].(bool) {
+					t.Error("expected the profile to be used")
+				}
 			},
 		},
 		{
@@ -336,6 +351,182 @@ func TestSession_Execute(t *testing.T) {
 			content: `\del-provider`,
 			wantErr: true,
 		},
+		{
+			name:    "history command",
+			content: `\history`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnHistory callback was not called")
+				}
+				if len(args) != 0 {
+					t.Errorf("expected 0 args, got %d", len(args))
+				}
+			},
+		},
+		{
+			name:    "replay command",
+			content: `\replay 3`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnReplay callback was not called")
+				}
+				if len(args) != 1 {
+					t.Errorf("expected 1 arg, got %d", len(args))
+				}
+				idx := args[0].(int)
+				if idx != 3 {
+					t.Errorf("expected idx 3, got %d", idx)
+				}
+			},
+		},
+		{
+			name:    "replay negative index",
+			content: `\replay -1`,
+			wantErr: true,
+		},
+		{
+			name:    "replay missing index",
+			content: `\replay`,
+			wantErr: true,
+		},
+		{
+			name:    "rename context command",
+			content: `\rename-ctx "docs" :to "manuals"`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnRenameContext callback was not called")
+				}
+				if args[0].(string) != "docs" || args[1].(string) != "manuals" {
+					t.Errorf("expected docs -> manuals, got %v", args)
+				}
+			},
+		},
+		{
+			name:    "rename provider command",
+			content: `\rename-provider "fast" :to "faster"`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnRenameProvider callback was not called")
+				}
+				if args[0].(string) != "fast" || args[1].(string) != "faster" {
+					t.Errorf("expected fast -> faster, got %v", args)
+				}
+			},
+		},
+		{
+			name:    "where used command",
+			content: `\where-used "docs"`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnWhereUsed callback was not called")
+				}
+				if args[0].(string) != "docs" {
+					t.Errorf("expected name 'docs', got %v", args[0])
+				}
+			},
+		},
+		{
+			name:    "workspace command",
+			content: `\workspace "billing"`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnWorkspace callback was not called")
+				}
+				if args[0].(string) != "billing" {
+					t.Errorf("expected name 'billing', got %v", args[0])
+				}
+			},
+		},
+		{
+			name:    "check context command",
+			content: `\check-ctx "docs"`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnCheckContext callback was not called")
+				}
+				if args[0].(string) != "docs" {
+					t.Errorf("expected name 'docs', got %v", args[0])
+				}
+			},
+		},
+		{
+			name:    "fork command",
+			content: `\fork "spin-off"`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnFork callback was not called")
+				}
+				if args[0].(string) != "spin-off" {
+					t.Errorf("expected name 'spin-off', got %v", args[0])
+				}
+			},
+		},
+		{
+			name:    "fork missing name",
+			content: `\fork`,
+			wantErr: true,
+		},
+		{
+			name:    "import markdown command",
+			content: `\import-md "notes" :provider "test-provider" :file "notes.md"`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnImportMarkdown callback was not called")
+				}
+				if args[0].(string) != "notes" || args[1].(string) != "test-provider" || args[2].(string) != "notes.md" {
+					t.Errorf("unexpected args %v", args)
+				}
+			},
+		},
+		{
+			name:    "import markdown missing file",
+			content: `\import-md "notes" :provider "test-provider"`,
+			wantErr: true,
+		},
+		{
+			name:    "restore command",
+			content: `\restore "old" :kind "chat"`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnRestore callback was not called")
+				}
+				if args[0].(string) != "old" || args[1].(string) != "chat" || args[2].(string) != "" {
+					t.Errorf("unexpected args %v", args)
+				}
+			},
+		},
+		{
+			name:    "restore by id",
+			content: `\restore "old" :kind "chat" :id "1700000000000000000"`,
+			validate: func(t *testing.T, called *bool, args []interface{}) {
+				if !*called {
+					t.Error("OnRestore callback was not called")
+				}
+				if args[2].(string) != "1700000000000000000" {
+					t.Errorf("unexpected args %v", args)
+				}
+			},
+		},
+		{
+			name:    "restore missing kind",
+			content: `\restore "old"`,
+			wantErr: true,
+		},
+		{
+			name:    "where used missing name",
+			content: `\where-used`,
+			wantErr: true,
+		},
+		{
+			name:    "rename without new name",
+			content: `\rename-ctx "docs"`,
+			wantErr: true,
+		},
+		{
+			name:    "rename to the same name",
+			content: `\rename-provider "fast" :to "fast"`,
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -364,18 +555,28 @@ func TestSession_Execute(t *testing.T) {
 				describeChatCalled    bool
 				listProvidersCalled   bool
 				deleteProviderCalled  bool
+				historyCalled         bool
+				replayCalled          bool
+				renameContextCalled   bool
+				renameProviderCalled  bool
+				whereUsedCalled       bool
+				checkContextCalled    bool
+				workspaceCalled       bool
+				forkCalled            bool
+				importMarkdownCalled  bool
+				restoreCalled         bool
 				callbackArgs          []interface{}
 			)
 
 			callbacks := OperationalCallback{
-				OnNewProvider: func(name, host, baseUrl string, maxTokens int, temperature float64, systemPrompt string) error {
+				OnNewProvider: func(provider ProviderStatement) error {
 					newProviderCalled = true
-					callbackArgs = []interface{}{name, host, baseUrl, maxTokens, temperature, systemPrompt}
+					callbackArgs = []interface{}{provider.Name, provider.Host, provider.BaseUrl, provider.MaxTokens, provider.Temperature, provider.SystemPrompt}
 					return nil
 				},
-				OnNewChat: func(name, provider string) error {
+				OnNewChat: func(name, provider string, useProfile, overwrite bool) error {
 					newChatCalled = true
-					callbackArgs = []interface{}{name, provider}
+					callbackArgs = []interface{}{name, provider, useProfile}
 					return nil
 				},
 				OnLoadChat: func(name string, hash *string) error {
@@ -418,6 +619,56 @@ func TestSession_Execute(t *testing.T) {
 					callbackArgs = []interface{}{name}
 					return nil
 				},
+				OnHistory: func() error {
+					historyCalled = true
+					callbackArgs = []interface{}{}
+					return nil
+				},
+				OnReplay: func(idx int) error {
+					replayCalled = true
+					callbackArgs = []interface{}{idx}
+					return nil
+				},
+				OnRenameContext: func(name, newName string) error {
+					renameContextCalled = true
+					callbackArgs = []interface{}{name, newName}
+					return nil
+				},
+				OnRenameProvider: func(name, newName string) error {
+					renameProviderCalled = true
+					callbackArgs = []interface{}{name, newName}
+					return nil
+				},
+				OnWhereUsed: func(name string) error {
+					whereUsedCalled = true
+					callbackArgs = []interface{}{name}
+					return nil
+				},
+				OnWorkspace: func(name string) error {
+					workspaceCalled = true
+					callbackArgs = []interface{}{name}
+					return nil
+				},
+				OnCheckContext: func(name string) error {
+					checkContextCalled = true
+					callbackArgs = []interface{}{name}
+					return nil
+				},
+				OnFork: func(name string) error {
+					forkCalled = true
+					callbackArgs = []interface{}{name}
+					return nil
+				},
+				OnImportMarkdown: func(name, provider, file string) error {
+					importMarkdownCalled = true
+					callbackArgs = []interface{}{name, provider, file}
+					return nil
+				},
+				OnRestore: func(name, kind, id string) error {
+					restoreCalled = true
+					callbackArgs = []interface{}{name, kind, id}
+					return nil
+				},
 			}
 
 			// Execute statement
@@ -456,6 +707,26 @@ func TestSession_Execute(t *testing.T) {
 				called = &listProvidersCalled
 			case "del-provider":
 				called = &deleteProviderCalled
+			case "history":
+				called = &historyCalled
+			case "replay":
+				called = &replayCalled
+			case "rename-ctx":
+				called = &renameContextCalled
+			case "rename-provider":
+				called = &renameProviderCalled
+			case "where-used":
+				called = &whereUsedCalled
+			case "check-ctx":
+				called = &checkContextCalled
+			case "workspace":
+				called = &workspaceCalled
+			case "fork":
+				called = &forkCalled
+			case "import-md":
+				called = &importMarkdownCalled
+			case "restore":
+				called = &restoreCalled
 			}
 
 			// Validate callback and args
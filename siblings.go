@@ -0,0 +1,130 @@
+package brunch
+
+import (
+	"strings"
+	"time"
+)
+
+// A child of the current node as it is listed, enough to pick a branch by without printing
+// the whole tree
+type ChildEntry struct {
+	Hash      string    `json:"hash"`
+	ShortHash string    `json:"short_hash"` // Goto takes it as well
+	Time      time.Time `json:"time"`
+	Preview   string    `json:"preview"`           // the first line of the message, or of the annotation
+	Summary   string    `json:"summary,omitempty"` // when one was made, see ChildSummaries
+	Children  int       `json:"children"`
+}
+
+// How much of a line the preview keeps
+const previewLength = 60
+
+func firstLine(content string) string {
+	line, _, cut := strings.Cut(strings.TrimSpace(content), "\n")
+	line = strings.TrimSpace(line)
+	if runes := []rune(line); len(runes) > previewLength {
+		return strings.TrimSpace(string(runes[:previewLength])) + "..."
+	}
+	if cut {
+		return line + " ..."
+	}
+	return line
+}
+
+func pairPreview(mp *MessagePairNode) string {
+	switch {
+	case mp.Annotation != nil:
+		return string(mp.Annotation.Kind) + ": " + firstLine(mp.Annotation.Content)
+	case mp.User != nil:
+		return firstLine(mp.User.UnencodedContent())
+	}
+	return ""
+}
+
+// A node that was branched from many times (asking the same thing different ways, fan-out
+// experiments) lists as a wall of hashes that can't be told apart. Once it has enough children
+// they get a one-line summary each, made by the chat's summarizer when they are listed. They
+// are kept with the chat by hash, so a child is only summarized again when it changes. Only a
+// few are made per listing, a wide fan-out is filled in over the next ones
+const (
+	branchSummaryFanOut = 3 // children a node needs before they are summarized
+	branchSummaryBatch  = 4 // summaries made per listing
+)
+
+// The first line of the summary, a summarizer that says more than asked is cut short
+func summaryLine(summary string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(summary), "\n")
+	return strings.TrimSpace(line)
+}
+
+// The one-line summaries of the current node's children, by hash. Children that couldn't be
+// summarized (yet) aren't in it, nor are the children of a node with only a few
+func (c *chatInstance) ChildSummaries() map[string]string {
+	children := nodeChildren(c.currentNode)
+	summaries := map[string]string{}
+	if len(children) < branchSummaryFanOut {
+		return summaries
+	}
+
+	made := 0
+	for _, child := range children {
+		hash := child.Hash()
+		c.branchMu.Lock()
+		summary, exists := c.branchSummaries[hash]
+		c.branchMu.Unlock()
+		if exists {
+			summaries[hash] = summary
+			continue
+		}
+		mp, ok := child.(*MessagePairNode)
+		if !ok || made >= branchSummaryBatch {
+			continue
+		}
+		user, assistant, ok := mp.Exchange()
+		if !ok {
+			continue
+		}
+
+		content := messageToString(user) + "\n" + messageToString(assistant)
+		ctx, cancel := c.detachedContext()
+		summary, err := c.getSummarizer().Summarize(ctx, SummaryForBranch, content)
+		cancel()
+		made++
+		if err != nil {
+			// Listing still works, it is tried again the next time
+			c.logger().Warn("failed to summarize branch", "node", hash, "error", err)
+			continue
+		}
+		c.estimateAuxiliary(ctx, content, summary)
+		if line := summaryLine(summary); line != "" {
+			c.branchMu.Lock()
+			if c.branchSummaries == nil {
+				c.branchSummaries = map[string]string{}
+			}
+			c.branchSummaries[hash] = line
+			c.branchMu.Unlock()
+			summaries[hash] = line
+		}
+	}
+	return summaries
+}
+
+// The summaries of the nodes still in the tree, for the snapshot
+func (c *chatInstance) keptBranchSummaries() map[string]string {
+	c.branchMu.Lock()
+	defer c.branchMu.Unlock()
+	if len(c.branchSummaries) == 0 {
+		return nil
+	}
+	tree := MapTree(&c.root)
+	kept := map[string]string{}
+	for hash, summary := range c.branchSummaries {
+		if _, exists := tree[hash]; exists {
+			kept[hash] = summary
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
@@ -0,0 +1,154 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type lineSummarizer struct {
+	calls int
+	fail  bool
+}
+
+func (ls *lineSummarizer) Summarize(ctx context.Context, purpose SummaryPurpose, content string) (string, error) {
+	ls.calls++
+	if ls.fail {
+		return "", errors.New("summarizer is down")
+	}
+	return fmt.Sprintf("summary %d for %s\nand a line too many", ls.calls, purpose), nil
+}
+
+// A chat whose root was branched from the given number of times
+func fannedOutChat(t *testing.T, replies int) (*chatInstance, *lineSummarizer) {
+	chat := newChatInstance(newMockProvider("mock"))
+	summarizer := &lineSummarizer{}
+	chat.SetSummarizer(summarizer)
+	for i := 0; i < replies; i++ {
+		require.NoError(t, chat.Root())
+		_, err := chat.SubmitMessage(fmt.Sprintf("attempt %d", i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, chat.Root())
+	return chat, summarizer
+}
+
+func TestChat_ChildSummaries(t *testing.T) {
+	chat, summarizer := fannedOutChat(t, 6)
+
+	// Made a few at a time, the rest on the next listing
+	summaries := chat.ChildSummaries()
+	assert.Len(t, summaries, branchSummaryBatch)
+	assert.Equal(t, "summary 1 for branch", summaries[chat.ListChildren()[0].Hash])
+	summaries = chat.ChildSummaries()
+	assert.Len(t, summaries, 6)
+	assert.Equal(t, 6, summarizer.calls)
+
+	// Kept, not made again
+	assert.Equal(t, summaries, chat.ChildSummaries())
+	assert.Equal(t, 6, summarizer.calls)
+	assert.Equal(t, 6, chat.usage.get().Auxiliary.Calls)
+
+	// Only nodes with many children are summarized
+	chat, summarizer = fannedOutChat(t, branchSummaryFanOut-1)
+	assert.Empty(t, chat.ChildSummaries())
+	assert.Zero(t, summarizer.calls)
+}
+
+func TestChat_ChildSummariesFailed(t *testing.T) {
+	chat, summarizer := fannedOutChat(t, 3)
+	summarizer.fail = true
+	assert.Empty(t, chat.ChildSummaries())
+
+	summarizer.fail = false
+	assert.Len(t, chat.ChildSummaries(), 3)
+}
+
+func TestChat_ChildSummariesSnapshot(t *testing.T) {
+	chat, _ := fannedOutChat(t, 3)
+	summaries := chat.ChildSummaries()
+	snap, err := chat.Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, summaries, snap.BranchSummaries)
+
+	// Summaries of nodes that left the tree aren't saved
+	chat.branchSummaries["gone"] = "no longer here"
+	snap, err = chat.Snapshot()
+	require.NoError(t, err)
+	assert.NotContains(t, snap.BranchSummaries, "gone")
+
+	chat, _ = fannedOutChat(t, 1)
+	snap, err = chat.Snapshot()
+	require.NoError(t, err)
+	assert.Nil(t, snap.BranchSummaries)
+}
+
+func TestChat_ListChildren(t *testing.T) {
+	chat, _ := fannedOutChat(t, 3)
+	require.NoError(t, chat.Goto(chat.ListChildren()[0].Hash))
+	_, err := chat.SubmitMessage("a long first line that goes on and on past what the preview keeps of it\nand a second")
+	require.NoError(t, err)
+	require.NoError(t, chat.Root())
+
+	children := chat.ListChildren()
+	require.Len(t, children, 3)
+	first := chat.root.Children[0].(*MessagePairNode)
+	assert.Equal(t, ChildEntry{
+		Hash:      first.Hash(),
+		ShortHash: first.Hash()[:8],
+		Time:      first.Time,
+		Preview:   "attempt 0",
+		Children:  1,
+	}, children[0])
+
+	// Summaries show once they are made
+	assert.Empty(t, children[1].Summary)
+	chat.ChildSummaries()
+	assert.Equal(t, "summary 2 for branch", chat.ListChildren()[1].Summary)
+
+	require.NoError(t, chat.Goto(children[0].ShortHash))
+	assert.Same(t, first, chat.currentNode)
+	next := chat.ListChildren()
+	require.Len(t, next, 1)
+	assert.Equal(t, "a long first line that goes on and on past what the preview...", next[0].Preview)
+	require.NoError(t, chat.Goto(next[0].ShortHash))
+	assert.Empty(t, chat.ListChildren())
+}
+
+func TestFirstLine(t *testing.T) {
+	assert.Equal(t, "hello", firstLine("  hello  "))
+	assert.Equal(t, "hello ...", firstLine("hello\nthere"))
+	assert.Equal(t, "", firstLine(""))
+
+	chat := newChatInstance(newMockProvider("mock"))
+	_, err := chat.Annotate(Annotation{Kind: AK_NOTE, Content: "why this branch\nis here"})
+	require.NoError(t, err)
+	require.NoError(t, chat.Root())
+	assert.Equal(t, "note: why this branch ...", chat.ListChildren()[0].Preview)
+}
+
+func TestChat_GotoShortHash(t *testing.T) {
+	// More nodes than there are hex digits, so two of them start the same
+	chat, _ := fannedOutChat(t, 16)
+	assert.Error(t, chat.Goto(""))
+	assert.Error(t, chat.Goto("not a hash"))
+
+	starts := map[byte]int{}
+	for hash := range MapTree(&chat.root) {
+		starts[hash[0]]++
+	}
+	for start, count := range starts {
+		if count > 1 {
+			assert.ErrorContains(t, chat.Goto(string(start)), "more than one node")
+			break
+		}
+	}
+
+	hashes := chat.ListChildren()
+	require.NoError(t, chat.Goto(hashes[2].Hash[:12]))
+	assert.Equal(t, hashes[2].Hash, chat.currentNode.Hash())
+}
@@ -0,0 +1,75 @@
+package brunch
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Said in place of a fenced code block, nobody wants to hear code read out
+const speechCodeBlock = "(there is a code block here)"
+
+var (
+	speechImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	speechLink       = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	speechURL        = regexp.MustCompile(`https?://\S+`)
+	speechInlineCode = regexp.MustCompile("`([^`]+)`")
+	speechBold       = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	speechStrike     = regexp.MustCompile(`~~(.+?)~~`)
+	speechItalic     = regexp.MustCompile(`\*([^*\s][^*]*?)\*|(^|[^\w])_([^_\s][^_]*?)_([^\w]|$)`)
+	speechHTML       = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	speechHeading    = regexp.MustCompile(`^#{1,6}\s+`)
+	speechBullet     = regexp.MustCompile(`^([-*+]|\d+[.)])\s+`)
+	speechRule       = regexp.MustCompile(`^([-*_]\s*){3,}$`)
+	speechTableRule  = regexp.MustCompile(`^\|?(\s*:?-+:?\s*\|)+\s*:?-*:?\s*$`)
+	speechBlankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// The reply as it should be said by a text-to-speech engine. Code blocks are mentioned instead of
+// read, the markdown around text is taken off, links are left as their text and tables are read
+// a row at a time. The reply isn't changed, this is only for how it is read out (and the speech
+// post-processor)
+func SpeechText(content string) string {
+	content = stripThinking(content)
+	lines := []string{}
+	inFence := false
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			if !inFence {
+				lines = append(lines, speechCodeBlock)
+			}
+			inFence = !inFence
+			continue
+		}
+		if inFence || speechRule.MatchString(trimmed) || speechTableRule.MatchString(trimmed) {
+			continue
+		}
+		trimmed = strings.TrimSpace(strings.TrimLeft(trimmed, ">"))
+		trimmed = speechHeading.ReplaceAllString(trimmed, "")
+		trimmed = speechBullet.ReplaceAllString(trimmed, "")
+		if strings.HasPrefix(trimmed, "|") {
+			cells := []string{}
+			for _, cell := range strings.Split(strings.Trim(trimmed, "|"), "|") {
+				if cell = strings.TrimSpace(cell); cell != "" {
+					cells = append(cells, cell)
+				}
+			}
+			trimmed = strings.Join(cells, ", ")
+		}
+		lines = append(lines, speechInline(trimmed))
+	}
+	spoken := strings.Join(lines, "\n")
+	return strings.TrimSpace(speechBlankLines.ReplaceAllString(spoken, "\n\n"))
+}
+
+func speechInline(line string) string {
+	line = speechImage.ReplaceAllString(line, "$1")
+	line = speechLink.ReplaceAllString(line, "$1")
+	line = speechURL.ReplaceAllString(line, "a link")
+	line = speechInlineCode.ReplaceAllString(line, "$1")
+	line = speechBold.ReplaceAllString(line, "$1$2")
+	line = speechStrike.ReplaceAllString(line, "$1")
+	line = speechItalic.ReplaceAllString(line, "$1$2$3$4")
+	line = speechHTML.ReplaceAllString(line, "")
+	return line
+}
@@ -0,0 +1,34 @@
+package brunch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpeechText(t *testing.T) {
+	reply := "## Setting it up\n\n" +
+		"First install it with `go install`, see the [docs](https://example.com/docs) or https://example.com.\n\n" +
+		"```go\nfunc main() {}\n```\n\n" +
+		"- **Fast**: it is _very_ quick\n" +
+		"- ~~Slow~~ not anymore\n\n" +
+		"---\n\n" +
+		"| name | speed |\n|------|:-----:|\n| brunch | fast |\n\n" +
+		"> quoted <b>text</b> and snake_case_names stay"
+
+	assert.Equal(t, "Setting it up\n\n"+
+		"First install it with go install, see the docs or a link\n\n"+
+		speechCodeBlock+"\n\n"+
+		"Fast: it is very quick\n"+
+		"Slow not anymore\n\n"+
+		"name, speed\nbrunch, fast\n\n"+
+		"quoted text and snake_case_names stay", SpeechText(reply))
+
+	assert.Equal(t, "plain", SpeechText("<thinking>hmm</thinking>plain"))
+}
+
+func TestSpeechPostProcessor(t *testing.T) {
+	content, err := applyPostProcessors([]string{PostProcessSpeech}, "# Hi\n\n```\ncode\n```")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi\n\n"+speechCodeBlock, content)
+}
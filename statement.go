@@ -1,6 +1,12 @@
 package brunch
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
 
 type Statement struct {
 	content string
@@ -21,14 +27,18 @@ func (p *Statement) IsPrepared() bool {
 
 func (p *Statement) Prepare() error {
 
-	if p.cmd != nil {
-		p.cmd = nil
-	}
+	// Statements can be prepared more than once, and every preparation starts from scratch
+	p.Reset()
 
 	if err := p.tokenize(); err != nil {
+		p.cmd = nil
 		return err
 	}
 
+	if p.cmd == nil {
+		return p.errorAt(0, expectedCommands(), "no command found")
+	}
+
 	return nil
 }
 
@@ -57,6 +67,20 @@ const (
 	TokenTypeDescribeChatCmd
 	TokenTypeListProviderCmd
 	TokenTypeDelProviderCmd
+	TokenTypeHistoryCmd
+	TokenTypeReplayCmd
+	TokenTypeRenameContextCmd
+	TokenTypeRenameProviderCmd
+	TokenTypeWhereUsedCmd
+	TokenTypeForkCmd
+	TokenTypeImportTranscriptCmd
+	TokenTypeRestoreCmd
+	TokenTypeCheckContextCmd
+	TokenTypeWorkspaceCmd
+	TokenTypeExportCmd
+	TokenTypeFsckCmd
+	TokenTypeUsageCmd
+	TokenTypeTrashCmd
 )
 
 type propertyType int
@@ -65,8 +89,113 @@ const (
 	PropertyTypeString propertyType = iota
 	PropertyTypeInteger
 	PropertyTypeReal
+	PropertyTypeBoolean
+	PropertyTypeList
 )
 
+func (t propertyType) String() string {
+	switch t {
+	case PropertyTypeString:
+		return "string"
+	case PropertyTypeInteger:
+		return "integer"
+	case PropertyTypeReal:
+		return "real"
+	case PropertyTypeBoolean:
+		return "boolean"
+	case PropertyTypeList:
+		return "list"
+	}
+	return "unknown"
+}
+
+// A ParseError reports where in a statement parsing failed, what was found there,
+// and what the parser would have accepted instead
+type ParseError struct {
+	Message  string
+	Pos      int
+	Line     int // 1 based
+	Column   int // 1 based
+	Token    string
+	Expected []string
+
+	lineText string
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("%s at line %d, column %d", e.Message, e.Line, e.Column)
+	if e.Token != "" {
+		msg += fmt.Sprintf(" near %q", e.Token)
+	}
+	return msg
+}
+
+// Detail renders the error for a person: the offending line with a marker under the
+// failure, followed by what was expected there
+func (e *ParseError) Detail() string {
+	var sb strings.Builder
+	sb.WriteString(e.lineText)
+	sb.WriteString("\n")
+	sb.WriteString(strings.Repeat(" ", e.Column-1))
+	sb.WriteString("^\n")
+	sb.WriteString(e.Error())
+	if len(e.Expected) > 0 {
+		sb.WriteString("\nexpected one of: ")
+		sb.WriteString(strings.Join(e.Expected, ", "))
+	}
+	return sb.String()
+}
+
+func (p *Statement) errorAt(pos int, expected []string, format string, args ...interface{}) *ParseError {
+	if pos > len(p.content) {
+		pos = len(p.content)
+	}
+	line := 1 + strings.Count(p.content[:pos], "\n")
+	lineStart := strings.LastIndex(p.content[:pos], "\n") + 1
+	lineEnd := strings.Index(p.content[lineStart:], "\n")
+	if lineEnd < 0 {
+		lineEnd = len(p.content)
+	} else {
+		lineEnd += lineStart
+	}
+
+	tokenEnd := pos
+	for tokenEnd < len(p.content) && !isWhitespace(p.content[tokenEnd]) {
+		tokenEnd++
+	}
+
+	return &ParseError{
+		Message:  fmt.Sprintf(format, args...),
+		Pos:      pos,
+		Line:     line,
+		Column:   utf8.RuneCountInString(p.content[lineStart:pos]) + 1,
+		Token:    p.content[pos:tokenEnd],
+		Expected: expected,
+		lineText: p.content[lineStart:lineEnd],
+	}
+}
+
+func expectedProperties(required map[string]propertyType, optional map[string]propertyType) []string {
+	expected := []string{}
+	for name, typ := range required {
+		expected = append(expected, fmt.Sprintf(":%s (%s, required)", name, typ))
+	}
+	for name, typ := range optional {
+		expected = append(expected, fmt.Sprintf(":%s (%s)", name, typ))
+	}
+	sort.Strings(expected)
+	return expected
+}
+
+func expectedCommands() []string {
+	expected := make([]string, 0, len(commands))
+	for name := range commands {
+		expected = append(expected, name)
+	}
+	sort.Strings(expected)
+	return expected
+}
+
 type token struct {
 	pos       int
 	tokenType tokenType
@@ -77,6 +206,9 @@ type property struct {
 	id   string
 	prop string
 	typ  propertyType
+
+	// Only set for list properties, prop holds the raw text of the list
+	values []string
 }
 
 type frame struct {
@@ -85,6 +217,7 @@ type frame struct {
 	requiredProps map[string]propertyType
 	optionalProps map[string]propertyType
 	singleton     bool
+	numbered      bool // takes a bare integer in place of the quoted name
 }
 
 var commands = map[string]frame{
@@ -95,10 +228,18 @@ var commands = map[string]frame{
 			"host": PropertyTypeString,
 		},
 		optionalProps: map[string]propertyType{
-			"base-url":      PropertyTypeString,
-			"system-prompt": PropertyTypeString,
-			"max-tokens":    PropertyTypeInteger,
-			"temperature":   PropertyTypeReal,
+			"base-url":        PropertyTypeString,
+			"system-prompt":   PropertyTypeString,
+			"max-tokens":      PropertyTypeInteger,
+			"temperature":     PropertyTypeReal,
+			"companion":       PropertyTypeString,
+			"seed":            PropertyTypeInteger,
+			"post-process":    PropertyTypeList,
+			"fallbacks":       PropertyTypeList,
+			"context-window":  PropertyTypeInteger,
+			"window-strategy": PropertyTypeString,
+			"rpm":             PropertyTypeInteger,
+			"tpm":             PropertyTypeInteger,
 		},
 	},
 	"\\new-chat": {
@@ -107,7 +248,11 @@ var commands = map[string]frame{
 		requiredProps: map[string]propertyType{
 			"provider": PropertyTypeString,
 		},
-		optionalProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{
+			"profile":   PropertyTypeBoolean,
+			"overwrite": PropertyTypeBoolean,
+			"confirm":   PropertyTypeString,
+		},
 	},
 	"\\chat": {
 		t:             TokenTypeChatCmd,
@@ -131,13 +276,17 @@ var commands = map[string]frame{
 		t:             TokenTypeDelChatCmd,
 		keyword:       "del-chat",
 		requiredProps: map[string]propertyType{},
-		optionalProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{
+			"confirm": PropertyTypeString,
+		},
 	},
 	"\\del-ctx": {
 		t:             TokenTypeDelContextCmd,
 		keyword:       "del-ctx",
 		requiredProps: map[string]propertyType{},
-		optionalProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{
+			"confirm": PropertyTypeString,
+		},
 	},
 	"\\list-ctx": {
 		t:             TokenTypeListContextCmd,
@@ -176,10 +325,178 @@ var commands = map[string]frame{
 		t:             TokenTypeDelProviderCmd,
 		keyword:       "del-provider",
 		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{
+			"confirm": PropertyTypeString,
+		},
+	},
+	"\\fsck": {
+		t:             TokenTypeFsckCmd,
+		keyword:       "fsck",
+		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{
+			"quarantine": PropertyTypeBoolean,
+		},
+		singleton: true,
+	},
+	"\\usage": {
+		t:             TokenTypeUsageCmd,
+		keyword:       "usage",
+		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{},
+		singleton:     true,
+	},
+	"\\trash": {
+		t:             TokenTypeTrashCmd,
+		keyword:       "trash",
+		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{},
+		singleton:     true,
+	},
+	"\\history": {
+		t:             TokenTypeHistoryCmd,
+		keyword:       "history",
+		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{},
+		singleton:     true,
+	},
+	"\\replay": {
+		t:             TokenTypeReplayCmd,
+		keyword:       "replay",
+		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{},
+		numbered:      true,
+	},
+	"\\where-used": {
+		t:             TokenTypeWhereUsedCmd,
+		keyword:       "where-used",
+		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{},
+	},
+	"\\check-ctx": {
+		t:             TokenTypeCheckContextCmd,
+		keyword:       "check-ctx",
+		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{},
+	},
+	"\\workspace": {
+		t:             TokenTypeWorkspaceCmd,
+		keyword:       "workspace",
+		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{},
+	},
+	"\\fork": {
+		t:             TokenTypeForkCmd,
+		keyword:       "fork",
+		requiredProps: map[string]propertyType{},
+		optionalProps: map[string]propertyType{},
+	},
+	"\\import-md": {
+		t:       TokenTypeImportTranscriptCmd,
+		keyword: "import-md",
+		requiredProps: map[string]propertyType{
+			"provider": PropertyTypeString,
+			"file":     PropertyTypeString,
+		},
+		optionalProps: map[string]propertyType{},
+	},
+	"\\restore": {
+		t:       TokenTypeRestoreCmd,
+		keyword: "restore",
+		requiredProps: map[string]propertyType{
+			"kind": PropertyTypeString,
+		},
+		optionalProps: map[string]propertyType{
+			"id": PropertyTypeString,
+		},
+	},
+	"\\export": {
+		t:       TokenTypeExportCmd,
+		keyword: "export",
+		requiredProps: map[string]propertyType{
+			"file": PropertyTypeString,
+		},
+		optionalProps: map[string]propertyType{
+			"format": PropertyTypeString,
+			"branch": PropertyTypeString,
+		},
+	},
+	"\\rename-ctx": {
+		t:       TokenTypeRenameContextCmd,
+		keyword: "rename-ctx",
+		requiredProps: map[string]propertyType{
+			"to": PropertyTypeString,
+		},
+		optionalProps: map[string]propertyType{},
+	},
+	"\\rename-provider": {
+		t:       TokenTypeRenameProviderCmd,
+		keyword: "rename-provider",
+		requiredProps: map[string]propertyType{
+			"to": PropertyTypeString,
+		},
 		optionalProps: map[string]propertyType{},
 	},
 }
 
+// Other names a command can be written with, so a front-end can be localized (\\nuevo-chat for
+// \\new-chat) without changing the parser. They are shared by every statement, and a statement
+// written with one runs the same as with the command's own keyword
+var (
+	keywordAliases   = map[string]string{}
+	keywordAliasesMu sync.RWMutex
+)
+
+// Let the command be written as the alias. Both are given with their leading '\\'
+func RegisterKeywordAlias(alias string, command string) error {
+	if len(alias) < 2 || alias[0] != '\\' {
+		return fmt.Errorf("alias %q must start with '\\'", alias)
+	}
+	if strings.ContainsAny(alias, " \t\r\n;#\"") {
+		return fmt.Errorf("alias %q can't contain whitespace, ';', '#' or '\"'", alias)
+	}
+	if _, exists := commands[alias]; exists {
+		return fmt.Errorf("alias %q is already a command", alias)
+	}
+	if _, exists := commands[command]; !exists {
+		return fmt.Errorf("unknown command: %s", command)
+	}
+
+	keywordAliasesMu.Lock()
+	defer keywordAliasesMu.Unlock()
+	if existing, exists := keywordAliases[alias]; exists && existing != command {
+		return fmt.Errorf("alias %q is already used for %s", alias, existing)
+	}
+	keywordAliases[alias] = command
+	return nil
+}
+
+func UnregisterKeywordAlias(alias string) {
+	keywordAliasesMu.Lock()
+	defer keywordAliasesMu.Unlock()
+	delete(keywordAliases, alias)
+}
+
+// The registered aliases and the commands they are for
+func KeywordAliases() map[string]string {
+	keywordAliasesMu.RLock()
+	defer keywordAliasesMu.RUnlock()
+	aliases := make(map[string]string, len(keywordAliases))
+	for alias, command := range keywordAliases {
+		aliases[alias] = command
+	}
+	return aliases
+}
+
+func lookupCommand(keyword string) (frame, bool) {
+	if cmdFrame, ok := commands[keyword]; ok {
+		return cmdFrame, true
+	}
+	keywordAliasesMu.RLock()
+	defer keywordAliasesMu.RUnlock()
+	cmdFrame, ok := commands[keywordAliases[keyword]]
+	return cmdFrame, ok
+}
+
 func NewStatement(content string) *Statement {
 	return &Statement{
 		content: content,
@@ -189,12 +506,91 @@ func NewStatement(content string) *Statement {
 	}
 }
 
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// Comments run from '#' to the end of the line and are treated as whitespace
 func (p *Statement) skipWhitespace() {
-	for p.idx < len(p.content) && (p.content[p.idx] == ' ' || p.content[p.idx] == '\t') {
+	for p.idx < len(p.content) {
+		if p.content[p.idx] == '#' {
+			for p.idx < len(p.content) && p.content[p.idx] != '\n' {
+				p.idx++
+			}
+			continue
+		}
+		if !isWhitespace(p.content[p.idx]) {
+			return
+		}
 		p.idx++
 	}
 }
 
+// A statement may be terminated with ';' but only one statement may be in a Statement.
+// Use ParseStatements for content that holds several
+func (p *Statement) parseTerminator() error {
+	p.skipWhitespace()
+	if p.idx < len(p.content) && p.content[p.idx] == ';' {
+		p.idx++
+		p.skipWhitespace()
+	}
+	if p.idx < len(p.content) {
+		return p.errorAt(p.idx, []string{";"}, "unexpected content after statement")
+	}
+	return nil
+}
+
+// ParseStatements splits content holding any number of statements into individual statements.
+// Statements are separated by ';' or simply by starting the next command, so a script file can
+// put one statement per line (or spread one over several lines). Comments are dropped
+func ParseStatements(content string) []*Statement {
+	statements := []*Statement{}
+	var current strings.Builder
+
+	flush := func() {
+		text := strings.TrimSpace(current.String())
+		if text != "" {
+			statements = append(statements, NewStatement(text))
+		}
+		current.Reset()
+	}
+
+	inString := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+
+		if inString {
+			current.WriteByte(c)
+			if c == '\\' && i+1 < len(content) && (content[i+1] == '"' || content[i+1] == '\\') {
+				i++
+				current.WriteByte(content[i])
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+			current.WriteByte(c)
+		case c == '#':
+			for i+1 < len(content) && content[i+1] != '\n' {
+				i++
+			}
+		case c == ';':
+			flush()
+		case c == '\\' && (i == 0 || isWhitespace(content[i-1])):
+			flush()
+			current.WriteByte(c)
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
+
 func (p *Statement) tokenize() error {
 	for p.idx < len(p.content) {
 		p.skipWhitespace()
@@ -207,25 +603,25 @@ func (p *Statement) tokenize() error {
 		switch p.content[p.idx] {
 		case '\\':
 			if p.idx+2 > len(p.content) {
-				return fmt.Errorf("invalid token at %d -> %s", p.idx, p.content[p.idx:])
+				return p.errorAt(p.idx, expectedCommands(), "invalid token")
 			}
 			start := p.idx
 			p.idx++
 
 			// Parse command keyword
-			for p.idx < len(p.content) && p.content[p.idx] != ' ' {
+			for p.idx < len(p.content) && !isWhitespace(p.content[p.idx]) && p.content[p.idx] != ';' && p.content[p.idx] != '#' {
 				p.idx++
 			}
 
 			if p.idx == start {
-				return fmt.Errorf("invalid token at %d -> %s", p.idx, p.content[p.idx:])
+				return p.errorAt(p.idx, expectedCommands(), "invalid token")
 			}
 
 			cmdStr := p.content[start:p.idx]
 
-			cmdFrame, ok := commands[cmdStr]
+			cmdFrame, ok := lookupCommand(cmdStr)
 			if !ok {
-				return fmt.Errorf("unknown command: %s", cmdStr)
+				return p.errorAt(start, expectedCommands(), "unknown command: %s", cmdStr)
 			}
 
 			p.cmd = &cmd{
@@ -239,35 +635,46 @@ func (p *Statement) tokenize() error {
 				value:     cmdStr,
 			})
 
-			// These dont take params
+			// These dont take a name, the ones with optional properties may still be given those
 			if cmdFrame.singleton {
-				return nil
+				if len(cmdFrame.optionalProps) == 0 {
+					return p.parseTerminator()
+				}
+				return p.parseProperties(cmdFrame.requiredProps, cmdFrame.optionalProps)
 			}
 
 			// Skip whitespace after command
 			p.skipWhitespace()
 
+			if cmdFrame.numbered {
+				num := p.parseInteger()
+				if num == nil {
+					return p.errorAt(p.idx, []string{"integer"}, "expected integer argument")
+				}
+				p.cmd.nameGiven = num.prop
+				return p.parseTerminator()
+			}
+
 			// Parse command name (must be a quoted string)
 			if p.idx >= len(p.content) {
-				return fmt.Errorf("missing command name at position %d", p.idx)
+				return p.errorAt(p.idx, []string{`"name"`}, "missing command name")
 			}
 
 			if p.content[p.idx] != '"' {
-				return fmt.Errorf("expected command name to start with '\"' at position %d", p.idx)
+				return p.errorAt(p.idx, []string{`"name"`}, "expected command name to start with '\"'")
 			}
 
+			nameStart := p.idx
 			nameToken := p.parseString()
 			if nameToken == nil {
-				return fmt.Errorf("invalid command name at position %d", p.idx)
+				return p.errorAt(nameStart, []string{`"name"`}, "unterminated command name")
 			}
 
 			p.cmd.nameGiven = nameToken.prop
 
 			return p.parseProperties(cmdFrame.requiredProps, cmdFrame.optionalProps)
-		case ':':
-			return nil
 		default:
-			p.idx++
+			return p.errorAt(p.idx, expectedCommands(), "expected command")
 		}
 	}
 	return nil
@@ -281,14 +688,21 @@ func (p *Statement) parseProperties(required map[string]propertyType, optional m
 			break
 		}
 
+		if p.content[p.idx] == ';' {
+			if err := p.parseTerminator(); err != nil {
+				return err
+			}
+			break
+		}
+
 		if p.content[p.idx] != ':' {
-			p.idx++
-			continue
+			return p.errorAt(p.idx, expectedProperties(required, optional), "expected property")
 		}
 
+		start := p.idx
 		prop := p.parseProperty(required, optional)
 		if prop == nil {
-			return fmt.Errorf("failed to parse property at position %d", p.idx)
+			return p.propertyError(start, required, optional)
 		}
 
 		p.cmd.properties[prop.id] = prop
@@ -298,13 +712,40 @@ func (p *Statement) parseProperties(required map[string]propertyType, optional m
 	// Verify all required properties are present
 	for propName := range required {
 		if _, exists := p.cmd.properties[propName]; !exists {
-			return fmt.Errorf("missing required property: %s", propName)
+			return p.errorAt(len(p.content), expectedProperties(required, nil), "missing required property: %s", propName)
 		}
 	}
 
 	return nil
 }
 
+// Work out why the property starting at pos didn't parse so the error can say so
+func (p *Statement) propertyError(pos int, required map[string]propertyType, optional map[string]propertyType) error {
+	nameStart := pos + 1
+	nameEnd := nameStart
+	for nameEnd < len(p.content) && isIdentifierChar(p.content[nameEnd]) {
+		nameEnd++
+	}
+	name := p.content[nameStart:nameEnd]
+	if name == "" {
+		return p.errorAt(pos, expectedProperties(required, optional), "missing property name")
+	}
+
+	typ, exists := required[name]
+	if !exists {
+		typ, exists = optional[name]
+	}
+	if !exists {
+		return p.errorAt(pos, expectedProperties(required, optional), "unknown property :%s", name)
+	}
+
+	valuePos := nameEnd
+	for valuePos < len(p.content) && (p.content[valuePos] == ' ' || p.content[valuePos] == '\t') {
+		valuePos++
+	}
+	return p.errorAt(valuePos, []string{typ.String()}, "invalid value for property :%s", name)
+}
+
 func (p *Statement) parseProperty(required map[string]propertyType, optional map[string]propertyType) *property {
 	if p.idx >= len(p.content) || p.content[p.idx] != ':' {
 		return nil
@@ -342,6 +783,10 @@ func (p *Statement) parseProperty(required map[string]propertyType, optional map
 		prop = p.parseInteger()
 	case PropertyTypeReal:
 		prop = p.parseReal()
+	case PropertyTypeBoolean:
+		prop = p.parseBoolean()
+	case PropertyTypeList:
+		prop = p.parseList()
 	}
 
 	if prop != nil {
@@ -355,6 +800,8 @@ func isIdentifierChar(c byte) bool {
 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
 }
 
+// Strings are double quoted, and may contain quotes and backslashes by escaping them
+// with a backslash. Any other backslash is kept as-is so paths and the like survive
 func (p *Statement) parseString() *property {
 	if p.idx >= len(p.content) || p.content[p.idx] != '"' {
 		return nil
@@ -363,17 +810,26 @@ func (p *Statement) parseString() *property {
 	start := p.idx
 	p.idx++ // Skip opening quote
 
+	var sb strings.Builder
 	for p.idx < len(p.content) {
-		if p.content[p.idx] == '"' && (p.idx == 0 || p.content[p.idx-1] != '\\') {
+		c := p.content[p.idx]
+		switch {
+		case c == '\\' && p.idx+1 < len(p.content) && (p.content[p.idx+1] == '"' || p.content[p.idx+1] == '\\'):
+			sb.WriteByte(p.content[p.idx+1])
+			p.idx += 2
+		case c == '"':
 			p.idx++ // Skip closing quote
 			return &property{
-				prop: p.content[start+1 : p.idx-1],
+				prop: sb.String(),
 				typ:  PropertyTypeString,
 			}
+		default:
+			sb.WriteByte(c)
+			p.idx++
 		}
-		p.idx++
 	}
 
+	p.idx = start
 	return nil // Unterminated string
 }
 
@@ -445,6 +901,54 @@ func (p *Statement) parseReal() *property {
 	}
 }
 
+func (p *Statement) parseBoolean() *property {
+	start := p.idx
+	for p.idx < len(p.content) && isIdentifierChar(p.content[p.idx]) {
+		p.idx++
+	}
+
+	value := p.content[start:p.idx]
+	if value != "true" && value != "false" {
+		p.idx = start
+		return nil
+	}
+
+	return &property{
+		prop: value,
+		typ:  PropertyTypeBoolean,
+	}
+}
+
+// Lists are one or more comma separated strings: "a", "b", "c"
+func (p *Statement) parseList() *property {
+	start := p.idx
+	values := []string{}
+
+	for {
+		item := p.parseString()
+		if item == nil {
+			p.idx = start
+			return nil
+		}
+		values = append(values, item.prop)
+
+		next := p.idx
+		p.skipWhitespace()
+		if p.idx >= len(p.content) || p.content[p.idx] != ',' {
+			p.idx = next
+			break
+		}
+		p.idx++ // Skip the comma
+		p.skipWhitespace()
+	}
+
+	return &property{
+		prop:   p.content[start:p.idx],
+		typ:    PropertyTypeList,
+		values: values,
+	}
+}
+
 func isDigit(c byte) bool {
 	return c >= '0' && c <= '9'
 }
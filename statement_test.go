@@ -1,6 +1,7 @@
 package brunch
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -118,11 +119,12 @@ func TestChatCommand(t *testing.T) {
 
 func TestParseProperty(t *testing.T) {
 	tests := []struct {
-		name      string
-		input     string
-		propType  propertyType
-		wantValue string
-		wantErr   bool
+		name       string
+		input      string
+		propType   propertyType
+		wantValue  string
+		wantValues []string
+		wantErr    bool
 	}{
 		{
 			name:      "valid string property",
@@ -152,6 +154,43 @@ func TestParseProperty(t *testing.T) {
 			wantValue: "",
 			wantErr:   true,
 		},
+		{
+			name:      "valid boolean property",
+			input:     `:stream true`,
+			propType:  PropertyTypeBoolean,
+			wantValue: "true",
+			wantErr:   false,
+		},
+		{
+			name:      "invalid boolean property",
+			input:     `:stream yes`,
+			propType:  PropertyTypeBoolean,
+			wantValue: "",
+			wantErr:   true,
+		},
+		{
+			name:       "valid single item list property",
+			input:      `:stops "a"`,
+			propType:   PropertyTypeList,
+			wantValue:  `"a"`,
+			wantValues: []string{"a"},
+			wantErr:    false,
+		},
+		{
+			name:       "valid list property",
+			input:      `:stops "a","b" , "c, d"`,
+			propType:   PropertyTypeList,
+			wantValue:  `"a","b" , "c, d"`,
+			wantValues: []string{"a", "b", "c, d"},
+			wantErr:    false,
+		},
+		{
+			name:      "list with dangling comma",
+			input:     `:stops "a",`,
+			propType:  PropertyTypeList,
+			wantValue: "",
+			wantErr:   true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -161,6 +200,8 @@ func TestParseProperty(t *testing.T) {
 				"host":        PropertyTypeString,
 				"max-tokens":  PropertyTypeInteger,
 				"temperature": PropertyTypeReal,
+				"stream":      PropertyTypeBoolean,
+				"stops":       PropertyTypeList,
 			}
 			prop := stmt.parseProperty(required, nil)
 
@@ -179,6 +220,14 @@ func TestParseProperty(t *testing.T) {
 			if prop.prop != tt.wantValue {
 				t.Errorf("parseProperty() got value = %v, want %v", prop.prop, tt.wantValue)
 			}
+
+			if prop.typ != tt.propType {
+				t.Errorf("parseProperty() got type = %v, want %v", prop.typ, tt.propType)
+			}
+
+			if tt.wantValues != nil && strings.Join(prop.values, "|") != strings.Join(tt.wantValues, "|") {
+				t.Errorf("parseProperty() got values = %v, want %v", prop.values, tt.wantValues)
+			}
 		})
 	}
 }
@@ -275,3 +324,396 @@ func TestNewContextCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		wantLine     int
+		wantColumn   int
+		wantToken    string
+		wantMessage  string
+		wantExpected string
+	}{
+		{
+			name:         "unknown command",
+			input:        `\bogus "x"`,
+			wantLine:     1,
+			wantColumn:   1,
+			wantToken:    `\bogus`,
+			wantMessage:  `unknown command: \bogus`,
+			wantExpected: `\chat`,
+		},
+		{
+			name:         "unknown property",
+			input:        `\new-provider "p" :host "anthropic" :hots "x"`,
+			wantLine:     1,
+			wantColumn:   37,
+			wantToken:    ":hots",
+			wantMessage:  "unknown property :hots",
+			wantExpected: ":host (string, required)",
+		},
+		{
+			name:         "bad property value on second line",
+			input:        "\\new-provider \"p\"\n  :host \"anthropic\" :max-tokens lots",
+			wantLine:     2,
+			wantColumn:   33,
+			wantToken:    "lots",
+			wantMessage:  "invalid value for property :max-tokens",
+			wantExpected: "integer",
+		},
+		{
+			name:         "unterminated name",
+			input:        `\chat "example`,
+			wantLine:     1,
+			wantColumn:   7,
+			wantToken:    `"example`,
+			wantMessage:  "unterminated command name",
+			wantExpected: `"name"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewStatement(tt.input).Prepare()
+			parseErr, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("expected *ParseError, got %T (%v)", err, err)
+			}
+			if parseErr.Line != tt.wantLine || parseErr.Column != tt.wantColumn {
+				t.Errorf("position = %d:%d, want %d:%d", parseErr.Line, parseErr.Column, tt.wantLine, tt.wantColumn)
+			}
+			if parseErr.Token != tt.wantToken {
+				t.Errorf("token = %q, want %q", parseErr.Token, tt.wantToken)
+			}
+			if parseErr.Message != tt.wantMessage {
+				t.Errorf("message = %q, want %q", parseErr.Message, tt.wantMessage)
+			}
+			found := false
+			for _, expected := range parseErr.Expected {
+				if expected == tt.wantExpected {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("expected set %v does not contain %q", parseErr.Expected, tt.wantExpected)
+			}
+		})
+	}
+}
+
+func FuzzStatementPrepare(f *testing.F) {
+	seeds := []string{
+		`\new-provider "my-provider" :host "anthropic" :base-url "some_url" :max-tokens 4096 :temperature 0.7 :system-prompt "prompts/sp-think.xml"`,
+		`\new-chat "example" :provider "my-provider"`,
+		`\chat "example" :hash "123456"`,
+		`\new-ctx "my-context" :dir "./docs" :web "http://api.example.com"`,
+		`\list-chat`,
+		`\replay 2`,
+		`\chat "unterminated`,
+		`\new-provider "p" :host "say \"hi\""`,
+		`\new-provider "日本語" :host "ünïcödé"`,
+		`:host "x"`,
+		`\`,
+		``,
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		stmt := NewStatement(input)
+		err := stmt.Prepare()
+		if err != nil {
+			if _, ok := err.(*ParseError); ok {
+				_ = err.(*ParseError).Detail()
+			}
+			return
+		}
+		if !stmt.IsPrepared() {
+			t.Fatalf("Prepare() succeeded without a command for %q", input)
+		}
+
+		// Preparing again must give the same result
+		first := *stmt.cmd
+		if err := stmt.Prepare(); err != nil {
+			t.Fatalf("second Prepare() failed for %q: %v", input, err)
+		}
+		if stmt.cmd.keyword != first.keyword || stmt.cmd.nameGiven != first.nameGiven {
+			t.Fatalf("second Prepare() differs for %q", input)
+		}
+
+		// Whatever was accepted must be executable without panicking
+		session := &coreSession{}
+		session.execute(stmt, noopCallbacks())
+	})
+}
+
+func noopCallbacks() OperationalCallback {
+	return OperationalCallback{
+		OnLoadChat:        func(string, *string) error { return nil },
+		OnNewChat:         func(string, string, bool, bool) error { return nil },
+		OnNewProvider:     func(ProviderStatement) error { return nil },
+		OnNewContext:      func(string, *string, *string, *string) error { return nil },
+		OnDeleteChat:      func(string) error { return nil },
+		OnDeleteContext:   func(string) error { return nil },
+		OnDeleteProvider:  func(string) error { return nil },
+		OnReplay:          func(int) error { return nil },
+		OnListChats:       func() error { return nil },
+		OnListProviders:   func() error { return nil },
+		OnListContexts:    func() error { return nil },
+		OnDescribeContext: func(string) error { return nil },
+		OnDescribeChat:    func(string) error { return nil },
+		OnHistory:         func() error { return nil },
+		OnImportMarkdown:  func(string, string, string) error { return nil },
+		OnRestore:         func(string, string, string) error { return nil },
+		OnTrash:           func() error { return nil },
+		OnCheckContext:    func(string) error { return nil },
+		OnWorkspace:       func(string) error { return nil },
+	}
+}
+
+func TestStatementHardening(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantErr  bool
+		wantName string
+		wantProp string
+	}{
+		{
+			name:     "escaped quotes in property",
+			input:    `\new-provider "p" :host "anthropic" :system-prompt "say \"hi\" to C:\\ users"`,
+			wantName: "p",
+			wantProp: `say "hi" to C:\ users`,
+		},
+		{
+			name:     "unicode name and value",
+			input:    `\new-provider "日本語" :host "anthropic" :system-prompt "ünïcödé ✓"`,
+			wantName: "日本語",
+			wantProp: "ünïcödé ✓",
+		},
+		{
+			name:     "statement split across lines",
+			input:    "\\new-provider \"p\"\n\t:host \"anthropic\"\n\t:system-prompt \"x\"\n",
+			wantName: "p",
+			wantProp: "x",
+		},
+		{
+			name:    "unterminated property value",
+			input:   `\new-provider "p" :host "anthropic" :system-prompt "oops`,
+			wantErr: true,
+		},
+		{
+			name:    "trailing escaped quote is not a terminator",
+			input:   `\chat "abc\"`,
+			wantErr: true,
+		},
+		{
+			name:    "empty statement",
+			input:   "",
+			wantErr: true,
+		},
+		{
+			name:    "properties without a command",
+			input:   `:host "x"`,
+			wantErr: true,
+		},
+		{
+			name:    "junk between properties",
+			input:   `\new-provider "p" :host "anthropic" junk :max-tokens 10`,
+			wantErr: true,
+		},
+		{
+			name:    "junk after a number",
+			input:   `\new-provider "p" :host "anthropic" :max-tokens 10abc`,
+			wantErr: true,
+		},
+		{
+			name:    "lone backslash",
+			input:   `\`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt := NewStatement(tt.input)
+			err := stmt.Prepare()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Prepare() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if stmt.IsPrepared() {
+					t.Error("failed statement should not be prepared")
+				}
+				return
+			}
+			if stmt.cmd.nameGiven != tt.wantName {
+				t.Errorf("name = %q, want %q", stmt.cmd.nameGiven, tt.wantName)
+			}
+			if prop := stmt.cmd.properties["system-prompt"]; prop == nil || prop.prop != tt.wantProp {
+				t.Errorf("system-prompt = %v, want %q", prop, tt.wantProp)
+			}
+
+			// Preparing a second time must not change anything
+			if err := stmt.Prepare(); err != nil {
+				t.Fatalf("second Prepare() error = %v", err)
+			}
+			if stmt.cmd.nameGiven != tt.wantName || len(stmt.tokens) != 1 {
+				t.Errorf("second Prepare() produced a different statement")
+			}
+		})
+	}
+
+	long := `\new-provider "p" :host "anthropic" :system-prompt "` + strings.Repeat("x", 1<<20) + `"`
+	stmt := NewStatement(long)
+	if err := stmt.Prepare(); err != nil {
+		t.Fatalf("long statement failed: %v", err)
+	}
+	if len(stmt.cmd.properties["system-prompt"].prop) != 1<<20 {
+		t.Error("long property value was truncated")
+	}
+}
+
+func TestParseStatements(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "semicolon separated",
+			input: `\list-chat; \list-provider ;\list-ctx`,
+			want:  []string{`\list-chat`, `\list-provider`, `\list-ctx`},
+		},
+		{
+			name: "script with comments",
+			input: "# set things up\n" +
+				"\\new-provider \"p\" # the provider\n" +
+				"\t:host \"anthropic\"\n" +
+				"\t:max-tokens 10\n" +
+				"\\new-chat \"c\" :provider \"p\"\n",
+			want: []string{
+				"\\new-provider \"p\" \n\t:host \"anthropic\"\n\t:max-tokens 10",
+				`\new-chat "c" :provider "p"`,
+			},
+		},
+		{
+			name:  "separators and comments inside strings are kept",
+			input: `\new-provider "a;b" :host "anthropic" :system-prompt "# not a comment; \"really\" \\"; \chat "x"`,
+			want: []string{
+				`\new-provider "a;b" :host "anthropic" :system-prompt "# not a comment; \"really\" \\"`,
+				`\chat "x"`,
+			},
+		},
+		{
+			name:  "empty statements are dropped",
+			input: ";; # nothing here\n ;",
+			want:  []string{},
+		},
+		{
+			name:    "unterminated string is left for prepare to report",
+			input:   `\chat "oops; \list-chat`,
+			want:    []string{`\chat "oops; \list-chat`},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statements := ParseStatements(tt.input)
+			got := []string{}
+			var prepareErr error
+			for _, stmt := range statements {
+				got = append(got, stmt.content)
+				if err := stmt.Prepare(); err != nil && prepareErr == nil {
+					prepareErr = err
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("ParseStatements() = %q, want %q", got, tt.want)
+			}
+			if (prepareErr != nil) != tt.wantErr {
+				t.Errorf("Prepare() error = %v, wantErr %v", prepareErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStatementCommentsAndTerminator(t *testing.T) {
+	stmt := NewStatement("\\new-provider \"p\" # comment\n :host \"anthropic\" # another\n :max-tokens 10;")
+	if err := stmt.Prepare(); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if stmt.cmd.nameGiven != "p" || stmt.cmd.properties["max-tokens"].prop != "10" {
+		t.Errorf("comments were not skipped: name %q, properties %v", stmt.cmd.nameGiven, stmt.cmd.properties)
+	}
+
+	if err := NewStatement(`\list-chat; # done`).Prepare(); err != nil {
+		t.Errorf("terminated statement failed: %v", err)
+	}
+
+	// A single statement only holds one command
+	for _, input := range []string{`\list-chat; \list-provider`, `\chat "a"; \chat "b"`} {
+		if err := NewStatement(input).Prepare(); err == nil {
+			t.Errorf("Prepare(%q) should fail with more than one statement", input)
+		}
+	}
+}
+
+func TestStatementSingletonProperties(t *testing.T) {
+	stmt := NewStatement(`\fsck :quarantine true;`)
+	if err := stmt.Prepare(); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if prop := stmt.cmd.properties["quarantine"]; prop == nil || prop.prop != "true" {
+		t.Errorf("quarantine was not parsed: %v", stmt.cmd.properties)
+	}
+	if got := ParseStatements(`\fsck :quarantine true \list-chat`); len(got) != 2 {
+		t.Errorf("ParseStatements() gave %d statements, want 2", len(got))
+	}
+
+	// They still don't take a name, or properties they don't have
+	for _, input := range []string{`\fsck "name"`, `\fsck :confirm "x"`, `\list-chat :quarantine true`} {
+		if err := NewStatement(input).Prepare(); err == nil {
+			t.Errorf("Prepare(%q) should fail", input)
+		}
+	}
+}
+
+func TestKeywordAliases(t *testing.T) {
+	if err := RegisterKeywordAlias(`\nuevo-chat`, `\new-chat`); err != nil {
+		t.Fatalf("RegisterKeywordAlias() error = %v", err)
+	}
+	defer UnregisterKeywordAlias(`\nuevo-chat`)
+
+	stmt := NewStatement(`\nuevo-chat "c" :provider "p"`)
+	if err := stmt.Prepare(); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if stmt.cmd.keyword != "new-chat" || stmt.cmd.nameGiven != "c" {
+		t.Errorf("alias ran as %q %q, want new-chat c", stmt.cmd.keyword, stmt.cmd.nameGiven)
+	}
+	if got := ParseStatements(`\nuevo-chat "a" :provider "p" \list-chat`); len(got) != 2 {
+		t.Errorf("ParseStatements() split aliased statements into %d, want 2", len(got))
+	}
+
+	for _, tt := range []struct{ alias, command string }{
+		{`\chat`, `\new-chat`},
+		{`nuevo`, `\new-chat`},
+		{`\nuevo chat`, `\new-chat`},
+		{`\otro`, `\nope`},
+		{`\nuevo-chat`, `\chat`},
+	} {
+		if err := RegisterKeywordAlias(tt.alias, tt.command); err == nil {
+			t.Errorf("RegisterKeywordAlias(%q, %q) should fail", tt.alias, tt.command)
+		}
+	}
+
+	UnregisterKeywordAlias(`\nuevo-chat`)
+	if err := NewStatement(`\nuevo-chat "c" :provider "p"`).Prepare(); err == nil {
+		t.Errorf("unregistered alias should be an unknown command")
+	}
+}
@@ -0,0 +1,96 @@
+package brunch
+
+import (
+	"sort"
+	"time"
+)
+
+// A rough count used for sizing branches up, we don't have the provider's tokenizer here.
+// Roughly four characters make a token for english text
+func estimateTokens(content string) int {
+	return (len(content) + 3) / 4
+}
+
+// BranchStats describes one branch of the tree, from the root down to one of its leaves
+type BranchStats struct {
+	Leaf         string    `json:"leaf"`          // hash of the last message pair on the branch
+	Depth        int       `json:"depth"`         // message pairs from the root to the leaf
+	Tokens       int       `json:"tokens"`        // estimated tokens sent with a message at the leaf (prompt and history)
+	LastActivity time.Time `json:"last_activity"` // time of the leaf's message pair
+}
+
+// TreeStats summarizes the size and shape of a conversation tree
+type TreeStats struct {
+	Nodes       int           `json:"nodes"`        // every node including the root
+	MaxDepth    int           `json:"max_depth"`    // deepest branch
+	BranchCount int           `json:"branch_count"` // leaves, every leaf ends a branch
+	Branches    []BranchStats `json:"branches"`     // in tree order
+}
+
+type BranchOrder int
+
+const (
+	BranchOrderRecent BranchOrder = iota // most recently active first
+	BranchOrderSize                      // most tokens first
+	BranchOrderDepth                     // deepest first
+)
+
+// ComputeTreeStats walks the tree once from the given root
+func ComputeTreeStats(root Node) TreeStats {
+	stats := TreeStats{Branches: []BranchStats{}}
+	if root == nil {
+		return stats
+	}
+	tokens := 0
+	if r, ok := root.(*RootNode); ok {
+		tokens = estimateTokens(r.Prompt)
+	}
+	stats.collect(root, 0, tokens)
+	return stats
+}
+
+func (s *TreeStats) collect(node Node, depth int, tokens int) {
+	s.Nodes++
+	if depth > s.MaxDepth {
+		s.MaxDepth = depth
+	}
+
+	mp, isPair := node.(*MessagePairNode)
+	if isPair {
+		if user, assistant, ok := mp.Exchange(); ok {
+			tokens += estimateTokens(user.UnencodedContent()) + estimateTokens(assistant.UnencodedContent())
+		}
+	}
+
+	children := nodeChildren(node)
+	if len(children) == 0 && isPair {
+		s.BranchCount++
+		s.Branches = append(s.Branches, BranchStats{
+			Leaf:         mp.Hash(),
+			Depth:        depth,
+			Tokens:       tokens,
+			LastActivity: mp.Time,
+		})
+		return
+	}
+	for _, child := range children {
+		s.collect(child, depth+1, tokens)
+	}
+}
+
+// RankBranches returns a copy of the branches sorted by the given order. Ties keep tree order
+func RankBranches(branches []BranchStats, order BranchOrder) []BranchStats {
+	ranked := make([]BranchStats, len(branches))
+	copy(ranked, branches)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		switch order {
+		case BranchOrderSize:
+			return ranked[i].Tokens > ranked[j].Tokens
+		case BranchOrderDepth:
+			return ranked[i].Depth > ranked[j].Depth
+		default:
+			return ranked[i].LastActivity.After(ranked[j].LastActivity)
+		}
+	})
+	return ranked
+}
@@ -0,0 +1,64 @@
+package brunch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeTreeStats(t *testing.T) {
+	empty := ComputeTreeStats(NewRootNode(RootOpt{Prompt: "hi"}))
+	if empty.Nodes != 1 || empty.BranchCount != 0 || empty.MaxDepth != 0 {
+		t.Errorf("unexpected stats for an empty tree: %+v", empty)
+	}
+
+	// The root with 3 children, and one of them with 3 of its own
+	root := syntheticTree(6, 3)
+	stats := ComputeTreeStats(root)
+	if stats.Nodes != 7 || stats.MaxDepth != 2 || stats.BranchCount != 5 || len(stats.Branches) != 5 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	deep := stats.Branches[0]
+	if deep.Depth != 2 {
+		t.Fatalf("expected the first branch to be under the first child, got depth %d", deep.Depth)
+	}
+	shallow := stats.Branches[len(stats.Branches)-1]
+	if shallow.Depth != 1 {
+		t.Fatalf("expected the last branch to be a child of the root, got depth %d", shallow.Depth)
+	}
+	if deep.Tokens <= shallow.Tokens {
+		t.Error("a deeper branch carries more history so should have more tokens")
+	}
+	if _, ok := MapTree(root)[deep.Leaf]; !ok {
+		t.Error("leaf hash should be in the tree")
+	}
+}
+
+func TestRankBranches(t *testing.T) {
+	now := time.Now()
+	branches := []BranchStats{
+		{Leaf: "a", Depth: 1, Tokens: 300, LastActivity: now.Add(-time.Hour)},
+		{Leaf: "b", Depth: 5, Tokens: 100, LastActivity: now},
+		{Leaf: "c", Depth: 3, Tokens: 200, LastActivity: now.Add(-2 * time.Hour)},
+	}
+
+	leaves := func(ranked []BranchStats) string {
+		out := ""
+		for _, b := range ranked {
+			out += b.Leaf
+		}
+		return out
+	}
+	if got := leaves(RankBranches(branches, BranchOrderRecent)); got != "bac" {
+		t.Errorf("recent order = %s", got)
+	}
+	if got := leaves(RankBranches(branches, BranchOrderSize)); got != "acb" {
+		t.Errorf("size order = %s", got)
+	}
+	if got := leaves(RankBranches(branches, BranchOrderDepth)); got != "bca" {
+		t.Errorf("depth order = %s", got)
+	}
+	if leaves(branches) != "abc" {
+		t.Error("ranking should not reorder the original")
+	}
+}
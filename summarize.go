@@ -0,0 +1,92 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// What a summary is going to be used for, which decides how it is asked for
+type SummaryPurpose string
+
+const (
+	SummaryForCompaction SummaryPurpose = "compaction" // replaces older history so a branch fits the model
+	SummaryForMerge      SummaryPurpose = "merge"      // carries the results of a branch into another
+	SummaryForTitle      SummaryPurpose = "title"      // names a chat or branch
+	SummaryForBranch     SummaryPurpose = "branch"     // tells a branch apart from its siblings, see siblings.go
+)
+
+var summaryInstructions = map[SummaryPurpose]string{
+	SummaryForCompaction: "Summarize the following conversation so it can replace the conversation itself. " +
+		"Keep every fact, decision, name, number and open question that later messages may depend on. " +
+		"Reply with the summary only.",
+	SummaryForMerge: "Summarize the results of the following conversation so they can be carried into another conversation " +
+		"on the same topic. Focus on conclusions and what was produced, not how the conversation went. " +
+		"Reply with the summary only.",
+	SummaryForTitle: "Write a short title (at most eight words) for the following conversation. " +
+		"Reply with the title only, without quotes.",
+	SummaryForBranch: "Write one line (at most twelve words) saying what the following exchange asks and how it was answered, " +
+		"so it can be told apart from other branches of the same conversation. Reply with the line only.",
+}
+
+// Summarizer condenses conversation content. Summaries are auxiliary work that doesn't need the
+// model that is having the conversation, so this can be swapped for something cheaper
+type Summarizer interface {
+	Summarize(ctx context.Context, purpose SummaryPurpose, content string) (string, error)
+}
+
+// The default summarizer asks a provider in a conversation of its own, so the summary
+// request never shows up in the tree of the chat being summarized
+type providerSummarizer struct {
+	provider Provider
+}
+
+// NewProviderSummarizer summarizes by prompting the given provider
+func NewProviderSummarizer(provider Provider) Summarizer {
+	return &providerSummarizer{provider: provider}
+}
+
+func (ps *providerSummarizer) Summarize(ctx context.Context, purpose SummaryPurpose, content string) (string, error) {
+	instruction, ok := summaryInstructions[purpose]
+	if !ok {
+		return "", fmt.Errorf("unknown summary purpose %s", purpose)
+	}
+	if strings.TrimSpace(content) == "" {
+		return "", errors.New("nothing to summarize")
+	}
+
+	pair, err := askAuxiliary(ctx, ps.provider, fmt.Sprintf("%s\n\n<conversation>\n%s\n</conversation>", instruction, content))
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize: %w", err)
+	}
+	if pair == nil || pair.Assistant == nil {
+		return "", errors.New("provider did not return a summary")
+	}
+	return strings.TrimSpace(pair.Assistant.UnencodedContent()), nil
+}
+
+// Ask the provider in a conversation of its own. Asked in a chat's context, the request is held
+// to the rate limit of the provider like the chat's messages are, and what the provider says
+// it used is counted with the chat
+func askAuxiliary(ctx context.Context, provider Provider, prompt string) (*MessagePairNode, error) {
+	root := provider.NewConversationRoot()
+	send := func() (*MessagePairNode, error) {
+		return provider.ExtendFrom(ctx, &root)(prompt)
+	}
+	req, ok := ctx.Value(chatRequestKey{}).(*chatRequest)
+	if !ok {
+		return send()
+	}
+	name := req.chat.auxiliaryName(provider)
+	pair, err := req.chat.limited(ctx, name, &root, prompt, send)
+	if err != nil {
+		return nil, err
+	}
+	estimateUsage(pair, &root, prompt)
+	if pair != nil {
+		req.chat.usage.addAuxiliary(name, pair.Usage)
+		req.asked = true
+	}
+	return pair, nil
+}
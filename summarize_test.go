@@ -0,0 +1,69 @@
+package brunch
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fixedSummarizer struct {
+	calls   int
+	content string
+}
+
+func (fs *fixedSummarizer) Summarize(ctx context.Context, purpose SummaryPurpose, content string) (string, error) {
+	fs.calls++
+	fs.content = content
+	return "summary for " + string(purpose), nil
+}
+
+func TestProviderSummarizer(t *testing.T) {
+	summarizer := NewProviderSummarizer(newMockProvider("mock"))
+
+	// The mock echoes the prompt, so we can see what was asked
+	summary, err := summarizer.Summarize(context.Background(), SummaryForTitle, "user: hello")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(summary, "echo: Write a short title"))
+	assert.Contains(t, summary, "<conversation>\nuser: hello\n</conversation>")
+
+	_, err = summarizer.Summarize(context.Background(), SummaryForTitle, "  ")
+	assert.Error(t, err)
+	_, err = summarizer.Summarize(context.Background(), "poem", "user: hello")
+	assert.Error(t, err)
+}
+
+func TestChat_Summarize(t *testing.T) {
+	chat := newChatInstance(newMockProvider("mock"))
+	_, err := chat.SubmitMessage("hello")
+	require.NoError(t, err)
+
+	// The provider is asked in a conversation of its own
+	summary, err := chat.Summarize(SummaryForCompaction)
+	require.NoError(t, err)
+	assert.Contains(t, summary, "user: hello")
+	assert.Len(t, chat.root.Children, 1)
+	assert.Empty(t, chat.root.Children[0].ToMap())
+
+	// The core's summarizer is used over the provider, and the chat's over the core's
+	coreSummarizer := &fixedSummarizer{}
+	chat.core = &Core{summarizer: coreSummarizer}
+	summary, err = chat.Summarize(SummaryForTitle)
+	require.NoError(t, err)
+	assert.Equal(t, "summary for title", summary)
+	assert.Equal(t, "user: hello\nassistant: echo: hello", coreSummarizer.content)
+
+	chatSummarizer := &fixedSummarizer{}
+	chat.SetSummarizer(chatSummarizer)
+	_, err = chat.Summarize(SummaryForMerge)
+	require.NoError(t, err)
+	assert.Equal(t, 1, chatSummarizer.calls)
+	assert.Equal(t, 1, coreSummarizer.calls)
+
+	chat.SetSummarizer(nil)
+	_, err = chat.Summarize(SummaryForMerge)
+	require.NoError(t, err)
+	assert.Equal(t, 2, coreSummarizer.calls)
+}
@@ -0,0 +1,61 @@
+package brunch
+
+import (
+	"context"
+	"time"
+)
+
+// Every request to a provider is made in a context so that a generation can be given up on.
+// Messages sent with SubmitMessageContext stop when its context is cancelled, and each request
+// made for a message has CoreOpts.RequestTimeout to be answered in. Auxiliary work done for a
+// message (summaries, translations, verification) is given the same context
+const DefaultRequestTimeout = 30 * time.Second
+
+func (c *chatInstance) requestTimeout() time.Duration {
+	if c.core != nil && c.core.requestTimeout > 0 {
+		return c.core.requestTimeout
+	}
+	return DefaultRequestTimeout
+}
+
+// The context of a request made for the message being sent, or for the chat while the submit
+// lock is held
+func (c *chatInstance) requestContext() (context.Context, context.CancelFunc) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithTimeout(withAuxiliaryChat(ctx, c), c.requestTimeout())
+}
+
+// The context of a request made for the chat without the submit lock (listing its children),
+// which doesn't belong to any message being sent
+func (c *chatInstance) detachedContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(withAuxiliaryChat(context.Background(), c), c.requestTimeout())
+}
+
+type chatRequestKey struct{}
+
+// A request made in one of the chat's contexts. Auxiliary work asked for it is held to the rate
+// limits of the chat's providers and its usage counted, see askAuxiliary
+type chatRequest struct {
+	chat  *chatInstance
+	asked bool // a provider was asked, the usage it reported was counted
+}
+
+func withAuxiliaryChat(ctx context.Context, c *chatInstance) context.Context {
+	return context.WithValue(ctx, chatRequestKey{}, &chatRequest{chat: c})
+}
+
+// Count the auxiliary work done in the context from what was sent and returned, unless a
+// provider of the chat was asked for it and its usage was counted then
+func (c *chatInstance) estimateAuxiliary(ctx context.Context, request string, response string) {
+	if req, ok := ctx.Value(chatRequestKey{}).(*chatRequest); ok && req.asked {
+		return
+	}
+	c.usage.addAuxiliary("", &TokenUsage{
+		InputTokens:  estimateTokens(request),
+		OutputTokens: estimateTokens(response),
+		Estimated:    true,
+	})
+}
@@ -0,0 +1,108 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Never answers, it only gives up when the request's context is done
+type hangingProvider struct {
+	*mockProvider
+	started chan struct{}
+}
+
+func (hp *hangingProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	return func(userMessage string) (*MessagePairNode, error) {
+		hp.started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+}
+
+func TestChat_SubmitMessageContextCancelled(t *testing.T) {
+	core := newTestCore(t)
+	core.queueOffline = true
+	provider := &hangingProvider{mockProvider: newMockProvider("hanging"), started: make(chan struct{}, 1)}
+	chat := newChatInstance(provider)
+	chat.core = core
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-provider.started
+		cancel()
+	}()
+	_, err := chat.SubmitMessageContext(ctx, "hello")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Given up on, not queued for when the provider is back
+	var queued *MessageQueuedError
+	assert.False(t, errors.As(err, &queued))
+	assert.Empty(t, pendingNodes(&chat.root))
+	assert.Nil(t, chat.ctx)
+}
+
+func TestChat_RequestTimeout(t *testing.T) {
+	core := newTestCore(t)
+	core.requestTimeout = 10 * time.Millisecond
+	provider := &hangingProvider{mockProvider: newMockProvider("hanging"), started: make(chan struct{}, 1)}
+	chat := newChatInstance(provider)
+	chat.core = core
+
+	_, err := chat.SubmitMessage("hello")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	chat.core = nil
+	assert.Equal(t, DefaultRequestTimeout, chat.requestTimeout())
+}
+
+func TestCore_ExecuteStatementContext(t *testing.T) {
+	core := newTestCore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, core.ExecuteStatementContext(ctx, "s1", NewStatement(`\new-chat "a" :provider "mock"`)), context.Canceled)
+	assert.False(t, core.ChatExists("a"))
+
+	require.NoError(t, core.ExecuteStatementContext(context.Background(), "s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+	assert.True(t, core.ChatExists("a"))
+}
+
+// Keeps the context it was asked in
+type contextSummarizer struct {
+	ctx context.Context
+}
+
+func (cs *contextSummarizer) Summarize(ctx context.Context, purpose SummaryPurpose, content string) (string, error) {
+	cs.ctx = ctx
+	return "summary", ctx.Err()
+}
+
+func TestChat_AuxiliaryContext(t *testing.T) {
+	core := newTestCore(t)
+	core.requestTimeout = time.Hour
+	chat := newChatInstance(newMockProvider("mock"))
+	chat.core = core
+	summarizer := &contextSummarizer{}
+	chat.SetSummarizer(summarizer)
+	_, err := chat.SubmitMessage("hello")
+	require.NoError(t, err)
+
+	// Auxiliary work has the core's request timeout
+	_, err = chat.Summarize(SummaryForTitle)
+	require.NoError(t, err)
+	deadline, ok := summarizer.ctx.Deadline()
+	require.True(t, ok)
+	assert.Greater(t, time.Until(deadline), 50*time.Minute)
+
+	// and is given up on with the message it is done for
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	chat.ctx = ctx
+	_, err = chat.summaryPair([]*MessagePairNode{chat.currentNode.(*MessagePairNode)})
+	chat.ctx = nil
+	assert.ErrorIs(t, err, context.Canceled)
+}
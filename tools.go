@@ -0,0 +1,273 @@
+package brunch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Tool is something the model can ask to have done for it, like looking something up or
+// running a command. Tools are registered on the core (CoreOpts.Tools or RegisterTool) and offered
+// to every chat whose provider is a ToolCaller. When a reply asks for tools the chat calls them and
+// sends what they returned back to the provider, and both show up in the tree: the pair that asked
+// keeps the calls (MessagePairNode.ToolCalls) and the pair under it was sent their results. So a
+// tool call can be branched from like any other message, and replayed (Conversation.ReplayTools)
+type Tool struct {
+	Name        string
+	Description string
+
+	// The JSON schema of the input the tool is called with, an object
+	Schema json.RawMessage
+
+	// Called with input that was meant to match the schema, it isn't checked against it, and the
+	// environment variables of the chat it is called for (see env.go), nil when it has none. What
+	// is returned, or the error, is given to the model
+	Call func(input json.RawMessage, env map[string]string) (string, error)
+}
+
+// A ToolCaller is a provider whose model can ask for tools to be called instead of answering
+type ToolCaller interface {
+
+	// ExtendWithTools is ExtendFrom with tools the model can use. When the reply asks for some, the
+	// pair it returns has them in ToolCalls with their IDs, names and inputs. When the node it
+	// extends from has ToolCalls, the message is their results (ToolResults) and the provider
+	// should send them as such
+	ExtendWithTools(ctx context.Context, node Node, tools []Tool) MessageCreator
+}
+
+// A call the model asked for and what the tool gave back
+type ToolCall struct {
+	ID     string          `json:"id"`
+	Name   string          `json:"name"`
+	Input  json.RawMessage `json:"input"`
+	Output string          `json:"output,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// How many times one message can call tools before the model has to answer with what it has
+const toolCallRounds = 5
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+func (t Tool) validate() error {
+	if !toolNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid tool name %q: use up to 64 letters, digits, '_' or '-'", t.Name)
+	}
+	if t.Call == nil {
+		return fmt.Errorf("tool %s has nothing to call", t.Name)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(t.Schema, &schema); err != nil {
+		return fmt.Errorf("tool %s schema is not a JSON object: %w", t.Name, err)
+	}
+	return nil
+}
+
+// Make a tool available to every chat, from the next message on
+func (c *Core) RegisterTool(tool Tool) error {
+	if err := tool.validate(); err != nil {
+		return err
+	}
+	c.toolsMu.Lock()
+	defer c.toolsMu.Unlock()
+	if _, exists := c.tools[tool.Name]; exists {
+		return fmt.Errorf("tool [%s] already exists", tool.Name)
+	}
+	c.tools[tool.Name] = tool
+	return nil
+}
+
+func (c *Core) UnregisterTool(name string) error {
+	c.toolsMu.Lock()
+	defer c.toolsMu.Unlock()
+	if _, exists := c.tools[name]; !exists {
+		return fmt.Errorf("tool [%s] not found", name)
+	}
+	delete(c.tools, name)
+	return nil
+}
+
+// The registered tools, by name
+func (c *Core) Tools() []Tool {
+	c.toolsMu.Lock()
+	defer c.toolsMu.Unlock()
+	tools := make([]Tool, 0, len(c.tools))
+	for _, tool := range c.tools {
+		tools = append(tools, tool)
+	}
+	sort.Slice(tools, func(i, j int) bool {
+		return tools[i].Name < tools[j].Name
+	})
+	return tools
+}
+
+// The tools the chat's provider is offered, none if it can't call them. The chat's databases
+// are queried with a tool of their own, see database.go
+func (c *chatInstance) tools() []Tool {
+	if _, ok := c.provider.(ToolCaller); !ok {
+		return nil
+	}
+	var tools []Tool
+	if c.core != nil {
+		tools = c.core.Tools()
+	}
+	if tool, ok := c.databaseTool(); ok && !offersTool(tools, tool.Name) {
+		tools = append(tools, tool)
+	}
+	return tools
+}
+
+func offersTool(tools []Tool, name string) bool {
+	for _, tool := range tools {
+		if tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func calledTools(n Node) bool {
+	mp, ok := n.(*MessagePairNode)
+	return ok && len(mp.ToolCalls) > 0
+}
+
+// The message creator for the parent, with the tools if there are any to offer. When the chat's
+// provider can't answer its fallbacks are asked. Both are held to their rate limits
+func (c *chatInstance) creator(parent Node, tools []Tool) MessageCreator {
+	return func(message string) (*MessagePairNode, error) {
+		ctx, cancel := c.requestContext()
+		defer cancel()
+		pair, err := c.limited(ctx, c.provider.Settings().Host, parent, message, func() (*MessagePairNode, error) {
+			return creatorFor(ctx, c.provider, parent, tools)(message)
+		})
+		if err != nil && IsRetryable(err) {
+			pair, err = c.failover(parent, tools, message, err)
+		}
+		if err == nil {
+			estimateUsage(pair, parent, message)
+		}
+		return pair, err
+	}
+}
+
+func creatorFor(ctx context.Context, provider Provider, parent Node, tools []Tool) MessageCreator {
+	if caller, ok := provider.(ToolCaller); ok && len(tools) > 0 {
+		return caller.ExtendWithTools(ctx, parent, tools)
+	}
+	return provider.ExtendFrom(ctx, parent)
+}
+
+// Call what the pair asked for and keep what came back on it. Calls that aren't allowed to run
+// (the message already called too many) are given an error instead. The submit lock must be held
+func (c *chatInstance) callTools(pair *MessagePairNode, tools []Tool, allowed bool) {
+	byName := map[string]Tool{}
+	for _, tool := range tools {
+		byName[tool.Name] = tool
+	}
+	for i := range pair.ToolCalls {
+		call := &pair.ToolCalls[i]
+		if call.ID == "" {
+			call.ID = fmt.Sprintf("call_%d", i)
+		}
+		call.Output, call.Error = "", ""
+		tool, exists := byName[call.Name]
+		switch {
+		case !allowed:
+			call.Error = "too many tool calls for one message, answer with what you have"
+		case !exists:
+			call.Error = fmt.Sprintf("there is no tool named %s", call.Name)
+		default:
+			output, err := tool.Call(call.Input, maps.Clone(c.env))
+			if err != nil {
+				c.logger().Debug("tool call failed", "tool", call.Name, "error", err)
+				call.Error = err.Error()
+			}
+			call.Output = output
+		}
+	}
+}
+
+// The message the results of the calls are sent back in. Providers that can send them as tool
+// results compare the message with this to tell it apart from something the user wrote
+func ToolResults(calls []ToolCall) string {
+	var sb strings.Builder
+	for i, call := range calls {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		if call.Error != "" {
+			fmt.Fprintf(&sb, "<tool_result id=%q name=%q error=\"true\">\n%s\n</tool_result>", call.ID, call.Name, call.Error)
+			continue
+		}
+		fmt.Fprintf(&sb, "<tool_result id=%q name=%q>\n%s\n</tool_result>", call.ID, call.Name, call.Output)
+	}
+	return sb.String()
+}
+
+// The reply with the calls it asked for written out, for providers that read the history as text
+func toolCallsText(reply string, calls []ToolCall) string {
+	var sb strings.Builder
+	sb.WriteString(reply)
+	for _, call := range calls {
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "<tool_call id=%q name=%q>%s</tool_call>", call.ID, call.Name, call.Input)
+	}
+	return sb.String()
+}
+
+// Call the tools of the current node again, with the same input, and ask the provider from there.
+// The node is copied next to itself with the new results so the branch under it is left as it was
+func (c *chatInstance) ReplayTools() (string, error) {
+	if !c.chatEnabled {
+		return "", nil
+	}
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+
+	mp, ok := c.currentNode.(*MessagePairNode)
+	if !ok || len(mp.ToolCalls) == 0 {
+		return "", errors.New("the current node didn't call any tools")
+	}
+	parent, ok := treeNode(mp.Parent)
+	if !ok {
+		return "", errors.New("message has an unknown parent")
+	}
+	tools := c.tools()
+	if len(tools) == 0 {
+		return "", errors.New("the chat's provider has no tools to call")
+	}
+	if err := c.checkGrowth(mp.Parent, 2); err != nil {
+		return "", err
+	}
+
+	before, started := c.usage.get(), time.Now()
+	replayed := NewMessagePairNode(mp.Parent)
+	replayed.User, replayed.Assistant = mp.User, mp.Assistant
+	replayed.ToolCalls = append([]ToolCall{}, mp.ToolCalls...)
+	c.callTools(replayed, tools, true)
+	children := len(parent.Children)
+	parent.AddChild(replayed)
+
+	results := ToolResults(replayed.ToolCalls)
+	pair, err := c.ask(replayed, results, tools)
+	if err != nil {
+		parent.Children = parent.Children[:children]
+		return "", err
+	}
+	if err := c.postProcess(pair); err != nil {
+		return "", err
+	}
+	c.currentNode = pair
+	response := pair.Assistant.UnencodedContent()
+	c.usage.addMain(pair)
+	c.recordActivity(ActivityMessage, pair, before, started)
+	return response, nil
+}
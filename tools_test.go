@@ -0,0 +1,191 @@
+package brunch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Calls the weather tool for any message about the weather, and answers with what it returned
+type toolProvider struct {
+	mockProvider
+	offered  []string
+	runaway  bool // call the tool no matter what it returned
+	extended int
+}
+
+func (tp *toolProvider) ExtendWithTools(ctx context.Context, node Node, tools []Tool) MessageCreator {
+	tp.offered = tp.offered[:0]
+	for _, tool := range tools {
+		tp.offered = append(tp.offered, tool.Name)
+	}
+	return func(userMessage string) (*MessagePairNode, error) {
+		tp.extended++
+		pair, err := tp.mockProvider.ExtendFrom(ctx, node)(userMessage)
+		if err != nil {
+			return nil, err
+		}
+		previous, _ := node.(*MessagePairNode)
+		switch {
+		case previous != nil && len(previous.ToolCalls) > 0 && !tp.runaway:
+			result := previous.ToolCalls[0].Output
+			if previous.ToolCalls[0].Error != "" {
+				result = "failed, " + previous.ToolCalls[0].Error
+			}
+			pair.Assistant = NewMessageData("assistant", "the weather is "+result)
+		case strings.Contains(userMessage, "weather") || tp.runaway:
+			pair.Assistant = NewMessageData("assistant", "let me look")
+			pair.ToolCalls = []ToolCall{{ID: fmt.Sprintf("toolu_%d", tp.extended), Name: "weather", Input: json.RawMessage(`{"city":"Paris"}`)}}
+		}
+		return pair, nil
+	}
+}
+
+func weatherTool(reports ...string) (Tool, *[]string) {
+	inputs := []string{}
+	return Tool{
+		Name:        "weather",
+		Description: "The weather in a city",
+		Schema:      json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`),
+		Call: func(input json.RawMessage, env map[string]string) (string, error) {
+			inputs = append(inputs, string(input))
+			if len(inputs) > len(reports) {
+				return "", errors.New("no more weather")
+			}
+			return reports[len(inputs)-1], nil
+		},
+	}, &inputs
+}
+
+func newToolTestChat(t *testing.T, provider Provider, tools ...Tool) *chatInstance {
+	t.Helper()
+	core := newTestCore(t)
+	for _, tool := range tools {
+		require.NoError(t, core.RegisterTool(tool))
+	}
+	chat := newChatInstance(provider)
+	chat.core = core
+	return chat
+}
+
+func TestCore_RegisterTool(t *testing.T) {
+	core := newTestCore(t)
+	tool, _ := weatherTool()
+	require.NoError(t, core.RegisterTool(tool))
+	assert.Error(t, core.RegisterTool(tool), "names are unique")
+
+	bad := tool
+	bad.Name = "the weather"
+	assert.Error(t, core.RegisterTool(bad))
+	bad = tool
+	bad.Name, bad.Call = "other", nil
+	assert.Error(t, core.RegisterTool(bad))
+	bad = tool
+	bad.Name, bad.Schema = "other", json.RawMessage(`"string"`)
+	assert.Error(t, core.RegisterTool(bad))
+
+	require.Len(t, core.Tools(), 1)
+	require.NoError(t, core.UnregisterTool("weather"))
+	assert.Empty(t, core.Tools())
+	assert.Error(t, core.UnregisterTool("weather"))
+}
+
+func TestChat_ToolCalls(t *testing.T) {
+	provider := &toolProvider{mockProvider: *newMockProvider("mock")}
+	tool, inputs := weatherTool("sunny", "raining")
+	chat := newToolTestChat(t, provider, tool)
+
+	reply, err := chat.SubmitMessage("what is the weather in paris?")
+	require.NoError(t, err)
+	assert.Equal(t, "the weather is sunny", reply)
+	assert.Equal(t, []string{"weather"}, provider.offered)
+	assert.Equal(t, []string{`{"city":"Paris"}`}, *inputs)
+
+	// The call is a node of its own, the answer was sent its results from under it
+	answer := chat.currentNode.(*MessagePairNode)
+	call := answer.Parent.(*MessagePairNode)
+	assert.Same(t, &chat.root, call.Parent)
+	assert.Equal(t, "what is the weather in paris?", call.User.UnencodedContent())
+	require.Len(t, call.ToolCalls, 1)
+	assert.Equal(t, "sunny", call.ToolCalls[0].Output)
+	assert.Equal(t, ToolResults(call.ToolCalls), answer.User.UnencodedContent())
+	assert.Contains(t, branchHistory(answer), `<tool_call id="toolu_1" name="weather">{"city":"Paris"}</tool_call>`)
+
+	// The calls are kept with the tree
+	data, err := marshalNode(&chat.root)
+	require.NoError(t, err)
+	loaded, err := unmarshalNode(data)
+	require.NoError(t, err)
+	reloaded := loaded.(*RootNode).Children[0].(*MessagePairNode)
+	assert.Equal(t, call.ToolCalls, reloaded.ToolCalls)
+
+	// Replaying calls the tool again on a branch next to the first
+	require.NoError(t, chat.Goto(call.Hash()))
+	_, err = chat.Regenerate()
+	assert.Error(t, err, "a pair that called tools can't be asked again in place")
+	reply, err = chat.ReplayTools()
+	require.NoError(t, err)
+	assert.Equal(t, "the weather is raining", reply)
+	require.Len(t, chat.root.Children, 2)
+	assert.Equal(t, "sunny", call.ToolCalls[0].Output)
+	assert.Len(t, call.Children, 1)
+}
+
+func TestChat_ToolEnvironment(t *testing.T) {
+	provider := &toolProvider{mockProvider: *newMockProvider("mock")}
+	var seen []map[string]string
+	tool := Tool{
+		Name:   "weather",
+		Schema: json.RawMessage(`{"type":"object"}`),
+		Call: func(input json.RawMessage, env map[string]string) (string, error) {
+			seen = append(seen, env)
+			return env["WEATHER_UNITS"], nil
+		},
+	}
+	chat := newToolTestChat(t, provider, tool)
+	_, err := chat.SubmitMessage("what is the weather in paris?")
+	require.NoError(t, err)
+	assert.Nil(t, seen[0])
+
+	require.NoError(t, chat.SetEnv("WEATHER_UNITS", "celsius"))
+	reply, err := chat.SubmitMessage("and the weather now?")
+	require.NoError(t, err)
+	assert.Equal(t, "the weather is celsius", reply)
+
+	// A tool can't change the chat's environment
+	seen[1]["WEATHER_UNITS"] = "kelvin"
+	assert.Equal(t, "celsius", chat.Environment()["WEATHER_UNITS"])
+}
+
+func TestChat_ToolCallRounds(t *testing.T) {
+	provider := &toolProvider{mockProvider: *newMockProvider("mock"), runaway: true}
+	tool, inputs := weatherTool("sunny", "sunny", "sunny", "sunny", "sunny", "sunny", "sunny", "sunny")
+	chat := newToolTestChat(t, provider, tool)
+
+	_, err := chat.SubmitMessage("weather?")
+	require.NoError(t, err)
+	assert.Len(t, *inputs, toolCallRounds)
+
+	// The calls past the limit are refused and the branch stops at the last one
+	last := chat.currentNode.(*MessagePairNode)
+	require.Len(t, last.ToolCalls, 1)
+	assert.Contains(t, last.ToolCalls[0].Error, "too many tool calls")
+	assert.Equal(t, toolCallRounds+2, ComputeTreeStats(&chat.root).MaxDepth)
+}
+
+func TestChat_ToolsNeedACaller(t *testing.T) {
+	tool, inputs := weatherTool("sunny")
+	chat := newToolTestChat(t, newMockProvider("mock"), tool)
+	reply, err := chat.SubmitMessage("weather?")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: weather?", reply)
+	assert.Empty(t, *inputs)
+	_, err = chat.ReplayTools()
+	assert.Error(t, err)
+}
@@ -0,0 +1,351 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A transaction records how to undo everything the statements executed in it changed, so
+// that a multi-step setup (provider, chat, contexts, ...) that fails half way through doesn't
+// leave the install with half of what was asked for
+type transaction struct {
+	core *Core
+	undo []func() error
+}
+
+// ExecuteTransaction executes the statements in order in the given session. If any of them fail
+// the changes made by the ones before it are rolled back, in reverse order, and the session is put
+// back the way it was. Every statement is prepared and authorized before anything is executed so a
+// syntax error or refused statement anywhere means nothing is run.
+//
+// The rollback only covers what the statements themselves did. Changes made by other sessions
+// while the transaction runs are not isolated from it
+func (c *Core) ExecuteTransaction(sessionId string, stmts []*Statement) error {
+	sanitized := strings.TrimSpace(sessionId)
+	if sanitized == "" {
+		return errors.New("session id is required")
+	}
+
+	for idx, stmt := range stmts {
+		if stmt == nil {
+			return fmt.Errorf("statement %d: statement is required", idx)
+		}
+		if !stmt.IsPrepared() {
+			if err := stmt.Prepare(); err != nil {
+				return fmt.Errorf("statement %d: %w", idx, err)
+			}
+		}
+		if err := c.authorizeStatement(sanitized, stmt); err != nil {
+			return fmt.Errorf("statement %d: %w", idx, err)
+		}
+	}
+
+	session := c.getSession(sanitized)
+	tx := &transaction{core: c}
+	tx.recordSession(session)
+
+	for idx, stmt := range stmts {
+		if err := c.executeInSession(context.Background(), session, stmt, tx); err != nil {
+			err = fmt.Errorf("statement %d: %w", idx, err)
+			rbErr := tx.rollback()
+
+			// Files were put back underneath the reference index
+			c.invalidateReferenceIndex()
+			if rbErr != nil {
+				return errors.Join(err, fmt.Errorf("rollback failed: %w", rbErr))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *transaction) record(undo func() error) {
+	tx.undo = append(tx.undo, undo)
+}
+
+// Undo everything in reverse order. We keep going when something fails so we undo as much as we can
+func (tx *transaction) rollback() error {
+	var errs []error
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if err := tx.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	tx.undo = nil
+	return errors.Join(errs...)
+}
+
+// Capture a file in one of the stores so it can be put back exactly as it is now,
+// including removing it if it doesn't exist yet
+func (tx *transaction) captureStoreFile(store string, filename string) func() error {
+	return capturePath(tx.core.storePath(store, filename))
+}
+
+// The same for a name's copies in the trash, deleting or restoring moves files in and out of it.
+// Copies trashed since are removed and the ones that were taken out are put back
+func (tx *transaction) captureTrash(kind string, name string) func() error {
+	c := tx.core
+	store := trashKinds[kind]
+	trashed := func() (map[string]bool, error) {
+		items, err := c.Trash()
+		if err != nil {
+			return nil, err
+		}
+		files := map[string]bool{}
+		for _, item := range items {
+			if item.Kind == kind && item.Name == name {
+				files[item.file] = true
+			}
+		}
+		return files, nil
+	}
+	before, err := trashed()
+	restoreFiles := []func() error{}
+	for file := range before {
+		restoreFiles = append(restoreFiles, capturePath(c.trashPath(store, file)))
+	}
+	return func() error {
+		if err != nil {
+			return err
+		}
+		after, err := trashed()
+		if err != nil {
+			return err
+		}
+		for file := range after {
+			if before[file] {
+				continue
+			}
+			if err := os.Remove(c.trashPath(store, file)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %s from the trash: %w", file, err)
+			}
+		}
+		if err := os.MkdirAll(c.trashPath(store, ""), 0755); err != nil {
+			return err
+		}
+		var errs []error
+		for _, restoreFile := range restoreFiles {
+			errs = append(errs, restoreFile())
+		}
+		return errors.Join(errs...)
+	}
+}
+
+func capturePath(path string) func() error {
+	content, err := os.ReadFile(path)
+	existed := err == nil
+	return func() error {
+		if existed {
+			return os.WriteFile(path, content, 0644)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		return nil
+	}
+}
+
+// The session's position and history go back to what they were when the transaction started,
+// and any chat the transaction loaded is dropped from the active chats
+func (tx *transaction) recordSession(session *coreSession) {
+	c := tx.core
+
+	c.sesMu.Lock()
+	activeChat := session.activeChatId
+	activeBranch := session.activeBranch
+	history := make([]string, len(session.history))
+	copy(history, session.history)
+	workspace := session.workspace
+	c.sesMu.Unlock()
+
+	c.chatMu.Lock()
+	wasActive := make(map[string]bool, len(c.activeChats))
+	for name := range c.activeChats {
+		wasActive[name] = true
+	}
+	c.chatMu.Unlock()
+
+	tx.record(func() error {
+		c.chatMu.Lock()
+		for name := range c.activeChats {
+			if !wasActive[name] {
+				delete(c.activeChats, name)
+			}
+		}
+		c.chatMu.Unlock()
+
+		c.sesMu.Lock()
+		session.activeChatId = activeChat
+		session.activeBranch = activeBranch
+		session.history = history
+		session.workspace = workspace
+		c.sesMu.Unlock()
+		return c.persistSession(session)
+	})
+}
+
+// Wrap the callbacks that change the install so that each successful change records its undo
+func (tx *transaction) wrap(callbacks OperationalCallback) OperationalCallback {
+	c := tx.core
+	wrapped := callbacks
+
+	wrapped.OnNewProvider = func(provider ProviderStatement) error {
+		restore := tx.captureStoreFile(providerStoreDirectory, fmt.Sprintf("%s.json", strings.ReplaceAll(provider.Name, " ", "_")))
+		if err := callbacks.OnNewProvider(provider); err != nil {
+			return err
+		}
+		tx.record(func() error {
+			c.provMu.Lock()
+			delete(c.providers, provider.Name)
+			c.provMu.Unlock()
+			return restore()
+		})
+		return nil
+	}
+
+	wrapped.OnDeleteProvider = func(name string) error {
+		c.provMu.Lock()
+		provider := c.providers[name]
+		c.provMu.Unlock()
+		restore := tx.captureStoreFile(providerStoreDirectory, fmt.Sprintf("%s.json", name))
+		restoreTrash := tx.captureTrash(TrashKindProvider, name)
+		if err := callbacks.OnDeleteProvider(name); err != nil {
+			return err
+		}
+		tx.record(func() error {
+			c.provMu.Lock()
+			c.providers[name] = provider
+			c.provMu.Unlock()
+			return errors.Join(restore(), restoreTrash())
+		})
+		return nil
+	}
+
+	wrapped.OnNewChat = func(name string, provider string, useProfile bool, overwrite bool) error {
+		restore := tx.captureStoreFile(chatStoreDirectory, fmt.Sprintf("%s.json", name))
+		restoreTrash := tx.captureTrash(TrashKindChat, name)
+		if err := callbacks.OnNewChat(name, provider, useProfile, overwrite); err != nil {
+			return err
+		}
+		tx.record(func() error {
+			return errors.Join(restore(), restoreTrash())
+		})
+		return nil
+	}
+
+	wrapped.OnFork = func(name string) error {
+		restore := tx.captureStoreFile(chatStoreDirectory, fmt.Sprintf("%s.json", name))
+		if err := callbacks.OnFork(name); err != nil {
+			return err
+		}
+		tx.record(restore)
+		return nil
+	}
+
+	wrapped.OnImportMarkdown = func(name string, provider string, file string) error {
+		restore := tx.captureStoreFile(chatStoreDirectory, fmt.Sprintf("%s.json", name))
+		if err := callbacks.OnImportMarkdown(name, provider, file); err != nil {
+			return err
+		}
+		tx.record(restore)
+		return nil
+	}
+
+	wrapped.OnDeleteChat = func(name string) error {
+		restore := tx.captureStoreFile(chatStoreDirectory, fmt.Sprintf("%s.json", name))
+		restoreTrash := tx.captureTrash(TrashKindChat, name)
+		if err := callbacks.OnDeleteChat(name); err != nil {
+			return err
+		}
+		tx.record(func() error {
+			return errors.Join(restore(), restoreTrash())
+		})
+		return nil
+	}
+
+	wrapped.OnNewContext = func(name string, dir *string, database *string, web *string) error {
+		restore := tx.captureStoreFile(contextStoreDirectory, fmt.Sprintf("%s.json", name))
+		if err := callbacks.OnNewContext(name, dir, database, web); err != nil {
+			return err
+		}
+		tx.record(func() error {
+			c.ctxMu.Lock()
+			delete(c.contexts, name)
+			c.ctxMu.Unlock()
+			return restore()
+		})
+		return nil
+	}
+
+	wrapped.OnDeleteContext = func(name string) error {
+		c.ctxMu.Lock()
+		ctx := c.contexts[name]
+		c.ctxMu.Unlock()
+		restore := tx.captureStoreFile(contextStoreDirectory, fmt.Sprintf("%s.json", name))
+		restoreTrash := tx.captureTrash(TrashKindContext, name)
+		if err := callbacks.OnDeleteContext(name); err != nil {
+			return err
+		}
+		tx.record(func() error {
+			c.ctxMu.Lock()
+			c.contexts[name] = ctx
+			c.ctxMu.Unlock()
+			return errors.Join(restore(), restoreTrash())
+		})
+		return nil
+	}
+
+	// Restoring is undone by putting the file back in the trash and forgetting what was loaded from it
+	wrapped.OnRestore = func(name string, kind string, id string) error {
+		store, known := trashKinds[kind]
+		if !known {
+			return callbacks.OnRestore(name, kind, id)
+		}
+		restore := tx.captureStoreFile(store, fmt.Sprintf("%s.json", name))
+		restoreTrash := tx.captureTrash(kind, name)
+		if err := callbacks.OnRestore(name, kind, id); err != nil {
+			return err
+		}
+		tx.record(func() error {
+			switch kind {
+			case TrashKindProvider:
+				c.provMu.Lock()
+				delete(c.providers, name)
+				c.provMu.Unlock()
+			case TrashKindContext:
+				c.ctxMu.Lock()
+				delete(c.contexts, name)
+				c.ctxMu.Unlock()
+			}
+			return errors.Join(restore(), restoreTrash())
+		})
+		return nil
+	}
+
+	// Renames are undone by renaming back, which also puts back the chats that were updated
+	wrapped.OnRenameContext = func(name string, newName string) error {
+		if err := callbacks.OnRenameContext(name, newName); err != nil {
+			return err
+		}
+		tx.record(func() error {
+			return c.renameContext(newName, name)
+		})
+		return nil
+	}
+
+	wrapped.OnRenameProvider = func(name string, newName string) error {
+		if err := callbacks.OnRenameProvider(name, newName); err != nil {
+			return err
+		}
+		tx.record(func() error {
+			return c.renameProvider(newName, name)
+		})
+		return nil
+	}
+
+	return wrapped
+}
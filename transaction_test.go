@@ -0,0 +1,62 @@
+package brunch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCore_ExecuteTransaction(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "keep" :provider "mock"`)))
+	keepBefore, err := core.LoadFromChatStore("keep.json")
+	require.NoError(t, err)
+
+	storeFile := func(store string, name string) string {
+		return filepath.Join(core.installDirectory, store, name)
+	}
+
+	// The last statement fails, so everything before it is undone
+	err = core.ExecuteTransaction("s1", ParseStatements(`
+		\new-provider "fast" :host "mock"
+		\new-ctx "docs" :dir "/tmp"
+		\new-chat "scratch" :provider "fast"
+		\new-chat "keep" :provider "fast" :overwrite true
+		\del-chat "scratch"
+		\new-chat "broken" :provider "nope"
+	`))
+	require.ErrorContains(t, err, "statement 5")
+
+	assert.NotContains(t, core.providers, "fast")
+	assert.NotContains(t, core.contexts, "docs")
+	assert.NoFileExists(t, storeFile(providerStoreDirectory, "fast.json"))
+	assert.NoFileExists(t, storeFile(contextStoreDirectory, "docs.json"))
+	assert.NoFileExists(t, storeFile(chatStoreDirectory, "scratch.json"))
+	assert.NoFileExists(t, storeFile(chatStoreDirectory, "broken.json"))
+
+	// An overwritten chat is put back the way it was
+	keepAfter, err := core.LoadFromChatStore("keep.json")
+	require.NoError(t, err)
+	assert.Equal(t, keepBefore, keepAfter)
+	assert.Equal(t, []string{`\new-chat "keep" :provider "mock"`}, core.sessions["s1"].history)
+
+	// A syntax error anywhere means nothing runs
+	err = core.ExecuteTransaction("s1", ParseStatements(`\new-ctx "docs" :dir "/tmp"; \new-chat "x" :provider`))
+	require.Error(t, err)
+	assert.NotContains(t, core.contexts, "docs")
+
+	// When everything succeeds it all sticks
+	require.NoError(t, core.ExecuteTransaction("s1", ParseStatements(`
+		\new-provider "fast" :host "mock"
+		\new-ctx "docs" :dir "/tmp"
+		\del-chat "keep"
+	`)))
+	assert.Contains(t, core.providers, "fast")
+	assert.Contains(t, core.contexts, "docs")
+	_, err = os.Stat(storeFile(chatStoreDirectory, "keep.json"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, core.sessions["s1"].history, 4)
+}
@@ -0,0 +1,173 @@
+package brunch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// One exchange from a transcript, it becomes a message pair when the transcript is imported
+type TranscriptTurn struct {
+	User      string
+	Assistant string
+}
+
+// If the line starts a section of a transcript, the role it starts and whatever follows the
+// marker on the same line. These all start a section:
+//
+//	User: hello
+//	**User:** hello
+//	## Assistant
+func transcriptMarker(line string) (role string, rest string, ok bool) {
+	trimmed := strings.TrimSpace(line)
+	heading := strings.HasPrefix(trimmed, "#")
+	trimmed = strings.TrimSpace(strings.TrimLeft(trimmed, "#"))
+
+	emphasis := ""
+	for _, marker := range []string{"**", "__"} {
+		if strings.HasPrefix(trimmed, marker) {
+			emphasis = marker
+			trimmed = trimmed[len(marker):]
+			break
+		}
+	}
+
+	for _, candidate := range []string{"user", "assistant"} {
+		if len(trimmed) < len(candidate) || !strings.EqualFold(trimmed[:len(candidate)], candidate) {
+			continue
+		}
+		after := trimmed[len(candidate):]
+		if emphasis != "" {
+			// The colon may be inside or outside of the emphasis
+			if strings.HasPrefix(after, ":"+emphasis) {
+				after = after[len(emphasis)+1:]
+			} else if strings.HasPrefix(after, emphasis) {
+				after = strings.TrimPrefix(after[len(emphasis):], ":")
+			} else {
+				return "", "", false
+			}
+			return candidate, strings.TrimSpace(after), true
+		}
+		if strings.HasPrefix(after, ":") {
+			return candidate, strings.TrimSpace(after[1:]), true
+		}
+		if heading && strings.TrimSpace(after) == "" {
+			return candidate, "", true
+		}
+	}
+	return "", "", false
+}
+
+// Parse a markdown transcript of alternating "User:" and "Assistant:" sections. A section runs until
+// the next marker, and markers inside of fenced code blocks are left alone. Every user section must
+// be answered, a transcript ending on the user's message can't be continued from
+func ParseMarkdownTranscript(content string) ([]TranscriptTurn, error) {
+	type section struct {
+		role  string
+		lines []string
+		line  int
+	}
+
+	var sections []*section
+	var current *section
+	inFence := false
+	for idx, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+		}
+		if !inFence {
+			if role, rest, ok := transcriptMarker(line); ok {
+				current = &section{role: role, line: idx + 1}
+				if rest != "" {
+					current.lines = append(current.lines, rest)
+				}
+				sections = append(sections, current)
+				continue
+			}
+		}
+		if current == nil {
+			if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("line %d: content before the first User: or Assistant: section", idx+1)
+			}
+			continue
+		}
+		current.lines = append(current.lines, line)
+	}
+
+	if len(sections) == 0 {
+		return nil, errors.New("no User: or Assistant: sections found")
+	}
+
+	turns := make([]TranscriptTurn, 0, len(sections)/2)
+	for idx, sec := range sections {
+		text := strings.TrimSpace(strings.Join(sec.lines, "\n"))
+		expected := "user"
+		if idx%2 == 1 {
+			expected = "assistant"
+		}
+		if sec.role != expected {
+			return nil, fmt.Errorf("line %d: expected a %s section, found %s", sec.line, expected, sec.role)
+		}
+		if text == "" {
+			return nil, fmt.Errorf("line %d: the %s section is empty", sec.line, sec.role)
+		}
+		if sec.role == "user" {
+			turns = append(turns, TranscriptTurn{User: text})
+		} else {
+			turns[len(turns)-1].Assistant = text
+		}
+	}
+	if len(sections)%2 == 1 {
+		return nil, fmt.Errorf("line %d: the last user section has no answer", sections[len(sections)-1].line)
+	}
+	return turns, nil
+}
+
+// Build a new chat on the provider from the transcript. The chat is a single branch, one message
+// pair per turn, with the last turn as its current node
+func (c *Core) ImportMarkdownTranscript(name string, providerName string, content string) error {
+	if c.ChatExists(name) {
+		return fmt.Errorf("chat %s already exists", name)
+	}
+
+	turns, err := ParseMarkdownTranscript(content)
+	if err != nil {
+		return fmt.Errorf("failed to parse transcript: %w", err)
+	}
+
+	chat, err := c.newChatOnProvider(name, providerName)
+	if err != nil {
+		return err
+	}
+	if err := c.treeLimits.check(&chat.root, &chat.root, len(turns), len(turns), 1); err != nil {
+		return err
+	}
+
+	var parent Node = &chat.root
+	for _, turn := range turns {
+		pair := NewMessagePairNode(parent)
+		pair.User = NewMessageData("user", turn.User)
+		pair.Assistant = NewMessageData("assistant", turn.Assistant)
+		switch p := parent.(type) {
+		case *RootNode:
+			p.AddChild(pair)
+		case *MessagePairNode:
+			p.AddChild(pair)
+		}
+		parent = pair
+	}
+	chat.currentNode = parent
+
+	return c.claimChatName(name, false, func() error {
+		return c.writeSnapshot(name, chat)
+	})
+}
+
+func (c *Core) importMarkdownFile(name string, providerName string, file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read transcript: %w", err)
+	}
+	return c.ImportMarkdownTranscript(name, providerName, string(content))
+}
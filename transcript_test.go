@@ -0,0 +1,91 @@
+package brunch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMarkdownTranscript(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []TranscriptTurn
+		wantErr bool
+	}{
+		{
+			name:    "plain markers",
+			content: "User: hi\nAssistant: hello\n\nthere\nUser: bye\nAssistant: later",
+			want: []TranscriptTurn{
+				{User: "hi", Assistant: "hello\n\nthere"},
+				{User: "bye", Assistant: "later"},
+			},
+		},
+		{
+			name:    "bold and heading markers",
+			content: "\n**User:** what is go\n\n__Assistant__: a language\n## User\nshow me\n## Assistant\n```go\nUser: not a marker\n```\n",
+			want: []TranscriptTurn{
+				{User: "what is go", Assistant: "a language"},
+				{User: "show me", Assistant: "```go\nUser: not a marker\n```"},
+			},
+		},
+		{
+			name:    "crlf and case",
+			content: "user: hi\r\nASSISTANT: hello\r\n",
+			want:    []TranscriptTurn{{User: "hi", Assistant: "hello"}},
+		},
+		{
+			name:    "words that only start like a marker",
+			content: "User: hi\nuserland: is not a marker\nAssistant: ok",
+			want:    []TranscriptTurn{{User: "hi\nuserland: is not a marker", Assistant: "ok"}},
+		},
+		{name: "empty", content: "", wantErr: true},
+		{name: "preamble", content: "notes\nUser: hi\nAssistant: hello", wantErr: true},
+		{name: "starts with the assistant", content: "Assistant: hello\nUser: hi", wantErr: true},
+		{name: "two users in a row", content: "User: hi\nUser: again\nAssistant: hello", wantErr: true},
+		{name: "unanswered", content: "User: hi\nAssistant: hello\nUser: and?", wantErr: true},
+		{name: "empty section", content: "User:\nAssistant: hello", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMarkdownTranscript(tt.content)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCore_ImportMarkdown(t *testing.T) {
+	core := newTestCore(t)
+	file := filepath.Join(t.TempDir(), "notes.md")
+	require.NoError(t, os.WriteFile(file, []byte("User: hi\nAssistant: hello\nUser: how are you\nAssistant: fine"), 0644))
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\import-md "notes" :provider "mock" :file "`+file+`"`)))
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\import-md "notes" :provider "mock" :file "`+file+`"`)))
+
+	// The imported chat picks up on the last turn
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "notes"`)))
+	chat, err := core.GetActiveChat("notes")
+	require.NoError(t, err)
+	pair, ok := chat.currentNode.(*MessagePairNode)
+	require.True(t, ok)
+	assert.Equal(t, "fine", pair.Assistant.UnencodedContent())
+	assert.Len(t, MapTree(&chat.root), 3)
+
+	reply, err := chat.SubmitMessage("continue")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: continue", reply)
+
+	// A transcript that doesn't parse leaves nothing behind
+	bad := filepath.Join(t.TempDir(), "bad.md")
+	require.NoError(t, os.WriteFile(bad, []byte("User: unanswered"), 0644))
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\import-md "bad" :provider "mock" :file "`+bad+`"`)))
+	assert.NoFileExists(t, core.storePath(chatStoreDirectory, "bad.json"))
+}
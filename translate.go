@@ -0,0 +1,132 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The language models are spoken to in unless configured otherwise
+const DefaultModelLanguage = "en"
+
+// Translation is the other form of a message that went through the translation layer. The message
+// content is what the model saw, and the translation is what the user wrote or was shown
+type Translation struct {
+	Language string `json:"language"`
+	Content  string `json:"content"`
+}
+
+// Translator detects and translates languages for the translation layer. Languages are
+// ISO 639-1 codes ("en", "fr", ...)
+type Translator interface {
+	DetectLanguage(ctx context.Context, text string) (string, error)
+	Translate(ctx context.Context, text string, from string, to string) (string, error)
+}
+
+// TranslationOpts turns on the translation layer for a chat. Messages that aren't in the model
+// language are translated to it before they are sent, and the replies are translated back
+type TranslationOpts struct {
+	Translator    Translator // optional, defaults to asking the chat's auxiliary provider
+	ModelLanguage string     // optional, defaults to DefaultModelLanguage
+}
+
+// The default translator asks a provider in a conversation of its own, like the default summarizer
+type providerTranslator struct {
+	provider Provider
+}
+
+// NewProviderTranslator translates by prompting the given provider
+func NewProviderTranslator(provider Provider) Translator {
+	return &providerTranslator{provider: provider}
+}
+
+func (pt *providerTranslator) ask(ctx context.Context, prompt string) (string, error) {
+	pair, err := askAuxiliary(ctx, pt.provider, prompt)
+	if err != nil {
+		return "", err
+	}
+	if pair == nil || pair.Assistant == nil {
+		return "", errors.New("provider did not reply")
+	}
+	return strings.TrimSpace(pair.Assistant.UnencodedContent()), nil
+}
+
+func (pt *providerTranslator) DetectLanguage(ctx context.Context, text string) (string, error) {
+	lang, err := pt.ask(ctx, fmt.Sprintf(
+		"What language is the following text written in? Reply with only its two letter ISO 639-1 code.\n\n<text>\n%s\n</text>", text))
+	if err != nil {
+		return "", fmt.Errorf("failed to detect language: %w", err)
+	}
+	return normalizeLanguage(lang), nil
+}
+
+func (pt *providerTranslator) Translate(ctx context.Context, text string, from string, to string) (string, error) {
+	translated, err := pt.ask(ctx, fmt.Sprintf(
+		"Translate the following text from the language with ISO 639-1 code %s to the language with code %s. "+
+			"Keep formatting and code blocks as they are. Reply with only the translation.\n\n<text>\n%s\n</text>", from, to, text))
+	if err != nil {
+		return "", fmt.Errorf("failed to translate from %s to %s: %w", from, to, err)
+	}
+	return translated, nil
+}
+
+func normalizeLanguage(lang string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(lang), `."'`))
+}
+
+// Translate the message into the model language if it needs it. The returned language is
+// empty when the message is sent as it is
+func (c *chatInstance) translateIn(message string) (sent string, lang string, err error) {
+	translator, modelLang := c.translator()
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	lang, err = translator.DetectLanguage(ctx, message)
+	c.estimateAuxiliary(ctx, message, lang)
+	if err != nil {
+		return "", "", err
+	}
+	lang = normalizeLanguage(lang)
+	if lang == "" || lang == modelLang {
+		return message, "", nil
+	}
+	ctx, cancel = c.requestContext()
+	defer cancel()
+	sent, err = translator.Translate(ctx, message, lang, modelLang)
+	c.estimateAuxiliary(ctx, message, sent)
+	if err != nil {
+		return "", "", err
+	}
+	return sent, lang, nil
+}
+
+// Translate the reply back and record both forms on the message pair. The reply is already in
+// the tree so if it can't be translated the user gets what the model said
+func (c *chatInstance) translateOut(msgPair *MessagePairNode, original string, lang string) string {
+	translator, modelLang := c.translator()
+	msgPair.User.Translation = &Translation{Language: lang, Content: original}
+
+	reply := msgPair.Assistant.UnencodedContent()
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	translated, err := translator.Translate(ctx, reply, modelLang, lang)
+	c.estimateAuxiliary(ctx, reply, translated)
+	if err != nil {
+		c.logger().Warn("failed to translate reply, returning it untranslated", "language", lang, "error", err)
+		return reply
+	}
+	msgPair.Assistant.Translation = &Translation{Language: lang, Content: translated}
+	return translated
+}
+
+func (c *chatInstance) translator() (Translator, string) {
+	translator := c.translation.Translator
+	if translator == nil {
+		translator = NewProviderTranslator(c.auxiliaryProvider())
+	}
+	modelLang := normalizeLanguage(c.translation.ModelLanguage)
+	if modelLang == "" {
+		modelLang = DefaultModelLanguage
+	}
+	return translator, modelLang
+}
@@ -0,0 +1,77 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Treats anything starting with "bonjour" as french and translates by tagging the text
+type fakeTranslator struct {
+	failBack bool
+}
+
+func (ft *fakeTranslator) DetectLanguage(ctx context.Context, text string) (string, error) {
+	if strings.HasPrefix(text, "bonjour") {
+		return "FR", nil
+	}
+	return "en", nil
+}
+
+func (ft *fakeTranslator) Translate(ctx context.Context, text string, from string, to string) (string, error) {
+	if ft.failBack && to != "en" {
+		return "", errors.New("no")
+	}
+	return "[" + from + "->" + to + "] " + text, nil
+}
+
+func TestChat_Translation(t *testing.T) {
+	chat := newChatInstance(newMockProvider("mock"))
+	translator := &fakeTranslator{}
+	chat.SetTranslation(&TranslationOpts{Translator: translator})
+
+	// Messages in the model language are sent as they are
+	reply, err := chat.SubmitMessage("hello")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello", reply)
+	pair := chat.currentNode.(*MessagePairNode)
+	assert.Nil(t, pair.User.Translation)
+	assert.Nil(t, pair.Assistant.Translation)
+
+	// Others go to the model translated and come back translated, with both kept on the node
+	reply, err = chat.SubmitMessage("bonjour")
+	require.NoError(t, err)
+	assert.Equal(t, "[en->fr] echo: [fr->en] bonjour", reply)
+	pair = chat.currentNode.(*MessagePairNode)
+	assert.Equal(t, "[fr->en] bonjour", pair.User.UnencodedContent())
+	assert.Equal(t, &Translation{Language: "fr", Content: "bonjour"}, pair.User.Translation)
+	assert.Equal(t, "echo: [fr->en] bonjour", pair.Assistant.UnencodedContent())
+	assert.Equal(t, &Translation{Language: "fr", Content: reply}, pair.Assistant.Translation)
+
+	// Detection for both messages, and a translation each way for the second
+	assert.Equal(t, 4, chat.Usage().Auxiliary.Calls)
+
+	// The translations are saved with the tree
+	data, err := marshalNode(&chat.root)
+	require.NoError(t, err)
+	loaded, err := unmarshalNode(data)
+	require.NoError(t, err)
+	saved := MapTree(loaded)[pair.Hash()].(*MessagePairNode)
+	assert.Equal(t, pair.User.Translation, saved.User.Translation)
+
+	// A reply that can't be translated back is still returned
+	translator.failBack = true
+	reply, err = chat.SubmitMessage("bonjour encore")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: [fr->en] bonjour encore", reply)
+	assert.Nil(t, chat.currentNode.(*MessagePairNode).Assistant.Translation)
+
+	chat.SetTranslation(nil)
+	reply, err = chat.SubmitMessage("bonjour")
+	require.NoError(t, err)
+	assert.Equal(t, "echo: bonjour", reply)
+}
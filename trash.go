@@ -0,0 +1,283 @@
+package brunch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deleted chats, providers and contexts are moved into the trash (in the data-store, a directory
+// per store) instead of being removed. They can be restored until they have been in the trash for
+// longer than the retention, then they are removed for good the next time something is trashed.
+// Every deletion is kept on its own, as <name>.<unix nanoseconds>.json, so deleting a name twice
+// doesn't lose the first copy
+const trashDirectory = "trash"
+
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+const (
+	TrashKindChat     = "chat"
+	TrashKindProvider = "provider"
+	TrashKindContext  = "context"
+)
+
+var trashKinds = map[string]string{
+	TrashKindChat:     chatStoreDirectory,
+	TrashKindProvider: providerStoreDirectory,
+	TrashKindContext:  contextStoreDirectory,
+}
+
+// Something in the trash. The id tells apart the copies of a name that was deleted more than once
+type TrashedItem struct {
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+	file      string
+}
+
+func (c *Core) trashPath(store string, filename string) string {
+	return c.storePath(dataStoreDirectory, trashDirectory, store, filename)
+}
+
+func trashFilename(name string, deletedAt time.Time) string {
+	return fmt.Sprintf("%s.%d.json", name, deletedAt.UnixNano())
+}
+
+// The name and id of a file in the trash. Files trashed before every deletion was kept have no id,
+// they were deleted at their modification time
+func parseTrashFilename(filename string) (name string, id string, deletedAt time.Time, ok bool) {
+	base, isJSON := strings.CutSuffix(filename, ".json")
+	if !isJSON {
+		return "", "", time.Time{}, false
+	}
+	dot := strings.LastIndex(base, ".")
+	if dot < 0 {
+		return base, "", time.Time{}, true
+	}
+	nanos, err := strconv.ParseInt(base[dot+1:], 10, 64)
+	if err != nil {
+		return base, "", time.Time{}, true
+	}
+	return base[:dot], base[dot+1:], time.Unix(0, nanos), true
+}
+
+// Rename doesn't work across file systems, and the stores don't have to be on the same one
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// Move a file from a store into the trash, next to anything trashed under the same name before
+func (c *Core) moveToTrash(store string, filename string) error {
+	c.emptyTrash()
+
+	src := c.storePath(store, filename)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	dst := c.trashPath(store, trashFilename(strings.TrimSuffix(filename, ".json"), time.Now()))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	if err := moveFile(src, dst); err != nil {
+		return fmt.Errorf("failed to move %s to the trash: %w", filename, err)
+	}
+	return nil
+}
+
+// Remove what has been in the trash for longer than the retention. It is best effort,
+// anything that can't be removed now will be tried again next time
+func (c *Core) emptyTrash() {
+	items, err := c.Trash()
+	if err != nil {
+		c.logger.Debug("failed to read trash", "error", err)
+		return
+	}
+	cutoff := time.Now().Add(-c.trashRetention)
+	chatsRemoved := false
+	for _, item := range items {
+		if !item.DeletedAt.Before(cutoff) {
+			continue
+		}
+		path := c.trashPath(trashKinds[item.Kind], item.file)
+		if err := os.Remove(path); err != nil {
+			c.logger.Warn("failed to remove expired trash", "path", path, "error", err)
+			continue
+		}
+		chatsRemoved = chatsRemoved || item.Kind == TrashKindChat
+	}
+
+	// The blobs only those chats referred to go with them
+	if chatsRemoved {
+		if _, err := c.CollectBlobs(); err != nil {
+			c.logger.Warn("failed to collect blobs", "error", err)
+		}
+	}
+}
+
+// Everything in the trash, every deletion of a name on its own, most recently deleted first
+func (c *Core) Trash() ([]TrashedItem, error) {
+	items := []TrashedItem{}
+	for kind, store := range trashKinds {
+		files, err := os.ReadDir(c.storePath(dataStoreDirectory, trashDirectory, store))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trash: %w", err)
+		}
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			name, id, deletedAt, ok := parseTrashFilename(file.Name())
+			if !ok {
+				continue
+			}
+			if id == "" {
+				info, err := file.Info()
+				if err != nil {
+					continue
+				}
+				deletedAt = info.ModTime()
+			}
+			items = append(items, TrashedItem{
+				Name:      name,
+				Kind:      kind,
+				ID:        id,
+				DeletedAt: deletedAt,
+				file:      file.Name(),
+			})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	return items, nil
+}
+
+// The copy of a name in the trash that the id picks, or the most recently deleted one without an id
+func (c *Core) findTrashed(name string, kind string, id string) (TrashedItem, error) {
+	items, err := c.Trash()
+	if err != nil {
+		return TrashedItem{}, err
+	}
+	for _, item := range items {
+		if item.Kind == kind && item.Name == name && (id == "" || item.ID == id) {
+			return item, nil
+		}
+	}
+	if id != "" {
+		return TrashedItem{}, fmt.Errorf("%s %s with id %s is not in the trash", kind, name, id)
+	}
+	return TrashedItem{}, fmt.Errorf("%s %s is not in the trash", kind, name)
+}
+
+// Put a chat, provider or context back from the trash. Nothing can have taken its name since
+func (c *Core) restoreFromTrash(name string, kind string, id string) error {
+	store, known := trashKinds[kind]
+	if !known {
+		return fmt.Errorf("unknown kind %s, expected %s, %s or %s", kind, TrashKindChat, TrashKindProvider, TrashKindContext)
+	}
+	item, err := c.findTrashed(name, kind, id)
+	if err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("%s.json", name)
+	trashed := c.trashPath(store, item.file)
+	content, err := os.ReadFile(trashed)
+	if err != nil {
+		return fmt.Errorf("%s %s is not in the trash", kind, name)
+	}
+	if _, err := os.Stat(c.storePath(store, filename)); err == nil {
+		return fmt.Errorf("%s %s already exists", kind, name)
+	}
+
+	switch kind {
+	case TrashKindChat:
+		resolved, err := c.resolveBlobs(string(content))
+		if err != nil {
+			return err
+		}
+		snapshot, err := SnapshotFromJSON([]byte(resolved))
+		if err != nil {
+			return err
+		}
+		refs, err := referencesFromSnapshot(snapshot)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal chat %s: %w", name, err)
+		}
+		if err := moveFile(trashed, c.storePath(store, filename)); err != nil {
+			return fmt.Errorf("failed to restore chat %s: %w", name, err)
+		}
+		return c.indexChat(name, refs)
+
+	case TrashKindProvider:
+		var settings ProviderSettings
+		if err := json.Unmarshal(content, &settings); err != nil {
+			return fmt.Errorf("failed to unmarshal provider settings: %w", err)
+		}
+		c.provMu.Lock()
+		defer c.provMu.Unlock()
+		if _, exists := c.providers[name]; exists {
+			return fmt.Errorf("provider %s already exists", name)
+		}
+		host, exists := c.providers[settings.Host]
+		if !exists {
+			return fmt.Errorf("cannot restore provider %s: its host provider %s does not exist", name, settings.Host)
+		}
+		provider, err := host.CloneWithSettings(settings)
+		if err != nil {
+			return fmt.Errorf("failed to restore provider %s: %w", name, err)
+		}
+		if err := moveFile(trashed, c.storePath(store, filename)); err != nil {
+			return fmt.Errorf("failed to restore provider %s: %w", name, err)
+		}
+		c.providers[name] = provider
+		return nil
+
+	case TrashKindContext:
+		var ctx ContextSettings
+		if err := json.Unmarshal(content, &ctx); err != nil {
+			return fmt.Errorf("failed to unmarshal context settings: %w", err)
+		}
+		c.ctxMu.Lock()
+		defer c.ctxMu.Unlock()
+		if _, exists := c.contexts[name]; exists {
+			return fmt.Errorf("context %s already exists", name)
+		}
+		if err := moveFile(trashed, c.storePath(store, filename)); err != nil {
+			return fmt.Errorf("failed to restore context %s: %w", name, err)
+		}
+		c.contexts[name] = &ctx
+		return nil
+	}
+	return nil
+}
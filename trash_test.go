@@ -0,0 +1,139 @@
+package brunch
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCore_TrashAndRestore(t *testing.T) {
+	core := newTestCore(t)
+	run := func(stmt string) error {
+		return core.ExecuteStatement("s1", NewStatement(stmt))
+	}
+	require.NoError(t, run(`\new-provider "fast" :host "mock"`))
+	require.NoError(t, run(`\new-chat "a" :provider "fast"`))
+	require.NoError(t, run(`\new-ctx "docs" :dir "/tmp/docs"`))
+
+	require.NoError(t, run(`\del-chat "a"`))
+	require.NoError(t, run(`\del-provider "fast"`))
+	require.NoError(t, run(`\del-ctx "docs"`))
+	assert.NoFileExists(t, core.storePath(chatStoreDirectory, "a.json"))
+
+	items, err := core.Trash()
+	require.NoError(t, err)
+	assert.Len(t, items, 3)
+
+	// The chat needs its provider back before it can be used, both come back as they were
+	assert.Error(t, run(`\restore "a" :kind "provider"`))
+	assert.Error(t, run(`\restore "a" :kind "bucket"`))
+	require.NoError(t, run(`\restore "fast" :kind "provider"`))
+	require.NoError(t, run(`\restore "a" :kind "chat"`))
+	require.NoError(t, run(`\restore "docs" :kind "context"`))
+	assert.Error(t, run(`\restore "a" :kind "chat"`), "it is no longer in the trash")
+
+	require.NoError(t, run(`\chat "a"`))
+	_, err = core.GetActiveChat("a")
+	assert.NoError(t, err)
+	chats, err := core.onListChats()
+	require.NoError(t, err)
+	assert.Contains(t, chats, "a")
+	assert.Contains(t, core.contexts, "docs")
+
+	items, err = core.Trash()
+	require.NoError(t, err)
+	assert.Empty(t, items)
+}
+
+func TestCore_TrashRetention(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "old" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "new" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\del-chat "old"`)))
+
+	expireTrash(t, core, TrashKindChat, "old")
+
+	// What has been in the trash too long goes the next time something is trashed
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\del-chat "new"`)))
+	items, err := core.Trash()
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "new", items[0].Name)
+	assert.Equal(t, TrashKindChat, items[0].Kind)
+}
+
+func TestCore_TrashKeepsEveryDeletion(t *testing.T) {
+	core := newTestCore(t)
+	run := func(stmt string) error {
+		return core.ExecuteStatement("s1", NewStatement(stmt))
+	}
+	useProfile := func() bool {
+		content, err := core.LoadFromChatStore("a.json")
+		require.NoError(t, err)
+		snapshot, err := SnapshotFromJSON([]byte(content))
+		require.NoError(t, err)
+		return snapshot.UseProfile
+	}
+
+	// Replacing a name twice keeps both of the chats it replaced
+	require.NoError(t, run(`\new-chat "a" :provider "mock"`))
+	require.NoError(t, run(`\new-chat "a" :provider "mock" :profile true :overwrite true`))
+	require.NoError(t, run(`\new-chat "a" :provider "mock" :overwrite true`))
+	require.NoError(t, run(`\del-chat "a"`))
+	require.NoError(t, run(`\trash`))
+
+	items, err := core.Trash()
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	oldest := items[2]
+	assert.Equal(t, "a", oldest.Name)
+	assert.NotEqual(t, items[0].ID, oldest.ID)
+
+	// The most recently deleted comes back unless another is picked
+	require.NoError(t, run(`\restore "a" :kind "chat"`))
+	assert.False(t, useProfile())
+	require.NoError(t, run(`\del-chat "a"`))
+	assert.Error(t, run(`\restore "a" :kind "chat" :id "1"`))
+	require.NoError(t, run(fmt.Sprintf(`\restore "a" :kind "chat" :id "%s"`, items[1].ID)))
+	assert.True(t, useProfile())
+
+	items, err = core.Trash()
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.Equal(t, oldest, items[1])
+}
+
+// Make a name's copies in the trash look like they were deleted longer ago than the retention
+func expireTrash(t *testing.T, core *Core, kind string, name string) {
+	t.Helper()
+	items, err := core.Trash()
+	require.NoError(t, err)
+	expired := time.Now().Add(-DefaultTrashRetention - time.Hour)
+	store := trashKinds[kind]
+	for _, item := range items {
+		if item.Kind != kind || item.Name != name {
+			continue
+		}
+		require.NoError(t, os.Rename(core.trashPath(store, item.file), core.trashPath(store, trashFilename(name, expired))))
+		expired = expired.Add(-time.Second)
+	}
+}
+
+func TestTransaction_RollbackDelete(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "mock"`)))
+
+	err := core.ExecuteTransaction("s1", []*Statement{
+		NewStatement(`\del-chat "a"`),
+		NewStatement(`\chat "missing"`),
+	})
+	require.Error(t, err)
+	assert.FileExists(t, core.storePath(chatStoreDirectory, "a.json"))
+	items, err := core.Trash()
+	require.NoError(t, err)
+	assert.Empty(t, items, "the rolled back delete shouldn't leave a copy in the trash")
+}
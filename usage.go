@@ -0,0 +1,290 @@
+package brunch
+
+import (
+	"sort"
+	"sync"
+)
+
+// CallUsage counts the calls made for a chat and the tokens they moved
+type CallUsage struct {
+	Calls     int `json:"calls"`
+	Tokens    int `json:"tokens"`              // request and response, as the provider reported them
+	Estimated int `json:"estimated,omitempty"` // calls whose tokens the provider didn't report, they were estimated
+}
+
+func (cu *CallUsage) add(usage *TokenUsage) {
+	cu.Calls++
+	if usage == nil {
+		return
+	}
+	cu.Tokens += usage.InputTokens + usage.OutputTokens
+	if usage.Estimated {
+		cu.Estimated++
+	}
+}
+
+// ChatUsage splits what a chat has used between answering the user (main) and the auxiliary
+// work done around it (summaries, titles) so the cost of a companion model can be seen on its own.
+// Usage is counted while the chat is loaded and starts over when it is loaded again. What the
+// auxiliary work used is also kept with the chat by provider, so it is in the usage report
+// along with the messages of the tree
+type ChatUsage struct {
+	Main      CallUsage `json:"main"`
+	Auxiliary CallUsage `json:"auxiliary"`
+}
+
+type usageCounter struct {
+	mu        sync.Mutex
+	usage     ChatUsage
+	auxiliary map[string]UsageTotals // by the provider asked, saved with the chat
+}
+
+// Count a message pair that answered the user
+func (uc *usageCounter) addMain(mp *MessagePairNode) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.usage.Main.add(mp.Usage)
+}
+
+// Count an auxiliary call. The provider is empty when it isn't known (a summarizer that isn't
+// a provider of the chat), its usage is only counted while the chat is loaded
+func (uc *usageCounter) addAuxiliary(provider string, usage *TokenUsage) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.usage.Auxiliary.add(usage)
+	if provider == "" || usage == nil {
+		return
+	}
+	if uc.auxiliary == nil {
+		uc.auxiliary = map[string]UsageTotals{}
+	}
+	totals := uc.auxiliary[provider]
+	totals.add(usage)
+	uc.auxiliary[provider] = totals
+}
+
+// What the auxiliary work used by provider, for the snapshot
+func (uc *usageCounter) auxiliaryTotals() map[string]UsageTotals {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return copyUsage(uc.auxiliary)
+}
+
+func (uc *usageCounter) get() ChatUsage {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.usage
+}
+
+// The tokens a message took, as the provider reported them. Providers that don't report them
+// get an estimate, which is marked as such
+type TokenUsage struct {
+	InputTokens  int  `json:"input_tokens"`
+	OutputTokens int  `json:"output_tokens"`
+	Estimated    bool `json:"estimated,omitempty"`
+}
+
+// What a provider charges, in dollars per million tokens
+type TokenPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+func (p TokenPrice) cost(totals UsageTotals) float64 {
+	return (float64(totals.InputTokens)*p.Input + float64(totals.OutputTokens)*p.Output) / 1e6
+}
+
+// The tokens taken by a number of messages
+type UsageTotals struct {
+	Messages     int `json:"messages"`
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	Estimated    int `json:"estimated,omitempty"` // messages whose tokens were estimated
+}
+
+func (t *UsageTotals) add(usage *TokenUsage) {
+	t.Messages++
+	t.InputTokens += usage.InputTokens
+	t.OutputTokens += usage.OutputTokens
+	if usage.Estimated {
+		t.Estimated++
+	}
+}
+
+func (t *UsageTotals) merge(other UsageTotals) {
+	t.Messages += other.Messages
+	t.InputTokens += other.InputTokens
+	t.OutputTokens += other.OutputTokens
+	t.Estimated += other.Estimated
+}
+
+// The usage of a chat or provider and what it cost. Priced is false when some of it was
+// answered by a provider without a price (CoreOpts.Prices), the cost leaves that out
+type UsageEntry struct {
+	Name string `json:"name"`
+	UsageTotals
+	Cost   float64 `json:"cost"`
+	Priced bool    `json:"priced"`
+}
+
+// Everything the saved and loaded chats used, by chat and by the provider that answered
+type UsageReport struct {
+	Chats     []UsageEntry `json:"chats"`
+	Providers []UsageEntry `json:"providers"`
+	Total     UsageEntry   `json:"total"`
+}
+
+// Estimate what a message took when the provider didn't say. The request is the branch it was
+// sent with
+func estimateUsage(pair *MessagePairNode, parent Node, message string) {
+	if pair == nil || pair.Usage != nil {
+		return
+	}
+	response := ""
+	if pair.Assistant != nil {
+		response = pair.Assistant.UnencodedContent()
+	}
+	pair.Usage = &TokenUsage{
+		InputTokens:  estimateTokens(branchHistory(parent) + "\n" + message),
+		OutputTokens: estimateTokens(response),
+		Estimated:    true,
+	}
+}
+
+// What the tree used, by the provider that answered. Replaced answers (revisions) were paid
+// for too, they are put on the chat's provider
+func treeUsage(root Node, provider string) map[string]UsageTotals {
+	usage := map[string]UsageTotals{}
+	add := func(name string, tokens *TokenUsage) {
+		if tokens == nil {
+			return
+		}
+		totals := usage[name]
+		totals.add(tokens)
+		usage[name] = totals
+	}
+	for _, n := range MapTree(root) {
+		mp, ok := n.(*MessagePairNode)
+		if !ok {
+			continue
+		}
+		answeredBy := provider
+		if mp.AnsweredBy != "" {
+			answeredBy = mp.AnsweredBy
+		}
+		add(answeredBy, mp.Usage)
+		for _, revision := range mp.Revisions {
+			add(provider, revision.Usage)
+		}
+	}
+	if len(usage) == 0 {
+		return nil
+	}
+	return usage
+}
+
+func copyUsage(usage map[string]UsageTotals) map[string]UsageTotals {
+	if len(usage) == 0 {
+		return nil
+	}
+	copied := make(map[string]UsageTotals, len(usage))
+	for provider, totals := range usage {
+		copied[provider] = totals
+	}
+	return copied
+}
+
+// The usage of the tree with that of the auxiliary work added in
+func withAuxiliaryUsage(usage map[string]UsageTotals, auxiliary map[string]UsageTotals) map[string]UsageTotals {
+	if len(auxiliary) == 0 {
+		return usage
+	}
+	merged := copyUsage(usage)
+	if merged == nil {
+		merged = map[string]UsageTotals{}
+	}
+	for provider, totals := range auxiliary {
+		sum := merged[provider]
+		sum.merge(totals)
+		merged[provider] = sum
+	}
+	return merged
+}
+
+// The price of the provider, a derived provider without one of its own costs what its host does
+func (c *Core) priceOf(name string) (TokenPrice, bool) {
+	c.provMu.Lock()
+	defer c.provMu.Unlock()
+	for seen := map[string]bool{}; !seen[name]; {
+		seen[name] = true
+		if price, ok := c.prices[name]; ok {
+			return price, true
+		}
+		provider, exists := c.providers[name]
+		if !exists {
+			break
+		}
+		name = provider.Settings().Host
+	}
+	return TokenPrice{}, false
+}
+
+// Usage adds up the tokens every chat used, from the reference index for saved chats and from
+// the tree for the ones that are loaded, which may have messages that weren't saved yet. The
+// auxiliary work done for a chat is put on the provider that was asked for it
+func (c *Core) Usage() (UsageReport, error) {
+	byChat := map[string]map[string]UsageTotals{}
+	c.refs.mu.Lock()
+	if err := c.ensureReferenceIndex(""); err != nil {
+		c.refs.mu.Unlock()
+		return UsageReport{}, err
+	}
+	for name, refs := range c.refs.chats {
+		byChat[name] = withAuxiliaryUsage(refs.Usage, refs.AuxiliaryUsage)
+	}
+	c.refs.mu.Unlock()
+
+	c.chatMu.Lock()
+	for name, chat := range c.activeChats {
+		byChat[name] = withAuxiliaryUsage(treeUsage(&chat.root, chat.provider.Settings().Host), chat.usage.auxiliaryTotals())
+	}
+	c.chatMu.Unlock()
+
+	byProvider := map[string]UsageTotals{}
+	report := UsageReport{
+		Chats:     []UsageEntry{},
+		Providers: []UsageEntry{},
+		Total:     UsageEntry{Name: "total", Priced: true},
+	}
+	for name, usage := range byChat {
+		if len(usage) == 0 {
+			continue
+		}
+		entry := UsageEntry{Name: name, Priced: true}
+		for provider, totals := range usage {
+			entry.merge(totals)
+			if price, ok := c.priceOf(provider); ok {
+				entry.Cost += price.cost(totals)
+			} else {
+				entry.Priced = false
+			}
+			sum := byProvider[provider]
+			sum.merge(totals)
+			byProvider[provider] = sum
+		}
+		report.Chats = append(report.Chats, entry)
+	}
+	for provider, totals := range byProvider {
+		entry := UsageEntry{Name: provider, UsageTotals: totals}
+		if price, ok := c.priceOf(provider); ok {
+			entry.Cost, entry.Priced = price.cost(totals), true
+		}
+		report.Providers = append(report.Providers, entry)
+		report.Total.merge(totals)
+		report.Total.Cost += entry.Cost
+		report.Total.Priced = report.Total.Priced && entry.Priced
+	}
+	sort.Slice(report.Chats, func(i, j int) bool { return report.Chats[i].Name < report.Chats[j].Name })
+	sort.Slice(report.Providers, func(i, j int) bool { return report.Providers[i].Name < report.Providers[j].Name })
+	return report, nil
+}
@@ -0,0 +1,162 @@
+package brunch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Says what every answer took, like the anthropic provider does
+type meteredProvider struct {
+	*mockProvider
+}
+
+func (mp *meteredProvider) ExtendFrom(ctx context.Context, node Node) MessageCreator {
+	creator := mp.mockProvider.ExtendFrom(ctx, node)
+	return func(userMessage string) (*MessagePairNode, error) {
+		pair, err := creator(userMessage)
+		if err == nil {
+			pair.Usage = &TokenUsage{InputTokens: 1000, OutputTokens: 500}
+		}
+		return pair, err
+	}
+}
+
+func (mp *meteredProvider) CloneWithSettings(settings ProviderSettings) (Provider, error) {
+	return &meteredProvider{&mockProvider{settings: settings}}, nil
+}
+
+func TestChat_TokenUsage(t *testing.T) {
+	chat := newChatInstance(&meteredProvider{newMockProvider("metered")})
+	_, err := chat.SubmitMessage("hello")
+	require.NoError(t, err)
+	mp, err := chat.currentPair()
+	require.NoError(t, err)
+	assert.Equal(t, &TokenUsage{InputTokens: 1000, OutputTokens: 500}, mp.Usage)
+
+	// Providers that don't say get an estimate
+	chat = newChatInstance(newMockProvider("mock"))
+	_, err = chat.SubmitMessage("hello there")
+	require.NoError(t, err)
+	mp, err = chat.currentPair()
+	require.NoError(t, err)
+	require.NotNil(t, mp.Usage)
+	assert.True(t, mp.Usage.Estimated)
+	assert.Equal(t, estimateTokens("echo: hello there"), mp.Usage.OutputTokens)
+	assert.Positive(t, mp.Usage.InputTokens)
+
+	// A regenerated answer was still paid for, the revision keeps what it took
+	first := mp.Usage
+	_, err = chat.Regenerate()
+	require.NoError(t, err)
+	require.Len(t, mp.Revisions, 1)
+	assert.Equal(t, first, mp.Revisions[0].Usage)
+	assert.NotNil(t, mp.Usage)
+
+	// And it is kept with the tree
+	data, err := marshalNode(&chat.root)
+	require.NoError(t, err)
+	root, err := unmarshalNode(data)
+	require.NoError(t, err)
+	usage := treeUsage(root, "mock")
+	assert.Equal(t, 2, usage["mock"].Messages)
+	assert.Equal(t, 2, usage["mock"].Estimated)
+}
+
+func TestCore_Usage(t *testing.T) {
+	core := newTestCore(t)
+	core.AddProvider("metered", &meteredProvider{newMockProvider("metered")})
+	core.prices = map[string]TokenPrice{"metered": {Input: 3, Output: 15}}
+
+	for _, name := range []string{"a", "b"} {
+		require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "`+name+`" :provider "metered"`)))
+		require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "`+name+`"`)))
+		chat, err := core.GetActiveChat(name)
+		require.NoError(t, err)
+		_, err = chat.SubmitMessage("hello")
+		require.NoError(t, err)
+		require.NoError(t, core.SaveActiveChat("s1"))
+	}
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "c" :provider "mock"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "c"`)))
+	chat, err := core.GetActiveChat("c")
+	require.NoError(t, err)
+	_, err = chat.SubmitMessage("hello")
+	require.NoError(t, err)
+
+	var reported UsageReport
+	core.infoHandler.OnUsage = func(report UsageReport) { reported = report }
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\usage`)))
+
+	require.Len(t, reported.Chats, 3)
+	assert.Equal(t, "a", reported.Chats[0].Name)
+	assert.InDelta(t, 0.0105, reported.Chats[0].Cost, 1e-9)
+	assert.True(t, reported.Chats[0].Priced)
+	assert.False(t, reported.Chats[2].Priced, "the mock has no price")
+	assert.Equal(t, 1, reported.Chats[2].Estimated)
+
+	require.Len(t, reported.Providers, 2)
+	assert.Equal(t, "metered", reported.Providers[0].Name)
+	assert.Equal(t, 2, reported.Providers[0].Messages)
+	assert.Equal(t, 2000, reported.Providers[0].InputTokens)
+	assert.InDelta(t, 0.021, reported.Providers[0].Cost, 1e-9)
+	assert.Equal(t, 3, reported.Total.Messages)
+	assert.False(t, reported.Total.Priced)
+
+	// Saved chats are counted from the index, without loading them
+	restarted := NewCore(CoreOpts{
+		InstallDirectory: core.installDirectory,
+		BaseProviders:    map[string]Provider{"metered": &meteredProvider{newMockProvider("metered")}},
+		InfoHandler:      core.infoHandler,
+		Prices:           core.prices,
+	})
+	report, err := restarted.Usage()
+	require.NoError(t, err)
+	require.Len(t, report.Chats, 2)
+	assert.Equal(t, reported.Providers[0], report.Providers[0])
+	assert.True(t, report.Total.Priced)
+}
+
+func TestCore_AuxiliaryUsage(t *testing.T) {
+	core := newTestCore(t)
+	core.AddProvider("metered", &meteredProvider{newMockProvider("metered")})
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "a" :provider "metered"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\chat "a"`)))
+	chat, err := core.GetActiveChat("a")
+	require.NoError(t, err)
+	_, err = chat.SubmitMessage("hello")
+	require.NoError(t, err)
+
+	// The summary is counted with what the provider said it used
+	_, err = chat.Summarize(SummaryForTitle)
+	require.NoError(t, err)
+	assert.Equal(t, ChatUsage{
+		Main:      CallUsage{Calls: 1, Tokens: 1500},
+		Auxiliary: CallUsage{Calls: 1, Tokens: 1500},
+	}, chat.Usage())
+
+	// A summarizer that isn't one of the chat's providers is estimated, and not reported
+	chat.SetSummarizer(&fixedSummarizer{})
+	_, err = chat.Summarize(SummaryForTitle)
+	require.NoError(t, err)
+	assert.Equal(t, 2, chat.Usage().Auxiliary.Calls)
+	assert.Equal(t, 1, chat.Usage().Auxiliary.Estimated)
+
+	report, err := core.Usage()
+	require.NoError(t, err)
+	require.Len(t, report.Providers, 1)
+	assert.Equal(t, UsageTotals{Messages: 2, InputTokens: 2000, OutputTokens: 1000}, report.Providers[0].UsageTotals)
+
+	// It is saved with the chat, and counted from the index
+	require.NoError(t, core.SaveActiveChat("s1"))
+	restarted := NewCore(CoreOpts{
+		InstallDirectory: core.installDirectory,
+		BaseProviders:    map[string]Provider{"metered": &meteredProvider{newMockProvider("metered")}},
+		InfoHandler:      core.infoHandler,
+	})
+	saved, err := restarted.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, report.Providers, saved.Providers)
+}
@@ -3,6 +3,7 @@ package brunch
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 func contentPreview(content string) string {
@@ -14,6 +15,22 @@ func contentPreview(content string) string {
 
 func PrettyPrint(node Node, indent string, isLastChild bool) string {
 	var sb strings.Builder
+	prettyPrintTo(&sb, node, indent, isLastChild)
+	return sb.String()
+}
+
+// Everything is written into the one builder. Returning a string from each level and
+// appending it to the parent's copies the deep parts of the tree once per level above them
+func prettyPrintTo(sb *strings.Builder, node Node, indent string, isLastChild bool) {
+	childIndent := writeNode(sb, node, indent, isLastChild)
+	children := nodeChildren(node)
+	for i, child := range children {
+		prettyPrintTo(sb, child, childIndent, i == len(children)-1)
+	}
+}
+
+// Write the lines for the node itself and return the indent its children are written at
+func writeNode(sb *strings.Builder, node Node, indent string, isLastChild bool) string {
 	nodeIndent := indent
 	if !isLastChild {
 		nodeIndent = indent + "│"
@@ -21,56 +38,357 @@ func PrettyPrint(node Node, indent string, isLastChild bool) string {
 
 	switch n := node.(type) {
 	case *RootNode:
-		sb.WriteString(fmt.Sprintf("%s[ROOT] Provider: %s, Model: %s\n", nodeIndent, n.Provider, n.Model))
-		sb.WriteString(fmt.Sprintf("%s├── Temperature: %.2f\n", nodeIndent, n.Temperature))
-		sb.WriteString(fmt.Sprintf("%s├── MaxTokens: %d\n", nodeIndent, n.MaxTokens))
-		sb.WriteString(fmt.Sprintf("%s└── Hash: %s\n", nodeIndent, n.Hash()))
-		if len(n.Children) > 0 {
-			for i, child := range n.Children {
-				isLast := i == len(n.Children)-1
-				childIndent := nodeIndent + "    "
-				sb.WriteString(PrettyPrint(child, childIndent, isLast))
-			}
+		fmt.Fprintf(sb, "%s[ROOT] Provider: %s, Model: %s\n", nodeIndent, n.Provider, n.Model)
+		for _, detail := range nodeDetails(n) {
+			fmt.Fprintf(sb, "%s├── %s\n", nodeIndent, detail)
 		}
+		fmt.Fprintf(sb, "%s└── Hash: %s\n", nodeIndent, n.Hash())
 
 	case *MessagePairNode:
 		prefix := "├──"
 		if isLastChild {
 			prefix = "└──"
 		}
-		sb.WriteString(fmt.Sprintf("%s%s [MESSAGE_PAIR] Time: %s\n", nodeIndent, prefix, n.Time.Format("2006-01-02 15:04:05")))
+		label := "MESSAGE_PAIR"
+		if n.Annotation != nil {
+			label = strings.ToUpper(string(n.Annotation.Kind))
+			if n.Annotation.InHistory {
+				label += ", SENT"
+			}
+		}
+		fmt.Fprintf(sb, "%s%s [%s] Time: %s\n", nodeIndent, prefix, label, n.Time.Format("2006-01-02 15:04:05"))
+		for _, detail := range nodeDetails(n) {
+			fmt.Fprintf(sb, "%s    ├── %s\n", nodeIndent, detail)
+		}
+		fmt.Fprintf(sb, "%s    └── Hash: %s\n", nodeIndent, n.Hash())
+	}
+	return nodeIndent + "    "
+}
+
+// The same node without box-drawing glyphs, for screen readers and files. The node says where it
+// is (which child of which parent) instead of the lines around it showing it, and everything is
+// indented with plain spaces
+func writePlainNode(sb *strings.Builder, node Node, indent string) string {
+	detailIndent := indent + "  "
+	switch n := node.(type) {
+	case *RootNode:
+		fmt.Fprintf(sb, "%sRoot, provider %s, model %s\n", indent, n.Provider, n.Model)
+	case *MessagePairNode:
+		label := "Message"
+		if n.Annotation != nil {
+			label = fmt.Sprintf("Annotation (%s", n.Annotation.Kind)
+			if n.Annotation.InHistory {
+				label += ", sent"
+			}
+			label += ")"
+		}
+		siblings := nodeChildren(n.Parent)
+		position := 1
+		for i, sibling := range siblings {
+			if sibling == Node(n) {
+				position = i + 1
+			}
+		}
+		parent := "the root"
+		if _, isRoot := n.Parent.(*RootNode); !isRoot && n.Parent != nil {
+			parent = "node " + ShortHash(n.Parent.Hash())
+		}
+		fmt.Fprintf(sb, "%s%s, child %d of %d of %s, time %s\n", indent, label, position, max(len(siblings), 1),
+			parent, n.Time.Format("2006-01-02 15:04:05"))
+	default:
+		return detailIndent
+	}
+	for _, detail := range nodeDetails(node) {
+		fmt.Fprintf(sb, "%s%s\n", detailIndent, detail)
+	}
+	fmt.Fprintf(sb, "%sHash: %s\n", detailIndent, node.Hash())
+	if children := len(nodeChildren(node)); children > 0 {
+		fmt.Fprintf(sb, "%sChildren: %d\n", detailIndent, children)
+	}
+	return detailIndent
+}
+
+// ShortHash is the start of a node's hash that is shown for it. Goto takes it in place of the
+// whole hash as long as no other node starts the same
+func ShortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+// What is printed about a node, other than its heading and hash
+func nodeDetails(node Node) []string {
+	details := []string{}
+	switch n := node.(type) {
+	case *RootNode:
+		details = append(details,
+			fmt.Sprintf("Temperature: %.2f", n.Temperature),
+			fmt.Sprintf("MaxTokens: %d", n.MaxTokens))
+
+	case *MessagePairNode:
+		if n.Annotation != nil {
+			details = append(details, contentPreview(n.Annotation.Content))
+			break
+		}
 		if n.User != nil {
+			details = append(details, fmt.Sprintf("User (%s): %s", n.User.Role, contentPreview(n.User.UnencodedContent())))
 			if len(n.User.Images) > 0 {
-				sb.WriteString(fmt.Sprintf("%s    ├── User (%s): %s\n", nodeIndent, n.User.Role, contentPreview(n.User.UnencodedContent())))
-				sb.WriteString(fmt.Sprintf("%s    ├── User Images: %s\n", nodeIndent, strings.Join(n.User.Images, ", ")))
-			} else {
-				sb.WriteString(fmt.Sprintf("%s    ├── User (%s): %s\n", nodeIndent, n.User.Role, contentPreview(n.User.UnencodedContent())))
+				details = append(details, fmt.Sprintf("User Images: %s", strings.Join(n.User.Images, ", ")))
 			}
 		}
 		if n.Assistant != nil {
+			details = append(details, fmt.Sprintf("Assistant (%s): %s", n.Assistant.Role, contentPreview(n.Assistant.UnencodedContent())))
 			if len(n.Assistant.Images) > 0 {
-				sb.WriteString(fmt.Sprintf("%s    ├── Assistant (%s): %s\n", nodeIndent, n.Assistant.Role, contentPreview(n.Assistant.UnencodedContent())))
-				sb.WriteString(fmt.Sprintf("%s    ├── Assistant Images: %s\n", nodeIndent, strings.Join(n.Assistant.Images, ", ")))
-			} else {
-				sb.WriteString(fmt.Sprintf("%s    ├── Assistant (%s): %s\n", nodeIndent, n.Assistant.Role, contentPreview(n.Assistant.UnencodedContent())))
+				details = append(details, fmt.Sprintf("Assistant Images: %s", strings.Join(n.Assistant.Images, ", ")))
 			}
 		}
-		sb.WriteString(fmt.Sprintf("%s    └── Hash: %s\n", nodeIndent, n.Hash()))
-		if len(n.Children) > 0 {
-			for i, child := range n.Children {
-				isLast := i == len(n.Children)-1
-				childIndent := nodeIndent + "    "
-				sb.WriteString(PrettyPrint(child, childIndent, isLast))
+		if n.AnsweredBy != "" {
+			details = append(details, fmt.Sprintf("Answered by fallback: %s", n.AnsweredBy))
+		}
+		if n.Usage != nil {
+			estimated := ""
+			if n.Usage.Estimated {
+				estimated = " (estimated)"
 			}
+			details = append(details, fmt.Sprintf("Tokens: %d in, %d out%s", n.Usage.InputTokens, n.Usage.OutputTokens, estimated))
+		}
+		if n.Response != nil {
+			details = append(details, fmt.Sprintf("Response: %s (model %s, stopped: %s)", n.Response.ID, n.Response.Model, n.Response.StopReason))
+		}
+		if len(n.Revisions) > 0 {
+			details = append(details, fmt.Sprintf("Revisions: %d", len(n.Revisions)))
+		}
+		if n.Chunked != nil {
+			details = append(details, fmt.Sprintf("Chunked: %d parts", n.Chunked.Parts))
+		}
+		if n.ChunkStep != nil {
+			details = append(details, fmt.Sprintf("Notes on part %d of %d", n.ChunkStep.Part, n.ChunkStep.Parts))
+		}
+		for _, call := range n.ToolCalls {
+			details = append(details, fmt.Sprintf("Tool %s: %s", call.Name, contentPreview(string(call.Input))))
 		}
 	}
-	return sb.String()
+	if holder, ok := treeNode(node); ok && len(holder.Pending) > 0 {
+		details = append(details, fmt.Sprintf("Pending: %d messages waiting to be sent", len(holder.Pending)))
+	}
+	return details
+}
+
+func nodeChildren(node Node) []Node {
+	switch n := node.(type) {
+	case *RootNode:
+		return n.Children
+	case *MessagePairNode:
+		return n.Children
+	}
+	return nil
+}
+
+func nodeParent(node Node) Node {
+	if n, ok := node.(*MessagePairNode); ok {
+		return n.Parent
+	}
+	return nil
+}
+
+// Count the nodes under (not including) the given node
+func countDescendants(node Node) int {
+	count := 0
+	for _, child := range nodeChildren(node) {
+		count += 1 + countDescendants(child)
+	}
+	return count
+}
+
+// TreePrintOpts limits how much of a tree is printed so big conversations stay readable.
+// Zero values mean no limit
+type TreePrintOpts struct {
+	MaxDepth int  // levels printed below the starting node
+	Limit    int  // total nodes printed, the rest of the tree is summarized
+	PageSize int  // nodes per page, with everything on one page when not set
+	Plain    bool // no box-drawing glyphs, each node says which child of which parent it is
+}
+
+type treePrinter struct {
+	opts    TreePrintOpts
+	pages   []string
+	page    strings.Builder
+	onPage  int
+	printed int
+}
+
+// Nodes are kept whole on a page, a page break never splits a node's lines
+func (p *treePrinter) writeNode(node Node, indent string, isLastChild bool) string {
+	if p.opts.PageSize > 0 && p.onPage == p.opts.PageSize {
+		p.breakPage()
+	}
+	p.onPage++
+	p.printed++
+	if p.opts.Plain {
+		return writePlainNode(&p.page, node, indent)
+	}
+	return writeNode(&p.page, node, indent, isLastChild)
+}
+
+// A line about nodes that aren't printed, hung off of the node above it like a child
+func (p *treePrinter) elided(indent string, last bool, format string, args ...interface{}) {
+	branch := "├── "
+	if last {
+		branch = "└── "
+	}
+	if p.opts.Plain {
+		branch = ""
+	}
+	fmt.Fprintf(&p.page, "%s%s... %s\n", indent, branch, fmt.Sprintf(format, args...))
+}
+
+func (p *treePrinter) breakPage() {
+	p.pages = append(p.pages, p.page.String())
+	p.page.Reset()
+	p.onPage = 0
+}
+
+func (p *treePrinter) limitReached() bool {
+	return p.opts.Limit > 0 && p.printed >= p.opts.Limit
+}
+
+// Print the subtree, returning the number of nodes that were left out because of the limit
+func (p *treePrinter) subtree(node Node, indent string, isLastChild bool, depth int) int {
+	if p.limitReached() {
+		return 1 + countDescendants(node)
+	}
+	childIndent := p.writeNode(node, indent, isLastChild)
+	children := nodeChildren(node)
+	if len(children) == 0 {
+		return 0
+	}
+	if p.opts.MaxDepth > 0 && depth >= p.opts.MaxDepth {
+		p.elided(childIndent, true, "%d more nodes below", countDescendants(node))
+		return 0
+	}
+	skipped := 0
+	for i, child := range children {
+		skipped += p.subtree(child, childIndent, i == len(children)-1, depth+1)
+	}
+	return skipped
+}
+
+func (p *treePrinter) finish(skipped int) []string {
+	if skipped > 0 {
+		fmt.Fprintf(&p.page, "... stopped after %d nodes, %d more not shown\n", p.printed, skipped)
+	}
+	if p.page.Len() > 0 || len(p.pages) == 0 {
+		p.breakPage()
+	}
+	return p.pages
+}
+
+// PrintTreePages prints the tree under (and including) the node within the limits of the options,
+// split into pages of opts.PageSize nodes
+func PrintTreePages(node Node, opts TreePrintOpts) []string {
+	p := &treePrinter{opts: opts}
+	if node == nil {
+		return p.finish(0)
+	}
+	return p.finish(p.subtree(node, "", true, 0))
+}
+
+// PrintBranchPages prints the branch around the current node: the `around` nodes above it
+// (without the branches that split off of them) and the tree under it down to `around` levels.
+// The depth of the options is replaced by `around`, so an `around` of 0 prints the current node
+// and everything under it
+func PrintBranchPages(current Node, around int, opts TreePrintOpts) []string {
+	opts.MaxDepth = around
+	p := &treePrinter{opts: opts}
+	if current == nil {
+		return p.finish(0)
+	}
+
+	ancestors := []Node{}
+	top := current
+	for len(ancestors) < around {
+		parent := nodeParent(top)
+		if parent == nil {
+			break
+		}
+		ancestors = append(ancestors, parent)
+		top = parent
+	}
+	if above := countAbove(top); above > 0 {
+		fmt.Fprintf(&p.page, "... %d earlier nodes on this branch\n", above)
+	}
+
+	indent := ""
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		indent = p.writeNode(ancestors[i], indent, true)
+		if others := len(nodeChildren(ancestors[i])) - 1; others > 0 {
+			p.elided(indent, false, "%d other branches", others)
+		}
+	}
+	return p.finish(p.subtree(current, indent, true, 0))
+}
+
+func countAbove(node Node) int {
+	count := 0
+	for parent := nodeParent(node); parent != nil; parent = nodeParent(parent) {
+		count++
+	}
+	return count
 }
 
 func PrintTree(node Node) string {
 	return PrettyPrint(node, "", true)
 }
 
+// PrintTreeSince prints only the parts of the tree with activity at or after the given time.
+// Older nodes leading to recent ones are kept so the recent ones have their place in the tree,
+// branches with nothing recent in them are counted instead of printed
+func PrintTreeSince(node Node, since time.Time) string {
+	if node == nil {
+		return ""
+	}
+	latest := map[Node]time.Time{}
+	lastActivity(node, latest)
+	if latest[node].Before(since) {
+		return fmt.Sprintf("no activity since %s\n", since.Format("2006-01-02 15:04:05"))
+	}
+	var sb strings.Builder
+	printSinceTo(&sb, node, "", true, since, latest)
+	return sb.String()
+}
+
+// The time of the most recent message at or under every node
+func lastActivity(node Node, latest map[Node]time.Time) time.Time {
+	var last time.Time
+	if mp, ok := node.(*MessagePairNode); ok {
+		last = mp.Time
+	}
+	for _, child := range nodeChildren(node) {
+		if childLast := lastActivity(child, latest); childLast.After(last) {
+			last = childLast
+		}
+	}
+	latest[node] = last
+	return last
+}
+
+func printSinceTo(sb *strings.Builder, node Node, indent string, isLastChild bool, since time.Time, latest map[Node]time.Time) {
+	childIndent := writeNode(sb, node, indent, isLastChild)
+	recent := []Node{}
+	for _, child := range nodeChildren(node) {
+		if !latest[child].Before(since) {
+			recent = append(recent, child)
+		}
+	}
+	if older := len(nodeChildren(node)) - len(recent); older > 0 {
+		fmt.Fprintf(sb, "%s├── ... %d branches with no recent activity\n", childIndent, older)
+	}
+	for i, child := range recent {
+		printSinceTo(sb, child, childIndent, i == len(recent)-1, since, latest)
+	}
+}
+
 func messageToString(message *MessageData) string {
 	return fmt.Sprintf("%s: %s", message.Role, message.UnencodedContent())
 }
@@ -79,37 +397,31 @@ func messageToStringWithImages(message *MessageData, images []string) string {
 	return fmt.Sprintf("%s: %s [%d images]: %s", message.Role, message.UnencodedContent(), len(images), strings.Join(images, ", "))
 }
 
-// todo: make this not so bad
+// MapTree maps the hash of every node in the tree under (and including) the given node
 func MapTree(node Node) map[string]Node {
 	if node == nil {
 		return nil
 	}
-
 	tree := make(map[string]Node)
+	mapTreeInto(tree, node)
+	return tree
+}
 
+// Walk the tree filling the one map, merging a map per subtree copies deep nodes once per level
+func mapTreeInto(tree map[string]Node, node Node) {
 	// Add the current node to the map
-	hash := node.Hash()
-	if hash != "" {
+	if hash := node.Hash(); hash != "" {
 		tree[hash] = node
 	}
 
-	// Recursively map children based on node type
 	switch n := node.(type) {
 	case *RootNode:
 		for _, child := range n.Children {
-			childMap := MapTree(child)
-			for k, v := range childMap {
-				tree[k] = v
-			}
+			mapTreeInto(tree, child)
 		}
 	case *MessagePairNode:
 		for _, child := range n.Children {
-			childMap := MapTree(child)
-			for k, v := range childMap {
-				tree[k] = v
-			}
+			mapTreeInto(tree, child)
 		}
 	}
-
-	return tree
 }
@@ -0,0 +1,163 @@
+package brunch
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func countPrintedNodes(pages []string) int {
+	count := 0
+	for _, page := range pages {
+		count += strings.Count(page, "[ROOT]") + strings.Count(page, "[MESSAGE_PAIR]")
+	}
+	return count
+}
+
+func TestPrintTreePages(t *testing.T) {
+	root := syntheticTree(30, 3)
+
+	all := PrintTreePages(root, TreePrintOpts{})
+	if len(all) != 1 || all[0] != PrintTree(root) {
+		t.Fatal("printing without limits should match PrintTree")
+	}
+
+	pages := PrintTreePages(root, TreePrintOpts{PageSize: 10})
+	if len(pages) != 4 {
+		t.Fatalf("expected 4 pages for 31 nodes, got %d", len(pages))
+	}
+	if strings.Join(pages, "") != PrintTree(root) {
+		t.Error("pages should add up to the whole tree")
+	}
+	for i, page := range pages[:3] {
+		if n := countPrintedNodes([]string{page}); n != 10 {
+			t.Errorf("page %d has %d nodes", i, n)
+		}
+	}
+
+	// The root with 3 children, each with 3 children
+	shallow := PrintTreePages(root, TreePrintOpts{MaxDepth: 2})
+	if n := countPrintedNodes(shallow); n != 13 {
+		t.Errorf("expected 13 nodes at depth 2, got %d", n)
+	}
+	if !strings.Contains(shallow[0], "more nodes below") {
+		t.Error("cut off subtrees should be summarized")
+	}
+
+	limited := PrintTreePages(root, TreePrintOpts{Limit: 5})
+	if n := countPrintedNodes(limited); n != 5 {
+		t.Errorf("expected 5 nodes with a limit, got %d", n)
+	}
+	if !strings.Contains(limited[0], "stopped after 5 nodes, 26 more not shown") {
+		t.Errorf("limit should report what was left out:\n%s", limited[0])
+	}
+}
+
+func TestPrintBranchPages(t *testing.T) {
+	root := syntheticTree(20, 1)
+
+	// Walk down the chain to the middle
+	var current Node = root
+	for i := 0; i < 10; i++ {
+		current = nodeChildren(current)[0]
+	}
+
+	pages := PrintBranchPages(current, 2, TreePrintOpts{})
+	if n := countPrintedNodes(pages); n != 5 {
+		t.Errorf("expected the current node with 2 above and below, got %d nodes", n)
+	}
+	if !strings.Contains(pages[0], "... 8 earlier nodes on this branch") {
+		t.Errorf("nodes above the window should be summarized:\n%s", pages[0])
+	}
+	if !strings.Contains(pages[0], current.Hash()) {
+		t.Error("the current node should be printed")
+	}
+
+	// Near the root there is nothing above to summarize
+	pages = PrintBranchPages(nodeChildren(root)[0], 3, TreePrintOpts{})
+	if strings.Contains(pages[0], "earlier nodes") || !strings.Contains(pages[0], "[ROOT]") {
+		t.Errorf("window should start at the root:\n%s", pages[0])
+	}
+
+	// Siblings of the branch are summarized rather than printed
+	wide := syntheticTree(12, 3)
+	leaf := nodeChildren(nodeChildren(wide)[0])[0]
+	pages = PrintBranchPages(leaf, 2, TreePrintOpts{})
+	if n := countPrintedNodes(pages); n != 3 {
+		t.Errorf("expected only the branch to be printed, got %d nodes", n)
+	}
+	if strings.Count(pages[0], "... 2 other branches") != 2 {
+		t.Errorf("expected both ancestors to summarize their other branches:\n%s", pages[0])
+	}
+}
+
+func TestPrintTreeSince(t *testing.T) {
+	now := time.Now()
+	root := NewRootNode(RootOpt{Provider: "mock"})
+	add := func(parent Node, content string, at time.Time) *MessagePairNode {
+		pair := NewMessagePairNode(parent)
+		pair.Time = at
+		pair.User = NewMessageData("user", content)
+		pair.Assistant = NewMessageData("assistant", content)
+		switch p := parent.(type) {
+		case *RootNode:
+			p.AddChild(pair)
+		case *MessagePairNode:
+			p.AddChild(pair)
+		}
+		return pair
+	}
+	old := now.Add(-30 * 24 * time.Hour)
+	kept := add(root, "old but continued", old)
+	add(kept, "recent reply", now)
+	stale := add(root, "stale", old)
+	add(stale, "also stale", old)
+	add(root, "recent start", now)
+
+	printed := PrintTreeSince(root, now.Add(-48*time.Hour))
+	if n := countPrintedNodes([]string{printed}); n != 4 {
+		t.Errorf("expected the root, the recent nodes and the old node leading to one, got %d:\n%s", n, printed)
+	}
+	if strings.Contains(printed, "stale") {
+		t.Errorf("branches without recent activity should not be printed:\n%s", printed)
+	}
+	if !strings.Contains(printed, "... 1 branches with no recent activity") {
+		t.Errorf("left out branches should be counted:\n%s", printed)
+	}
+
+	if printed := PrintTreeSince(root, now.Add(time.Hour)); !strings.HasPrefix(printed, "no activity since") {
+		t.Errorf("expected nothing to be printed:\n%s", printed)
+	}
+	if PrintTreeSince(root, old.Add(-time.Hour)) != PrintTree(root) {
+		t.Error("everything is recent enough, it should match PrintTree")
+	}
+}
+
+func TestPrintTreePlain(t *testing.T) {
+	root := syntheticTree(4, 2)
+	plain := PrintTreePages(root, TreePrintOpts{Plain: true})
+	if len(plain) != 1 {
+		t.Fatalf("expected one page, got %d", len(plain))
+	}
+	if strings.ContainsAny(plain[0], "│├└─") {
+		t.Errorf("plain tree has box-drawing glyphs:\n%s", plain[0])
+	}
+
+	first := nodeChildren(root)[0]
+	for _, want := range []string{
+		"Root, provider bench, model bench-model\n  Temperature: 0.50\n",
+		"\n  Message, child 2 of 2 of the root, time 2024-01-01 00:00:01\n    User (user): question number 1",
+		"\n    Message, child 1 of 2 of node " + first.Hash()[:8],
+		"\n  Children: 2\n",
+	} {
+		if !strings.Contains(plain[0], want) {
+			t.Errorf("plain tree is missing %q:\n%s", want, plain[0])
+		}
+	}
+
+	// The limits work the same way, only without the glyphs
+	limited := PrintTreePages(root, TreePrintOpts{Plain: true, MaxDepth: 1})
+	if !strings.Contains(limited[0], "    ... 2 more nodes below\n") || strings.Contains(limited[0], "└") {
+		t.Errorf("elided nodes should be noted without glyphs:\n%s", limited[0])
+	}
+}
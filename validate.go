@@ -0,0 +1,275 @@
+package brunch
+
+import (
+	"fmt"
+	"os"
+)
+
+// The validator walks statements through the same session logic that executes them, but the
+// callbacks only check the names against what the core has (or what earlier statements in the
+// same batch would have created). Nothing is written and no chat is started
+type statementValidator struct {
+	core *Core
+
+	// Things created or deleted by statements earlier in the batch
+	providers map[string]bool
+	chats     map[string]bool
+	contexts  map[string]bool
+}
+
+func newStatementValidator(c *Core) *statementValidator {
+	return &statementValidator{
+		core:      c,
+		providers: map[string]bool{},
+		chats:     map[string]bool{},
+		contexts:  map[string]bool{},
+	}
+}
+
+// ValidateStatement checks that the statement parses, that its properties are valid, and that the
+// providers, chats and contexts it refers to exist (or don't, if it creates them) without executing it
+func (c *Core) ValidateStatement(stmt *Statement) error {
+	if stmt == nil {
+		return fmt.Errorf("statement is required")
+	}
+	return newStatementValidator(c).validate(stmt)
+}
+
+// ValidateStatements checks a batch of statements (like a setup script) in order. Statements may
+// refer to things that earlier statements in the batch create. The first failure is returned
+// along with the index of the statement it came from
+func (c *Core) ValidateStatements(stmts []*Statement) error {
+	v := newStatementValidator(c)
+	for idx, stmt := range stmts {
+		if stmt == nil {
+			return fmt.Errorf("statement %d: statement is required", idx)
+		}
+		if err := v.validate(stmt); err != nil {
+			return fmt.Errorf("statement %d: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+func (v *statementValidator) validate(stmt *Statement) error {
+	// Throwaway session so the history of real sessions isn't touched
+	session := &coreSession{history: []string{}}
+	return session.execute(stmt, v.callbacks())
+}
+
+func (v *statementValidator) callbacks() OperationalCallback {
+	noop := func() error { return nil }
+	return OperationalCallback{
+		OnNewProvider: func(provider ProviderStatement) error {
+			if v.providerExists(provider.Name) {
+				return fmt.Errorf("provider [%s] already exists", provider.Name)
+			}
+			if !v.providerExists(provider.Host) {
+				return fmt.Errorf("host provider (base provider) [%s] does not exist", provider.Host)
+			}
+			if provider.Companion != "" && !v.providerExists(provider.Companion) {
+				return fmt.Errorf("companion provider [%s] does not exist", provider.Companion)
+			}
+			if err := validateFallbacks(provider.Name, provider.Fallbacks, v.providerExists); err != nil {
+				return err
+			}
+			if err := ValidatePostProcessors(provider.PostProcess); err != nil {
+				return err
+			}
+			if err := ValidateContextWindow(provider.Window); err != nil {
+				return err
+			}
+			if err := ValidateRateLimit(provider.RateLimit); err != nil {
+				return err
+			}
+			v.providers[provider.Name] = true
+			return nil
+		},
+		OnNewChat: func(name string, provider string, useProfile bool, overwrite bool) error {
+			if v.chatExists(name) && !overwrite {
+				return fmt.Errorf("chat %s already exists, give :overwrite true to replace it", name)
+			}
+			if !v.providerExists(provider) {
+				return fmt.Errorf("provider [%s] not found", provider)
+			}
+			v.chats[name] = true
+			return nil
+		},
+		OnNewContext: func(name string, dir *string, database *string, web *string) error {
+			if v.contextExists(name) {
+				return fmt.Errorf("context %s already exists", name)
+			}
+			v.contexts[name] = true
+			return nil
+		},
+		OnLoadChat: func(name string, hash *string) error {
+			if !v.chatExists(name) {
+				return fmt.Errorf("chat %s does not exist", name)
+			}
+			return nil
+		},
+		OnDeleteChat: func(name string) error {
+			if !v.chatExists(name) {
+				return fmt.Errorf("chat %s does not exist", name)
+			}
+			v.chats[name] = false
+			return nil
+		},
+		OnDeleteContext: func(name string) error {
+			if !v.contextExists(name) {
+				return fmt.Errorf("context %s does not exist", name)
+			}
+			v.contexts[name] = false
+			return nil
+		},
+		OnDeleteProvider: func(name string) error {
+			if !v.providerExists(name) {
+				return fmt.Errorf("provider %s does not exist", name)
+			}
+			v.core.provMu.Lock()
+			_, isBase := v.core.baseProviders[name]
+			v.core.provMu.Unlock()
+			if isBase {
+				return fmt.Errorf("cannot delete base provider %s", name)
+			}
+			v.providers[name] = false
+			return nil
+		},
+		OnRenameContext: func(name string, newName string) error {
+			if !v.contextExists(name) {
+				return fmt.Errorf("context %s does not exist", name)
+			}
+			if v.contextExists(newName) {
+				return fmt.Errorf("context %s already exists", newName)
+			}
+			v.contexts[name] = false
+			v.contexts[newName] = true
+			return nil
+		},
+		OnRenameProvider: func(name string, newName string) error {
+			if !v.providerExists(name) {
+				return fmt.Errorf("provider %s does not exist", name)
+			}
+			v.core.provMu.Lock()
+			_, isBase := v.core.baseProviders[name]
+			v.core.provMu.Unlock()
+			if isBase {
+				return fmt.Errorf("cannot rename base provider %s", name)
+			}
+			if v.providerExists(newName) {
+				return fmt.Errorf("provider [%s] already exists", newName)
+			}
+			v.providers[name] = false
+			v.providers[newName] = true
+			return nil
+		},
+		// The branch that is forked depends on the session, so only the new name is checked
+		OnFork: func(name string) error {
+			if v.chatExists(name) {
+				return fmt.Errorf("chat %s already exists", name)
+			}
+			v.chats[name] = true
+			return nil
+		},
+		// The transcript is only parsed when the statement is executed
+		OnImportMarkdown: func(name string, provider string, file string) error {
+			if v.chatExists(name) {
+				return fmt.Errorf("chat %s already exists", name)
+			}
+			if !v.providerExists(provider) {
+				return fmt.Errorf("provider [%s] not found", provider)
+			}
+			v.chats[name] = true
+			return nil
+		},
+		// Whether it is in the trash is only known when the statement is executed
+		OnRestore: func(name string, kind string, id string) error {
+			var exists bool
+			switch kind {
+			case TrashKindChat:
+				exists = v.chatExists(name)
+				v.chats[name] = true
+			case TrashKindProvider:
+				exists = v.providerExists(name)
+				v.providers[name] = true
+			case TrashKindContext:
+				exists = v.contextExists(name)
+				v.contexts[name] = true
+			default:
+				return fmt.Errorf("unknown kind %s, expected %s, %s or %s", kind, TrashKindChat, TrashKindProvider, TrashKindContext)
+			}
+			if exists {
+				return fmt.Errorf("%s %s already exists", kind, name)
+			}
+			return nil
+		},
+		OnDescribeChat: func(name string) error {
+			if !v.chatExists(name) {
+				return fmt.Errorf("chat %s does not exist", name)
+			}
+			return nil
+		},
+		OnDescribeContext: func(name string) error {
+			if !v.contextExists(name) {
+				return fmt.Errorf("context %s does not exist", name)
+			}
+			return nil
+		},
+		// The branch is only looked for when the statement is executed
+		OnExport: func(name string, file string, format string, branch string) error {
+			if !v.chatExists(name) {
+				return fmt.Errorf("chat %s does not exist", name)
+			}
+			if format != "" && !ExportFormat(format).valid() {
+				return fmt.Errorf("unknown export format %q, expected %s, %s or %s", format, ExportMarkdown, ExportHTML, ExportDOT)
+			}
+			return nil
+		},
+		OnCheckContext: func(name string) error {
+			if !v.contextExists(name) {
+				return fmt.Errorf("context %s does not exist", name)
+			}
+			return nil
+		},
+
+		// Replays depend on the session they run in, so only the statement itself is checked
+		OnReplay:        func(idx int) error { return nil },
+		OnListChats:     noop,
+		OnListProviders: noop,
+		OnListContexts:  noop,
+		OnHistory:       noop,
+		OnWhereUsed:     func(name string) error { return nil },
+		OnFsck:          func(quarantine bool) error { return nil },
+		OnUsage:         noop,
+		OnTrash:         noop,
+		OnWorkspace:     func(name string) error { return nil },
+	}
+}
+
+func (v *statementValidator) providerExists(name string) bool {
+	if exists, ok := v.providers[name]; ok {
+		return exists
+	}
+	v.core.provMu.Lock()
+	defer v.core.provMu.Unlock()
+	_, exists := v.core.providers[name]
+	return exists
+}
+
+func (v *statementValidator) chatExists(name string) bool {
+	if exists, ok := v.chats[name]; ok {
+		return exists
+	}
+	_, err := os.Stat(v.core.storePath(chatStoreDirectory, fmt.Sprintf("%s.json", name)))
+	return err == nil
+}
+
+func (v *statementValidator) contextExists(name string) bool {
+	if exists, ok := v.contexts[name]; ok {
+		return exists
+	}
+	v.core.ctxMu.Lock()
+	defer v.core.ctxMu.Unlock()
+	_, exists := v.core.contexts[name]
+	return exists
+}
@@ -0,0 +1,63 @@
+package brunch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCore_ValidateStatement(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-chat "existing" :provider "mock"`)))
+
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"new provider on base", `\new-provider "p" :host "mock"`, false},
+		{"new provider on missing host", `\new-provider "p" :host "nope"`, true},
+		{"new provider shadowing base", `\new-provider "mock" :host "mock"`, true},
+		{"new chat", `\new-chat "c" :provider "mock"`, false},
+		{"new chat missing provider", `\new-chat "c" :provider "nope"`, true},
+		{"load existing chat", `\chat "existing"`, false},
+		{"load missing chat", `\chat "nope"`, true},
+		{"delete base provider", `\del-provider "mock"`, true},
+		{"describe missing context", `\desc-ctx "nope"`, true},
+		{"invalid property", `\new-provider "p" :host "mock" :bogus "x"`, true},
+		{"parse error", `\new-chat "c" :provider`, true},
+		{"listing", `\list-chat`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := core.ValidateStatement(NewStatement(tt.input))
+			assert.Equal(t, tt.wantErr, err != nil, "error: %v", err)
+		})
+	}
+
+	// Nothing was created and the session history is untouched
+	_, err := os.Stat(filepath.Join(core.installDirectory, chatStoreDirectory, "c.json"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NotContains(t, core.providers, "p")
+	assert.Len(t, core.sessions["s1"].history, 1)
+}
+
+func TestCore_ValidateStatements(t *testing.T) {
+	core := newTestCore(t)
+
+	script := ParseStatements(`
+		\new-provider "fast" :host "mock" :max-tokens 10
+		\new-ctx "docs" :dir "/tmp"
+		\new-chat "scratch" :provider "fast"
+		\chat "scratch"
+	`)
+	require.NoError(t, core.ValidateStatements(script))
+
+	script = ParseStatements(`\new-provider "fast" :host "mock"; \del-provider "fast"; \new-chat "c" :provider "fast"`)
+	err := core.ValidateStatements(script)
+	assert.ErrorContains(t, err, "statement 2")
+}
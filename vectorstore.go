@@ -0,0 +1,168 @@
+package brunch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// A VectorStore keeps embedded chunks and finds the ones closest to a query. The core keeps them
+// in flat files in the context-store unless it is given another store (CoreOpts.VectorStore), so
+// they can live in pgvector, Qdrant or the like. Each context has a collection of its own, named
+// after it, and each file or page in it is a source whose vectors are replaced together
+type VectorStore interface {
+
+	// Upsert replaces every vector kept for the source in the collection
+	Upsert(collection string, source string, vectors []Vector) error
+
+	// Delete removes the source's vectors from the collection
+	Delete(collection string, source string) error
+
+	// Search returns the vectors closest to the query, most similar first
+	Search(collection string, query []float32, limit int) ([]VectorMatch, error)
+
+	// Drop removes the collection and everything in it
+	Drop(collection string) error
+}
+
+// A chunk of a source and its embedding. The offset is where the chunk starts in the source
+type Vector struct {
+	Source    string    `json:"source"`
+	Offset    int       `json:"offset,omitempty"`
+	Content   string    `json:"content"`
+	Embedding []float32 `json:"embedding"`
+}
+
+type VectorMatch struct {
+	Vector
+	Score float64 `json:"score"`
+}
+
+// The vector stores are kept in the context-store, beside the directory indexes
+const vectorStoreDirectory = "vectors"
+
+// Each collection is a file, loaded the first time it is used and written whole when it changes.
+// Search compares the query with every vector, which is plenty for the contexts of a chat
+type fileVectorStore struct {
+	dir         string
+	mu          sync.Mutex
+	collections map[string]map[string][]Vector
+}
+
+var _ VectorStore = (*fileVectorStore)(nil)
+
+// A vector store kept in flat files in the directory
+func NewFileVectorStore(dir string) VectorStore {
+	return &fileVectorStore{
+		dir:         dir,
+		collections: map[string]map[string][]Vector{},
+	}
+}
+
+func (vs *fileVectorStore) path(collection string) string {
+	return filepath.Join(vs.dir, fmt.Sprintf("%s.json", collection))
+}
+
+// Must be called with the lock held
+func (vs *fileVectorStore) load(collection string) (map[string][]Vector, error) {
+	if sources, loaded := vs.collections[collection]; loaded {
+		return sources, nil
+	}
+	sources := map[string][]Vector{}
+	content, err := os.ReadFile(vs.path(collection))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read vectors of %s: %w", collection, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &sources); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vectors of %s: %w", collection, err)
+		}
+	}
+	vs.collections[collection] = sources
+	return sources, nil
+}
+
+func (vs *fileVectorStore) save(collection string, sources map[string][]Vector) error {
+	content, err := json.Marshal(sources)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(vs.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create vector store: %w", err)
+	}
+	if err := os.WriteFile(vs.path(collection), content, 0644); err != nil {
+		return fmt.Errorf("failed to save vectors of %s: %w", collection, err)
+	}
+	return nil
+}
+
+func (vs *fileVectorStore) Upsert(collection string, source string, vectors []Vector) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	sources, err := vs.load(collection)
+	if err != nil {
+		return err
+	}
+	sources[source] = vectors
+	return vs.save(collection, sources)
+}
+
+func (vs *fileVectorStore) Delete(collection string, source string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	sources, err := vs.load(collection)
+	if err != nil {
+		return err
+	}
+	if _, exists := sources[source]; !exists {
+		return nil
+	}
+	delete(sources, source)
+	return vs.save(collection, sources)
+}
+
+func (vs *fileVectorStore) Search(collection string, query []float32, limit int) ([]VectorMatch, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	sources, err := vs.load(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []VectorMatch{}
+	if limit <= 0 {
+		return matches, nil
+	}
+	for _, vectors := range sources {
+		for _, vector := range vectors {
+			if score := cosineSimilarity(query, vector.Embedding); score > 0 {
+				matches = append(matches, VectorMatch{Vector: vector, Score: score})
+			}
+		}
+	}
+	// Sources are a map, ties are broken by source so the same query finds the same chunks
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Source < matches[j].Source
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+func (vs *fileVectorStore) Drop(collection string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	delete(vs.collections, collection)
+	if err := os.Remove(vs.path(collection)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to drop vectors of %s: %w", collection, err)
+	}
+	return nil
+}
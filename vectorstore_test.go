@@ -0,0 +1,99 @@
+package brunch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileVectorStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileVectorStore(dir)
+	require.NoError(t, store.Upsert("docs", "a.md", []Vector{
+		{Source: "a.md", Content: "backups", Embedding: []float32{1, 0}},
+		{Source: "a.md", Content: "both", Embedding: []float32{1, 1}},
+	}))
+	require.NoError(t, store.Upsert("docs", "b.md", []Vector{{Source: "b.md", Content: "deploys", Embedding: []float32{0, 1}}}))
+
+	matches, err := store.Search("docs", []float32{1, 0}, 2)
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+	assert.Equal(t, "backups", matches[0].Content)
+	assert.Equal(t, "both", matches[1].Content)
+
+	// Upserting a source replaces all of it
+	require.NoError(t, store.Upsert("docs", "a.md", []Vector{{Source: "a.md", Content: "restores", Embedding: []float32{1, 0}}}))
+	matches, err = store.Search("docs", []float32{1, 0}, 5)
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "restores", matches[0].Content)
+
+	// What is stored is there for the next store opened on the directory
+	reopened := NewFileVectorStore(dir)
+	matches, err = reopened.Search("docs", []float32{0, 1}, 5)
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "deploys", matches[0].Content)
+
+	require.NoError(t, reopened.Delete("docs", "b.md"))
+	matches, err = reopened.Search("docs", []float32{0, 1}, 5)
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+
+	require.NoError(t, reopened.Drop("docs"))
+	assert.NoFileExists(t, filepath.Join(dir, "docs.json"))
+	matches, err = reopened.Search("other", []float32{0, 1}, 5)
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+// Stands in for an external store, counting the searches made in it
+type countingVectorStore struct {
+	fileVectorStore
+	searched int
+}
+
+func (cs *countingVectorStore) Search(collection string, query []float32, limit int) ([]VectorMatch, error) {
+	cs.searched++
+	return cs.fileVectorStore.Search(collection, query, limit)
+}
+
+func TestCore_VectorStore(t *testing.T) {
+	store := &countingVectorStore{fileVectorStore: fileVectorStore{dir: t.TempDir(), collections: map[string]map[string][]Vector{}}}
+	core := NewCore(CoreOpts{
+		InstallDirectory: t.TempDir(),
+		BaseProviders:    map[string]Provider{"mock": newMockProvider("mock")},
+		ChatStartHandler: func(Conversation) error { return nil },
+		Embedder:         &wordEmbedder{name: "words-v1"},
+		VectorStore:      store,
+	})
+	require.NoError(t, core.Install())
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ops.md"), []byte("how to deploy"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "old.md"), []byte("the backup tape"), 0644))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-ctx "docs" :dir "`+dir+`"`)))
+	knowledge, err := core.knowledgeProvider(core.contexts["docs"])
+	require.NoError(t, err)
+	require.NoError(t, knowledge.Index())
+	assert.Len(t, store.collections["docs"], 2)
+
+	found, err := knowledge.Retrieve("deploy it", 1)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "ops.md", found[0].Source)
+	assert.Equal(t, 1, store.searched)
+
+	// Files that are gone are taken out of the store
+	require.NoError(t, os.Remove(filepath.Join(dir, "old.md")))
+	knowledge, err = core.knowledgeProvider(core.contexts["docs"])
+	require.NoError(t, err)
+	require.NoError(t, knowledge.Index())
+	assert.Len(t, store.collections["docs"], 1)
+
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\del-ctx "docs"`)))
+	assert.NotContains(t, store.collections, "docs")
+}
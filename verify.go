@@ -0,0 +1,150 @@
+package brunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Verdict is the result of checking an answer for claims its grounding doesn't support
+type Verdict struct {
+	Supported   bool      `json:"supported"`
+	Unsupported []string  `json:"unsupported,omitempty"` // the claims that were flagged
+	Time        time.Time `json:"time"`
+}
+
+// Verifier checks an answer against the material it should be grounded in. Until contexts
+// supply retrieved content the grounding is the conversation that led up to the answer
+type Verifier interface {
+	Verify(ctx context.Context, question string, answer string, grounding []string) (*Verdict, error)
+}
+
+// VerificationOpts turns on verification of every reply in a chat
+type VerificationOpts struct {
+	Verifier Verifier // optional, defaults to asking the chat's auxiliary provider
+}
+
+// The default verifier asks a provider in a conversation of its own, like the default summarizer
+type providerVerifier struct {
+	provider Provider
+}
+
+// NewProviderVerifier verifies by prompting the given provider
+func NewProviderVerifier(provider Provider) Verifier {
+	return &providerVerifier{provider: provider}
+}
+
+const verifiedMarker = "SUPPORTED"
+
+func (pv *providerVerifier) Verify(ctx context.Context, question string, answer string, grounding []string) (*Verdict, error) {
+	prompt := fmt.Sprintf("Check the answer below for claims that are not supported by the grounding material or the question. "+
+		"General knowledge that is not in dispute counts as supported. If every claim is supported reply with only %s. "+
+		"Otherwise reply with each unsupported claim on its own line starting with \"- \" and nothing else.\n\n"+
+		"<grounding>\n%s\n</grounding>\n\n<question>\n%s\n</question>\n\n<answer>\n%s\n</answer>",
+		verifiedMarker, strings.Join(grounding, "\n\n"), question, answer)
+
+	pair, err := askAuxiliary(ctx, pv.provider, prompt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify: %w", err)
+	}
+	if pair == nil || pair.Assistant == nil {
+		return nil, errors.New("provider did not reply")
+	}
+	return parseVerdict(pair.Assistant.UnencodedContent()), nil
+}
+
+func parseVerdict(reply string) *Verdict {
+	verdict := &Verdict{Time: time.Now()}
+	for _, line := range strings.Split(reply, "\n") {
+		line = strings.TrimSpace(line)
+		if claim, ok := strings.CutPrefix(line, "- "); ok && strings.TrimSpace(claim) != "" {
+			verdict.Unsupported = append(verdict.Unsupported, strings.TrimSpace(claim))
+		}
+	}
+
+	// Anything that isn't a list of claims is taken at its word
+	verdict.Supported = len(verdict.Unsupported) == 0 && strings.Contains(strings.ToUpper(reply), verifiedMarker)
+	if !verdict.Supported && len(verdict.Unsupported) == 0 {
+		verdict.Unsupported = []string{strings.TrimSpace(reply)}
+	}
+	return verdict
+}
+
+func (c *chatInstance) verifier() Verifier {
+	if c.verification != nil && c.verification.Verifier != nil {
+		return c.verification.Verifier
+	}
+	return NewProviderVerifier(c.auxiliaryProvider())
+}
+
+// Verify the pair and store the verdict on it. The submit lock must be held
+func (c *chatInstance) verifyPair(mp *MessagePairNode) (*Verdict, error) {
+	if mp.User == nil || mp.Assistant == nil {
+		return nil, errors.New("message has no answer to verify")
+	}
+	grounding := []string{}
+	if history := branchHistory(mp.Parent); history != "" {
+		grounding = append(grounding, history)
+	}
+	question := mp.User.UnencodedContent()
+	answer := mp.Assistant.UnencodedContent()
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	verdict, err := c.verifier().Verify(ctx, question, answer, grounding)
+	c.estimateAuxiliary(ctx, strings.Join(append(grounding, question, answer), "\n"), "")
+	if err != nil {
+		return nil, err
+	}
+	mp.Verdict = verdict
+	return verdict, nil
+}
+
+func (c *chatInstance) SetVerification(opts *VerificationOpts) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	c.verification = opts
+}
+
+func (c *chatInstance) Verify() (*Verdict, error) {
+	c.submitMu.Lock()
+	defer c.submitMu.Unlock()
+	mp, err := c.currentPair()
+	if err != nil {
+		return nil, err
+	}
+	return c.verifyPair(mp)
+}
+
+// Automatic verification doesn't hold up the reply, a failed check is only logged
+func (c *chatInstance) verifyReply(mp *MessagePairNode) {
+	if _, err := c.verifyPair(mp); err != nil {
+		c.logger().Warn("failed to verify reply", "error", err)
+	}
+}
+
+// The verdicts on the branch down to the node that flagged something, to follow the history
+func branchVerdicts(n Node) string {
+	flagged := []*MessagePairNode{}
+	for current := n; current != nil; current = nodeParent(current) {
+		if mp, ok := current.(*MessagePairNode); ok && mp.Verdict != nil && !mp.Verdict.Supported {
+			flagged = append(flagged, mp)
+		}
+	}
+	if len(flagged) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("verification flagged unsupported claims:")
+	for i := len(flagged) - 1; i >= 0; i-- {
+		mp := flagged[i]
+		fmt.Fprintf(&sb, "\n  in reply to %q:", contentPreview(mp.User.UnencodedContent()))
+		for _, claim := range mp.Verdict.Unsupported {
+			fmt.Fprintf(&sb, "\n    - %s", claim)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,82 @@
+package brunch
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Flags answers that mention the moon
+type moonVerifier struct {
+	grounding []string
+}
+
+func (mv *moonVerifier) Verify(ctx context.Context, question string, answer string, grounding []string) (*Verdict, error) {
+	mv.grounding = grounding
+	if strings.Contains(answer, "moon") {
+		return &Verdict{Unsupported: []string{"the moon is cheese"}}, nil
+	}
+	return &Verdict{Supported: true}, nil
+}
+
+func TestParseVerdict(t *testing.T) {
+	assert.Equal(t, true, parseVerdict("SUPPORTED").Supported)
+	assert.Equal(t, true, parseVerdict(" supported.\n").Supported)
+
+	verdict := parseVerdict("- one\n-  two \nsomething else")
+	assert.False(t, verdict.Supported)
+	assert.Equal(t, []string{"one", "two"}, verdict.Unsupported)
+
+	// A reply that is neither is kept as the reason it wasn't supported
+	verdict = parseVerdict("I can't tell")
+	assert.False(t, verdict.Supported)
+	assert.Equal(t, []string{"I can't tell"}, verdict.Unsupported)
+}
+
+func TestChat_Verification(t *testing.T) {
+	chat := newChatInstance(newMockProvider("mock"))
+	verifier := &moonVerifier{}
+	chat.SetVerification(&VerificationOpts{Verifier: verifier})
+
+	_, err := chat.SubmitMessage("hello")
+	require.NoError(t, err)
+	first := chat.currentNode.(*MessagePairNode)
+	require.NotNil(t, first.Verdict)
+	assert.True(t, first.Verdict.Supported)
+	assert.Empty(t, verifier.grounding)
+
+	_, err = chat.SubmitMessage("the moon")
+	require.NoError(t, err)
+	second := chat.currentNode.(*MessagePairNode)
+	assert.False(t, second.Verdict.Supported)
+	assert.Equal(t, []string{"user: hello\nassistant: echo: hello"}, verifier.grounding)
+
+	history := chat.PrintHistory()
+	assert.Contains(t, history, "verification flagged unsupported claims:")
+	assert.Contains(t, history, "- the moon is cheese")
+
+	// Verdicts are saved with the tree, and replaced along with the answer
+	data, err := marshalNode(&chat.root)
+	require.NoError(t, err)
+	loaded, err := unmarshalNode(data)
+	require.NoError(t, err)
+	assert.Equal(t, second.Verdict.Unsupported, MapTree(loaded)[second.Hash()].(*MessagePairNode).Verdict.Unsupported)
+
+	_, err = chat.Edit("the sun")
+	require.NoError(t, err)
+	assert.True(t, second.Verdict.Supported)
+	assert.NotContains(t, chat.PrintHistory(), "verification")
+
+	// Checked on demand when verification is off
+	chat.SetVerification(nil)
+	_, err = chat.SubmitMessage("no check")
+	require.NoError(t, err)
+	assert.Nil(t, chat.currentNode.(*MessagePairNode).Verdict)
+	chat.SetVerification(&VerificationOpts{Verifier: verifier})
+	verdict, err := chat.Verify()
+	require.NoError(t, err)
+	assert.True(t, verdict.Supported)
+}
@@ -0,0 +1,176 @@
+package brunch
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A provider with a context window has the branch it is sent kept within it. Before a message
+// is sent, the branch is estimated and when it (with the system prompt, the message and room
+// for the reply) goes over the window, a strategy decides what is sent instead. The tree isn't
+// changed, the reply is added where it would have been. Branches that go over without a window
+// being set still fail with an overflow, see overflow.go
+type ContextWindow struct {
+	Tokens   int    `json:"tokens"`             // what the model takes in, prompt and reply
+	Strategy string `json:"strategy,omitempty"` // how the branch is shortened, summarize if not given
+}
+
+// The strategies a window can be given:
+//
+//	summarize    the oldest pairs are summarized and sent as one, the newest as they are
+//	drop-oldest  the oldest pairs aren't sent at all
+const (
+	WindowSummarize  = "summarize"
+	WindowDropOldest = "drop-oldest"
+)
+
+// A WindowStrategy shortens a branch that doesn't fit. It is given the answered pairs of the
+// branch, oldest first, and the tokens they may take, and returns the pairs to send in their
+// place. Pairs it makes (like a summary) don't have to be in any tree
+type WindowStrategy func(pairs []*MessagePairNode, budget int, summarize func([]*MessagePairNode) (*MessagePairNode, error)) ([]*MessagePairNode, error)
+
+// How much of the budget the newest pairs may take when the rest is summarized, so the summary
+// has room
+const summarizeKeepShare = 0.75
+
+var (
+	windowStrategies = map[string]WindowStrategy{
+		WindowSummarize:  summarizeOldest,
+		WindowDropOldest: dropOldest,
+	}
+	windowStrategiesMu sync.RWMutex
+)
+
+// Make the strategy available to context windows under the name
+func RegisterWindowStrategy(name string, strategy WindowStrategy) error {
+	if name == "" {
+		return fmt.Errorf("window strategy must have a name")
+	}
+	windowStrategiesMu.Lock()
+	defer windowStrategiesMu.Unlock()
+	if _, exists := windowStrategies[name]; exists {
+		return fmt.Errorf("window strategy [%s] already exists", name)
+	}
+	windowStrategies[name] = strategy
+	return nil
+}
+
+// The names of the strategies, sorted
+func WindowStrategies() []string {
+	windowStrategiesMu.RLock()
+	defer windowStrategiesMu.RUnlock()
+	names := make([]string, 0, len(windowStrategies))
+	for name := range windowStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func windowStrategy(name string) (WindowStrategy, error) {
+	if name == "" {
+		name = WindowSummarize
+	}
+	windowStrategiesMu.RLock()
+	defer windowStrategiesMu.RUnlock()
+	strategy, exists := windowStrategies[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown window strategy: %s", name)
+	}
+	return strategy, nil
+}
+
+func ValidateContextWindow(window *ContextWindow) error {
+	if window == nil {
+		return nil
+	}
+	if window.Tokens <= 0 {
+		return fmt.Errorf("context-window must be a positive number of tokens")
+	}
+	_, err := windowStrategy(window.Strategy)
+	return err
+}
+
+func pairTokens(mp *MessagePairNode) int {
+	user, assistant, ok := mp.Exchange()
+	if !ok {
+		return 0
+	}
+	return estimateTokens(messageToString(user) + "\n" + messageToString(assistant) + "\n")
+}
+
+func pairsTokens(pairs []*MessagePairNode) int {
+	total := 0
+	for _, mp := range pairs {
+		total += pairTokens(mp)
+	}
+	return total
+}
+
+// The newest pairs that fit in the budget
+func newestWithin(pairs []*MessagePairNode, budget int) []*MessagePairNode {
+	used := 0
+	for i := len(pairs) - 1; i >= 0; i-- {
+		used += pairTokens(pairs[i])
+		if used > budget {
+			return pairs[i+1:]
+		}
+	}
+	return pairs
+}
+
+func dropOldest(pairs []*MessagePairNode, budget int, _ func([]*MessagePairNode) (*MessagePairNode, error)) ([]*MessagePairNode, error) {
+	return newestWithin(pairs, budget), nil
+}
+
+func summarizeOldest(pairs []*MessagePairNode, budget int, summarize func([]*MessagePairNode) (*MessagePairNode, error)) ([]*MessagePairNode, error) {
+	kept := newestWithin(pairs, int(float64(budget)*summarizeKeepShare))
+	older := pairs[:len(pairs)-len(kept)]
+	if len(older) == 0 {
+		return kept, nil
+	}
+	summary, err := summarize(older)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize the branch: %w", err)
+	}
+
+	// A long summary pushes out the oldest of the kept pairs, it covers everything before them
+	remaining := budget - pairTokens(summary)
+	if remaining < 0 {
+		return nil, fmt.Errorf("the summary of the branch doesn't fit the context window: %w", ErrContextOverflow)
+	}
+	return append([]*MessagePairNode{summary}, newestWithin(kept, remaining)...), nil
+}
+
+// The end of a detached branch to send from when the branch down to the parent doesn't fit
+// the provider's window. Nothing is returned when there is no window or the branch fits
+func (c *chatInstance) fitWindow(parent Node, sent string) (Node, error) {
+	settings := c.provider.Settings()
+	if settings.Window == nil {
+		return nil, nil
+	}
+	root, pairs, err := branchPairs(parent)
+	if err != nil {
+		return nil, err
+	}
+	budget := settings.Window.Tokens - settings.MaxTokens - estimateTokens(root.Prompt) - estimateTokens(sent)
+	if budget < 0 {
+		return nil, fmt.Errorf("the message doesn't fit the context window of %d tokens: %w", settings.Window.Tokens, ErrContextOverflow)
+	}
+	if pairsTokens(pairs) <= budget {
+		return nil, nil
+	}
+
+	strategy, err := windowStrategy(settings.Window.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	fitted, err := strategy(pairs, budget, c.summaryPair)
+	if err != nil {
+		return nil, err
+	}
+	c.logger().Info("branch is over the context window, shortening it",
+		"window", settings.Window.Tokens, "pairs", len(pairs), "sent", len(fitted))
+	return detachedBranch(root, fitted), nil
+}
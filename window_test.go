@@ -0,0 +1,94 @@
+package brunch
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A chat on a provider with a window of 200 tokens past what is kept for the reply
+func windowedChat(t *testing.T, strategy string) (*chatInstance, *overflowProvider) {
+	provider := &overflowProvider{mockProvider: *newMockProvider("mock"), limit: 1 << 20}
+	provider.settings.Window = &ContextWindow{Tokens: provider.settings.MaxTokens + 200, Strategy: strategy}
+	chat := newChatInstance(provider)
+	chat.SetSummarizer(&fixedSummarizer{})
+	for i := 0; i < 10; i++ {
+		_, err := chat.SubmitMessage(fmt.Sprintf("message number %d, with some padding to fill the window up", i))
+		require.NoError(t, err)
+	}
+	return chat, provider
+}
+
+func TestChat_WindowDropOldest(t *testing.T) {
+	chat, provider := windowedChat(t, WindowDropOldest)
+	before := chat.currentNode
+
+	_, err := chat.SubmitMessage("one more")
+	require.NoError(t, err)
+	sent := provider.seen[len(provider.seen)-1]
+	assert.NotContains(t, sent, "message number 0,")
+	assert.Contains(t, sent, "message number 9,")
+	assert.LessOrEqual(t, estimateTokens(sent), 200)
+
+	// The tree has everything, the reply is where it would have been
+	assert.Same(t, before, chat.currentNode.(*MessagePairNode).Parent)
+	_, pairs, err := branchPairs(chat.currentNode)
+	require.NoError(t, err)
+	assert.Len(t, pairs, 11)
+}
+
+func TestChat_WindowSummarize(t *testing.T) {
+	chat, provider := windowedChat(t, "")
+	summarizer := &fixedSummarizer{}
+	chat.SetSummarizer(summarizer)
+
+	_, err := chat.SubmitMessage("one more")
+	require.NoError(t, err)
+	sent := provider.seen[len(provider.seen)-1]
+	assert.Contains(t, sent, "summary for "+string(SummaryForCompaction))
+	assert.Contains(t, sent, "message number 9,")
+	assert.NotContains(t, sent, "message number 0,")
+	assert.Contains(t, summarizer.content, "message number 0,")
+	assert.Equal(t, 1, summarizer.calls)
+
+	// Branches that fit are sent as they are
+	chat, provider = windowedChat(t, "")
+	provider.settings.Window.Tokens = 1 << 20
+	_, err = chat.SubmitMessage("one more")
+	require.NoError(t, err)
+	assert.Contains(t, provider.seen[len(provider.seen)-1], "message number 0,")
+}
+
+func TestChat_WindowMessageTooLong(t *testing.T) {
+	chat, _ := windowedChat(t, WindowDropOldest)
+	_, err := chat.SubmitMessage(strings.Repeat("long ", 200))
+	assert.ErrorIs(t, err, ErrContextOverflow)
+}
+
+func TestCore_ProviderContextWindow(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "windowed" :host "mock" :context-window 8000 :window-strategy "drop-oldest"`)))
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "derived" :host "windowed"`)))
+	assert.Equal(t, &ContextWindow{Tokens: 8000, Strategy: WindowDropOldest}, core.providers["windowed"].Settings().Window)
+	assert.Equal(t, core.providers["windowed"].Settings().Window, core.providers["derived"].Settings().Window)
+
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "bad" :host "mock" :context-window 8000 :window-strategy "nope"`)))
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "bad" :host "mock" :window-strategy "drop-oldest"`)))
+	assert.Error(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "bad" :host "mock" :context-window 0`)))
+
+	// Strategies can be added
+	require.NoError(t, RegisterWindowStrategy("newest-only", func(pairs []*MessagePairNode, budget int, _ func([]*MessagePairNode) (*MessagePairNode, error)) ([]*MessagePairNode, error) {
+		return pairs[len(pairs)-1:], nil
+	}))
+	defer func() {
+		windowStrategiesMu.Lock()
+		delete(windowStrategies, "newest-only")
+		windowStrategiesMu.Unlock()
+	}()
+	assert.Error(t, RegisterWindowStrategy(WindowSummarize, dropOldest))
+	assert.Contains(t, WindowStrategies(), "newest-only")
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\new-provider "custom" :host "mock" :context-window 8000 :window-strategy "newest-only"`)))
+}
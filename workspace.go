@@ -0,0 +1,291 @@
+package brunch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// A workspace groups the chats, providers and contexts of a project inside an install. They
+// are labels kept in the data-store, so a chat, provider or context can be in any number of
+// workspaces and nothing moves on disk. A session that has entered a workspace (\workspace)
+// adds what it creates to it and only lists what is in it
+const workspacesFile = "workspaces.json"
+
+const workspaceExportVersion = 1
+
+type Workspace struct {
+	Name      string   `json:"name"`
+	Chats     []string `json:"chats"`
+	Providers []string `json:"providers"`
+	Contexts  []string `json:"contexts"`
+}
+
+// A workspace with everything in it, so it can be moved to another install
+type WorkspaceExport struct {
+	Version   int                        `json:"version"`
+	Name      string                     `json:"name"`
+	Providers []ProviderSettings         `json:"providers"`
+	Contexts  []ContextSettings          `json:"contexts"`
+	Chats     map[string]json.RawMessage `json:"chats"` // snapshots, by chat name
+}
+
+// The kind of thing each statement that creates something creates
+var workspaceCreates = map[string]string{
+	"new-chat":     TrashKindChat,
+	"fork":         TrashKindChat,
+	"import-md":    TrashKindChat,
+	"new-provider": TrashKindProvider,
+	"new-ctx":      TrashKindContext,
+}
+
+func (w *Workspace) members(kind string) *[]string {
+	switch kind {
+	case TrashKindChat:
+		return &w.Chats
+	case TrashKindProvider:
+		return &w.Providers
+	case TrashKindContext:
+		return &w.Contexts
+	}
+	return nil
+}
+
+func (w *Workspace) has(kind string, name string) bool {
+	members := w.members(kind)
+	return members != nil && slices.Contains(*members, name)
+}
+
+// Must be called with the workspace lock held
+func (c *Core) loadWorkspaces() (map[string]*Workspace, error) {
+	workspaces := map[string]*Workspace{}
+	content, err := os.ReadFile(c.storePath(dataStoreDirectory, workspacesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return workspaces, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workspaces: %w", err)
+	}
+	if err := json.Unmarshal(content, &workspaces); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal workspaces: %w", err)
+	}
+	return workspaces, nil
+}
+
+func (c *Core) saveWorkspaces(workspaces map[string]*Workspace) error {
+	content, err := json.Marshal(workspaces)
+	if err != nil {
+		return err
+	}
+	return c.AddToDataStore(workspacesFile, string(content))
+}
+
+func (c *Core) updateWorkspaces(update func(workspaces map[string]*Workspace) bool) error {
+	c.workspaceMu.Lock()
+	defer c.workspaceMu.Unlock()
+	workspaces, err := c.loadWorkspaces()
+	if err != nil {
+		return err
+	}
+	if !update(workspaces) {
+		return nil
+	}
+	return c.saveWorkspaces(workspaces)
+}
+
+// Every workspace, by name
+func (c *Core) Workspaces() ([]Workspace, error) {
+	c.workspaceMu.Lock()
+	defer c.workspaceMu.Unlock()
+	workspaces, err := c.loadWorkspaces()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Workspace, 0, len(workspaces))
+	for _, workspace := range workspaces {
+		list = append(list, *workspace)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+func (c *Core) GetWorkspace(name string) (Workspace, error) {
+	c.workspaceMu.Lock()
+	defer c.workspaceMu.Unlock()
+	workspaces, err := c.loadWorkspaces()
+	if err != nil {
+		return Workspace{}, err
+	}
+	workspace, exists := workspaces[name]
+	if !exists {
+		return Workspace{}, fmt.Errorf("workspace %s does not exist", name)
+	}
+	return *workspace, nil
+}
+
+// Scope the session to a workspace, creating it if it doesn't exist yet. An empty name
+// leaves the workspace the session is in
+func (c *Core) enterWorkspace(session *coreSession, name string) error {
+	name = strings.TrimSpace(name)
+	if name != "" {
+		err := c.updateWorkspaces(func(workspaces map[string]*Workspace) bool {
+			if _, exists := workspaces[name]; exists {
+				return false
+			}
+			workspaces[name] = &Workspace{
+				Name:      name,
+				Chats:     []string{},
+				Providers: []string{},
+				Contexts:  []string{},
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.sesMu.Lock()
+	session.workspace = name
+	c.sesMu.Unlock()
+	return c.persistSession(session)
+}
+
+// Keep the workspaces in step with a statement that was executed: what the session created goes
+// into its workspace, and what was renamed or deleted is renamed or removed in every workspace
+func (c *Core) workspaceFollow(session *coreSession, stmt *Statement) error {
+	keyword, name := stmt.cmd.keyword, stmt.cmd.nameGiven
+
+	c.sesMu.Lock()
+	current := session.workspace
+	c.sesMu.Unlock()
+
+	if kind, creates := workspaceCreates[keyword]; creates {
+		if current == "" {
+			return nil
+		}
+		return c.updateWorkspaces(func(workspaces map[string]*Workspace) bool {
+			workspace, exists := workspaces[current]
+			if !exists || workspace.has(kind, name) {
+				return false
+			}
+			members := workspace.members(kind)
+			*members = append(*members, name)
+			return true
+		})
+	}
+
+	var kind, renamed string
+	switch keyword {
+	case "del-chat":
+		kind = TrashKindChat
+	case "del-provider":
+		kind = TrashKindProvider
+	case "del-ctx":
+		kind = TrashKindContext
+	case "rename-provider", "rename-ctx":
+		kind = TrashKindProvider
+		if keyword == "rename-ctx" {
+			kind = TrashKindContext
+		}
+		if prop, given := stmt.cmd.properties["to"]; given {
+			renamed = prop.prop
+		}
+	default:
+		return nil
+	}
+	return c.updateWorkspaces(func(workspaces map[string]*Workspace) bool {
+		changed := false
+		for _, workspace := range workspaces {
+			members := workspace.members(kind)
+			idx := slices.Index(*members, name)
+			if idx < 0 {
+				continue
+			}
+			if renamed != "" {
+				(*members)[idx] = renamed
+			} else {
+				*members = slices.Delete(*members, idx, idx+1)
+			}
+			changed = true
+		}
+		return changed
+	})
+}
+
+// Filter a listing down to the session's workspace, if it is in one
+func (c *Core) inSessionWorkspace(session *coreSession, kind string, names []string) ([]string, error) {
+	c.sesMu.Lock()
+	current := session.workspace
+	c.sesMu.Unlock()
+	if current == "" {
+		return names, nil
+	}
+	workspace, err := c.GetWorkspace(current)
+	if err != nil {
+		return nil, err
+	}
+	filtered := []string{}
+	for _, name := range names {
+		if workspace.has(kind, name) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered, nil
+}
+
+// Export the workspace's providers, contexts and chats as JSON. Anything in the workspace that
+// no longer exists is left out
+func (c *Core) ExportWorkspace(name string) ([]byte, error) {
+	workspace, err := c.GetWorkspace(name)
+	if err != nil {
+		return nil, err
+	}
+
+	export := WorkspaceExport{
+		Version:   workspaceExportVersion,
+		Name:      workspace.Name,
+		Providers: []ProviderSettings{},
+		Contexts:  []ContextSettings{},
+		Chats:     map[string]json.RawMessage{},
+	}
+	for _, provider := range workspace.Providers {
+		content, err := c.loadFromStore(providerStoreDirectory, fmt.Sprintf("%s.json", strings.ReplaceAll(provider, " ", "_")))
+		if err != nil {
+			c.logger.Warn("workspace provider is missing", "workspace", name, "provider", provider)
+			continue
+		}
+		var settings ProviderSettings
+		if err := json.Unmarshal([]byte(content), &settings); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal provider %s: %w", provider, err)
+		}
+		export.Providers = append(export.Providers, settings)
+	}
+	for _, ctxName := range workspace.Contexts {
+		content, err := c.loadFromStore(contextStoreDirectory, fmt.Sprintf("%s.json", ctxName))
+		if err != nil {
+			c.logger.Warn("workspace context is missing", "workspace", name, "context", ctxName)
+			continue
+		}
+		var ctx ContextSettings
+		if err := json.Unmarshal([]byte(content), &ctx); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal context %s: %w", ctxName, err)
+		}
+		export.Contexts = append(export.Contexts, ctx)
+	}
+	for _, chat := range workspace.Chats {
+		content, err := c.LoadFromChatStore(fmt.Sprintf("%s.json", chat))
+		if err != nil {
+			c.logger.Warn("workspace chat is missing", "workspace", name, "chat", chat)
+			continue
+		}
+		export.Chats[chat] = json.RawMessage(content)
+	}
+	return json.MarshalIndent(export, "", "  ")
+}
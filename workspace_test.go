@@ -0,0 +1,97 @@
+package brunch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCore_Workspaces(t *testing.T) {
+	core := newTestCore(t)
+	exec := func(session string, stmt string) error { return core.ExecuteStatement(session, NewStatement(stmt)) }
+
+	require.NoError(t, exec("s1", `\new-chat "loose" :provider "mock"`))
+	require.NoError(t, exec("s1", `\workspace "billing"`))
+	require.NoError(t, exec("s1", `\new-provider "fast" :host "mock"`))
+	require.NoError(t, exec("s1", `\new-ctx "invoices" :dir "/tmp"`))
+	require.NoError(t, exec("s1", `\new-chat "q3" :provider "fast"`))
+
+	workspace, err := core.GetWorkspace("billing")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"q3"}, workspace.Chats)
+	assert.Equal(t, []string{"fast"}, workspace.Providers)
+	assert.Equal(t, []string{"invoices"}, workspace.Contexts)
+
+	// Listing in the workspace only shows what is in it
+	var chats, providers []string
+	core.infoHandler.OnListChats = func(names []string) { chats = names }
+	core.infoHandler.OnListProviders = func(names []string) { providers = names }
+	require.NoError(t, exec("s1", `\list-chat`))
+	assert.Equal(t, []string{"q3"}, chats)
+	require.NoError(t, exec("s1", `\list-provider`))
+	assert.Contains(t, providers, "\tfast")
+
+	// Other sessions aren't in it, and the session stays in it after a restart
+	require.NoError(t, exec("s2", `\list-chat`))
+	assert.ElementsMatch(t, []string{"loose", "q3"}, chats)
+	delete(core.sessions, "s1")
+	require.NoError(t, exec("s1", `\list-chat`))
+	assert.Equal(t, []string{"q3"}, chats)
+
+	// Renames and deletes are followed from any session
+	require.NoError(t, exec("s2", `\rename-ctx "invoices" :to "receipts"`))
+	require.NoError(t, exec("s2", `\del-chat "q3"`))
+	workspace, err = core.GetWorkspace("billing")
+	require.NoError(t, err)
+	assert.Empty(t, workspace.Chats)
+	assert.Equal(t, []string{"receipts"}, workspace.Contexts)
+
+	require.NoError(t, exec("s1", `\workspace ""`))
+	require.NoError(t, exec("s1", `\list-chat`))
+	assert.Equal(t, []string{"loose"}, chats)
+
+	workspaces, err := core.Workspaces()
+	require.NoError(t, err)
+	require.Len(t, workspaces, 1)
+	assert.Equal(t, "billing", workspaces[0].Name)
+}
+
+func TestCore_ExportWorkspace(t *testing.T) {
+	core := newTestCore(t)
+	exec := func(stmt string) error { return core.ExecuteStatement("s1", NewStatement(stmt)) }
+	require.NoError(t, exec(`\workspace "docs"`))
+	require.NoError(t, exec(`\new-provider "terse" :host "mock" :system-prompt "be brief"`))
+	require.NoError(t, exec(`\new-ctx "manual" :web "https://example.com/manual"`))
+	require.NoError(t, exec(`\new-chat "a" :provider "terse"`))
+
+	data, err := core.ExportWorkspace("docs")
+	require.NoError(t, err)
+	var export WorkspaceExport
+	require.NoError(t, json.Unmarshal(data, &export))
+	assert.Equal(t, "docs", export.Name)
+	require.Len(t, export.Providers, 1)
+	assert.Equal(t, "be brief", export.Providers[0].SystemPrompt)
+	require.Len(t, export.Contexts, 1)
+	assert.Equal(t, ContextTypeWeb, export.Contexts[0].Type)
+	require.Contains(t, export.Chats, "a")
+	snapshot, err := SnapshotFromJSON(export.Chats["a"])
+	require.NoError(t, err)
+	assert.Equal(t, "terse", snapshot.ProviderName)
+
+	_, err = core.ExportWorkspace("nope")
+	assert.Error(t, err)
+}
+
+func TestCore_WorkspaceTransaction(t *testing.T) {
+	core := newTestCore(t)
+	require.NoError(t, core.ExecuteStatement("s1", NewStatement(`\workspace "w"`)))
+
+	// A failed transaction doesn't leave anything in the workspace
+	err := core.ExecuteTransaction("s1", ParseStatements(`\new-chat "a" :provider "mock"; \chat "missing"`))
+	require.Error(t, err)
+	workspace, err := core.GetWorkspace("w")
+	require.NoError(t, err)
+	assert.Empty(t, workspace.Chats)
+}